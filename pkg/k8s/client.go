@@ -1,8 +1,11 @@
 package k8s
 
 import (
+	"context"
 	"crypto/tls"
+	"net"
 	"net/http"
+	"strings"
 
 	"github.com/improbable-eng/kedge/pkg/tokenauth"
 	"github.com/improbable-eng/kedge/pkg/tokenauth/http"
@@ -12,21 +15,126 @@ type APIClient struct {
 	*http.Client
 
 	Address string
+	// InsecureSkipVerify is true if kube-apiserver certificate is not verified. Users of the client warn about it on
+	// every connection, since it should never be used outside of development clusters.
+	InsecureSkipVerify bool
+
+	// k8sURL, tlsConfig, source and mutate are kept to build the client again with client certificate or request
+	// mutator. For client not created by New they are unknown, so built is false.
+	built     bool
+	k8sURL    string
+	tlsConfig *tls.Config
+	source    tokenauth.Source
+	mutate    func(*http.Request)
 }
 
+// UnixSocketScheme is a scheme of kube-apiserver URL to reach it over Unix domain socket, e.g. a local cache or
+// aggregating proxy of endpoints exposed by a sidecar: unix:///var/run/proxy.sock.
+const UnixSocketScheme = "unix://"
+
+// unixSocketAddress is the Address of the client connected over Unix domain socket. Host does not matter, since every
+// connection is dialed to the socket.
+const unixSocketAddress = "http://localhost"
+
 // New returns a new Kubernetes client with HTTP client (based on given tokenauth Source and tlsConfig) to be used against kube-apiserver.
+// Source can be nil if client authenticates with client certificate only.
+// If k8sURL has UnixSocketScheme, connections are dialed to the socket with plain HTTP, since the socket is local, so
+// tlsConfig is ignored.
 func New(k8sURL string, source tokenauth.Source, tlsConfig *tls.Config) *APIClient {
+	return newAPIClient(k8sURL, source, tlsConfig, nil)
+}
+
+func newAPIClient(k8sURL string, source tokenauth.Source, tlsConfig *tls.Config, mutate func(*http.Request)) *APIClient {
+	address := k8sURL
+	httpTransport := &http.Transport{
+		TLSClientConfig: tlsConfig,
+	}
+	if strings.HasPrefix(k8sURL, UnixSocketScheme) {
+		socket := strings.TrimPrefix(k8sURL, UnixSocketScheme)
+		address = unixSocketAddress
+		httpTransport.TLSClientConfig = nil
+		httpTransport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		}
+	}
+
+	var transport http.RoundTripper = httpTransport
+	if mutate != nil {
+		transport = &mutatingTripper{parent: transport, mutate: mutate}
+	}
+	if source != nil {
+		// TLS transport with auth injection.
+		transport = httpauth.NewTripper(transport, source, "Authorization")
+	}
 	return &APIClient{
-		Client: &http.Client{
-			// TLS transport with auth injection.
-			Transport: httpauth.NewTripper(
-				&http.Transport{
-					TLSClientConfig: tlsConfig,
-				},
-				source,
-				"Authorization",
-			),
-		},
-		Address: k8sURL,
+		Client:             &http.Client{Transport: transport},
+		Address:            address,
+		InsecureSkipVerify: httpTransport.TLSClientConfig != nil && tlsConfig.InsecureSkipVerify,
+		built:              true,
+		k8sURL:             k8sURL,
+		tlsConfig:          tlsConfig,
+		source:             source,
+		mutate:             mutate,
+	}
+}
+
+// WithClientCertificate returns a copy of the client presenting certificate returned by getCert on every TLS
+// connection, e.g. for clusters authenticating clients with mTLS. CA, server name and token auth of the client are kept,
+// if it was created by New. Otherwise its HTTP client is replaced by one with default transport.
+// Use ClientCertReloader to read certificate from files rotated on disk.
+func (c *APIClient) WithClientCertificate(getCert func(*tls.CertificateRequestInfo) (*tls.Certificate, error)) *APIClient {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.tlsConfig != nil {
+		tlsConfig = c.tlsConfig.Clone()
+	}
+	tlsConfig.Certificates = nil
+	tlsConfig.GetClientCertificate = getCert
+	return newAPIClient(c.k8sURL, c.source, tlsConfig, c.mutate)
+}
+
+// WithRequestMutator returns a copy of the client calling mutate on every request right before it is sent, e.g. to set
+// impersonation or tenant headers. For client created by New it is called after token auth, so it can override
+// Authorization header as well. Other clients call it before their transport, which can override what it sets.
+func (c *APIClient) WithRequestMutator(mutate func(*http.Request)) *APIClient {
+	if !c.built {
+		parent := c.Client.Transport
+		if parent == nil {
+			parent = http.DefaultTransport
+		}
+		httpClient := *c.Client
+		httpClient.Transport = &mutatingTripper{parent: parent, mutate: mutate}
+		return &APIClient{Client: &httpClient, Address: c.Address, InsecureSkipVerify: c.InsecureSkipVerify}
+	}
+
+	if previous := c.mutate; previous != nil {
+		next := mutate
+		mutate = func(req *http.Request) {
+			previous(req)
+			next(req)
+		}
 	}
+	return newAPIClient(c.k8sURL, c.source, c.tlsConfig, mutate)
+}
+
+// WithHTTPClient returns a copy of the client sending requests with the given HTTP client, e.g. with tuned timeouts or
+// proxy. Address and InsecureSkipVerify are kept. The HTTP client is responsible for authentication, so token auth and
+// TLS config of the client are not used by the copy anymore.
+func (c *APIClient) WithHTTPClient(httpClient *http.Client) *APIClient {
+	cp := *c
+	cp.Client = httpClient
+	cp.built = false
+	return &cp
+}
+
+// mutatingTripper calls mutate on copy of every request before passing it to the parent.
+type mutatingTripper struct {
+	parent http.RoundTripper
+	mutate func(*http.Request)
+}
+
+func (t *mutatingTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	t.mutate(req)
+	return t.parent.RoundTrip(req)
 }
@@ -0,0 +1,104 @@
+package k8s
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/improbable-eng/kedge/pkg/tokenauth/sources/direct"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIClient_WithRequestMutator(t *testing.T) {
+	headers := make(chan http.Header, 10)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+	}))
+	defer srv.Close()
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(srv.Certificate())
+	c := New(srv.URL, directauth.New("kube_api", "token1"), &tls.Config{RootCAs: rootCAs}).
+		WithRequestMutator(func(r *http.Request) { r.Header.Set("Impersonate-User", "user1") }).
+		WithRequestMutator(func(r *http.Request) { r.Header.Add("Impersonate-Group", "group1") })
+
+	req, err := http.NewRequest("GET", srv.URL, nil)
+	require.NoError(t, err)
+	resp, err := c.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	h := <-headers
+	require.Equal(t, "Bearer token1", h.Get("Authorization"))
+	require.Equal(t, "user1", h.Get("Impersonate-User"))
+	require.Equal(t, []string{"group1"}, h["Impersonate-Group"])
+	require.Empty(t, req.Header.Get("Impersonate-User"), "request of the caller should not be mutated")
+
+	// Mutator runs after token auth, so it can override it.
+	overridden := c.WithRequestMutator(func(r *http.Request) { r.Header.Set("Authorization", "Bearer token2") })
+	resp, err = overridden.Get(srv.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	h = <-headers
+	require.Equal(t, "Bearer token2", h.Get("Authorization"))
+	require.Equal(t, "user1", h.Get("Impersonate-User"))
+
+	// Client not created by New is wrapped.
+	plain := (&APIClient{Client: srv.Client(), Address: srv.URL}).WithRequestMutator(func(r *http.Request) { r.Header.Set("X-Tenant", "tenant1") })
+	resp, err = plain.Get(srv.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, "tenant1", (<-headers).Get("X-Tenant"))
+}
+
+func TestAPIClient_WithHTTPClient(t *testing.T) {
+	c := New("https://kubernetes.default", directauth.New("kube_api", "token1"), &tls.Config{InsecureSkipVerify: true})
+	httpClient := &http.Client{}
+	withHTTP := c.WithHTTPClient(httpClient)
+	require.Equal(t, httpClient, withHTTP.Client)
+	require.Equal(t, "https://kubernetes.default", withHTTP.Address)
+	require.True(t, withHTTP.InsecureSkipVerify, "insecure client should still be warned about")
+	require.NotEqual(t, httpClient, c.Client, "original client should not be modified")
+}
+
+func TestAPIClient_UnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "client")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "kube-api.sock")
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	requests := make(chan *http.Request, 10)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+	}))
+	srv.Listener.Close()
+	srv.Listener = l
+	srv.Start()
+	defer srv.Close()
+
+	// TLS config is ignored, since socket is reached with plain HTTP.
+	c := New(UnixSocketScheme+socket, directauth.New("kube_api", "token1"), &tls.Config{InsecureSkipVerify: true})
+	require.Equal(t, "http://localhost", c.Address)
+	require.False(t, c.InsecureSkipVerify)
+
+	resp, err := c.Get(c.Address + "/api/v1/namespaces/namespace1/endpoints/service1")
+	require.NoError(t, err)
+	resp.Body.Close()
+	r := <-requests
+	require.Equal(t, "/api/v1/namespaces/namespace1/endpoints/service1", r.URL.Path)
+	require.Equal(t, "Bearer token1", r.Header.Get("Authorization"))
+
+	// Client built again still dials the socket.
+	mutated := c.WithRequestMutator(func(r *http.Request) { r.Header.Set("X-Tenant", "tenant1") })
+	resp, err = mutated.Get(mutated.Address + "/api/v1/namespaces/namespace1/endpoints/service1")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, "tenant1", (<-requests).Header.Get("X-Tenant"))
+}
@@ -0,0 +1,65 @@
+package k8s
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ClientCertReloader returns tls.Config.GetClientCertificate presenting certificate and key read from PEM files.
+// Files are checked on every TLS handshake and read again when they change on disk, so rotated certificates are
+// used by new connections, the same way rotated tokens are. If changed files cannot be loaded (e.g. only one of them
+// was written yet), the last loaded certificate is used until they can.
+func ClientCertReloader(certFile string, keyFile string) func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r := &clientCertReloader{certFile: certFile, keyFile: keyFile}
+	return r.get
+}
+
+type clientCertReloader struct {
+	certFile, keyFile string
+
+	mu                      sync.Mutex
+	cert                    *tls.Certificate
+	certModTime, keyModTime time.Time
+}
+
+func (r *clientCertReloader) get(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	certModTime, keyModTime, err := r.modTimes()
+	if err != nil {
+		if r.cert != nil {
+			return r.cert, nil
+		}
+		return nil, err
+	}
+	if r.cert != nil && certModTime.Equal(r.certModTime) && keyModTime.Equal(r.keyModTime) {
+		return r.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		if r.cert != nil {
+			return r.cert, nil
+		}
+		return nil, errors.Wrapf(err, "k8sclient: failed to load client certificate from %s and %s", r.certFile, r.keyFile)
+	}
+	r.cert, r.certModTime, r.keyModTime = &cert, certModTime, keyModTime
+	return r.cert, nil
+}
+
+func (r *clientCertReloader) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.Wrapf(err, "k8sclient: failed to read client certificate %s", r.certFile)
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.Wrapf(err, "k8sclient: failed to read client key %s", r.keyFile)
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
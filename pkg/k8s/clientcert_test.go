@@ -0,0 +1,118 @@
+package k8s
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/improbable-eng/kedge/pkg/tokenauth/sources/direct"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestClientCert returns PEM encoded self-signed client certificate and key.
+func newTestClientCert(t *testing.T, commonName string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestClientCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clientcert")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	certPath, keyPath := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+
+	getCert := ClientCertReloader(certPath, keyPath)
+	_, err = getCert(nil)
+	require.Error(t, err, "missing files should fail the handshake")
+
+	writeCert := func(commonName string, modTime time.Time) {
+		cert, key := newTestClientCert(t, commonName)
+		require.NoError(t, ioutil.WriteFile(certPath, cert, 0600))
+		require.NoError(t, ioutil.WriteFile(keyPath, key, 0600))
+		require.NoError(t, os.Chtimes(certPath, modTime, modTime))
+		require.NoError(t, os.Chtimes(keyPath, modTime, modTime))
+	}
+	commonName := func(cert *tls.Certificate) string {
+		c, err := x509.ParseCertificate(cert.Certificate[0])
+		require.NoError(t, err)
+		return c.Subject.CommonName
+	}
+
+	now := time.Now()
+	writeCert("client1", now.Add(-time.Hour))
+	cert, err := getCert(nil)
+	require.NoError(t, err)
+	require.Equal(t, "client1", commonName(cert))
+
+	// Rotated certificate is loaded.
+	writeCert("client2", now)
+	cert, err = getCert(nil)
+	require.NoError(t, err)
+	require.Equal(t, "client2", commonName(cert))
+
+	// Certificate written without the matching key yet keeps the last one.
+	newCert, _ := newTestClientCert(t, "client3")
+	require.NoError(t, ioutil.WriteFile(certPath, newCert, 0600))
+	require.NoError(t, os.Chtimes(certPath, now.Add(time.Hour), now.Add(time.Hour)))
+	cert, err = getCert(nil)
+	require.NoError(t, err)
+	require.Equal(t, "client2", commonName(cert))
+}
+
+func TestAPIClient_WithClientCertificate(t *testing.T) {
+	certPEM, keyPEM := newTestClientCert(t, "client1")
+	clientCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(certPEM)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "Bearer token1", r.Header.Get("Authorization"))
+		require.Equal(t, "client1", r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	srv.StartTLS()
+	defer srv.Close()
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(srv.Certificate())
+	c := New(srv.URL, directauth.New("kube_api", "token1"), &tls.Config{RootCAs: rootCAs})
+
+	_, err = c.Get(srv.URL)
+	require.Error(t, err, "server requires client certificate")
+
+	// Pinned CA and token are kept.
+	withCert := c.WithClientCertificate(func(*tls.CertificateRequestInfo) (*tls.Certificate, error) { return &clientCert, nil })
+	resp, err := withCert.Get(srv.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
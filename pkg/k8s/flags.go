@@ -2,16 +2,16 @@ package k8s
 
 import (
 	"crypto/tls"
-	"crypto/x509"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/url"
 	"os"
+	"strings"
 
 	"github.com/improbable-eng/kedge/pkg/sharedflags"
 	"github.com/improbable-eng/kedge/pkg/tokenauth"
-	"github.com/improbable-eng/kedge/pkg/tokenauth/sources/direct"
+	"github.com/improbable-eng/kedge/pkg/tokenauth/sources/file"
 	"github.com/improbable-eng/kedge/pkg/tokenauth/sources/k8s"
 	"github.com/pkg/errors"
 )
@@ -19,18 +19,26 @@ import (
 const (
 	defaultSAToken  = "/var/run/secrets/kubernetes.io/serviceaccount/token"
 	defaultSACACert = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+	// defaultSANamespace is a file with namespace of the pod the service account secret is mounted to.
+	defaultSANamespace = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
 )
 
 var (
 	// NOTE: Default values for all flags are designed for running within k8s pod.
 	defaultKubeURL = fmt.Sprintf("https://%s", net.JoinHostPort(os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")))
 	fKubeAPIURL    = sharedflags.Set.String("k8sclient_kubeapi_url", defaultKubeURL,
-		"TCP address to Kube API server in a form of 'http(s)://host:value'. If empty it will be fetched from env variables:"+
+		"TCP address to Kube API server in a form of 'http(s)://host:value' or Unix domain socket in a form of "+
+			"'unix:///path/to/socket' (plain HTTP, TLS flags are ignored). If empty it will be fetched from env variables:"+
 			"KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT")
 	fInsecureSkipVerify = sharedflags.Set.Bool("k8sclient_tls_insecure", false, "If enabled, no server verification will be "+
-		"performed on client side. Not recommended.")
+		"performed on client side. Only for development clusters with self-signed certificates (e.g. kind or minikube). "+
+		"Incompatible with k8sclient_ca_file and k8sclient_tls_server_name, which are ignored. Warning is logged on every "+
+		"connection.")
 	fKubeAPIRootCAPath = sharedflags.Set.String("k8sclient_ca_file", defaultSACACert, "Path to service account CA file. "+
-		"Required if kubeapi_tls_insecure = false.")
+		"Required if k8sclient_tls_insecure = false. Ignored otherwise.")
+	fTLSServerName = sharedflags.Set.String("k8sclient_tls_server_name", "", "Server name used to verify Kube API server "+
+		"certificate, e.g. when it is reached through load balancer or proxy not present in certificate SANs. If empty, "+
+		"host from k8sclient_kubeapi_url is used.")
 
 	// Different kinds of auth are supported. Currently supported with flags:
 	// - specifying file with token
@@ -60,17 +68,16 @@ func NewFromFlags() (*APIClient, error) {
 	tlsConfig := &tls.Config{
 		InsecureSkipVerify: *fInsecureSkipVerify,
 	}
-	if !*fInsecureSkipVerify {
-		ca, err := ioutil.ReadFile(*fKubeAPIRootCAPath)
+	if strings.HasPrefix(k8sURL, UnixSocketScheme) {
+		// Socket is local, so no CA file is needed.
+		tlsConfig = nil
+	} else if !*fInsecureSkipVerify {
+		tlsConfig, err = rootCATLSConfig(*fKubeAPIRootCAPath)
 		if err != nil {
-			return nil, errors.Wrapf(err, "k8sclient: failed to parse RootCA from file %s", *fKubeAPIRootCAPath)
-		}
-		certPool := x509.NewCertPool()
-		certPool.AppendCertsFromPEM(ca)
-		tlsConfig = &tls.Config{
-			MinVersion: tls.VersionTLS10,
-			RootCAs:    certPool,
+			return nil, err
 		}
+		// Empty server name means host from URL.
+		tlsConfig.ServerName = *fTLSServerName
 	}
 
 	var source tokenauth.Source
@@ -84,12 +91,11 @@ func NewFromFlags() (*APIClient, error) {
 	}
 
 	if source == nil {
-		// Try token auth as fallback.
-		token, err := ioutil.ReadFile(*fTokenAuthPath)
-		if err != nil {
+		// Try token auth as fallback. Token is read on every request, since it can be rotated.
+		if _, err := ioutil.ReadFile(*fTokenAuthPath); err != nil {
 			return nil, errors.Wrapf(err, "k8sclient: failed to parse token from %s. No auth method found", *fTokenAuthPath)
 		}
-		source = directauth.New("kube_api", string(token))
+		source = fileauth.New("kube_api", *fTokenAuthPath)
 	}
 
 	return New(k8sURL, source, tlsConfig), nil
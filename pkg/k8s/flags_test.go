@@ -0,0 +1,64 @@
+package k8s
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewFromFlags_TLSServerName(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "Bearer token1", r.Header.Get("Authorization"))
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "flags")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	caPath := filepath.Join(dir, "ca.crt")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	require.NoError(t, ioutil.WriteFile(caPath, ca, 0600))
+	tokenPath := filepath.Join(dir, "token")
+	require.NoError(t, ioutil.WriteFile(tokenPath, []byte("token1"), 0600))
+
+	oldURL, oldCA, oldToken, oldServerName := *fKubeAPIURL, *fKubeAPIRootCAPath, *fTokenAuthPath, *fTLSServerName
+	defer func() {
+		*fKubeAPIURL, *fKubeAPIRootCAPath, *fTokenAuthPath, *fTLSServerName = oldURL, oldCA, oldToken, oldServerName
+	}()
+	*fKubeAPIURL, *fKubeAPIRootCAPath, *fTokenAuthPath = srv.URL, caPath, tokenPath
+
+	for _, tcase := range []struct {
+		serverName  string
+		expectedErr string
+	}{
+		// httptest certificate is valid for example.com and 127.0.0.1.
+		{serverName: "example.com"},
+		{serverName: "kubernetes.default.svc", expectedErr: "kubernetes.default.svc"},
+		// Empty server name falls back to the host from URL.
+		{serverName: ""},
+	} {
+		t.Run(tcase.serverName, func(t *testing.T) {
+			*fTLSServerName = tcase.serverName
+			c, err := NewFromFlags()
+			require.NoError(t, err)
+
+			resp, err := c.Get(srv.URL)
+			if tcase.expectedErr != "" {
+				require.Error(t, err)
+				require.True(t, strings.Contains(err.Error(), tcase.expectedErr), err.Error())
+				return
+			}
+			require.NoError(t, err)
+			resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+		})
+	}
+}
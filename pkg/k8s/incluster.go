@@ -0,0 +1,63 @@
+package k8s
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/improbable-eng/kedge/pkg/tokenauth/sources/file"
+	"github.com/pkg/errors"
+)
+
+// InClusterConfig returns APIClient for kube-apiserver of the cluster the pod is running in. Address is taken from
+// KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT env variables and CA and token from the service account secret.
+// Token is read before every request, so tokens rotated on disk (BoundServiceAccountTokenVolume) are picked up.
+func InClusterConfig() (*APIClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("k8sclient: KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be defined for in-cluster config")
+	}
+
+	if _, err := ioutil.ReadFile(defaultSAToken); err != nil {
+		return nil, errors.Wrapf(err, "k8sclient: failed to read service account token from %s", defaultSAToken)
+	}
+	tlsConfig, err := rootCATLSConfig(defaultSACACert)
+	if err != nil {
+		return nil, err
+	}
+	return New(fmt.Sprintf("https://%s", net.JoinHostPort(host, port)), fileauth.New("kube_api", defaultSAToken), tlsConfig), nil
+}
+
+// InClusterNamespace returns namespace of the pod it is running in, taken from the service account secret.
+func InClusterNamespace() (string, error) {
+	return namespaceFromFile(defaultSANamespace)
+}
+
+func namespaceFromFile(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "k8sclient: failed to read namespace from %s", path)
+	}
+	namespace := strings.TrimSpace(string(b))
+	if namespace == "" {
+		return "", errors.Errorf("k8sclient: namespace file %s is empty", path)
+	}
+	return namespace, nil
+}
+
+func rootCATLSConfig(caPath string) (*tls.Config, error) {
+	ca, err := ioutil.ReadFile(caPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "k8sclient: failed to parse RootCA from file %s", caPath)
+	}
+	certPool := x509.NewCertPool()
+	certPool.AppendCertsFromPEM(ca)
+	return &tls.Config{
+		MinVersion: tls.VersionTLS10,
+		RootCAs:    certPool,
+	}, nil
+}
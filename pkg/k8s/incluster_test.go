@@ -0,0 +1,29 @@
+package k8s
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNamespaceFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "incluster")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "namespace")
+	_, err = namespaceFromFile(path)
+	require.Error(t, err)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte(" \n"), 0600))
+	_, err = namespaceFromFile(path)
+	require.Error(t, err)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("namespace1\n"), 0600))
+	namespace, err := namespaceFromFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "namespace1", namespace)
+}
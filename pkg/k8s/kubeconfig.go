@@ -0,0 +1,232 @@
+package k8s
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/improbable-eng/kedge/pkg/tokenauth"
+	"github.com/improbable-eng/kedge/pkg/tokenauth/sources/direct"
+	"github.com/improbable-eng/kedge/pkg/tokenauth/sources/exec"
+	"github.com/improbable-eng/kedge/pkg/tokenauth/sources/file"
+	"github.com/improbable-eng/kedge/pkg/tokenauth/sources/k8s"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// kubeConfig is a subset of kubeconfig file fields used to connect to kube-apiserver.
+// See https://kubernetes.io/docs/concepts/configuration/organize-cluster-access-kubeconfig/
+type kubeConfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Contexts       []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster string `yaml:"cluster"`
+			User    string `yaml:"user"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+	Clusters []struct {
+		Name    string            `yaml:"name"`
+		Cluster kubeConfigCluster `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		Name string         `yaml:"name"`
+		User kubeConfigUser `yaml:"user"`
+	} `yaml:"users"`
+}
+
+type kubeConfigCluster struct {
+	Server                   string `yaml:"server"`
+	CertificateAuthority     string `yaml:"certificate-authority"`
+	CertificateAuthorityData string `yaml:"certificate-authority-data"`
+	InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+	TLSServerName            string `yaml:"tls-server-name"`
+
+	// dir is a directory of the kubeconfig file the cluster was loaded from. Relative paths are resolved against it.
+	dir string
+}
+
+type kubeConfigUser struct {
+	Token                 string `yaml:"token"`
+	TokenFile             string `yaml:"tokenFile"`
+	ClientCertificate     string `yaml:"client-certificate"`
+	ClientCertificateData string `yaml:"client-certificate-data"`
+	ClientKey             string `yaml:"client-key"`
+	ClientKeyData         string `yaml:"client-key-data"`
+	Exec                  *struct {
+		Command string   `yaml:"command"`
+		Args    []string `yaml:"args"`
+		Env     []struct {
+			Name  string `yaml:"name"`
+			Value string `yaml:"value"`
+		} `yaml:"env"`
+	} `yaml:"exec"`
+	AuthProvider *struct {
+		Name string `yaml:"name"`
+	} `yaml:"auth-provider"`
+
+	// path is the kubeconfig file the user was loaded from.
+	path string
+}
+
+// kubeConfigPaths returns kubeconfig files to be used. If path is empty, KUBECONFIG env variable (list of files) is used
+// and ~/.kube/config otherwise.
+func kubeConfigPaths(path string) []string {
+	if path != "" {
+		return []string{path}
+	}
+	if env := os.Getenv("KUBECONFIG"); env != "" {
+		var paths []string
+		for _, p := range filepath.SplitList(env) {
+			if p != "" {
+				paths = append(paths, p)
+			}
+		}
+		return paths
+	}
+	return []string{filepath.Join(os.Getenv("HOME"), ".kube", "config")}
+}
+
+// NewFromKubeConfig creates APIClient for the current-context of the given kubeconfig file. If path is empty, files
+// from KUBECONFIG env variable are merged (first file setting a value wins) or ~/.kube/config is used.
+// Supported auth methods: client certificates, token, token file, exec credential plugins and auth providers
+// supported by k8sauth.
+func NewFromKubeConfig(path string) (*APIClient, error) {
+	var (
+		currentContext string
+		contexts       = map[string]struct{ cluster, user string }{}
+		clusters       = map[string]kubeConfigCluster{}
+		users          = map[string]kubeConfigUser{}
+	)
+	for _, p := range kubeConfigPaths(path) {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "k8sclient: failed to read kubeconfig %s", p)
+		}
+		var cfg kubeConfig
+		if err := yaml.Unmarshal(b, &cfg); err != nil {
+			return nil, errors.Wrapf(err, "k8sclient: failed to parse kubeconfig %s", p)
+		}
+
+		if currentContext == "" {
+			currentContext = cfg.CurrentContext
+		}
+		for _, c := range cfg.Contexts {
+			if _, ok := contexts[c.Name]; !ok {
+				contexts[c.Name] = struct{ cluster, user string }{cluster: c.Context.Cluster, user: c.Context.User}
+			}
+		}
+		for _, c := range cfg.Clusters {
+			if _, ok := clusters[c.Name]; !ok {
+				c.Cluster.dir = filepath.Dir(p)
+				clusters[c.Name] = c.Cluster
+			}
+		}
+		for _, u := range cfg.Users {
+			if _, ok := users[u.Name]; !ok {
+				u.User.path = p
+				users[u.Name] = u.User
+			}
+		}
+	}
+
+	ctx, ok := contexts[currentContext]
+	if !ok {
+		return nil, errors.Errorf("k8sclient: current-context %q not found in kubeconfig", currentContext)
+	}
+	cluster, ok := clusters[ctx.cluster]
+	if !ok {
+		return nil, errors.Errorf("k8sclient: cluster %q of context %q not found in kubeconfig", ctx.cluster, currentContext)
+	}
+	user, ok := users[ctx.user]
+	if !ok {
+		return nil, errors.Errorf("k8sclient: user %q of context %q not found in kubeconfig", ctx.user, currentContext)
+	}
+
+	tlsConfig, err := kubeConfigTLS(cluster, user)
+	if err != nil {
+		return nil, err
+	}
+	source, err := kubeConfigSource(ctx.user, user)
+	if err != nil {
+		return nil, err
+	}
+
+	// Source is nil if user has client certificates only.
+	return New(cluster.Server, source, tlsConfig), nil
+}
+
+// dataOrFile returns base64 decoded data if not empty, or content of the file otherwise.
+func dataOrFile(data string, path string, dir string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if path == "" {
+		return nil, nil
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	return ioutil.ReadFile(path)
+}
+
+func kubeConfigTLS(cluster kubeConfigCluster, user kubeConfigUser) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS10,
+		InsecureSkipVerify: cluster.InsecureSkipTLSVerify,
+		ServerName:         cluster.TLSServerName,
+	}
+	ca, err := dataOrFile(cluster.CertificateAuthorityData, cluster.CertificateAuthority, cluster.dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "k8sclient: failed to read certificate authority from kubeconfig")
+	}
+	if len(ca) > 0 {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		tlsConfig.RootCAs.AppendCertsFromPEM(ca)
+	}
+
+	userDir := filepath.Dir(user.path)
+	cert, err := dataOrFile(user.ClientCertificateData, user.ClientCertificate, userDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "k8sclient: failed to read client certificate from kubeconfig")
+	}
+	key, err := dataOrFile(user.ClientKeyData, user.ClientKey, userDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "k8sclient: failed to read client key from kubeconfig")
+	}
+	if len(cert) > 0 || len(key) > 0 {
+		pair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, errors.Wrap(err, "k8sclient: failed to load client certificate from kubeconfig")
+		}
+		tlsConfig.Certificates = []tls.Certificate{pair}
+	}
+	return tlsConfig, nil
+}
+
+// kubeConfigSource returns token auth source of the user. Nil is returned if user has no token based auth.
+func kubeConfigSource(name string, user kubeConfigUser) (tokenauth.Source, error) {
+	switch {
+	case user.Token != "":
+		return directauth.New("kube_api", user.Token), nil
+	case user.TokenFile != "":
+		path := user.TokenFile
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(user.path), path)
+		}
+		return fileauth.New("kube_api", path), nil
+	case user.Exec != nil:
+		var env []string
+		for _, e := range user.Exec.Env {
+			env = append(env, strings.Join([]string{e.Name, e.Value}, "="))
+		}
+		return execauth.New("kube_api", user.Exec.Command, user.Exec.Args, env), nil
+	case user.AuthProvider != nil:
+		return k8sauth.New("kube_api", user.path, name)
+	}
+	return nil, nil
+}
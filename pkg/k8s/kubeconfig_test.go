@@ -0,0 +1,68 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testKubeConfig = `
+current-context: ctx2
+contexts:
+- name: ctx1
+  context: {cluster: cluster1, user: user1}
+- name: ctx2
+  context: {cluster: cluster2, user: user2}
+clusters:
+- name: cluster1
+  cluster: {server: "https://cluster1.example.org"}
+- name: cluster2
+  cluster: {server: "%s", insecure-skip-tls-verify: true}
+users:
+- name: user1
+  user: {token: token1}
+- name: user2
+  user:
+    exec:
+      command: sh
+      args: ["-c", "echo '{\"status\": {\"token\": \"'$TOKEN'\"}}'"]
+      env: [{name: TOKEN, value: token2}]
+`
+
+func TestNewFromKubeConfig(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "Bearer token2", r.Header.Get("Authorization"))
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "kubeconfig")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Context switched by the first file wins.
+	path1 := filepath.Join(dir, "config1")
+	require.NoError(t, ioutil.WriteFile(path1, []byte("current-context: ctx2\n"), 0600))
+	path2 := filepath.Join(dir, "config2")
+	require.NoError(t, ioutil.WriteFile(path2, []byte(fmt.Sprintf(testKubeConfig, srv.URL)), 0600))
+
+	require.NoError(t, os.Setenv("KUBECONFIG", path1+string(filepath.ListSeparator)+path2))
+	defer os.Unsetenv("KUBECONFIG")
+
+	c, err := NewFromKubeConfig("")
+	require.NoError(t, err)
+	require.Equal(t, srv.URL, c.Address)
+
+	req, err := http.NewRequest("GET", srv.URL, nil)
+	require.NoError(t, err)
+	resp, err := c.Do(req.WithContext(context.Background()))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
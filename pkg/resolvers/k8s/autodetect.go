@@ -0,0 +1,143 @@
+package k8sresolver
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// discoveryGroupVersionPath lists resources of discovery.k8s.io/v1, the same as ServerResourcesForGroupVersion does.
+const discoveryGroupVersionPath = "/apis/discovery.k8s.io/v1"
+
+type apiResourceList struct {
+	Resources []struct {
+		Name string `json:"name"`
+	} `json:"resources"`
+}
+
+// endpointAPIDetector returns function that detects if kube-apiserver serves EndpointSlices. EndpointSliceAPI is
+// returned if it does and EndpointsAPI otherwise. Result is cached and logged after first successful detection.
+func endpointAPIDetector(cl *client) func(ctx context.Context) (EndpointAPI, error) {
+	var (
+		mu       sync.Mutex
+		detected bool
+		api      EndpointAPI
+	)
+	return func(ctx context.Context) (EndpointAPI, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if detected {
+			return api, nil
+		}
+		a, err := cl.detectEndpointAPI(ctx)
+		if err != nil {
+			return EndpointsAPI, err
+		}
+		detected, api = true, a
+		cl.logger.WithField("endpointslices", api == EndpointSliceAPI).Info("k8sresolver: Detected endpoint API")
+		return api, nil
+	}
+}
+
+func (c *client) detectEndpointAPI(ctx context.Context) (EndpointAPI, error) {
+	body, err := c.startGET(ctx, discoveryGroupVersionPath)
+	if err != nil {
+		if sErr, ok := errors.Cause(err).(*statusError); ok && (sErr.code == http.StatusNotFound || sErr.code == http.StatusForbidden) {
+			// Older cluster without the group, or discovery is not permitted. Endpoints are served either way.
+			return EndpointsAPI, nil
+		}
+		return EndpointsAPI, errors.Wrap(err, "Failed to detect endpoint API")
+	}
+	defer body.Close()
+
+	var list apiResourceList
+	if err := json.NewDecoder(body).Decode(&list); err != nil {
+		return EndpointsAPI, errors.Wrapf(err, "Failed to decode resources from GET %s response", discoveryGroupVersionPath)
+	}
+	for _, r := range list.Resources {
+		if r.Name == "endpointslices" {
+			return EndpointSliceAPI, nil
+		}
+	}
+	return EndpointsAPI, nil
+}
+
+// autoEndpointClient is an endpointClient that uses EndpointSlices if kube-apiserver serves them and Endpoints
+// otherwise. API is detected on the first request. Endpoints are used as well once EndpointSlices are forbidden, so
+// RBAC granting only endpoints keeps working. Slices client keeps the state of slices, so it should be used for single
+// target only.
+type autoEndpointClient struct {
+	cl     *client
+	detect func(ctx context.Context) (EndpointAPI, error)
+
+	mu       sync.Mutex
+	delegate endpointClient
+}
+
+func (c *autoEndpointClient) client(ctx context.Context) (endpointClient, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.delegate != nil {
+		return c.delegate, nil
+	}
+	api, err := c.detect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.delegate = c.cl
+	if api == EndpointSliceAPI {
+		c.delegate = &endpointSliceClient{cl: c.cl}
+	}
+	return c.delegate, nil
+}
+
+// fallBack switches to Endpoints if EndpointSlices request of cl failed with 403. It returns false if the request
+// should not be retried with Endpoints.
+func (c *autoEndpointClient) fallBack(cl endpointClient, err error) bool {
+	if _, ok := cl.(*endpointSliceClient); !ok || !isForbidden(err) {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.delegate == cl {
+		c.cl.logger.WithError(err).Warn("k8sresolver: EndpointSlices are forbidden. Using Endpoints instead")
+		c.delegate = c.cl
+	}
+	return true
+}
+
+func (c *autoEndpointClient) List(ctx context.Context, t targetEntry) (*endpoints, error) {
+	cl, err := c.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ep, err := cl.List(ctx, t)
+	if err != nil && c.fallBack(cl, err) {
+		return c.cl.List(ctx, t)
+	}
+	return ep, err
+}
+
+func (c *autoEndpointClient) StartChangeStream(ctx context.Context, t targetEntry, resourceVersion string) (io.ReadCloser, error) {
+	cl, err := c.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := cl.StartChangeStream(ctx, t, resourceVersion)
+	if err != nil && c.fallBack(cl, err) {
+		// Resource version of slices is not the one of Endpoints, so watch starts from the current state.
+		return c.cl.StartChangeStream(ctx, t, "")
+	}
+	return conn, err
+}
+
+// ListPods returns pods in the namespace matching the label selector by their IPs.
+func (c *autoEndpointClient) ListPods(ctx context.Context, namespace string, selector string) (map[string]pod, error) {
+	return c.cl.ListPods(ctx, namespace, selector)
+}
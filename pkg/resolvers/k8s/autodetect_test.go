@@ -0,0 +1,134 @@
+package k8sresolver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/improbable-eng/kedge/pkg/k8s"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAutoEndpointClient_DetectsAPI(t *testing.T) {
+	for _, tcase := range []struct {
+		name             string
+		discoveryCode    int
+		discoveryBody    string
+		expectedListPath string
+	}{
+		{
+			name:             "EndpointSlices served",
+			discoveryCode:    http.StatusOK,
+			discoveryBody:    `{"kind": "APIResourceList", "groupVersion": "discovery.k8s.io/v1", "resources": [{"name": "endpointslices", "kind": "EndpointSlice"}]}`,
+			expectedListPath: "/apis/discovery.k8s.io/v1/namespaces/namespace1/endpointslices",
+		},
+		{
+			name:             "group without EndpointSlices",
+			discoveryCode:    http.StatusOK,
+			discoveryBody:    `{"kind": "APIResourceList", "groupVersion": "discovery.k8s.io/v1", "resources": []}`,
+			expectedListPath: "/api/v1/namespaces/namespace1/endpoints/service1",
+		},
+		{
+			name:             "older cluster without the group",
+			discoveryCode:    http.StatusNotFound,
+			expectedListPath: "/api/v1/namespaces/namespace1/endpoints/service1",
+		},
+		{
+			name:             "discovery not permitted",
+			discoveryCode:    http.StatusForbidden,
+			expectedListPath: "/api/v1/namespaces/namespace1/endpoints/service1",
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			var discoveries int32
+			lists := make(chan string, 10)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == discoveryGroupVersionPath {
+					atomic.AddInt32(&discoveries, 1)
+					w.WriteHeader(tcase.discoveryCode)
+					_, _ = w.Write([]byte(tcase.discoveryBody))
+					return
+				}
+				lists <- r.URL.Path
+				if r.URL.Path == "/apis/discovery.k8s.io/v1/namespaces/namespace1/endpointslices" {
+					_, _ = w.Write([]byte(`{"metadata": {"resourceVersion": "10"}}`))
+					return
+				}
+				require.NoError(t, json.NewEncoder(w).Encode(newTestEndpoints("10", 8080, "1.2.3.4")))
+			}))
+			defer srv.Close()
+
+			r := newResolver(context.Background(), &k8s.APIClient{Client: srv.Client(), Address: srv.URL}, newOptions([]Option{WithEndpointAPI(AutoEndpointAPI)}))
+			target := targetEntry{service: "service1", namespace: "namespace1", port: noTargetPort}
+			for i := 0; i < 2; i++ {
+				_, err := r.watches.newClient().List(context.Background(), target)
+				require.NoError(t, err)
+				require.Equal(t, tcase.expectedListPath, <-lists)
+			}
+			require.Equal(t, int32(1), atomic.LoadInt32(&discoveries), "detected API should be cached")
+		})
+	}
+}
+
+func TestAutoEndpointClient_DetectionFailureIsRetried(t *testing.T) {
+	var discoveries int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == discoveryGroupVersionPath {
+			if atomic.AddInt32(&discoveries, 1) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		require.NoError(t, json.NewEncoder(w).Encode(newTestEndpoints("10", 8080, "1.2.3.4")))
+	}))
+	defer srv.Close()
+
+	r := newResolver(context.Background(), &k8s.APIClient{Client: srv.Client(), Address: srv.URL}, newOptions([]Option{WithEndpointAPI(AutoEndpointAPI)}))
+	target := targetEntry{service: "service1", namespace: "namespace1", port: noTargetPort}
+	cl := r.watches.newClient()
+	_, err := cl.List(context.Background(), target)
+	require.Error(t, err)
+	require.False(t, isFatal(err))
+
+	ep, err := cl.List(context.Background(), target)
+	require.NoError(t, err)
+	require.Equal(t, "10", ep.Metadata.ResourceVersion)
+	require.Equal(t, int32(2), atomic.LoadInt32(&discoveries))
+}
+
+func TestAutoEndpointClient_ForbiddenSlicesFallBackToEndpoints(t *testing.T) {
+	lists := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == discoveryGroupVersionPath {
+			_, _ = w.Write([]byte(`{"resources": [{"name": "endpointslices"}]}`))
+			return
+		}
+		lists <- r.URL.Path
+		if r.URL.Path == "/apis/discovery.k8s.io/v1/namespaces/namespace1/endpointslices" {
+			// RBAC granting only endpoints.
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		require.NoError(t, json.NewEncoder(w).Encode(newTestEndpoints("10", 8080, "1.2.3.4")))
+	}))
+	defer srv.Close()
+
+	r := newResolver(context.Background(), &k8s.APIClient{Client: srv.Client(), Address: srv.URL}, newOptions([]Option{WithEndpointAPI(AutoEndpointAPI)}))
+	target := targetEntry{service: "service1", namespace: "namespace1", port: noTargetPort}
+	cl := r.watches.newClient()
+	ep, err := cl.List(context.Background(), target)
+	require.NoError(t, err)
+	require.Equal(t, "10", ep.Metadata.ResourceVersion)
+	require.Equal(t, "/apis/discovery.k8s.io/v1/namespaces/namespace1/endpointslices", <-lists)
+	require.Equal(t, "/api/v1/namespaces/namespace1/endpoints/service1", <-lists)
+
+	// Slices are not tried again.
+	_, err = cl.List(context.Background(), target)
+	require.NoError(t, err)
+	require.Equal(t, "/api/v1/namespaces/namespace1/endpoints/service1", <-lists)
+}
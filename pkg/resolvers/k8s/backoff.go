@@ -0,0 +1,73 @@
+package k8sresolver
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// WatchBackoff configures delays between consecutive attempts to (re)start the watch stream.
+// Delay after n-th failed attempt is min(Base * Multiplier^n, Max) plus random jitter of up to Jitter fraction of it.
+type WatchBackoff struct {
+	// Base is a delay after the first failed attempt.
+	Base time.Duration
+	// Max is a maximum delay (without jitter).
+	Max time.Duration
+	// Multiplier is a factor by which delay grows with every failed attempt.
+	Multiplier float64
+	// Jitter is a fraction of delay (0-1) that is randomly added, so many resolvers do not reconnect at the same moment.
+	Jitter float64
+	// MinHealthyDuration is a time stream needs to be alive to reset the backoff.
+	MinHealthyDuration time.Duration
+}
+
+// DefaultWatchBackoff is the WatchBackoff used if nothing else is specified.
+var DefaultWatchBackoff = WatchBackoff{
+	Base:               100 * time.Millisecond,
+	Max:                30 * time.Second,
+	Multiplier:         2,
+	Jitter:             0.2,
+	MinHealthyDuration: 30 * time.Second,
+}
+
+// backoff is a state of WatchBackoff for single stream watcher.
+type backoff struct {
+	cnf WatchBackoff
+	// randFloat returns random number from [0,1).
+	randFloat func() float64
+	clock     clock
+
+	attempts int
+}
+
+func newBackoff(cnf WatchBackoff, c clock) *backoff {
+	return &backoff{
+		cnf:       cnf,
+		randFloat: rand.Float64,
+		clock:     c,
+	}
+}
+
+// Duration returns delay before next attempt and increases number of attempts.
+func (b *backoff) Duration() time.Duration {
+	d := float64(b.cnf.Base) * math.Pow(b.cnf.Multiplier, float64(b.attempts))
+	if maxDelay := float64(b.cnf.Max); d > maxDelay {
+		d = maxDelay
+	}
+	d += d * b.cnf.Jitter * b.randFloat()
+
+	b.attempts++
+	return time.Duration(d)
+}
+
+// Attempts returns number of delays returned since last reset.
+func (b *backoff) Attempts() int {
+	return b.attempts
+}
+
+// StreamEnded resets backoff if stream started at given time was healthy long enough.
+func (b *backoff) StreamEnded(startTime time.Time) {
+	if b.clock.Now().Sub(startTime) >= b.cnf.MinHealthyDuration {
+		b.attempts = 0
+	}
+}
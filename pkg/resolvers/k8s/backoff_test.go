@@ -0,0 +1,44 @@
+package k8sresolver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackoff_Schedule(t *testing.T) {
+	b := newBackoff(WatchBackoff{
+		Base:               100 * time.Millisecond,
+		Max:                1 * time.Second,
+		Multiplier:         2,
+		Jitter:             0.5,
+		MinHealthyDuration: 1 * time.Minute,
+	}, realClock{})
+	b.randFloat = func() float64 { return 0 }
+
+	for _, expected := range []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		1 * time.Second,
+		1 * time.Second,
+	} {
+		require.Equal(t, expected, b.Duration())
+	}
+	require.Equal(t, 6, b.Attempts())
+
+	// Jitter is added on top of the delay.
+	b.randFloat = func() float64 { return 0.5 }
+	require.Equal(t, 1250*time.Millisecond, b.Duration())
+
+	// Short living stream does not reset the backoff.
+	b.StreamEnded(time.Now().Add(-1 * time.Second))
+	require.Equal(t, 7, b.Attempts())
+
+	b.StreamEnded(time.Now().Add(-2 * time.Minute))
+	require.Equal(t, 0, b.Attempts())
+	b.randFloat = func() float64 { return 0 }
+	require.Equal(t, 100*time.Millisecond, b.Duration())
+}
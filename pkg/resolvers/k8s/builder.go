@@ -0,0 +1,273 @@
+package k8sresolver
+
+import (
+	"context"
+	"sync"
+
+	"github.com/improbable-eng/kedge/pkg/k8s"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/attributes"
+	grpcresolver "google.golang.org/grpc/resolver"
+)
+
+// Scheme is a scheme under which Kubernetes resolver.Builder is registered. Target endpoint is expected in
+// ExpectedTargetFmt format, e.g: grpc.Dial("k8s:///service1.namespace1:grpc").
+const Scheme = "k8s"
+
+// registerMu guards checking and registering builders, so concurrent registrations cannot clobber each other.
+var registerMu sync.Mutex
+
+// RegisterDefault registers resolver.Builder configured from flags under Scheme, unless any builder is registered under
+// it already. Importing the package registers nothing, so it needs to be called before dialing k8s:/// targets. It is
+// safe to call it many times. Use Register to detect conflicting registrations.
+func RegisterDefault() {
+	registerMu.Lock()
+	defer registerMu.Unlock()
+
+	if grpcresolver.Get(Scheme) != nil {
+		return
+	}
+	grpcresolver.Register(&builder{scheme: Scheme, newResolver: resolverFromFlags()})
+}
+
+// Register registers resolver.Builder configured from flags under the scheme, e.g. to resolve targets under a custom
+// scheme. Every scheme uses the same flags, so to resolve targets of other cluster use NewBuilder with its API client
+// instead. It returns error instead of overwriting builder registered under the scheme already, since grpc silently
+// replaces it.
+func Register(scheme string) error {
+	registerMu.Lock()
+	defer registerMu.Unlock()
+
+	if grpcresolver.Get(scheme) != nil {
+		return errors.Errorf("k8sresolver: resolver.Builder for scheme %q is already registered", scheme)
+	}
+	grpcresolver.Register(&builder{scheme: scheme, newResolver: resolverFromFlags()})
+	return nil
+}
+
+// resolverFromFlags lazily creates resolver from flags, since flags are not parsed yet when builder is registered.
+func resolverFromFlags() func() (*resolver, error) {
+	var (
+		once sync.Once
+		r    *resolver
+		err  error
+	)
+	return func() (*resolver, error) {
+		once.Do(func() {
+			var apiClient *k8s.APIClient
+			apiClient, err = k8s.NewFromFlags()
+			if err != nil {
+				return
+			}
+			var opts []Option
+			opts, err = optionsFromFlags()
+			if err != nil {
+				return
+			}
+			r = newResolver(context.Background(), apiClient, newOptions(opts))
+		})
+		return r, err
+	}
+}
+
+// builder is a resolver.Builder that watches Kubernetes endpoints and pushes the full state of addresses to the
+// grpc.ClientConn on every change.
+type builder struct {
+	// scheme is returned by Scheme(). Scheme is used if empty.
+	scheme      string
+	newResolver func() (*resolver, error)
+}
+
+// NewBuilder returns a new Kubernetes resolver.Builder using given k8s.APIClient configured to be used against
+// kube-apiserver. It can be used with grpc.WithResolvers if builder registered under Scheme is not suitable.
+func NewBuilder(ctx context.Context, apiClient *k8s.APIClient, opts ...Option) grpcresolver.Builder {
+	r := newResolver(ctx, apiClient, newOptions(opts))
+	return &builder{newResolver: func() (*resolver, error) { return r, nil }}
+}
+
+// Scheme returns the scheme supported by this builder.
+func (b *builder) Scheme() string {
+	if b.scheme == "" {
+		return Scheme
+	}
+	return b.scheme
+}
+
+// Build starts watching endpoints of the target. It fails only if the target or WithServerNameTemplate is malformed,
+// initial list failed or WithClusters is used.
+func (b *builder) Build(target grpcresolver.Target, cc grpcresolver.ClientConn, _ grpcresolver.BuildOptions) (grpcresolver.Resolver, error) {
+	r, err := b.newResolver()
+	if err != nil {
+		return nil, errors.Wrap(err, "k8sresolver: failed to create resolver")
+	}
+	if err := checkServerNameTemplate(r.opts.serverNameTemplate); err != nil {
+		return nil, err
+	}
+	if len(r.clusters) > 0 {
+		return nil, errors.New("k8sresolver: WithClusters is supported only by naming.Resolver")
+	}
+
+	targets, err := r.targets(target.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(r.ctx)
+	w, err := startNewMultiWatcher(ctx, targets, r.watches, r.watcherOptions())
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	ccr := &clientConnResolver{
+		ctx:     ctx,
+		cancel:  cancel,
+		targets: targets,
+		r:       r,
+		cc:      cc,
+	}
+	go ccr.run(w)
+	return ccr, nil
+}
+
+// clientConnResolver is a resolver.Resolver that translates watcher updates into resolver.State.
+// Since watcher errors are not recoverable, it reports the error to the grpc.ClientConn and starts a new watcher.
+type clientConnResolver struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	targets []targetEntry
+	r       *resolver
+	cc      grpcresolver.ClientConn
+
+	// w is the current watcher. Nil while a new one is being started.
+	mu sync.Mutex
+	w  *watcher
+}
+
+func (r *clientConnResolver) run(w *watcher) {
+	b := newBackoff(r.r.opts.watchBackoff, r.r.opts.clock)
+	for {
+		startTime := r.r.opts.clock.Now()
+		r.setWatcher(w)
+		err := r.watch(w)
+		r.setWatcher(nil)
+		if r.ctx.Err() != nil {
+			return
+		}
+		r.cc.ReportError(err)
+		b.StreamEnded(startTime)
+
+		for {
+			select {
+			case <-r.ctx.Done():
+				return
+			case <-r.r.opts.clock.After(b.Duration()):
+			}
+
+			w, err = startNewMultiWatcher(r.ctx, r.targets, r.r.watches, r.r.watcherOptions())
+			if err == nil {
+				break
+			}
+			if r.ctx.Err() != nil {
+				return
+			}
+			r.cc.ReportError(err)
+		}
+	}
+}
+
+// watch updates state of the grpc.ClientConn until watcher returns error.
+// Whole state is pushed at once, even if it is a result of many updates (e.g. the initial list or a resync after which
+// most addresses changed), so balancer never sees partially populated set of addresses.
+func (r *clientConnResolver) watch(w *watcher) error {
+	for initial := true; ; initial = false {
+		u, err := w.Next()
+		if err != nil {
+			return err
+		}
+		if len(u) == 0 && !initial {
+			// Nothing changed, e.g. resync returned the same addresses.
+			continue
+		}
+
+		// Watcher keeps all addresses from the last update.
+		addrs := w.Current()
+		state := grpcresolver.State{Addresses: make([]grpcresolver.Address, 0, len(addrs))}
+		for _, addr := range addrs {
+			md := w.lastUpdates[addr]
+			t := w.namespaceTarget(md.Namespace)
+			mapped, attrs := r.r.opts.addressMapper(t.String(), addr, md)
+			state.Addresses = append(state.Addresses, grpcresolver.Address{
+				Addr:       mapped,
+				ServerName: serverName(r.r.opts.serverNameTemplate, t, md),
+				Attributes: attrs,
+			})
+		}
+		r.cc.UpdateState(state)
+	}
+}
+
+type addressMetadataKey struct{}
+
+// AddressMapper translates resolved address of the target into the address and attributes pushed to the
+// grpc.ClientConn by the resolver.Builder, e.g. to attach attributes needed to build EDS ClusterLoadAssignment (zone,
+// weight, port name) under keys of a custom balancer. Target is in ExpectedTargetFmt format. It is called for every
+// address on every change, so it must not block.
+type AddressMapper func(target string, addr string, md AddressMetadata) (string, *attributes.Attributes)
+
+// DefaultAddressMapper keeps the address and attaches AddressMetadata to it, so it is returned by
+// AddressMetadataFromAddress. Custom mappers can extend its attributes with WithValues.
+func DefaultAddressMapper(_ string, addr string, md AddressMetadata) (string, *attributes.Attributes) {
+	return addr, attributes.New(addressMetadataKey{}, md)
+}
+
+// AddressMetadataFromAddress returns AddressMetadata attached to the address by the resolver.Builder.
+func AddressMetadataFromAddress(addr grpcresolver.Address) (AddressMetadata, bool) {
+	if addr.Attributes == nil {
+		return AddressMetadata{}, false
+	}
+	md, ok := addr.Attributes.Value(addressMetadataKey{}).(AddressMetadata)
+	return md, ok
+}
+
+// PodRef identifies the pod backing the resolved address.
+type PodRef struct {
+	Name      string
+	Namespace string
+	UID       string
+}
+
+// PodIdentityFromAddress returns the pod backing the address pushed by the resolver.Builder, e.g. to log or trace which
+// pod the call was sent to from a custom balancer. It returns false if the address has no AddressMetadata (see
+// AddressMapper) or it is not backed by a pod.
+func PodIdentityFromAddress(addr grpcresolver.Address) (PodRef, bool) {
+	md, ok := AddressMetadataFromAddress(addr)
+	if !ok || md.TargetRef == nil || md.TargetRef.Kind != "Pod" {
+		return PodRef{}, false
+	}
+	return PodRef{Name: md.TargetRef.Name, Namespace: md.TargetRef.Namespace, UID: md.TargetRef.UID}, true
+}
+
+func (r *clientConnResolver) setWatcher(w *watcher) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.w = w
+}
+
+// ResolveNow lists endpoints out of the watch, e.g. when balancer suspects addresses are stale after connection
+// failure. It does not block. List is shared by all watchers of the same service and rapid calls are coalesced, see
+// refreshInterval. Listed state is pushed to the grpc.ClientConn only if addresses changed.
+func (r *clientConnResolver) ResolveNow(grpcresolver.ResolveNowOptions) {
+	r.mu.Lock()
+	w := r.w
+	r.mu.Unlock()
+	if w != nil {
+		w.resolveNow()
+	}
+}
+
+// Close closes the resolver and its watcher.
+func (r *clientConnResolver) Close() {
+	r.cancel()
+}
@@ -0,0 +1,203 @@
+package k8sresolver
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/improbable-eng/kedge/pkg/k8s"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/attributes"
+	grpcresolver "google.golang.org/grpc/resolver"
+)
+
+type clientConnMock struct {
+	grpcresolver.ClientConn
+
+	statesCh chan grpcresolver.State
+	errsCh   chan error
+}
+
+func (m *clientConnMock) UpdateState(s grpcresolver.State) {
+	m.statesCh <- s
+}
+
+func (m *clientConnMock) ReportError(err error) {
+	m.errsCh <- err
+}
+
+func requireStateAddrs(t *testing.T, expected []string, state grpcresolver.State) {
+	var got []string
+	for _, a := range state.Addresses {
+		got = append(got, a.Addr)
+	}
+	require.Equal(t, expected, got)
+}
+
+func TestBuilder_RegisteredUnderScheme(t *testing.T) {
+	RegisterDefault()
+	registered := grpcresolver.Get(Scheme)
+	require.NotNil(t, registered)
+
+	// Registering default again is no-op.
+	RegisterDefault()
+	require.True(t, registered == grpcresolver.Get(Scheme), "registered builder should not be replaced")
+	require.Error(t, Register(Scheme))
+	require.True(t, registered == grpcresolver.Get(Scheme), "registered builder should not be replaced")
+
+	require.NoError(t, Register("k8s-other"))
+	require.Equal(t, "k8s-other", grpcresolver.Get("k8s-other").Scheme())
+	require.Error(t, Register("k8s-other"))
+}
+
+func startTestBuilder(t *testing.T, opts ...Option) (chan []byte, *endpointClientMock, *clientConnMock, grpcresolver.Resolver) {
+	bytesCh := make(chan []byte)
+	listResult := newTestEndpoints("10", 8080, "1.2.3.5", "1.2.3.4")
+	epClientMock := &endpointClientMock{
+		t: t,
+		expectedTarget: targetEntry{
+			service:   "service1",
+			port:      noTargetPort,
+			namespace: "namespace1",
+		},
+		bytesCh:    bytesCh,
+		errCh:      make(chan error),
+		startErrCh: make(chan error, 1),
+		streamsCh:  make(chan startedStream, 10),
+		listResult: &listResult,
+	}
+
+	b := &builder{newResolver: func() (*resolver, error) {
+		opts := newOptions(append([]Option{WithWatchBackoff(testWatchBackoff)}, opts...))
+		return &resolver{
+			ctx:     context.Background(),
+			watches: newWatchRegistry(context.Background(), func() endpointClient { return epClientMock }, opts),
+			opts:    opts,
+		}, nil
+	}}
+	cc := &clientConnMock{
+		statesCh: make(chan grpcresolver.State, 10),
+		errsCh:   make(chan error, 10),
+	}
+
+	r, err := b.Build(grpcresolver.Target{Scheme: Scheme, Endpoint: "service1.namespace1"}, cc, grpcresolver.BuildOptions{})
+	require.NoError(t, err)
+	<-epClientMock.streamsCh
+	return bytesCh, epClientMock, cc, r
+}
+
+func TestBuilder_UpdatesState(t *testing.T) {
+	bytesCh, epClientMock, cc, r := startTestBuilder(t)
+	defer r.Close()
+
+	requireStateAddrs(t, []string{"1.2.3.4:8080", "1.2.3.5:8080"}, <-cc.statesCh)
+
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: newTestEndpoints("11", 8080, "1.2.3.6")})
+	state := <-cc.statesCh
+	require.Len(t, state.Addresses, 1)
+	require.Equal(t, "1.2.3.6:8080", state.Addresses[0].Addr)
+	md, ok := AddressMetadataFromAddress(state.Addresses[0])
+	require.True(t, ok)
+	require.Equal(t, AddressMetadata{IP: "1.2.3.6", Namespace: "namespace1", PortName: "grpc"}, md)
+
+	// Watcher error is reported and a new watcher is started.
+	sendTestEvent(t, bytesCh, event{Type: failed, Object: endpoints{Kind: "Status", Code: http.StatusForbidden}})
+	require.Error(t, <-cc.errsCh)
+	select {
+	case stream := <-epClientMock.streamsCh:
+		require.Equal(t, "10", stream.resourceVersion)
+	case <-time.After(200 * time.Millisecond):
+		t.Fatal("Watcher was not restarted")
+	}
+	requireStateAddrs(t, []string{"1.2.3.4:8080", "1.2.3.5:8080"}, <-cc.statesCh)
+}
+
+type zoneKey struct{}
+
+func TestBuilder_AddressMapper(t *testing.T) {
+	_, _, cc, r := startTestBuilder(t, WithAddressMapper(func(target string, addr string, md AddressMetadata) (string, *attributes.Attributes) {
+		require.Equal(t, "service1.namespace1", target)
+		mapped, attrs := DefaultAddressMapper(target, addr, md)
+		return "ipv4:" + mapped, attrs.WithValues(zoneKey{}, "zone-"+md.IP)
+	}))
+	defer r.Close()
+
+	state := <-cc.statesCh
+	requireStateAddrs(t, []string{"ipv4:1.2.3.4:8080", "ipv4:1.2.3.5:8080"}, state)
+	require.Equal(t, "zone-1.2.3.4", state.Addresses[0].Attributes.Value(zoneKey{}))
+	md, ok := AddressMetadataFromAddress(state.Addresses[0])
+	require.True(t, ok, "attributes of the default mapper should be kept")
+	require.Equal(t, "1.2.3.4", md.IP)
+}
+
+func TestBuilder_ServerNameTemplate(t *testing.T) {
+	_, _, cc, r := startTestBuilder(t, WithServerNameTemplate("{port}.{service}.{namespace}.svc"))
+	defer r.Close()
+
+	state := <-cc.statesCh
+	require.Len(t, state.Addresses, 2)
+	for _, addr := range state.Addresses {
+		require.Equal(t, "grpc.service1.namespace1.svc", addr.ServerName)
+	}
+
+	b := NewBuilder(context.Background(), &k8s.APIClient{}, WithServerNameTemplate("{pod}.{cluster}"))
+	_, err := b.Build(grpcresolver.Target{Scheme: Scheme, Endpoint: "service1.namespace1"}, &clientConnMock{}, grpcresolver.BuildOptions{})
+	require.Error(t, err)
+}
+
+func TestPodIdentityFromAddress(t *testing.T) {
+	ref := &TargetRef{Kind: "Pod", Name: "web-0", Namespace: "namespace1", UID: "uid-0", NodeName: "node1"}
+	addr, attrs := DefaultAddressMapper("web.namespace1", "1.2.3.4:8080", AddressMetadata{IP: "1.2.3.4", TargetRef: ref})
+	pod, ok := PodIdentityFromAddress(grpcresolver.Address{Addr: addr, Attributes: attrs})
+	require.True(t, ok)
+	require.Equal(t, PodRef{Name: "web-0", Namespace: "namespace1", UID: "uid-0"}, pod)
+
+	_, attrs = DefaultAddressMapper("web.namespace1", "1.2.3.4:8080", AddressMetadata{IP: "1.2.3.4"})
+	_, ok = PodIdentityFromAddress(grpcresolver.Address{Addr: addr, Attributes: attrs})
+	require.False(t, ok, "address without target ref")
+
+	_, attrs = DefaultAddressMapper("web.namespace1", "1.2.3.4:8080", AddressMetadata{IP: "1.2.3.4", TargetRef: &TargetRef{Kind: "Node", Name: "node1"}})
+	_, ok = PodIdentityFromAddress(grpcresolver.Address{Addr: addr, Attributes: attrs})
+	require.False(t, ok, "address not backed by pod")
+
+	_, ok = PodIdentityFromAddress(grpcresolver.Address{Addr: addr})
+	require.False(t, ok, "address without metadata")
+}
+
+func TestBuilder_ResolveNow(t *testing.T) {
+	_, epClientMock, cc, r := startTestBuilder(t)
+	defer r.Close()
+	requireStateAddrs(t, []string{"1.2.3.4:8080", "1.2.3.5:8080"}, <-cc.statesCh)
+
+	// Endpoints are listed out of the watch.
+	listResult := newTestEndpoints("11", 8080, "1.2.3.6")
+	epClientMock.listResult = &listResult
+	r.ResolveNow(grpcresolver.ResolveNowOptions{})
+	select {
+	case state := <-cc.statesCh:
+		requireStateAddrs(t, []string{"1.2.3.6:8080"}, state)
+	case <-time.After(time.Second):
+		t.Fatal("state should be pushed after ResolveNow")
+	}
+}
+
+func TestBuilder_ResyncIsSingleState(t *testing.T) {
+	bytesCh, _, cc, r := startTestBuilder(t)
+	defer r.Close()
+	requireStateAddrs(t, []string{"1.2.3.4:8080", "1.2.3.5:8080"}, <-cc.statesCh)
+
+	// Fresh watch after resync starts with the full state, which replaces most addresses at once.
+	sendTestEvent(t, bytesCh, event{Type: added, Object: newTestEndpoints("20", 8080, "1.2.3.5", "1.2.3.6", "1.2.3.7")})
+	requireStateAddrs(t, []string{"1.2.3.5:8080", "1.2.3.6:8080", "1.2.3.7:8080"}, <-cc.statesCh)
+
+	// Resync without any change does not update the state.
+	sendTestEvent(t, bytesCh, event{Type: added, Object: newTestEndpoints("30", 8080, "1.2.3.7", "1.2.3.6", "1.2.3.5")})
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: newTestEndpoints("31", 8080, "1.2.3.8")})
+	requireStateAddrs(t, []string{"1.2.3.8:8080"}, <-cc.statesCh)
+	select {
+	case s := <-cc.statesCh:
+		t.Errorf("No more states were expected, got %v", s)
+	default:
+	}
+}
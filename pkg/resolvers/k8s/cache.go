@@ -0,0 +1,154 @@
+package k8sresolver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultResolutionCacheMaxAge is a default age after which cached endpoints are not used anymore.
+const DefaultResolutionCacheMaxAge = 1 * time.Hour
+
+// cacheWriteInterval is a delay of the file write after the cache changes, so events of busy services are written
+// together instead of rewriting the file on every event.
+const cacheWriteInterval = 5 * time.Second
+
+// resolutionCache persists the last endpoints of every watched service to a file, so watches can start from them when
+// kube-apiserver is not reachable on startup. See WithResolutionCache.
+type resolutionCache struct {
+	path   string
+	maxAge time.Duration
+	logger logrus.FieldLogger
+	clock  clock
+
+	mu      sync.Mutex
+	loaded  bool
+	entries map[string]cacheEntry
+	// dirty is true if entries changed since written. writeTimer writes them, if scheduled.
+	dirty      bool
+	writeTimer timer
+}
+
+type cacheEntry struct {
+	Saved     time.Time `json:"saved"`
+	Endpoints endpoints `json:"endpoints"`
+}
+
+func newResolutionCache(path string, maxAge time.Duration, logger logrus.FieldLogger, c clock) *resolutionCache {
+	return &resolutionCache{path: path, maxAge: maxAge, logger: logger, clock: c, entries: map[string]cacheEntry{}}
+}
+
+// load returns cached endpoints of the service, unless they are older than max age. Endpoints have no resourceVersion,
+// since they are provisional until listed again.
+func (c *resolutionCache) load(key watchKey) (*endpoints, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.readFile(); err != nil {
+		return nil, false, err
+	}
+	entry, ok := c.entries[key.String()]
+	if !ok || c.clock.Now().Sub(entry.Saved) > c.maxAge {
+		return nil, false, nil
+	}
+	ep := entry.Endpoints
+	ep.Metadata.ResourceVersion = ""
+	return &ep, true, nil
+}
+
+// store saves the state of the service if it comes from kube-apiserver. Deleted endpoints are removed from the cache.
+// The file is written after cacheWriteInterval or by flush, whichever comes first.
+func (c *resolutionCache) store(key watchKey, e event) {
+	if e.Object.Metadata.ResourceVersion == "" {
+		// Provisional state (e.g. from the cache or DNS) is never cached.
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.readFile(); err != nil {
+		// Corrupted cache is replaced.
+		c.entries = map[string]cacheEntry{}
+	}
+	if e.Type == deleted {
+		delete(c.entries, key.String())
+	} else {
+		c.entries[key.String()] = cacheEntry{Saved: c.clock.Now(), Endpoints: e.Object}
+	}
+	c.dirty = true
+	if c.writeTimer == nil {
+		c.writeTimer = c.clock.AfterFunc(cacheWriteInterval, func() {
+			if err := c.flush(); err != nil {
+				c.logger.WithError(err).Warn("k8sresolver: Failed to update resolution cache")
+			}
+		})
+	}
+}
+
+// flush writes the changed entries to the file right away, e.g. when watches stop.
+func (c *resolutionCache) flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.writeTimer != nil {
+		c.writeTimer.Stop()
+		c.writeTimer = nil
+	}
+	if !c.dirty {
+		return nil
+	}
+	if err := c.writeFile(); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+// readFile reads entries from the file once. Missing file means empty cache.
+func (c *resolutionCache) readFile() error {
+	if c.loaded {
+		return nil
+	}
+	c.loaded = true
+
+	b, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "k8sresolver: failed to read resolution cache %s", c.path)
+	}
+	if err := json.Unmarshal(b, &c.entries); err != nil {
+		return errors.Wrapf(err, "k8sresolver: failed to decode resolution cache %s", c.path)
+	}
+	return nil
+}
+
+// writeFile replaces the file atomically, so it is never read partially written.
+func (c *resolutionCache) writeFile() error {
+	b, err := json.Marshal(c.entries)
+	if err != nil {
+		return errors.Wrap(err, "k8sresolver: failed to encode resolution cache")
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".tmp")
+	if err != nil {
+		return errors.Wrapf(err, "k8sresolver: failed to write resolution cache %s", c.path)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "k8sresolver: failed to write resolution cache %s", c.path)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrapf(err, "k8sresolver: failed to write resolution cache %s", c.path)
+	}
+	return errors.Wrapf(os.Rename(tmp.Name(), c.path), "k8sresolver: failed to write resolution cache %s", c.path)
+}
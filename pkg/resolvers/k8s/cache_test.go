@@ -0,0 +1,224 @@
+package k8sresolver
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/naming"
+)
+
+func tempCachePath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "k8sresolver")
+	require.NoError(t, err)
+	return filepath.Join(dir, "cache.json"), func() { _ = os.RemoveAll(dir) }
+}
+
+func TestResolutionCache_StoreAndLoad(t *testing.T) {
+	path, cleanup := tempCachePath(t)
+	defer cleanup()
+	key1 := watchKey{namespace: "namespace1", service: "service1"}
+	key2 := watchKey{namespace: "namespace1", service: "service2"}
+
+	c := newResolutionCache(path, time.Hour, logrus.New(), realClock{})
+	_, ok, err := c.load(key1)
+	require.NoError(t, err)
+	require.False(t, ok, "missing file is empty cache")
+
+	c.store(key1, event{Type: modified, Object: newTestEndpoints("10", 8080, "1.2.3.4")})
+	c.store(key2, event{Type: modified, Object: newTestEndpoints("11", 8080, "1.2.3.5")})
+	// Provisional state is not cached.
+	c.store(key2, event{Type: modified, Object: newTestEndpoints("", 8080, "1.2.3.6")})
+	require.NoError(t, c.flush())
+
+	// Cache is loaded from the file by the next process.
+	c = newResolutionCache(path, time.Hour, logrus.New(), realClock{})
+	ep, ok, err := c.load(key1)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, newTestEndpoints("", 8080, "1.2.3.4"), *ep, "cached endpoints should have no resourceVersion")
+	ep, ok, err = c.load(key2)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, newTestEndpoints("", 8080, "1.2.3.5"), *ep)
+
+	// Deleted endpoints are removed.
+	c.store(key2, event{Type: deleted, Object: newTestEndpoints("12", 8080)})
+	require.NoError(t, c.flush())
+	_, ok, err = newResolutionCache(path, time.Hour, logrus.New(), realClock{}).load(key2)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("{corrupted"), 0600))
+	_, _, err = newResolutionCache(path, time.Hour, logrus.New(), realClock{}).load(key1)
+	require.Error(t, err)
+}
+
+// storeTestCache stores the event in the cache file right away.
+func storeTestCache(t *testing.T, path string, c clock, key watchKey, e event) {
+	cache := newResolutionCache(path, time.Hour, logrus.New(), c)
+	cache.store(key, e)
+	require.NoError(t, cache.flush())
+}
+
+func TestResolutionCache_WritesAfterInterval(t *testing.T) {
+	path, cleanup := tempCachePath(t)
+	defer cleanup()
+	key := watchKey{namespace: "namespace1", service: "service1"}
+
+	clk := newFakeClock()
+	c := newResolutionCache(path, time.Hour, logrus.New(), clk)
+	c.store(key, event{Type: modified, Object: newTestEndpoints("10", 8080, "1.2.3.4")})
+	c.store(key, event{Type: modified, Object: newTestEndpoints("11", 8080, "1.2.3.5")})
+	_, err := os.Stat(path)
+	require.True(t, os.IsNotExist(err), "file should not be written on every event")
+
+	// Both events are written together once the interval passes.
+	clk.waitForTimers(1)
+	clk.Advance(cacheWriteInterval)
+	require.Eventually(t, func() bool {
+		ep, ok, err := newResolutionCache(path, time.Hour, logrus.New(), clk).load(key)
+		return err == nil && ok && ep.Subsets[0].Addresses[0].IP == "1.2.3.5"
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestResolutionCache_Expiry(t *testing.T) {
+	path, cleanup := tempCachePath(t)
+	defer cleanup()
+	key := watchKey{namespace: "namespace1", service: "service1"}
+
+	clk := newFakeClock()
+	storeTestCache(t, path, clk, key, event{Type: modified, Object: newTestEndpoints("10", 8080, "1.2.3.4")})
+	clk.Advance(20 * time.Millisecond)
+
+	_, ok, err := newResolutionCache(path, 10*time.Millisecond, logrus.New(), clk).load(key)
+	require.NoError(t, err)
+	require.False(t, ok, "expired endpoints should not be used")
+	_, ok, err = newResolutionCache(path, time.Hour, logrus.New(), clk).load(key)
+	require.NoError(t, err)
+	require.True(t, ok)
+}
+
+// flakyListClient fails List until the error is cleared.
+type flakyListClient struct {
+	*endpointClientMock
+
+	mu      sync.Mutex
+	listErr error
+}
+
+func (c *flakyListClient) setListErr(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.listErr = err
+}
+
+func (c *flakyListClient) List(ctx context.Context, t targetEntry) (*endpoints, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.listErr != nil {
+		return nil, c.listErr
+	}
+	return c.endpointClientMock.List(ctx, t)
+}
+
+func startCachedTestWatcher(t *testing.T, path string, opts ...Option) (*flakyListClient, *watcher, error) {
+	listResult := newTestEndpoints("20", 8080, "1.2.3.5")
+	epClient := &flakyListClient{
+		endpointClientMock: &endpointClientMock{
+			t:              t,
+			expectedTarget: targetEntry{service: "service1", port: noTargetPort, namespace: "namespace1"},
+			bytesCh:        make(chan []byte),
+			errCh:          make(chan error),
+			startErrCh:     make(chan error, 1),
+			streamsCh:      make(chan startedStream, 10),
+			listResult:     &listResult,
+		},
+		listErr: &statusError{code: http.StatusServiceUnavailable},
+	}
+	o := newOptions(append([]Option{WithResolutionCache(path), WithWatchBackoff(testWatchBackoff)}, opts...))
+	registry := newWatchRegistry(context.Background(), func() endpointClient { return epClient }, o)
+	w, err := startNewMultiWatcher(context.Background(), []targetEntry{epClient.expectedTarget}, registry, o)
+	return epClient, w, err
+}
+
+func TestWatchRegistry_ResolutionCache_Reconcile(t *testing.T) {
+	path, cleanup := tempCachePath(t)
+	defer cleanup()
+	key := watchKey{namespace: "namespace1", service: "service1"}
+	storeTestCache(t, path, realClock{}, key, event{Type: modified, Object: newTestEndpoints("10", 8080, "1.2.3.4")})
+
+	// List fails, so watcher starts with cached addresses.
+	epClient, w, err := startCachedTestWatcher(t, path)
+	require.NoError(t, err)
+	defer w.Close()
+	u, err := w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{{Op: naming.Add, Addr: "1.2.3.4:8080"}}, u)
+	select {
+	case <-epClient.streamsCh:
+		t.Fatal("watch should not be started before the list succeeds")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Listed state replaces the cached one and watch starts from it.
+	epClient.setListErr(nil)
+	u, err = w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{
+		{Op: naming.Delete, Addr: "1.2.3.4:8080"},
+		{Op: naming.Add, Addr: "1.2.3.5:8080"},
+	}, u)
+	select {
+	case stream := <-epClient.streamsCh:
+		require.Equal(t, "20", stream.resourceVersion)
+	case <-time.After(time.Second):
+		t.Fatal("watch should be started after the list")
+	}
+
+	// Listed state is written when the watch stops.
+	w.Close()
+	ep, ok, err := newResolutionCache(path, time.Hour, logrus.New(), realClock{}).load(key)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, newTestEndpoints("", 8080, "1.2.3.5"), *ep)
+}
+
+func TestWatchRegistry_ResolutionCache_Deleted(t *testing.T) {
+	path, cleanup := tempCachePath(t)
+	defer cleanup()
+	key := watchKey{namespace: "namespace1", service: "service1"}
+	storeTestCache(t, path, realClock{}, key, event{Type: modified, Object: newTestEndpoints("10", 8080, "1.2.3.4")})
+
+	epClient, w, err := startCachedTestWatcher(t, path)
+	require.NoError(t, err)
+	defer w.Close()
+	_, err = w.Next()
+	require.NoError(t, err)
+
+	// Endpoints do not exist anymore, so cached addresses are deleted.
+	epClient.setListErr(&statusError{code: http.StatusNotFound})
+	u, err := w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{{Op: naming.Delete, Addr: "1.2.3.4:8080"}}, u)
+	require.Empty(t, w.Current())
+}
+
+func TestWatchRegistry_ResolutionCache_Expired(t *testing.T) {
+	path, cleanup := tempCachePath(t)
+	defer cleanup()
+	key := watchKey{namespace: "namespace1", service: "service1"}
+	storeTestCache(t, path, realClock{}, key, event{Type: modified, Object: newTestEndpoints("10", 8080, "1.2.3.4")})
+	time.Sleep(20 * time.Millisecond)
+
+	// Expired cache is not used, so list error is returned.
+	_, _, err := startCachedTestWatcher(t, path, WithResolutionCacheMaxAge(10*time.Millisecond))
+	require.Error(t, err)
+}
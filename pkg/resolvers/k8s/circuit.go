@@ -0,0 +1,95 @@
+package k8sresolver
+
+import (
+	"fmt"
+	"time"
+)
+
+// CircuitBreaker configures throttling of the watch that keeps reconnecting, e.g. against permanently broken
+// kube-apiserver. If the watch is restarted more than MaxReconnects times within Window, the circuit opens: no restart
+// is attempted for Cooldown. Then single restart is tried (half-open). If it succeeds the circuit closes, otherwise it
+// opens again. Unlike fatal errors, open circuit does not fail the watcher.
+type CircuitBreaker struct {
+	// MaxReconnects is a number of restarts within Window allowed before the circuit opens.
+	MaxReconnects int
+	// Window is a rolling window in which restarts are counted.
+	Window time.Duration
+	// Cooldown is a time circuit stays open before the restart is tried again.
+	Cooldown time.Duration
+}
+
+// CircuitState is a state of the watch CircuitBreaker. It is exported as kedge_k8sresolver_circuit_state metric.
+type CircuitState int
+
+const (
+	// CircuitClosed means that the watch is restarted as usual.
+	CircuitClosed CircuitState = iota
+	// CircuitHalfOpen means that cooldown passed and single restart is tried.
+	CircuitHalfOpen
+	// CircuitOpen means that the watch restarted too many times, so it is not restarted until cooldown passes.
+	CircuitOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "Closed"
+	case CircuitHalfOpen:
+		return "HalfOpen"
+	case CircuitOpen:
+		return "Open"
+	}
+	return fmt.Sprintf("CircuitState(%d)", int(s))
+}
+
+// circuitBreaker is a state of CircuitBreaker for single stream watcher.
+type circuitBreaker struct {
+	cnf   CircuitBreaker
+	clock clock
+
+	state CircuitState
+	// restarts are times of restarts within the window, oldest first.
+	restarts []time.Time
+}
+
+func newCircuitBreaker(cnf CircuitBreaker, c clock) *circuitBreaker {
+	return &circuitBreaker{cnf: cnf, clock: c}
+}
+
+// Restart records restart about to be attempted. It returns true if the circuit opens instead, so restart needs to wait
+// for the cooldown. Restart attempted while half-open means that the trial failed, so the circuit opens again.
+func (c *circuitBreaker) Restart() bool {
+	if c.state == CircuitHalfOpen {
+		c.state = CircuitOpen
+		return true
+	}
+
+	now := c.clock.Now()
+	c.restarts = append(c.restarts, now)
+	i := 0
+	for i < len(c.restarts) && now.Sub(c.restarts[i]) >= c.cnf.Window {
+		i++
+	}
+	c.restarts = c.restarts[i:]
+	if len(c.restarts) <= c.cnf.MaxReconnects {
+		return false
+	}
+	c.state = CircuitOpen
+	c.restarts = nil
+	return true
+}
+
+// CooledDown makes the circuit half-open, so single restart is tried.
+func (c *circuitBreaker) CooledDown() {
+	c.state = CircuitHalfOpen
+}
+
+// Connected closes the circuit after the successful restart.
+func (c *circuitBreaker) Connected() {
+	c.state = CircuitClosed
+}
+
+// State returns the current state of the circuit.
+func (c *circuitBreaker) State() CircuitState {
+	return c.state
+}
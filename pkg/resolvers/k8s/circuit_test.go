@@ -0,0 +1,111 @@
+package k8sresolver
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreaker_Transitions(t *testing.T) {
+	clk := newFakeClock()
+	c := newCircuitBreaker(CircuitBreaker{MaxReconnects: 2, Window: time.Minute, Cooldown: time.Hour}, clk)
+
+	// Restarts outside of the window are not counted.
+	require.False(t, c.Restart())
+	clk.Advance(time.Minute)
+	require.False(t, c.Restart())
+	require.False(t, c.Restart())
+	require.Equal(t, CircuitClosed, c.State())
+
+	require.True(t, c.Restart())
+	require.Equal(t, CircuitOpen, c.State())
+
+	// Failed trial opens the circuit again.
+	c.CooledDown()
+	require.Equal(t, CircuitHalfOpen, c.State())
+	require.True(t, c.Restart())
+	require.Equal(t, CircuitOpen, c.State())
+
+	// Restarts before the circuit opened are not counted after it closes.
+	c.CooledDown()
+	c.Connected()
+	require.Equal(t, CircuitClosed, c.State())
+	require.False(t, c.Restart())
+	require.False(t, c.Restart())
+	require.True(t, c.Restart())
+	require.Equal(t, "HalfOpen", CircuitHalfOpen.String())
+}
+
+func TestStreamWatcher_CircuitBreaker(t *testing.T) {
+	clk := newFakeClock()
+	reg := prometheus.NewRegistry()
+	states := make(chan ConnState, 20)
+	_, errCh, epClientMock, _, _, cancel := startTestStream(t,
+		withClock(clk),
+		WithRegisterer(reg),
+		WithWatchBackoff(WatchBackoff{Base: time.Second, Max: time.Second, Multiplier: 1, MinHealthyDuration: time.Hour}),
+		WithCircuitBreaker(CircuitBreaker{MaxReconnects: 2, Window: time.Minute, Cooldown: 10 * time.Minute}),
+		WithOnConnState(func(_ string, state ConnState) { states <- state }),
+	)
+	defer cancel()
+	requireStates := func(expected ...ConnState) {
+		for _, e := range expected {
+			select {
+			case got := <-states:
+				require.Equal(t, e, got)
+			case <-time.After(2 * time.Second):
+				t.Fatalf("%v state was expected", e)
+			}
+		}
+	}
+	requireCircuit := func(expected CircuitState) {
+		require.Equal(t, float64(expected), gatheredValue(t, reg, "kedge_k8sresolver_circuit_state", "service1.namespace1"))
+	}
+	requireStates(ConnStateConnecting, ConnStateConnected)
+	requireCircuit(CircuitClosed)
+
+	// Restarts within the limit are not throttled.
+	for i := 0; i < 2; i++ {
+		errCh <- io.EOF
+		clk.waitForTimers(1)
+		clk.Advance(time.Second)
+		<-epClientMock.streamsCh
+		requireStates(ConnStateReconnecting, ConnStateConnected)
+	}
+
+	// Circuit opens, so the stream is not restarted until the cooldown passes.
+	errCh <- io.EOF
+	clk.waitForTimers(1)
+	clk.Advance(time.Second)
+	requireStates(ConnStateReconnecting, ConnStateCircuitOpen)
+	requireCircuit(CircuitOpen)
+	clk.waitForTimers(1)
+	clk.Advance(10*time.Minute - time.Millisecond)
+	select {
+	case <-epClientMock.streamsCh:
+		t.Fatal("stream restarted while circuit is open")
+	default:
+	}
+
+	// Failed trial of the half-open circuit opens it again.
+	epClientMock.startErrCh <- errors.New("connection refused")
+	clk.Advance(time.Millisecond)
+	<-epClientMock.streamsCh
+	requireStates(ConnStateReconnecting)
+	clk.waitForTimers(1)
+	clk.Advance(time.Second)
+	requireStates(ConnStateCircuitOpen)
+	requireCircuit(CircuitOpen)
+
+	// Successful trial closes the circuit.
+	clk.waitForTimers(1)
+	clk.Advance(10 * time.Minute)
+	<-epClientMock.streamsCh
+	requireStates(ConnStateReconnecting, ConnStateConnected)
+	requireCircuit(CircuitClosed)
+	require.Len(t, states, 0)
+}
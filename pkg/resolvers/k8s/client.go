@@ -1,52 +1,429 @@
 package k8sresolver
 
 import (
+	"compress/gzip"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/improbable-eng/kedge/pkg/k8s"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
 type endpointClient interface {
-	StartChangeStream(ctx context.Context, t targetEntry) (io.ReadCloser, error)
+	List(ctx context.Context, t targetEntry) (*endpoints, error)
+	StartChangeStream(ctx context.Context, t targetEntry, resourceVersion string) (io.ReadCloser, error)
+	// ListPods returns pods in the namespace matching the label selector by their IPs.
+	ListPods(ctx context.Context, namespace string, selector string) (map[string]pod, error)
 }
 
 type client struct {
 	k8sClient *k8s.APIClient
+	// watchTimeout is passed as timeoutSeconds to watch requests, if not zero.
+	watchTimeout time.Duration
+	// listPageSize is passed as limit to list requests that can be paginated, if not zero.
+	listPageSize int
+	// maxEventSize is a maximum size of single event in watch streams, if not zero.
+	maxEventSize int64
+	logger       logrus.FieldLogger
+	// limiter paces all requests made by the client, if not nil.
+	limiter *rateLimiter
+	// servers are kube-apiserver replicas to fail over between. Only k8sClient.Address is used if nil.
+	servers *apiServers
+	// gzip requests gzip-compressed responses.
+	gzip bool
+	// userAgent is sent with every request, followed by the target the request is made for, if known.
+	userAgent string
+	// requestID returns ID sent as RequestIDHeader with every request, if not nil.
+	requestID func() string
+	// clock is a source of time for Retry-After dates. realClock is used if nil.
+	clock clock
+}
+
+// DefaultUserAgent is a default User-Agent of kube-apiserver requests. Target of the request is appended to it, e.g.
+// "kedge-k8sresolver (target=service1.namespace1)", so kube-apiserver load can be attributed in audit logs.
+const DefaultUserAgent = "kedge-k8sresolver"
+
+// RequestIDHeader is a header of kube-apiserver requests with ID returned by the function specified by WithRequestIDs.
+const RequestIDHeader = "X-Request-Id"
+
+type requestTargetKey struct{}
+
+// withRequestTarget returns context of requests made for the target, so they can be attributed to it.
+func withRequestTarget(ctx context.Context, target string) context.Context {
+	return context.WithValue(ctx, requestTargetKey{}, target)
+}
+
+// userAgentOf returns User-Agent of the request made with ctx.
+func (c *client) userAgentOf(ctx context.Context) string {
+	ua := c.userAgent
+	if ua == "" {
+		ua = DefaultUserAgent
+	}
+	if target, ok := ctx.Value(requestTargetKey{}).(string); ok {
+		ua = fmt.Sprintf("%s (target=%s)", ua, target)
+	}
+	return ua
+}
+
+// watchQuery returns query parameters of the watch request.
+func (c *client) watchQuery(resourceVersion string) url.Values {
+	q := url.Values{}
+	// Bookmarks keep resourceVersion up to date even if there are no changes, so watch can be resumed without 410.
+	q.Set("allowWatchBookmarks", "true")
+	if resourceVersion != "" {
+		q.Set("resourceVersion", resourceVersion)
+	}
+	if c.watchTimeout > 0 {
+		seconds := int(c.watchTimeout / time.Second)
+		if seconds < 1 {
+			seconds = 1
+		}
+		q.Set("timeoutSeconds", strconv.Itoa(seconds))
+	}
+	return q
+}
+
+// List returns current state of endpoints object for given target.
+// See https://kubernetes.io/docs/api-reference/v1.7/#endpoints-v1-core
+func (c *client) List(ctx context.Context, t targetEntry) (*endpoints, error) {
+	epURL := fmt.Sprintf("/api/v1/namespaces/%s/endpoints/%s",
+		t.namespace,
+		t.service,
+	)
+
+	body, err := c.startGET(ctx, epURL)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	var ep endpoints
+	if err := json.NewDecoder(body).Decode(&ep); err != nil {
+		return nil, errors.Wrapf(err, "Failed to decode endpoints from GET %s response", epURL)
+	}
+	return &ep, nil
 }
 
 // StartChangeStream starts stream of changes from watch endpoint.
 // See https://kubernetes.io/docs/api-reference/v1.7/#watch-132
-// NOTE: In the beginning of stream, k8s will give us sufficient info about current state. (No need to GET first)
-func (c *client) StartChangeStream(ctx context.Context, t targetEntry) (io.ReadCloser, error) {
-	epWatchURL := fmt.Sprintf("%s/api/v1/watch/namespaces/%s/endpoints/%s",
-		c.k8sClient.Address,
+// NOTE: In the beginning of stream, k8s will give us sufficient info about current state, unless resourceVersion is
+// specified. In that case stream will start from changes that happened after that version.
+func (c *client) StartChangeStream(ctx context.Context, t targetEntry, resourceVersion string) (io.ReadCloser, error) {
+	epWatchURL := fmt.Sprintf("/api/v1/watch/namespaces/%s/endpoints/%s",
 		t.namespace,
 		t.service,
 	)
+	if q := c.watchQuery(resourceVersion); len(q) > 0 {
+		epWatchURL = fmt.Sprintf("%s?%s", epWatchURL, q.Encode())
+	}
+	c.warnIfInsecure()
 
 	return c.startGET(ctx, epWatchURL)
 }
 
-// NOTE: It is caller responsibility to read body through and close it.
-func (c *client) startGET(ctx context.Context, url string) (io.ReadCloser, error) {
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, errors.Wrapf(err, "Failed to create new GET request %s", url)
+type podList struct {
+	Metadata listMetadata `json:"metadata"`
+	Items    []podObject  `json:"items"`
+}
+
+// podObject is a subset of core/v1 Pod fields used by the resolver.
+type podObject struct {
+	Metadata struct {
+		Name            string            `json:"name"`
+		Namespace       string            `json:"namespace"`
+		UID             string            `json:"uid"`
+		ResourceVersion string            `json:"resourceVersion"`
+		Annotations     map[string]string `json:"annotations"`
+		// DeletionTimestamp is set when the pod is terminating.
+		DeletionTimestamp *string `json:"deletionTimestamp,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		NodeName   string      `json:"nodeName"`
+		Containers []container `json:"containers"`
+	} `json:"spec"`
+	Status struct {
+		Phase      string         `json:"phase"`
+		PodIP      string         `json:"podIP"`
+		PodIPs     []podIP        `json:"podIPs"`
+		Conditions []podCondition `json:"conditions"`
+	} `json:"status"`
+}
+
+type container struct {
+	Ports []containerPort `json:"ports"`
+}
+
+type podIP struct {
+	IP string `json:"ip"`
+}
+
+type podCondition struct {
+	Type   string `json:"type"`
+	Status string `json:"status"`
+}
+
+type containerPort struct {
+	Name          string `json:"name"`
+	ContainerPort int    `json:"containerPort"`
+	// Protocol is TCP, UDP or SCTP. Empty means TCP.
+	Protocol string `json:"protocol,omitempty"`
+}
+
+// ips returns all IPs of the pod. PodIPs include PodIP, if set.
+func (p podObject) ips() []string {
+	if len(p.Status.PodIPs) == 0 {
+		if p.Status.PodIP == "" {
+			return nil
+		}
+		return []string{p.Status.PodIP}
+	}
+	ips := make([]string, 0, len(p.Status.PodIPs))
+	for _, ip := range p.Status.PodIPs {
+		ips = append(ips, ip.IP)
+	}
+	return ips
+}
+
+// pod is a pod backing the endpoints address.
+type pod struct {
+	Annotations map[string]string
+}
+
+// ListPods returns pods in the namespace matching the label selector by their IPs. Pod with many IPs (dual-stack) is
+// returned for each of them. Empty selector matches all pods. If page size is configured, pods are listed page by page,
+// so no single response holds all pods of large namespace.
+// See https://kubernetes.io/docs/concepts/overview/working-with-objects/labels/#label-selectors
+func (c *client) ListPods(ctx context.Context, namespace string, selector string) (map[string]pod, error) {
+	byIP := map[string]pod{}
+	continueToken := ""
+	for {
+		page, err := c.listPodsPage(ctx, namespace, selector, c.listPageSize, continueToken)
+		if err != nil {
+			if continueToken == "" || !isGone(err) {
+				return nil, err
+			}
+			// Continue token expired, since the list took too long. Start over from the first page, as pages of
+			// different resourceVersions cannot be merged.
+			byIP, continueToken = map[string]pod{}, ""
+			continue
+		}
+
+		for _, p := range page.Items {
+			pd := pod{Annotations: p.Metadata.Annotations}
+			for _, ip := range p.ips() {
+				byIP[canonicalIP(ip)] = pd
+			}
+		}
+		if page.Metadata.Continue == "" {
+			return byIP, nil
+		}
+		continueToken = page.Metadata.Continue
+	}
+}
+
+func (c *client) listPodsPage(ctx context.Context, namespace string, selector string, limit int, continueToken string) (*podList, error) {
+	q := url.Values{}
+	q.Set("labelSelector", selector)
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+		if continueToken != "" {
+			q.Set("continue", continueToken)
+		}
 	}
+	podsURL := fmt.Sprintf("/api/v1/namespaces/%s/pods?%s", namespace, q.Encode())
 
-	resp, err := c.k8sClient.Do(req.WithContext(ctx))
+	body, err := c.startGET(ctx, podsURL)
 	if err != nil {
-		return nil, errors.Wrapf(err, "Failed to do GET %s request", url)
+		return nil, err
+	}
+	defer body.Close()
+
+	var page podList
+	if err := json.NewDecoder(body).Decode(&page); err != nil {
+		return nil, errors.Wrapf(err, "Failed to decode pods from GET %s response", podsURL)
+	}
+	return &page, nil
+}
+
+// statusError is returned when kube-apiserver responds with non 200 status code.
+type statusError struct {
+	code int
+	url  string
+	// retryAfter is a delay requested by Retry-After header, e.g. by API Priority and Fairness with 429. Zero if there
+	// was no header.
+	retryAfter time.Duration
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("Invalid response code %d on GET %s request", e.code, e.url)
+}
+
+// retryAfterOf returns delay kube-apiserver requested before the request failing with the error is retried. It returns
+// false if there was no Retry-After header.
+func retryAfterOf(err error) (time.Duration, bool) {
+	sErr, ok := errors.Cause(err).(*statusError)
+	if !ok || sErr.retryAfter <= 0 {
+		return 0, false
+	}
+	return sErr.retryAfter, true
+}
+
+// isGone returns true if the error means that requested resourceVersion is too old and the history is not available.
+func isGone(err error) bool {
+	sErr, ok := errors.Cause(err).(*statusError)
+	return ok && sErr.code == http.StatusGone
+}
+
+// isNotFound returns true if the error means that requested object does not exist (yet).
+func isNotFound(err error) bool {
+	sErr, ok := errors.Cause(err).(*statusError)
+	return ok && sErr.code == http.StatusNotFound
+}
+
+// isForbidden returns true if the error means that the request is not permitted, e.g. by RBAC.
+func isForbidden(err error) bool {
+	sErr, ok := errors.Cause(err).(*statusError)
+	return ok && sErr.code == http.StatusForbidden
+}
+
+// isFatal returns true if the error cannot be recovered by restarting the watch, e.g. because of missing permissions or
+// cancelled context. Other errors (e.g. malformed event or kube-apiserver unavailable) are recovered by resync.
+func isFatal(err error) bool {
+	cause := errors.Cause(err)
+	if cause == context.Canceled || cause == context.DeadlineExceeded {
+		return true
+	}
+	if wErr, ok := cause.(*watchStatusError); ok {
+		return isFatalStatusCode(wErr.code)
+	}
+	if _, ok := cause.(*strictModeError); ok {
+		return true
+	}
+	if _, ok := cause.(*noClusterIPError); ok {
+		return true
+	}
+	sErr, ok := cause.(*statusError)
+	return ok && isFatalCode(sErr.code)
+}
+
+// isFatalCode returns true if response code means that request will never succeed without changes in the
+// configuration.
+func isFatalCode(code int) bool {
+	switch code {
+	case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden:
+		return true
+	}
+	return false
+}
+
+// warnIfInsecure logs warning if kube-apiserver certificate is not verified, so it is not missed when shipped outside of
+// development cluster by accident.
+func (c *client) warnIfInsecure() {
+	if c.k8sClient.InsecureSkipVerify {
+		c.logger.WithField("address", c.k8sClient.Address).Warn("k8sresolver: INSECURE connection to kube-apiserver. " +
+			"Its certificate is not verified (k8sclient_tls_insecure), which must never be used outside of development clusters")
+	}
+}
+
+// startGET does GET request of the path to kube-apiserver. If connection to the replica fails, request fails over to the
+// next one, so it fails only if no replica can be reached.
+// NOTE: It is caller responsibility to read body through and close it.
+func (c *client) startGET(ctx context.Context, path string) (io.ReadCloser, error) {
+	if c.limiter != nil {
+		if err := c.limiter.wait(ctx); err != nil {
+			return nil, errors.Wrapf(err, "Failed to wait for rate limiter before GET %s request", path)
+		}
+	}
+
+	addresses := []string{c.k8sClient.Address}
+	if c.servers != nil {
+		addresses = c.servers.ordered()
+	}
+
+	var (
+		url  string
+		resp *http.Response
+	)
+	for i, address := range addresses {
+		url = address + path
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to create new GET request %s", url)
+		}
+		req.Header.Set("User-Agent", c.userAgentOf(ctx))
+		if c.requestID != nil {
+			req.Header.Set(RequestIDHeader, c.requestID())
+		}
+		if c.gzip {
+			// Transport does not decompress the response if the header is set explicitly, see gzipReader.
+			req.Header.Set("Accept-Encoding", "gzip")
+		}
+
+		resp, err = c.k8sClient.Do(req.WithContext(ctx))
+		if err == nil {
+			if c.servers != nil {
+				c.servers.markHealthy(address)
+			}
+			break
+		}
+		if ctx.Err() != nil || i == len(addresses)-1 {
+			return nil, errors.Wrapf(err, "Failed to do GET %s request", url)
+		}
+		c.logger.WithError(err).WithField("address", address).Debug("k8sresolver: Failed to connect to kube-apiserver. Trying next one")
 	}
 
 	if resp.StatusCode != http.StatusOK {
 		resp.Body.Close()
-		return nil, errors.Errorf("Invalid response code %d on GET %s request", resp.StatusCode, url)
+		sErr := &statusError{code: resp.StatusCode, url: url}
+		if d, ok := retryAfter(resp, c.now()); ok {
+			sErr.retryAfter = d
+			if resp.StatusCode == http.StatusTooManyRequests && c.limiter != nil {
+				// No request is made before kube-apiserver allows it, no matter which watcher makes it.
+				c.limiter.pause(d)
+			}
+		}
+		return nil, sErr
 	}
 
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		return &gzipReader{body: resp.Body}, nil
+	}
 	return resp.Body, nil
 }
+
+// gzipReader decompresses gzip-compressed response body as it is read, so events of the watch stream are decoded as
+// soon as they are flushed by kube-apiserver. It reads gzip header on first Read, since watch stream can be idle for
+// long and starting the stream should not wait for the first event.
+type gzipReader struct {
+	body io.ReadCloser
+	gz   *gzip.Reader
+}
+
+func (r *gzipReader) Read(p []byte) (int, error) {
+	if r.gz == nil {
+		gz, err := gzip.NewReader(r.body)
+		if err != nil {
+			return 0, errors.Wrap(err, "Failed to read gzip header of the response")
+		}
+		r.gz = gz
+	}
+	return r.gz.Read(p)
+}
+
+func (r *gzipReader) Close() error {
+	return r.body.Close()
+}
+
+func (c *client) now() time.Time {
+	if c.clock == nil {
+		return realClock{}.Now()
+	}
+	return c.clock.Now()
+}
@@ -0,0 +1,298 @@
+package k8sresolver
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/improbable-eng/kedge/pkg/k8s"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient_WatchQuery(t *testing.T) {
+	c := &client{}
+	require.Equal(t, "allowWatchBookmarks=true", c.watchQuery("").Encode())
+	require.Equal(t, "allowWatchBookmarks=true&resourceVersion=123", c.watchQuery("123").Encode())
+
+	c.watchTimeout = 5 * time.Minute
+	require.Equal(t, "allowWatchBookmarks=true&resourceVersion=123&timeoutSeconds=300", c.watchQuery("123").Encode())
+
+	c.watchTimeout = 10 * time.Millisecond
+	require.Equal(t, "allowWatchBookmarks=true&timeoutSeconds=1", c.watchQuery("").Encode())
+}
+
+func TestClient_InsecureWarnsOnEveryConnect(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	logger, hook := test.NewNullLogger()
+	c := &client{k8sClient: &k8s.APIClient{Client: srv.Client(), Address: srv.URL}, logger: logger}
+	for _, insecure := range []bool{false, true, true} {
+		c.k8sClient.InsecureSkipVerify = insecure
+		conn, err := c.StartChangeStream(context.Background(), targetEntry{service: "service1", namespace: "namespace1"}, "")
+		require.NoError(t, err)
+		_, _ = ioutil.ReadAll(conn)
+		require.NoError(t, conn.Close())
+	}
+
+	require.Len(t, hook.AllEntries(), 2, "warning should be logged on every connection if insecure")
+	for _, e := range hook.AllEntries() {
+		require.Equal(t, logrus.WarnLevel, e.Level)
+		require.Contains(t, e.Message, "INSECURE")
+	}
+}
+
+func TestClient_APIServersFailover(t *testing.T) {
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		_, _ = w.Write([]byte(`{"metadata": {"resourceVersion": "10"}}`))
+	}))
+	defer srv.Close()
+
+	// Address that refuses connections.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	refused := "http://" + l.Addr().String()
+	require.NoError(t, l.Close())
+
+	c := &client{
+		k8sClient: &k8s.APIClient{Client: srv.Client(), Address: refused},
+		servers:   newAPIServers([]string{refused, srv.URL}),
+		logger:    logrus.New(),
+	}
+	target := targetEntry{service: "service1", namespace: "namespace1"}
+
+	ep, err := c.List(context.Background(), target)
+	require.NoError(t, err)
+	require.Equal(t, "10", ep.Metadata.ResourceVersion)
+	require.Equal(t, []string{"/api/v1/namespaces/namespace1/endpoints/service1"}, requests)
+
+	// Replica that responded is preferred.
+	require.Equal(t, []string{srv.URL, refused}, c.servers.ordered())
+	_, err = c.List(context.Background(), target)
+	require.NoError(t, err)
+	require.Len(t, requests, 2)
+
+	// Request fails only if no replica can be reached.
+	srv.Close()
+	_, err = c.List(context.Background(), target)
+	require.Error(t, err)
+	require.False(t, isFatal(err))
+	require.Equal(t, []string{srv.URL, refused}, c.servers.ordered())
+}
+
+func TestClient_GzipWatchStream(t *testing.T) {
+	decoded := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "gzip", r.Header.Get("Accept-Encoding"))
+		w.Header().Set("Content-Encoding", "gzip")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+
+		gz := gzip.NewWriter(w)
+		for _, rv := range []string{"11", "12"} {
+			require.NoError(t, json.NewEncoder(gz).Encode(event{Type: modified, Object: newTestEndpoints(rv, 8080, "1.2.3.4")}))
+			require.NoError(t, gz.Flush())
+			w.(http.Flusher).Flush()
+			// Next event is sent only after the previous one was decoded, so it cannot be buffered until stream end.
+			<-decoded
+		}
+		require.NoError(t, gz.Close())
+	}))
+	defer srv.Close()
+
+	c := &client{k8sClient: &k8s.APIClient{Client: srv.Client(), Address: srv.URL}, logger: logrus.New(), gzip: true}
+	conn, err := c.StartChangeStream(context.Background(), targetEntry{service: "service1", namespace: "namespace1"}, "")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	decoder := newEventDecoder(conn, DefaultMaxEventSize)
+	for _, rv := range []string{"11", "12"} {
+		var got event
+		require.NoError(t, decoder.Decode(&got))
+		require.Equal(t, event{Type: modified, Object: newTestEndpoints(rv, 8080, "1.2.3.4")}, got)
+		decoded <- struct{}{}
+	}
+	var got event
+	require.Equal(t, io.EOF, decoder.Decode(&got))
+}
+
+func TestClient_UserAgentAndRequestIDs(t *testing.T) {
+	headers := make(chan http.Header, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+		_, _ = w.Write([]byte(`{"metadata": {"resourceVersion": "10"}}`))
+	}))
+	defer srv.Close()
+
+	c := &client{k8sClient: &k8s.APIClient{Client: srv.Client(), Address: srv.URL}, logger: logrus.New()}
+	target := targetEntry{service: "service1", namespace: "namespace1"}
+	_, err := c.List(context.Background(), target)
+	require.NoError(t, err)
+	h := <-headers
+	require.Equal(t, DefaultUserAgent, h.Get("User-Agent"))
+	require.Empty(t, h.Get(RequestIDHeader))
+
+	ids := 0
+	c.userAgent = "kedge-k8sresolver/v1.0.0"
+	c.requestID = func() string {
+		ids++
+		return fmt.Sprintf("id-%d", ids)
+	}
+	for _, expectedID := range []string{"id-1", "id-2"} {
+		_, err = c.List(withRequestTarget(context.Background(), target.String()), target)
+		require.NoError(t, err)
+		h = <-headers
+		require.Equal(t, "kedge-k8sresolver/v1.0.0 (target=service1.namespace1)", h.Get("User-Agent"))
+		require.Equal(t, expectedID, h.Get(RequestIDHeader))
+	}
+}
+
+func TestClient_ListPodsPages(t *testing.T) {
+	queries := make(chan url.Values, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.Query()
+		if r.URL.Query().Get("continue") == "" {
+			_, _ = w.Write([]byte(`{"metadata": {"continue": "page2"}, "items": [{"metadata": {"annotations": {"a": "1"}}, "status": {"podIP": "1.2.3.4"}}]}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"metadata": {}, "items": [{"status": {"podIP": "1.2.3.5"}}]}`))
+	}))
+	defer srv.Close()
+
+	c := &client{k8sClient: &k8s.APIClient{Client: srv.Client(), Address: srv.URL}, logger: logrus.New(), listPageSize: 1}
+	pods, err := c.ListPods(context.Background(), "namespace1", "app=web")
+	require.NoError(t, err)
+	require.Equal(t, map[string]pod{"1.2.3.4": {Annotations: map[string]string{"a": "1"}}, "1.2.3.5": {}}, pods)
+
+	q := <-queries
+	require.Equal(t, "app=web", q.Get("labelSelector"))
+	require.Equal(t, "1", q.Get("limit"))
+	require.Equal(t, "", q.Get("continue"))
+	q = <-queries
+	require.Equal(t, "page2", q.Get("continue"))
+}
+
+func TestResolver_ClientCert(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "client1"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	clientCAs := x509.NewCertPool()
+	caCert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	clientCAs.AddCert(caCert)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "client1", r.TLS.PeerCertificates[0].Subject.CommonName)
+		require.NoError(t, json.NewEncoder(w).Encode(newTestEndpoints("10", 8080, "1.2.3.4")))
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	srv.StartTLS()
+	defer srv.Close()
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(srv.Certificate())
+	apiClient := k8s.New(srv.URL, nil, &tls.Config{RootCAs: rootCAs})
+	target := targetEntry{service: "service1", namespace: "namespace1", port: noTargetPort}
+
+	r := newResolver(context.Background(), apiClient, newOptions(nil))
+	_, err = r.watches.newClient().List(context.Background(), target)
+	require.Error(t, err, "server requires client certificate")
+
+	r = newResolver(context.Background(), apiClient, newOptions([]Option{
+		WithClientCertificate(tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}),
+	}))
+	ep, err := r.watches.newClient().List(context.Background(), target)
+	require.NoError(t, err)
+	require.Equal(t, "10", ep.Metadata.ResourceVersion)
+}
+
+func TestResolver_RequestMutator(t *testing.T) {
+	headers := make(chan http.Header, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+		_, _ = w.Write([]byte(`{"metadata": {"resourceVersion": "10"}}`))
+	}))
+	defer srv.Close()
+
+	r := newResolver(context.Background(), k8s.New(srv.URL, nil, nil), newOptions([]Option{
+		WithUserAgent("kedge-k8sresolver/v1.0.0"),
+		WithRequestMutator(func(req *http.Request) {
+			req.Header.Set("Impersonate-User", "user1")
+			// Standard headers can be overridden.
+			req.Header.Set("User-Agent", "custom")
+		}),
+	}))
+	target := targetEntry{service: "service1", namespace: "namespace1", port: noTargetPort}
+	cl := r.watches.newClient()
+
+	_, err := cl.List(context.Background(), target)
+	require.NoError(t, err)
+	conn, err := cl.StartChangeStream(context.Background(), target, "10")
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+
+	for _, request := range []string{"list", "watch"} {
+		h := <-headers
+		require.Equal(t, "user1", h.Get("Impersonate-User"), request)
+		require.Equal(t, "custom", h.Get("User-Agent"), request)
+	}
+}
+
+func TestResolver_HTTPClientKeepsAPIClientFields(t *testing.T) {
+	apiClient := k8s.New("https://kubernetes.default", nil, &tls.Config{InsecureSkipVerify: true})
+	r := newResolver(context.Background(), apiClient, newOptions([]Option{WithHTTPClient(&http.Client{})}))
+	cl := r.watches.newClient().(*client)
+	require.Equal(t, "https://kubernetes.default", cl.k8sClient.Address)
+	require.True(t, cl.k8sClient.InsecureSkipVerify, "insecure client should still be warned about")
+}
+
+func TestIsFatal(t *testing.T) {
+	for _, tcase := range []struct {
+		err      error
+		expected bool
+	}{
+		{err: errors.New("connection refused")},
+		{err: errors.Wrap(io.ErrUnexpectedEOF, "decoding")},
+		{err: &statusError{code: http.StatusInternalServerError}},
+		{err: &statusError{code: http.StatusGone}},
+		{err: errors.Wrap(&statusError{code: http.StatusForbidden}, "list"), expected: true},
+		{err: &statusError{code: http.StatusUnauthorized}, expected: true},
+		{err: errors.Wrap(context.Canceled, "list"), expected: true},
+		{err: &watchStatusError{code: http.StatusServiceUnavailable}},
+		{err: &watchStatusError{code: http.StatusNotFound}, expected: true},
+	} {
+		require.Equal(t, tcase.expected, isFatal(tcase.err), "%v", tcase.err)
+	}
+}
@@ -0,0 +1,55 @@
+package k8sresolver
+
+import "time"
+
+// clock is a source of time for backoff, resync, delete grace and other delays, so their timing can be tested
+// deterministically without sleeps. realClock is used unless another one is injected by withClock.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTimer(d time.Duration) timer
+	// AfterFunc calls f in its own goroutine after d. C of the returned timer is nil.
+	AfterFunc(d time.Duration, f func()) timer
+}
+
+// timer is a single event timer of the clock, the same as time.Timer.
+type timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// realClock is a clock of the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) NewTimer(d time.Duration) timer {
+	return realTimer{t: time.NewTimer(d)}
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) timer {
+	return realTimer{t: time.AfterFunc(d, f)}
+}
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t realTimer) Stop() bool {
+	return t.t.Stop()
+}
+
+func (t realTimer) Reset(d time.Duration) bool {
+	return t.t.Reset(d)
+}
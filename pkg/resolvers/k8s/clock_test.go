@@ -0,0 +1,164 @@
+package k8sresolver
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock is a clock that moves only when advanced, so timing can be asserted without sleeps.
+type fakeClock struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	now    time.Time
+	timers map[*fakeTimer]struct{}
+}
+
+func newFakeClock() *fakeClock {
+	c := &fakeClock{now: time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC), timers: map[*fakeTimer]struct{}{}}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &fakeTimer{clock: c, deadline: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.c <- c.now
+		return t
+	}
+	c.timers[t] = struct{}{}
+	c.cond.Broadcast()
+	return t
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &fakeTimer{clock: c, deadline: c.now.Add(d), f: f}
+	if d <= 0 {
+		go f()
+		return t
+	}
+	c.timers[t] = struct{}{}
+	c.cond.Broadcast()
+	return t
+}
+
+// Advance moves the clock by d and fires all timers that are due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	for t := range c.timers {
+		if !t.deadline.After(c.now) {
+			delete(c.timers, t)
+			t.fire(c.now)
+		}
+	}
+}
+
+// waitForTimers blocks until n timers are waiting to fire, so the clock is not advanced before the delay is scheduled.
+func (c *fakeClock) waitForTimers(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.timers) < n {
+		c.cond.Wait()
+	}
+}
+
+type fakeTimer struct {
+	clock    *fakeClock
+	deadline time.Time
+	c        chan time.Time
+	// f is called instead of sending to c, if not nil.
+	f func()
+}
+
+func (t *fakeTimer) fire(now time.Time) {
+	if t.f != nil {
+		go t.f()
+		return
+	}
+	t.c <- now
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	_, pending := t.clock.timers[t]
+	delete(t.clock.timers, t)
+	return pending
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	_, pending := t.clock.timers[t]
+	t.deadline = t.clock.now.Add(d)
+	t.clock.timers[t] = struct{}{}
+	t.clock.cond.Broadcast()
+	return pending
+}
+
+func TestFakeClock(t *testing.T) {
+	c := newFakeClock()
+	start := c.Now()
+
+	after := c.After(time.Second)
+	stopped := c.NewTimer(time.Second)
+	require.True(t, stopped.Stop())
+	require.False(t, stopped.Stop())
+	c.waitForTimers(1)
+
+	c.Advance(999 * time.Millisecond)
+	select {
+	case <-after:
+		t.Fatal("timer should not fire before its deadline")
+	default:
+	}
+	c.Advance(time.Millisecond)
+	require.Equal(t, start.Add(time.Second), <-after)
+	require.Empty(t, stopped.C())
+	require.Equal(t, start.Add(time.Second), c.Now())
+}
+
+func TestFakeClock_AfterFunc(t *testing.T) {
+	c := newFakeClock()
+	called := make(chan struct{}, 1)
+	timer := c.AfterFunc(time.Second, func() { called <- struct{}{} })
+
+	c.Advance(500 * time.Millisecond)
+	require.True(t, timer.Reset(time.Second), "timer should be pending before reset")
+	c.Advance(999 * time.Millisecond)
+	select {
+	case <-called:
+		t.Fatal("reset timer should not fire before its new deadline")
+	default:
+	}
+	c.Advance(time.Millisecond)
+	<-called
+	require.False(t, timer.Stop())
+}
@@ -0,0 +1,144 @@
+package k8sresolver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// headlessClusterIP is the ClusterIP of headless service.
+const headlessClusterIP = "None"
+
+// clusterIPClient is an endpointClient that resolves the ClusterIP of the service instead of its pods, so kube-proxy
+// balances connections (e.g. with session affinity configured on the service). Service is translated into endpoints
+// with single address and the service ports. It keeps no state, so it can be shared by all watches.
+type clusterIPClient struct {
+	cl *client
+}
+
+// serviceEvent is a watch event for Service. Object can be either Service or Status.
+type serviceEvent struct {
+	Type   eventType       `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// noClusterIPError is returned when the service has no ClusterIP to resolve, e.g. it is headless.
+type noClusterIPError struct {
+	target targetEntry
+}
+
+func (e *noClusterIPError) Error() string {
+	return fmt.Sprintf("Service %s has no ClusterIP (headless or ExternalName service). Resolve its endpoints instead", e.target)
+}
+
+// List returns the service of the target translated into endpoints.
+func (c *clusterIPClient) List(ctx context.Context, t targetEntry) (*endpoints, error) {
+	svc, err := c.cl.service(ctx, t.namespace, t.service)
+	if err != nil {
+		return nil, err
+	}
+	return serviceToEndpoints(t, svc)
+}
+
+// ListPods returns pods in the namespace matching the label selector by their IPs.
+func (c *clusterIPClient) ListPods(ctx context.Context, namespace string, selector string) (map[string]pod, error) {
+	return c.cl.ListPods(ctx, namespace, selector)
+}
+
+// StartChangeStream starts stream of changes of the service translated into endpoints. Service that becomes headless is
+// passed as BadRequest Status, so the watcher fails the same way as on List.
+func (c *clusterIPClient) StartChangeStream(ctx context.Context, t targetEntry, resourceVersion string) (io.ReadCloser, error) {
+	svcWatchURL := fmt.Sprintf("/api/v1/watch/namespaces/%s/services/%s", t.namespace, t.service)
+	if q := c.cl.watchQuery(resourceVersion); len(q) > 0 {
+		svcWatchURL = fmt.Sprintf("%s?%s", svcWatchURL, q.Encode())
+	}
+	c.cl.warnIfInsecure()
+	body, err := c.cl.startGET(ctx, svcWatchURL)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		err := proxyServices(t, newEventDecoder(body, c.cl.maxEventSize), json.NewEncoder(pw))
+		body.Close()
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+// proxyServices decodes service events and encodes translated endpoints events until decoding fails. It returns nil on
+// EOF, so the translated stream is closed in the same way.
+func proxyServices(t targetEntry, decoder *eventDecoder, encoder *json.Encoder) error {
+	for {
+		var got serviceEvent
+		if err := decoder.Decode(&got); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		translated := event{Type: got.Type}
+		switch got.Type {
+		case added, modified, deleted:
+			var svc service
+			if err := json.Unmarshal(got.Object, &svc); err != nil {
+				return errors.Wrap(err, "Unable to decode service from the watch stream")
+			}
+			if got.Type == deleted {
+				translated.Object = endpoints{Kind: "Endpoints", APIVersion: "v1", Metadata: svc.Metadata}
+				break
+			}
+			ep, err := serviceToEndpoints(t, &svc)
+			if err != nil {
+				translated = event{Type: failed, Object: endpoints{
+					Kind:    statusKind,
+					Status:  "Failure",
+					Message: err.Error(),
+					Code:    http.StatusBadRequest,
+				}}
+				break
+			}
+			translated.Object = *ep
+		default:
+			// Bookmark, status and unknown events are passed as they are. Streamer will handle them.
+			if err := json.Unmarshal(got.Object, &translated.Object); err != nil {
+				return errors.Wrap(err, "Unable to decode an object from the watch stream")
+			}
+		}
+		if err := encoder.Encode(translated); err != nil {
+			return err
+		}
+	}
+}
+
+// serviceToEndpoints translates the service into endpoints with its ClusterIPs (both families of dual-stack service)
+// and service ports, so ports of targets are matched by service port names and numbers.
+func serviceToEndpoints(t targetEntry, svc *service) (*endpoints, error) {
+	ips := svc.Spec.ClusterIPs
+	if len(ips) == 0 && svc.Spec.ClusterIP != "" {
+		ips = []string{svc.Spec.ClusterIP}
+	}
+	if len(ips) == 0 || ips[0] == headlessClusterIP {
+		return nil, &noClusterIPError{target: t}
+	}
+
+	sub := subset{}
+	for _, ip := range ips {
+		sub.Addresses = append(sub.Addresses, address{IP: ip})
+	}
+	for _, sp := range svc.Spec.Ports {
+		sub.Ports = append(sub.Ports, port{Name: sp.Name, Port: sp.Port, Protocol: sp.Protocol, AppProtocol: sp.AppProtocol})
+	}
+	return &endpoints{
+		Kind:       "Endpoints",
+		APIVersion: "v1",
+		Metadata:   metadata{Name: t.service, ResourceVersion: svc.Metadata.ResourceVersion},
+		Subsets:    []subset{sub},
+	}, nil
+}
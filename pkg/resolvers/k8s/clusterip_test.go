@@ -0,0 +1,126 @@
+package k8sresolver
+
+import (
+	"encoding/json"
+	stderrors "errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/improbable-eng/kedge/pkg/k8s"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/naming"
+)
+
+func newTestClusterIPService(resourceVersion string, clusterIP string) service {
+	svc := service{Metadata: metadata{Name: "service1", ResourceVersion: resourceVersion}}
+	svc.Spec.ClusterIP = clusterIP
+	svc.Spec.Ports = []servicePort{
+		{Name: "grpc", Port: 80, TargetPort: "8080", AppProtocol: "grpc"},
+		{Name: "metrics", Port: 9100},
+	}
+	return svc
+}
+
+// startClusterIPAPIMock returns resolver in ClusterIPAPI mode with the service listed first and then sent as watch
+// events.
+func startClusterIPAPIMock(t *testing.T, svc service) (naming.Resolver, chan serviceEvent, func()) {
+	eventsCh := make(chan serviceEvent, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/namespaces/namespace1/services/service1":
+			require.NoError(t, json.NewEncoder(w).Encode(svc))
+		case "/api/v1/watch/namespaces/namespace1/services/service1":
+			require.Equal(t, svc.Metadata.ResourceVersion, r.URL.Query().Get("resourceVersion"))
+			w.(http.Flusher).Flush()
+			for e := range eventsCh {
+				require.NoError(t, json.NewEncoder(w).Encode(e))
+				w.(http.Flusher).Flush()
+			}
+		default:
+			t.Errorf("unexpected request %s", r.URL.String())
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	r := NewWithClient(&k8s.APIClient{Client: srv.Client(), Address: srv.URL}, WithEndpointAPI(ClusterIPAPI))
+	return r, eventsCh, func() {
+		close(eventsCh)
+		srv.Close()
+	}
+}
+
+func testServiceEvent(t *testing.T, typ eventType, svc service) serviceEvent {
+	b, err := json.Marshal(svc)
+	require.NoError(t, err)
+	return serviceEvent{Type: typ, Object: b}
+}
+
+func TestClusterIPAPI_ResolvesClusterIPChanges(t *testing.T) {
+	r, eventsCh, closeFn := startClusterIPAPIMock(t, newTestClusterIPService("10", "10.0.0.1"))
+	defer closeFn()
+
+	// Service port is resolved, not the target port of pods.
+	w, err := r.Resolve("service1.namespace1:grpc")
+	require.NoError(t, err)
+	defer w.Close()
+	u, err := w.Next()
+	require.NoError(t, err)
+	require.Equal(t, []*naming.Update{{
+		Op:       naming.Add,
+		Addr:     "10.0.0.1:80",
+		Metadata: AddressMetadata{IP: "10.0.0.1", Namespace: "namespace1", PortName: "grpc", AppProtocol: "grpc"},
+	}}, u)
+
+	// Service recreated with another ClusterIP.
+	eventsCh <- testServiceEvent(t, modified, newTestClusterIPService("11", "10.0.0.2"))
+	u, err = w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{
+		{Op: naming.Delete, Addr: "10.0.0.1:80"},
+		{Op: naming.Add, Addr: "10.0.0.2:80"},
+	}, u)
+
+	// Port changed.
+	svc := newTestClusterIPService("12", "10.0.0.2")
+	svc.Spec.Ports[0].Port = 81
+	eventsCh <- testServiceEvent(t, modified, svc)
+	u, err = w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{
+		{Op: naming.Delete, Addr: "10.0.0.2:80"},
+		{Op: naming.Add, Addr: "10.0.0.2:81"},
+	}, u)
+
+	// Service becomes headless.
+	eventsCh <- testServiceEvent(t, modified, newTestClusterIPService("13", headlessClusterIP))
+	_, err = w.Next()
+	require.Error(t, err)
+	var resolveErr *ResolveError
+	require.True(t, stderrors.As(err, &resolveErr))
+	require.False(t, resolveErr.Recoverable)
+}
+
+func TestClusterIPAPI_RejectsHeadlessService(t *testing.T) {
+	r, _, closeFn := startClusterIPAPIMock(t, newTestClusterIPService("10", headlessClusterIP))
+	defer closeFn()
+
+	_, err := r.Resolve("service1.namespace1:grpc")
+	require.Error(t, err)
+	require.True(t, isFatal(err))
+
+	_, err = r.Resolve("service1-0@service1.namespace1:grpc")
+	require.Error(t, err, "pod cannot be resolved")
+}
+
+func TestServiceToEndpoints_DualStack(t *testing.T) {
+	svc := newTestClusterIPService("10", "10.0.0.1")
+	svc.Spec.ClusterIPs = []string{"10.0.0.1", "fd00::1"}
+	ep, err := serviceToEndpoints(targetEntry{service: "service1", namespace: "namespace1"}, &svc)
+	require.NoError(t, err)
+	require.Equal(t, []address{{IP: "10.0.0.1"}, {IP: "fd00::1"}}, ep.Subsets[0].Addresses)
+	require.Equal(t, []port{{Name: "grpc", Port: 80, AppProtocol: "grpc"}, {Name: "metrics", Port: 9100}}, ep.Subsets[0].Ports)
+
+	svc.Spec.ClusterIP, svc.Spec.ClusterIPs = "", nil
+	_, err = serviceToEndpoints(targetEntry{service: "service1", namespace: "namespace1"}, &svc)
+	require.Error(t, err, "ExternalName service has no ClusterIP")
+}
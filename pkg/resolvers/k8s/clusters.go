@@ -0,0 +1,378 @@
+package k8sresolver
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/improbable-eng/kedge/pkg/k8s"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/naming"
+)
+
+// ClusterConfig is a cluster resolved by WithClusters.
+type ClusterConfig struct {
+	// Name identifies the cluster in AddressMetadata.Cluster. It must be unique.
+	Name string
+	// Client is configured to be used against kube-apiserver of the cluster.
+	Client *k8s.APIClient
+}
+
+// cluster is a resolver of a single cluster resolved by WithClusters.
+type cluster struct {
+	name string
+	r    *resolver
+}
+
+// newClusters returns resolver of every cluster with the same options. Resolution cache is kept per cluster, since
+// clusters can have services of the same name.
+func newClusters(ctx context.Context, configs []ClusterConfig, o options) []cluster {
+	clusters := make([]cluster, 0, len(configs))
+	for _, c := range configs {
+		co := o
+		co.clusters = nil
+		// Replicas of kube-apiserver belong to single cluster.
+		co.apiServers = nil
+		if co.resolutionCachePath != "" {
+			co.resolutionCachePath = co.resolutionCachePath + "." + c.Name
+		}
+		clusters = append(clusters, cluster{name: c.Name, r: newResolver(ctx, c.Client, co)})
+	}
+	return clusters
+}
+
+// checkClusters returns error if clusters cannot be told apart by their names.
+func checkClusters(configs []ClusterConfig) error {
+	seen := map[string]struct{}{}
+	for _, c := range configs {
+		if c.Name == "" {
+			return errors.New("k8sresolver: cluster name cannot be empty")
+		}
+		if _, ok := seen[c.Name]; ok {
+			return errors.Errorf("k8sresolver: cluster name %q is not unique", c.Name)
+		}
+		seen[c.Name] = struct{}{}
+		if c.Client == nil {
+			return errors.Errorf("k8sresolver: cluster %q has no API client", c.Name)
+		}
+	}
+	return nil
+}
+
+// clusterChange is a change of addresses of the cluster. Failed watcher of the cluster has err set, so all its addresses
+// are deleted.
+type clusterChange struct {
+	cluster string
+	updates []*naming.Update
+	err     error
+}
+
+// clusterWatcher is a naming.Watcher of the target in many clusters. Every cluster is watched by its own watcher, so
+// failure of one cluster deletes only its addresses, while the cluster is resolved again with backoff.
+// Address resolved in many clusters is returned once, with metadata of the cluster that resolved it first.
+type clusterWatcher struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	target   string
+	clusters []cluster
+	opts     options
+	changes  chan clusterChange
+	wg       sync.WaitGroup
+
+	// initial are merged initial states of the clusters returned by the first Next() call.
+	initial []*naming.Update
+	started bool
+	// addresses are the last addresses of every cluster. owners are clusters whose metadata was returned for address.
+	// Both are modified only by Next().
+	addresses map[string]map[string]AddressMetadata
+	owners    map[string]string
+}
+
+// defaultClusterJoinTimeout is how long startNewClusterWatcher waits for other clusters once one resolved the target, if
+// initial resolve timeout is not set.
+const defaultClusterJoinTimeout = 5 * time.Second
+
+// clusterResult is the initial state of the target in the cluster.
+type clusterResult struct {
+	index   int
+	watcher *watcher
+	updates []*naming.Update
+	err     error
+}
+
+// startNewClusterWatcher resolves the target in all clusters concurrently. Clusters that fail are resolved again with
+// backoff in the background. It fails only if all clusters fail. Once any cluster resolves the target, other clusters
+// are waited for at most initial resolve timeout (defaultClusterJoinTimeout if not set), so hung cluster does not block
+// the rest. Clusters resolved later join in the background.
+func startNewClusterWatcher(parentCtx context.Context, target string, clusters []cluster, opts options) (*clusterWatcher, error) {
+	ctx, cancel := context.WithCancel(parentCtx)
+	w := &clusterWatcher{
+		ctx:       ctx,
+		cancel:    cancel,
+		target:    target,
+		clusters:  clusters,
+		opts:      opts,
+		changes:   make(chan clusterChange),
+		addresses: make(map[string]map[string]AddressMetadata),
+		owners:    make(map[string]string),
+	}
+
+	resultsCh := make(chan clusterResult, len(clusters))
+	for i, c := range clusters {
+		go func(i int, c cluster) {
+			cw, u, err := w.resolve(c)
+			resultsCh <- clusterResult{index: i, watcher: cw, updates: u, err: err}
+		}(i, c)
+	}
+
+	joinTimeout := opts.initialResolveTimeout
+	if joinTimeout <= 0 {
+		joinTimeout = defaultClusterJoinTimeout
+	}
+	results := make([]*clusterResult, len(clusters))
+	pending := len(clusters)
+	var joined <-chan time.Time
+wait:
+	for ; pending > 0; pending-- {
+		select {
+		case res := <-resultsCh:
+			results[res.index] = &res
+			if res.err == nil && joined == nil {
+				joined = opts.clock.After(joinTimeout)
+			}
+		case <-joined:
+			break wait
+		}
+	}
+	if joined == nil {
+		// All clusters failed.
+		cancel()
+		for _, res := range results {
+			if res.err != nil {
+				return nil, res.err
+			}
+		}
+	}
+
+	// Initial states are merged in the order of clusters, so the order of results does not matter.
+	for i, c := range clusters {
+		res := results[i]
+		if res == nil {
+			continue
+		}
+		if res.err != nil {
+			opts.logger.WithError(res.err).WithField("target", target).WithField("cluster", c.name).Warn(
+				"k8sresolver: Failed to resolve target in the cluster. Resolving again")
+		} else {
+			w.initial = append(w.initial, w.apply(clusterChange{cluster: c.name, updates: res.updates})...)
+		}
+		w.wg.Add(1)
+		go w.run(c, res.watcher)
+	}
+	if pending > 0 {
+		opts.logger.WithField("target", target).Warnf("k8sresolver: %d clusters did not resolve target within %v. "+
+			"They join once resolved", pending, joinTimeout)
+		w.wg.Add(1)
+		go w.join(resultsCh, pending)
+	}
+	return w, nil
+}
+
+// join passes initial states of the clusters resolved after startNewClusterWatcher returned as any other change and
+// starts watching them.
+func (w *clusterWatcher) join(resultsCh <-chan clusterResult, pending int) {
+	defer w.wg.Done()
+	for ; pending > 0; pending-- {
+		res := <-resultsCh
+		c := w.clusters[res.index]
+		if res.err != nil {
+			w.opts.logger.WithError(res.err).WithField("target", w.target).WithField("cluster", c.name).Warn(
+				"k8sresolver: Failed to resolve target in the cluster. Resolving again")
+		} else if !w.send(clusterChange{cluster: c.name, updates: res.updates}) {
+			res.watcher.Close()
+			continue
+		}
+		w.wg.Add(1)
+		go w.run(c, res.watcher)
+	}
+}
+
+// resolve starts watcher of the target in the cluster and returns its initial state.
+func (w *clusterWatcher) resolve(c cluster) (*watcher, []*naming.Update, error) {
+	targets, err := c.r.targets(w.target)
+	if err != nil {
+		return nil, nil, err
+	}
+	cw, err := startNewMultiWatcher(w.ctx, targets, c.r.watches, c.r.watcherOptions())
+	if err != nil {
+		return nil, nil, err
+	}
+	u, err := cw.Next()
+	if err != nil {
+		cw.Close()
+		return nil, nil, err
+	}
+	return cw, u, nil
+}
+
+// run passes changes of the cluster watcher until it fails and resolves the cluster again with backoff. Watcher is nil
+// if the cluster failed to resolve.
+func (w *clusterWatcher) run(c cluster, cw *watcher) {
+	defer w.wg.Done()
+
+	logger := w.opts.logger.WithField("target", w.target).WithField("cluster", c.name)
+	b := newBackoff(w.opts.watchBackoff, w.opts.clock)
+	for {
+		if cw != nil {
+			startTime := w.opts.clock.Now()
+			err := w.forward(c, cw)
+			cw.Close()
+			if w.ctx.Err() != nil {
+				return
+			}
+			logger.WithError(err).Warn("k8sresolver: Watcher of the cluster failed. Deleting its addresses and resolving again")
+			if !w.send(clusterChange{cluster: c.name, err: err}) {
+				return
+			}
+			b.StreamEnded(startTime)
+		}
+
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-w.opts.clock.After(b.Duration()):
+		}
+
+		var (
+			u   []*naming.Update
+			err error
+		)
+		cw, u, err = w.resolve(c)
+		if err != nil {
+			if w.ctx.Err() != nil {
+				return
+			}
+			logger.WithError(err).Debug("k8sresolver: Failed to resolve target in the cluster. Retrying")
+			continue
+		}
+		if !w.send(clusterChange{cluster: c.name, updates: u}) {
+			cw.Close()
+			return
+		}
+	}
+}
+
+// forward passes updates of the cluster watcher until it fails.
+func (w *clusterWatcher) forward(c cluster, cw *watcher) error {
+	for {
+		u, err := cw.Next()
+		if err != nil {
+			return err
+		}
+		if !w.send(clusterChange{cluster: c.name, updates: u}) {
+			return w.ctx.Err()
+		}
+	}
+}
+
+func (w *clusterWatcher) send(c clusterChange) bool {
+	select {
+	case <-w.ctx.Done():
+		return false
+	case w.changes <- c:
+		return true
+	}
+}
+
+// Next returns updates of addresses of all clusters. Failure of a cluster is not returned, its addresses are deleted
+// instead. It returns error only after Close.
+func (w *clusterWatcher) Next() ([]*naming.Update, error) {
+	if !w.started {
+		w.started = true
+		if w.initial == nil {
+			return noUpdates, nil
+		}
+		sortUpdates(w.initial)
+		initial := w.initial
+		w.initial = nil
+		return initial, nil
+	}
+
+	for {
+		select {
+		case <-w.ctx.Done():
+			return []*naming.Update(nil), &ResolveError{
+				Target: w.target,
+				Cause: errors.Wrap(w.ctx.Err(), "k8sresolver: watcher.Next already stopped. "+
+					"Note that watcher errors are not recoverable."),
+			}
+		case c := <-w.changes:
+			if u := w.apply(c); len(u) > 0 {
+				sortUpdates(u)
+				return u, nil
+			}
+		}
+	}
+}
+
+// Close closes watchers of all clusters.
+func (w *clusterWatcher) Close() {
+	w.cancel()
+	w.wg.Wait()
+}
+
+// apply updates addresses of the cluster and returns updates of the merged addresses.
+func (w *clusterWatcher) apply(c clusterChange) []*naming.Update {
+	addrs, ok := w.addresses[c.cluster]
+	if !ok {
+		addrs = make(map[string]AddressMetadata)
+		w.addresses[c.cluster] = addrs
+	}
+
+	var updates []*naming.Update
+	if c.err != nil {
+		for addr := range addrs {
+			delete(addrs, addr)
+			updates = append(updates, w.release(c.cluster, addr)...)
+		}
+		return updates
+	}
+	for _, u := range c.updates {
+		if u.Op == naming.Delete {
+			delete(addrs, u.Addr)
+			updates = append(updates, w.release(c.cluster, u.Addr)...)
+			continue
+		}
+
+		md, _ := u.Metadata.(AddressMetadata)
+		md.Cluster = c.cluster
+		addrs[u.Addr] = md
+		if owner, ok := w.owners[u.Addr]; ok && owner != c.cluster {
+			// Already returned with metadata of another cluster.
+			continue
+		}
+		w.owners[u.Addr] = c.cluster
+		updates = append(updates, &naming.Update{Op: naming.Add, Addr: u.Addr, Metadata: md})
+	}
+	return updates
+}
+
+// release returns updates for the address deleted from the cluster. If another cluster still has it, address is added
+// back with its metadata.
+func (w *clusterWatcher) release(cluster string, addr string) []*naming.Update {
+	if w.owners[addr] != cluster {
+		return nil
+	}
+	delete(w.owners, addr)
+
+	updates := []*naming.Update{{Op: naming.Delete, Addr: addr}}
+	for _, c := range w.clusters {
+		if md, ok := w.addresses[c.name][addr]; ok {
+			w.owners[addr] = c.name
+			updates = append(updates, &naming.Update{Op: naming.Add, Addr: addr, Metadata: md})
+			break
+		}
+	}
+	return updates
+}
@@ -0,0 +1,173 @@
+package k8sresolver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/improbable-eng/kedge/pkg/k8s"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/naming"
+)
+
+func startTestClusterWatcher(t *testing.T, clusters map[string]*FakeAPI, order ...string) *clusterWatcher {
+	o := newOptions([]Option{WithWatchBackoff(testWatchBackoff)})
+	var cs []cluster
+	for _, name := range order {
+		cs = append(cs, cluster{name: name, r: clusters[name].newResolver(context.Background(), o)})
+	}
+	w, err := startNewClusterWatcher(context.Background(), "service1.namespace1:8080", cs, o)
+	require.NoError(t, err)
+	return w
+}
+
+func TestClusterWatcher_ClusterGoingDarkKeepsOtherClusters(t *testing.T) {
+	apiA, apiB := NewFakeAPI(), NewFakeAPI()
+	apiA.SetEndpoints("namespace1", "service1", FakeSubset{Addresses: []string{"10.0.0.1"}, Ports: []FakePort{{Name: "grpc", Port: 8080}}})
+	apiB.SetEndpoints("namespace1", "service1", FakeSubset{Addresses: []string{"10.1.0.1"}, Ports: []FakePort{{Name: "grpc", Port: 8080}}})
+	w := startTestClusterWatcher(t, map[string]*FakeAPI{"a": apiA, "b": apiB}, "a", "b")
+	defer w.Close()
+
+	u, err := w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{
+		{Op: naming.Add, Addr: "10.0.0.1:8080", Metadata: AddressMetadata{IP: "10.0.0.1", Namespace: "namespace1", PortName: "grpc", Cluster: "a"}},
+		{Op: naming.Add, Addr: "10.1.0.1:8080", Metadata: AddressMetadata{IP: "10.1.0.1", Namespace: "namespace1", PortName: "grpc", Cluster: "b"}},
+	}, u)
+
+	// Cluster b fails and it cannot be watched for a while, so only its addresses are deleted.
+	apiB.FailNextWatch("namespace1", "service1", http.StatusForbidden, http.StatusForbidden)
+	apiB.SendStatus("namespace1", "service1", http.StatusForbidden, "forbidden")
+	u, err = w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{{Op: naming.Delete, Addr: "10.1.0.1:8080"}}, u)
+
+	// Cluster a is still watched, while cluster b is resolved again once it can be watched. Both can come first.
+	apiA.SetEndpoints("namespace1", "service1", FakeSubset{Addresses: []string{"10.0.0.1", "10.0.0.2"}, Ports: []FakePort{{Name: "grpc", Port: 8080}}})
+	var added []*naming.Update
+	for len(added) < 2 {
+		u, err = w.Next()
+		require.NoError(t, err)
+		added = append(added, u...)
+	}
+	sortUpdates(added)
+	requireUpdates(t, []*naming.Update{
+		{Op: naming.Add, Addr: "10.0.0.2:8080", Metadata: AddressMetadata{IP: "10.0.0.2", Namespace: "namespace1", PortName: "grpc", Cluster: "a"}},
+		{Op: naming.Add, Addr: "10.1.0.1:8080", Metadata: AddressMetadata{IP: "10.1.0.1", Namespace: "namespace1", PortName: "grpc", Cluster: "b"}},
+	}, added)
+
+	w.Close()
+	_, err = w.Next()
+	require.Error(t, err)
+}
+
+func TestClusterWatcher_AddressInManyClusters(t *testing.T) {
+	apiA, apiB := NewFakeAPI(), NewFakeAPI()
+	apiA.SetEndpoints("namespace1", "service1", FakeSubset{Addresses: []string{"10.0.0.1"}, Ports: []FakePort{{Name: "grpc", Port: 8080}}})
+	apiB.SetEndpoints("namespace1", "service1", FakeSubset{Addresses: []string{"10.0.0.1"}, Ports: []FakePort{{Name: "grpc", Port: 8080}}})
+	w := startTestClusterWatcher(t, map[string]*FakeAPI{"a": apiA, "b": apiB}, "a", "b")
+	defer w.Close()
+
+	// Address is returned once.
+	u, err := w.Next()
+	require.NoError(t, err)
+	require.Len(t, u, 1)
+	require.Equal(t, "a", u[0].Metadata.(AddressMetadata).Cluster)
+
+	// Address deleted from the first cluster is still resolved by the other one.
+	apiA.DeleteEndpoints("namespace1", "service1")
+	u, err = w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{
+		{Op: naming.Delete, Addr: "10.0.0.1:8080"},
+		{Op: naming.Add, Addr: "10.0.0.1:8080", Metadata: AddressMetadata{IP: "10.0.0.1", Namespace: "namespace1", PortName: "grpc", Cluster: "b"}},
+	}, u)
+
+	// Address disappears with the last cluster.
+	apiB.DeleteEndpoints("namespace1", "service1")
+	u, err = w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{{Op: naming.Delete, Addr: "10.0.0.1:8080"}}, u)
+}
+
+func TestClusterWatcher_UnreachableClusterOnStartup(t *testing.T) {
+	apiA := NewFakeAPI()
+	apiA.SetEndpoints("namespace1", "service1", FakeSubset{Addresses: []string{"10.0.0.1"}, Ports: []FakePort{{Name: "grpc", Port: 8080}}})
+	o := newOptions([]Option{WithWatchBackoff(testWatchBackoff), WithEndpointAPI(EndpointsAPI)})
+	unreachable := newResolver(context.Background(), &k8s.APIClient{Client: http.DefaultClient, Address: "http://127.0.0.1:1"}, o)
+
+	// Resolution does not fail, since cluster a can be resolved.
+	w, err := startNewClusterWatcher(context.Background(), "service1.namespace1:8080", []cluster{
+		{name: "b", r: unreachable},
+		{name: "a", r: apiA.newResolver(context.Background(), o)},
+	}, o)
+	require.NoError(t, err)
+	u, err := w.Next()
+	require.NoError(t, err)
+	require.Len(t, u, 1)
+	require.Equal(t, "10.0.0.1:8080", u[0].Addr)
+	w.Close()
+
+	// It fails if no cluster can be resolved.
+	_, err = startNewClusterWatcher(context.Background(), "service1.namespace1:8080", []cluster{{name: "b", r: unreachable}}, o)
+	require.Error(t, err)
+}
+
+func TestClusterWatcher_HungClusterDoesNotBlockOthers(t *testing.T) {
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer hung.Close()
+	apiA := NewFakeAPI()
+	apiA.SetEndpoints("namespace1", "service1", FakeSubset{Addresses: []string{"10.0.0.1"}, Ports: []FakePort{{Name: "grpc", Port: 8080}}})
+	o := newOptions([]Option{WithWatchBackoff(testWatchBackoff), WithEndpointAPI(EndpointsAPI)})
+	clusters := []cluster{
+		{name: "b", r: newResolver(context.Background(), &k8s.APIClient{Client: hung.Client(), Address: hung.URL}, o)},
+		{name: "a", r: apiA.newResolver(context.Background(), o)},
+	}
+
+	// Cluster b never responds, so the watcher starts with cluster a once the join timeout passes.
+	clk := newFakeClock()
+	type started struct {
+		w   *clusterWatcher
+		err error
+	}
+	startedCh := make(chan started)
+	go func() {
+		w, err := startNewClusterWatcher(context.Background(), "service1.namespace1:8080", clusters,
+			newOptions([]Option{WithWatchBackoff(testWatchBackoff), withClock(clk)}))
+		startedCh <- started{w: w, err: err}
+	}()
+	clk.waitForTimers(1)
+	clk.Advance(defaultClusterJoinTimeout)
+	s := <-startedCh
+	require.NoError(t, s.err)
+
+	u, err := s.w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{
+		{Op: naming.Add, Addr: "10.0.0.1:8080", Metadata: AddressMetadata{IP: "10.0.0.1", Namespace: "namespace1", PortName: "grpc", Cluster: "a"}},
+	}, u)
+
+	// Close does not wait for the hung cluster.
+	s.w.Close()
+}
+
+func TestResolver_WithClusters(t *testing.T) {
+	for _, tcase := range []struct {
+		clusters []ClusterConfig
+		err      string
+	}{
+		{clusters: []ClusterConfig{{Name: "", Client: &k8s.APIClient{}}}, err: "cluster name cannot be empty"},
+		{clusters: []ClusterConfig{{Name: "a", Client: &k8s.APIClient{}}, {Name: "a", Client: &k8s.APIClient{}}}, err: `cluster name "a" is not unique`},
+		{clusters: []ClusterConfig{{Name: "a"}}, err: `cluster "a" has no API client`},
+	} {
+		_, err := NewWithClient(&k8s.APIClient{}, WithClusters(tcase.clusters)).Resolve("service1.namespace1")
+		require.Error(t, err)
+		require.Contains(t, err.Error(), tcase.err)
+	}
+
+	_, err := NewRunner(&k8s.APIClient{}, "service1.namespace1", func([]*naming.Update) {}, WithClusters([]ClusterConfig{{Name: "a", Client: &k8s.APIClient{}}}))
+	require.Error(t, err)
+}
@@ -0,0 +1,118 @@
+package k8sresolver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// dnsFallbackAfterFailures is a number of failed watch restarts in a row after which DNS fallback starts.
+	dnsFallbackAfterFailures = 3
+	// dnsFallbackPortName is a name of the port looked up in DNS.
+	dnsFallbackPortName = "grpc"
+	// defaultClusterDomain is the DNS domain of the cluster used if WithClusterDomain is not set.
+	defaultClusterDomain = "cluster.local"
+)
+
+// dnsFallbackInterval is an interval between DNS lookups while the fallback is active.
+var dnsFallbackInterval = 30 * time.Second
+
+// DNSResolver looks up DNS records for WithDNSFallback. *net.Resolver implements it.
+type DNSResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (cname string, addrs []*net.SRV, err error)
+	LookupHost(ctx context.Context, host string) (addrs []string, err error)
+}
+
+// dnsFallback is a running loop of DNS lookups.
+type dnsFallback struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// startDNSFallback starts passing endpoints resolved from DNS as events, unless it is not configured or already started.
+// Watch started after that needs to start from the current state, so addresses from DNS are reconciled with it.
+func (s *streamWatcher) startDNSFallback(reason error) {
+	if s.dnsResolver == nil || s.fallback != nil {
+		return
+	}
+	s.logger.WithError(reason).Warn("k8sresolver: Watch is unavailable. Falling back to DNS")
+	s.resourceVersion = ""
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	f := &dnsFallback{cancel: cancel, done: make(chan struct{})}
+	s.fallback = f
+	go func() {
+		defer close(f.done)
+		for {
+			ep, err := lookupSRVEndpoints(ctx, s.dnsResolver, s.clusterDomain, s.target)
+			if err != nil {
+				s.logger.WithError(err).Debug("k8sresolver: DNS fallback lookup failed")
+			} else {
+				select {
+				case <-ctx.Done():
+					return
+				case s.eventsCh <- watchResult{namespace: s.target.namespace, ep: &event{Type: modified, Object: *ep}}:
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.clock.After(dnsFallbackInterval):
+			}
+		}
+	}()
+}
+
+// stopDNSFallback stops DNS lookups. When it returns, no more events from DNS are sent.
+func (s *streamWatcher) stopDNSFallback() {
+	if s.fallback == nil {
+		return
+	}
+	s.fallback.cancel()
+	<-s.fallback.done
+	s.fallback = nil
+	s.logger.Info("k8sresolver: Watch is available again. Stopped DNS fallback")
+}
+
+// lookupSRVEndpoints returns endpoints with a subset per port of SRV records of the target service in the cluster domain.
+// Hosts that cannot be resolved are skipped. Endpoints have no resourceVersion, so they never delete all addresses from
+// the watcher.
+func lookupSRVEndpoints(ctx context.Context, r DNSResolver, domain string, t targetEntry) (*endpoints, error) {
+	name := fmt.Sprintf("%s.%s.svc.%s", t.service, t.namespace, domain)
+	_, srvs, err := r.LookupSRV(ctx, dnsFallbackPortName, "tcp", name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "k8sresolver: failed to look up SRV records of %s", name)
+	}
+
+	ports := map[int][]address{}
+	for _, srv := range srvs {
+		ips, err := r.LookupHost(ctx, srv.Target)
+		if err != nil {
+			continue
+		}
+		for _, ip := range ips {
+			ports[int(srv.Port)] = append(ports[int(srv.Port)], address{IP: ip})
+		}
+	}
+
+	ep := &endpoints{Kind: "Endpoints", APIVersion: "v1", Metadata: metadata{Name: t.service}}
+	var numbers []int
+	for p := range ports {
+		numbers = append(numbers, p)
+	}
+	// Keep subsets order stable.
+	sort.Ints(numbers)
+	for _, p := range numbers {
+		ep.Subsets = append(ep.Subsets, subset{
+			Addresses: ports[p],
+			Ports:     []port{{Name: dnsFallbackPortName, Port: p}},
+		})
+	}
+	return ep, nil
+}
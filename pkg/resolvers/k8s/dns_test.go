@@ -0,0 +1,136 @@
+package k8sresolver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+type dnsResolverMock struct {
+	t     *testing.T
+	srvs  map[string][]*net.SRV
+	hosts map[string][]string
+}
+
+func (m *dnsResolverMock) LookupSRV(_ context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	require.Equal(m.t, "grpc", service)
+	require.Equal(m.t, "tcp", proto)
+	srvs, ok := m.srvs[name]
+	if !ok {
+		return "", nil, errors.Errorf("no such host %s", name)
+	}
+	return name, srvs, nil
+}
+
+func (m *dnsResolverMock) LookupHost(_ context.Context, host string) ([]string, error) {
+	ips, ok := m.hosts[host]
+	if !ok {
+		return nil, errors.Errorf("no such host %s", host)
+	}
+	return ips, nil
+}
+
+func TestLookupSRVEndpoints(t *testing.T) {
+	dns := &dnsResolverMock{
+		t: t,
+		srvs: map[string][]*net.SRV{
+			"service1.namespace1.svc.cluster.local": {
+				{Target: "pod1.service1.namespace1.svc.cluster.local.", Port: 8080},
+				{Target: "pod2.service1.namespace1.svc.cluster.local.", Port: 8080},
+				{Target: "gone.service1.namespace1.svc.cluster.local.", Port: 8080},
+				{Target: "pod3.service1.namespace1.svc.cluster.local.", Port: 7070},
+			},
+		},
+		hosts: map[string][]string{
+			"pod1.service1.namespace1.svc.cluster.local.": {"1.2.3.1"},
+			"pod2.service1.namespace1.svc.cluster.local.": {"1.2.3.2"},
+			"pod3.service1.namespace1.svc.cluster.local.": {"1.2.3.3"},
+		},
+	}
+
+	ep, err := lookupSRVEndpoints(context.Background(), dns, "cluster.local", targetEntry{service: "service1", namespace: "namespace1", port: noTargetPort})
+	require.NoError(t, err)
+	require.Equal(t, &endpoints{
+		Kind:       "Endpoints",
+		APIVersion: "v1",
+		Metadata:   metadata{Name: "service1"},
+		Subsets: []subset{
+			{Addresses: []address{{IP: "1.2.3.3"}}, Ports: []port{{Name: "grpc", Port: 7070}}},
+			{Addresses: []address{{IP: "1.2.3.1"}, {IP: "1.2.3.2"}}, Ports: []port{{Name: "grpc", Port: 8080}}},
+		},
+	}, ep)
+
+	_, err = lookupSRVEndpoints(context.Background(), dns, "cluster.local", targetEntry{service: "service2", namespace: "namespace1", port: noTargetPort})
+	require.Error(t, err)
+
+	// Services of other cluster domain are looked up there.
+	dns.srvs["service1.namespace1.svc.cluster2.example.org"] = dns.srvs["service1.namespace1.svc.cluster.local"]
+	delete(dns.srvs, "service1.namespace1.svc.cluster.local")
+	ep2, err := lookupSRVEndpoints(context.Background(), dns, "cluster2.example.org", targetEntry{service: "service1", namespace: "namespace1", port: noTargetPort})
+	require.NoError(t, err)
+	require.Equal(t, ep, ep2)
+}
+
+func TestStreamWatcher_DNSFallback(t *testing.T) {
+	dns := &dnsResolverMock{
+		t: t,
+		srvs: map[string][]*net.SRV{
+			"service1.namespace1.svc.cluster.local": {{Target: "pod1.service1.namespace1.svc.cluster.local.", Port: 8080}},
+		},
+		hosts: map[string][]string{"pod1.service1.namespace1.svc.cluster.local.": {"1.2.3.1"}},
+	}
+	expectedDNSEvent := event{Type: modified, Object: endpoints{
+		Kind:       "Endpoints",
+		APIVersion: "v1",
+		Metadata:   metadata{Name: "service1"},
+		Subsets:    []subset{{Addresses: []address{{IP: "1.2.3.1"}}, Ports: []port{{Name: "grpc", Port: 8080}}}},
+	}}
+
+	for _, code := range []int{http.StatusForbidden, http.StatusServiceUnavailable} {
+		t.Run(fmt.Sprintf("%d", code), func(t *testing.T) {
+			bytesCh, errCh, epClientMock, _, eventsCh, cancel := startTestStream(t, WithDNSFallback(dns))
+			defer cancel()
+
+			sendTestEvent(t, bytesCh, event{Type: added, Object: endpoints{Metadata: metadata{ResourceVersion: "123"}}})
+			gotEvent := <-eventsCh
+			require.NoError(t, gotEvent.err)
+
+			// Watch keeps failing to restart until addresses from DNS are passed.
+			epClientMock.startErrCh <- &statusError{code: code}
+			errCh <- io.EOF
+		dnsLoop:
+			for {
+				select {
+				case gotEvent = <-eventsCh:
+					require.NoError(t, gotEvent.err)
+					require.Equal(t, expectedDNSEvent, *gotEvent.ep)
+					break dnsLoop
+				case stream := <-epClientMock.streamsCh:
+					require.Nil(t, stream.connMock, "expected failed stream")
+					epClientMock.startErrCh <- &statusError{code: code}
+				case <-time.After(2 * time.Second):
+					t.Fatal("No addresses from DNS")
+				}
+			}
+
+			// Once watch is started again, it starts from the current state.
+			var stream startedStream
+			for stream.connMock == nil {
+				stream = <-epClientMock.streamsCh
+			}
+			require.Equal(t, "", stream.resourceVersion)
+			expectedEvent := event{Type: added, Object: endpoints{Metadata: metadata{ResourceVersion: "400"}}}
+			sendTestEvent(t, bytesCh, expectedEvent)
+			gotEvent = <-eventsCh
+			require.NoError(t, gotEvent.err)
+			require.Equal(t, expectedEvent, *gotEvent.ep)
+		})
+	}
+}
@@ -0,0 +1,341 @@
+package k8sresolver
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/naming"
+	grpcresolver "google.golang.org/grpc/resolver"
+)
+
+// FakeAPI is an in-memory endpoints API, which can be used instead of kube-apiserver to test code using the resolver.
+// Every change is passed as watch event to all started watches in order. Changes made while watch is reconnecting are
+// passed once it is started again, so tests do not need to wait for reconnect.
+// Pods are not faked, so WithAddressSelector and WithPodWeights options see no pods.
+type FakeAPI struct {
+	mu              sync.Mutex
+	resourceVersion int
+	services        map[watchKey]*fakeService
+}
+
+// FakeSubset is a subset of fake endpoints.
+type FakeSubset struct {
+	// Addresses are IPs of ready pods.
+	Addresses []string
+	// NotReadyAddresses are IPs of pods that are not ready.
+	NotReadyAddresses []string
+	Ports             []FakePort
+}
+
+// FakePort is a port of fake endpoints. Empty protocol means TCP.
+type FakePort struct {
+	Name     string
+	Port     int
+	Protocol string
+}
+
+type fakeService struct {
+	// ep is nil if endpoints do not exist.
+	ep *endpoints
+	// history holds all events sent for the service, so watch can be resumed from any resourceVersion.
+	history []fakeEvent
+	streams map[*fakeStream]struct{}
+	// failNext holds codes returned by the next watch requests.
+	failNext []int
+}
+
+type fakeEvent struct {
+	resourceVersion int
+	ev              event
+}
+
+// NewFakeAPI returns FakeAPI without any endpoints.
+func NewFakeAPI() *FakeAPI {
+	return &FakeAPI{services: make(map[watchKey]*fakeService)}
+}
+
+// Resolver returns naming.Resolver using the fake API.
+func (f *FakeAPI) Resolver(opts ...Option) naming.Resolver {
+	return f.newResolver(context.Background(), newOptions(opts))
+}
+
+// Builder returns grpc resolver.Builder using the fake API. It can be used with grpc.WithResolvers.
+func (f *FakeAPI) Builder(opts ...Option) grpcresolver.Builder {
+	r := f.newResolver(context.Background(), newOptions(opts))
+	return &builder{newResolver: func() (*resolver, error) { return r, nil }}
+}
+
+// Runner returns Runner of the target using the fake API.
+func (f *FakeAPI) Runner(target string, onUpdate func(updates []*naming.Update), opts ...Option) (*Runner, error) {
+	return newRunner(f.newResolver(context.Background(), newOptions(opts)), target, onUpdate)
+}
+
+func (f *FakeAPI) newResolver(ctx context.Context, o options) *resolver {
+	return &resolver{
+		ctx:     ctx,
+		watches: newWatchRegistry(ctx, func() endpointClient { return &fakeClient{api: f} }, o),
+		opts:    o,
+		localZone: func(context.Context) (string, error) {
+			return "", errors.New("zone detection is not supported by FakeAPI. Pass zone to WithPreferSameZone")
+		},
+		servicePorts: func(context.Context, string, string) ([]servicePort, error) {
+			return nil, errors.New("services are not supported by FakeAPI. Do not use WithServicePortMapping")
+		},
+	}
+}
+
+func (f *FakeAPI) service(namespace string, service string) *fakeService {
+	key := watchKey{namespace: namespace, service: service}
+	s, ok := f.services[key]
+	if !ok {
+		s = &fakeService{streams: make(map[*fakeStream]struct{})}
+		f.services[key] = s
+	}
+	return s
+}
+
+// SetEndpoints creates or replaces endpoints of the service. Watches get ADDED event if endpoints did not exist and
+// MODIFIED otherwise.
+func (f *FakeAPI) SetEndpoints(namespace string, service string, subsets ...FakeSubset) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s := f.service(namespace, service)
+	typ := modified
+	if s.ep == nil {
+		typ = added
+	}
+	f.resourceVersion++
+	ep := &endpoints{
+		Kind:       "Endpoints",
+		APIVersion: "v1",
+		Metadata:   metadata{Name: service, ResourceVersion: strconv.Itoa(f.resourceVersion)},
+	}
+	for _, fs := range subsets {
+		sub := subset{}
+		for _, ip := range fs.Addresses {
+			sub.Addresses = append(sub.Addresses, address{IP: ip})
+		}
+		for _, ip := range fs.NotReadyAddresses {
+			sub.NotReadyAddresses = append(sub.NotReadyAddresses, address{IP: ip})
+		}
+		for _, p := range fs.Ports {
+			sub.Ports = append(sub.Ports, port{Name: p.Name, Port: p.Port, Protocol: p.Protocol})
+		}
+		ep.Subsets = append(ep.Subsets, sub)
+	}
+	s.ep = ep
+	s.record(f.resourceVersion, event{Type: typ, Object: *ep})
+}
+
+// DeleteEndpoints deletes endpoints of the service. Watches get DELETED event.
+func (f *FakeAPI) DeleteEndpoints(namespace string, service string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s := f.service(namespace, service)
+	if s.ep == nil {
+		return
+	}
+	f.resourceVersion++
+	ep := *s.ep
+	ep.Metadata.ResourceVersion = strconv.Itoa(f.resourceVersion)
+	ep.Subsets = nil
+	s.ep = nil
+	s.record(f.resourceVersion, event{Type: deleted, Object: ep})
+}
+
+// SendStatus sends ERROR event with Status object of given code to all started watches of the service, e.g.
+// http.StatusForbidden to simulate missing permissions or http.StatusGone to simulate too old resourceVersion.
+func (f *FakeAPI) SendStatus(namespace string, service string, code int, message string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ev := event{Type: failed, Object: endpoints{
+		Kind:    statusKind,
+		Status:  "Failure",
+		Message: message,
+		Code:    code,
+	}}
+	for st := range f.service(namespace, service).streams {
+		st.push(ev)
+	}
+}
+
+// DropConnections breaks all started watches of the service as if the connection was lost. Resolver starts fresh watch
+// starting with the current endpoints.
+func (f *FakeAPI) DropConnections(namespace string, service string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s := f.service(namespace, service)
+	for st := range s.streams {
+		st.closeWithError(io.ErrUnexpectedEOF)
+		delete(s.streams, st)
+	}
+}
+
+// FailNextWatch makes the next watch requests for the service fail with given response codes, one code per request.
+func (f *FakeAPI) FailNextWatch(namespace string, service string, codes ...int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s := f.service(namespace, service)
+	s.failNext = append(s.failNext, codes...)
+}
+
+// Watches returns the number of started watches of the service.
+func (f *FakeAPI) Watches(namespace string, service string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.service(namespace, service).streams)
+}
+
+func (s *fakeService) record(resourceVersion int, ev event) {
+	s.history = append(s.history, fakeEvent{resourceVersion: resourceVersion, ev: ev})
+	for st := range s.streams {
+		st.push(ev)
+	}
+}
+
+// fakeClient is endpointClient using FakeAPI.
+type fakeClient struct {
+	api *FakeAPI
+}
+
+func (c *fakeClient) List(_ context.Context, t targetEntry) (*endpoints, error) {
+	f := c.api
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s := f.service(t.namespace, t.service)
+	if s.ep == nil {
+		return nil, &statusError{code: http.StatusNotFound, url: "fake://" + t.String()}
+	}
+	ep := *s.ep
+	return &ep, nil
+}
+
+func (c *fakeClient) StartChangeStream(ctx context.Context, t targetEntry, resourceVersion string) (io.ReadCloser, error) {
+	f := c.api
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s := f.service(t.namespace, t.service)
+	if len(s.failNext) > 0 {
+		code := s.failNext[0]
+		s.failNext = s.failNext[1:]
+		return nil, &statusError{code: code, url: "fake://" + t.String()}
+	}
+
+	st := newFakeStream()
+	if resourceVersion == "" {
+		// Fresh watch starts with the current state.
+		if s.ep != nil {
+			st.push(event{Type: added, Object: *s.ep})
+		}
+	} else {
+		rv, err := strconv.Atoi(resourceVersion)
+		if err != nil {
+			return nil, &statusError{code: http.StatusBadRequest, url: "fake://" + t.String()}
+		}
+		for _, e := range s.history {
+			if e.resourceVersion > rv {
+				st.push(e.ev)
+			}
+		}
+	}
+	s.streams[st] = struct{}{}
+
+	go func() {
+		<-ctx.Done()
+		f.mu.Lock()
+		delete(s.streams, st)
+		f.mu.Unlock()
+		st.closeWithError(io.EOF)
+	}()
+	go st.run()
+	return st.r, nil
+}
+
+func (c *fakeClient) ListPods(context.Context, string, string) (map[string]pod, error) {
+	return map[string]pod{}, nil
+}
+
+// fakeStream passes queued events to the pipe read by the resolver. Events are queued, so changes of FakeAPI never wait
+// for slow watchers.
+type fakeStream struct {
+	r *io.PipeReader
+	w *io.PipeWriter
+
+	mu     sync.Mutex
+	queue  [][]byte
+	err    error
+	notify chan struct{}
+}
+
+func newFakeStream() *fakeStream {
+	r, w := io.Pipe()
+	return &fakeStream{r: r, w: w, notify: make(chan struct{}, 1)}
+}
+
+func (s *fakeStream) push(ev event) {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		// Not possible for event.
+		panic(err)
+	}
+
+	s.mu.Lock()
+	s.queue = append(s.queue, b)
+	s.mu.Unlock()
+	s.wake()
+}
+
+// closeWithError closes the stream with given error once all queued events are read.
+func (s *fakeStream) closeWithError(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.mu.Unlock()
+	s.wake()
+}
+
+func (s *fakeStream) wake() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *fakeStream) run() {
+	for range s.notify {
+		for {
+			s.mu.Lock()
+			if len(s.queue) == 0 {
+				err := s.err
+				s.mu.Unlock()
+				if err != nil {
+					_ = s.w.CloseWithError(err)
+					return
+				}
+				break
+			}
+			b := s.queue[0]
+			s.queue = s.queue[1:]
+			s.mu.Unlock()
+
+			if _, err := s.w.Write(b); err != nil {
+				// Reader is closed.
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package k8sresolver
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/naming"
+)
+
+func TestFakeAPI_DrivesWatcher(t *testing.T) {
+	api := NewFakeAPI()
+	api.SetEndpoints("namespace1", "service1", FakeSubset{
+		Addresses: []string{"1.2.3.4"},
+		Ports:     []FakePort{{Name: "grpc", Port: 8080}},
+	})
+
+	w, err := api.Resolver(WithWatchBackoff(testWatchBackoff)).Resolve("service1.namespace1:grpc")
+	require.NoError(t, err)
+	defer w.Close()
+
+	u, err := w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{{Op: naming.Add, Addr: "1.2.3.4:8080"}}, u)
+
+	api.SetEndpoints("namespace1", "service1", FakeSubset{
+		Addresses: []string{"1.2.3.5"},
+		Ports:     []FakePort{{Name: "grpc", Port: 8080}},
+	})
+	u, err = w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{
+		{Op: naming.Delete, Addr: "1.2.3.4:8080"},
+		{Op: naming.Add, Addr: "1.2.3.5:8080"},
+	}, u)
+
+	// Transient error makes resolver start fresh watch, which begins with the current state. It changes nothing.
+	api.SendStatus("namespace1", "service1", http.StatusServiceUnavailable, "unavailable")
+	// Change made while reconnecting is passed once new watch is started.
+	api.DropConnections("namespace1", "service1")
+	api.SetEndpoints("namespace1", "service1", FakeSubset{
+		Addresses: []string{"1.2.3.6"},
+		Ports:     []FakePort{{Name: "grpc", Port: 8080}},
+	})
+	for {
+		u, err = w.Next()
+		require.NoError(t, err)
+		if len(u) > 0 {
+			break
+		}
+	}
+	requireUpdates(t, []*naming.Update{
+		{Op: naming.Delete, Addr: "1.2.3.5:8080"},
+		{Op: naming.Add, Addr: "1.2.3.6:8080"},
+	}, u)
+
+	api.DeleteEndpoints("namespace1", "service1")
+	u, err = w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{{Op: naming.Delete, Addr: "1.2.3.6:8080"}}, u)
+}
+
+func TestFakeAPI_FatalErrors(t *testing.T) {
+	api := NewFakeAPI()
+	r := api.Resolver(WithWatchBackoff(testWatchBackoff))
+
+	// Endpoints do not exist yet.
+	w, err := r.Resolve("service1.namespace1")
+	require.NoError(t, err)
+	defer w.Close()
+	u, err := w.Next()
+	require.NoError(t, err)
+	require.Empty(t, u)
+	require.Equal(t, 1, api.Watches("namespace1", "service1"))
+
+	api.SendStatus("namespace1", "service1", http.StatusForbidden, "forbidden")
+	_, err = w.Next()
+	require.Error(t, err)
+
+	// Reconnect failing with fatal code is returned as well.
+	w, err = r.Resolve("service1.namespace1")
+	require.NoError(t, err)
+	defer w.Close()
+	_, err = w.Next()
+	require.NoError(t, err)
+
+	api.FailNextWatch("namespace1", "service1", http.StatusUnauthorized)
+	api.DropConnections("namespace1", "service1")
+	_, err = w.Next()
+	require.Error(t, err)
+}
@@ -0,0 +1,43 @@
+package k8sresolver
+
+import "net"
+
+// IPFamily is a family of IP addresses.
+type IPFamily int
+
+const (
+	// AnyIPFamily means that addresses of all families are resolved.
+	AnyIPFamily IPFamily = iota
+	// IPv4Family is a family of IPv4 addresses.
+	IPv4Family
+	// IPv6Family is a family of IPv6 addresses.
+	IPv6Family
+)
+
+// ipFamily returns family of the given IP. AnyIPFamily is returned if IP is malformed.
+func ipFamily(ip string) IPFamily {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return AnyIPFamily
+	}
+	if parsed.To4() != nil {
+		return IPv4Family
+	}
+	return IPv6Family
+}
+
+// preferredFamilyAddresses returns only addresses of the given family. If there are no such addresses, all of them are
+// returned to never black-hole the traffic.
+func preferredFamilyAddresses(family IPFamily, addresses map[string]AddressMetadata) map[string]AddressMetadata {
+	preferred := make(map[string]AddressMetadata)
+	for addr, md := range addresses {
+		if ipFamily(md.IP) == family {
+			preferred[addr] = md
+		}
+	}
+
+	if len(preferred) == 0 {
+		return addresses
+	}
+	return preferred
+}
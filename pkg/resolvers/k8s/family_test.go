@@ -0,0 +1,70 @@
+package k8sresolver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/naming"
+)
+
+func TestIPFamily(t *testing.T) {
+	require.Equal(t, IPv4Family, ipFamily("1.2.3.4"))
+	require.Equal(t, IPv6Family, ipFamily("2001:db8::1"))
+	require.Equal(t, IPv4Family, ipFamily("::ffff:1.2.3.4"), "IPv4-mapped IPv6 address is IPv4")
+	require.Equal(t, AnyIPFamily, ipFamily("not-an-ip"))
+}
+
+func startDualStackWatcher(t *testing.T, opts ...Option) (chan []byte, *watcher) {
+	bytesCh := make(chan []byte)
+	listResult := newTestEndpoints("10", 50051, "1.2.3.4", "2001:db8::1")
+	epClientMock := &endpointClientMock{
+		t: t,
+		expectedTarget: targetEntry{
+			service:   "service1",
+			port:      noTargetPort,
+			namespace: "namespace1",
+		},
+		bytesCh:    bytesCh,
+		errCh:      make(chan error),
+		startErrCh: make(chan error, 1),
+		streamsCh:  make(chan startedStream, 10),
+		listResult: &listResult,
+	}
+
+	w, err := startNewWatcher(context.Background(), epClientMock.expectedTarget, epClientMock, newOptions(opts))
+	require.NoError(t, err)
+	return bytesCh, w
+}
+
+func TestWatcher_DualStack(t *testing.T) {
+	_, w := startDualStackWatcher(t)
+	defer w.Close()
+
+	u, err := w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{
+		{Op: naming.Add, Addr: "1.2.3.4:50051"},
+		{Op: naming.Add, Addr: "[2001:db8::1]:50051", Metadata: AddressMetadata{IP: "2001:db8::1", Namespace: "namespace1", PortName: "grpc"}},
+	}, u)
+}
+
+func TestWatcher_PreferredIPFamily(t *testing.T) {
+	bytesCh, w := startDualStackWatcher(t, WithPreferredIPFamily(IPv6Family))
+	defer w.Close()
+
+	u, err := w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{
+		{Op: naming.Add, Addr: "[2001:db8::1]:50051"},
+	}, u)
+
+	// No IPv6 addresses left, so IPv4 ones are used.
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: newTestEndpoints("11", 50051, "1.2.3.4")})
+	u, err = w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{
+		{Op: naming.Delete, Addr: "[2001:db8::1]:50051"},
+		{Op: naming.Add, Addr: "1.2.3.4:50051"},
+	}, u)
+}
@@ -0,0 +1,230 @@
+package k8sresolver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// endpointsSelectorClient is an endpointClient that resolves all Endpoints objects in the namespace of the target
+// matching the label selector, e.g. of sharded service where every shard is a separate Service. Objects are merged into
+// single endpoints object named as the target service, so objects created or deleted later are added to or removed
+// from the state of the target.
+// It keeps the last known state of objects to be able to resume watch, so it should be used for single target only.
+type endpointsSelectorClient struct {
+	cl       *client
+	selector string
+
+	mu              sync.Mutex
+	objects         map[string]endpoints
+	resourceVersion string
+}
+
+type endpointsList struct {
+	Metadata listMetadata `json:"metadata"`
+	Items    []endpoints  `json:"items"`
+}
+
+func (c *endpointsSelectorClient) endpointsURL(t targetEntry, watch bool) string {
+	watchPath := ""
+	if watch {
+		watchPath = "/watch"
+	}
+	return fmt.Sprintf("/api/v1%s/namespaces/%s/endpoints?labelSelector=%s",
+		watchPath,
+		t.namespace,
+		url.QueryEscape(c.selector),
+	)
+}
+
+// List returns all endpoints objects matching the selector merged into single endpoints object.
+func (c *endpointsSelectorClient) List(ctx context.Context, t targetEntry) (*endpoints, error) {
+	list, err := c.list(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+
+	objects := map[string]endpoints{}
+	for _, ep := range list.Items {
+		objects[ep.Metadata.Name] = ep
+	}
+	c.setState(list.Metadata.ResourceVersion, objects)
+
+	ep := mergeEndpoints(t, list.Metadata.ResourceVersion, objects)
+	return &ep, nil
+}
+
+// ListPods returns pods in the namespace matching the label selector by their IPs.
+func (c *endpointsSelectorClient) ListPods(ctx context.Context, namespace string, selector string) (map[string]pod, error) {
+	return c.cl.ListPods(ctx, namespace, selector)
+}
+
+func (c *endpointsSelectorClient) setState(resourceVersion string, objects map[string]endpoints) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.resourceVersion = resourceVersion
+	c.objects = map[string]endpoints{}
+	for name, ep := range objects {
+		c.objects[name] = ep
+	}
+}
+
+// state returns copy of the last known objects if they are in given resourceVersion.
+func (c *endpointsSelectorClient) state(resourceVersion string) (map[string]endpoints, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if resourceVersion == "" || resourceVersion != c.resourceVersion {
+		return nil, false
+	}
+	objects := map[string]endpoints{}
+	for name, ep := range c.objects {
+		objects[name] = ep
+	}
+	return objects, true
+}
+
+func (c *endpointsSelectorClient) list(ctx context.Context, t targetEntry) (*endpointsList, error) {
+	listURL := c.endpointsURL(t, false)
+	body, err := c.cl.startGET(ctx, listURL)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	var list endpointsList
+	if err := json.NewDecoder(body).Decode(&list); err != nil {
+		return nil, errors.Wrapf(err, "Failed to decode endpoints from GET %s response", listURL)
+	}
+	return &list, nil
+}
+
+// StartChangeStream starts stream of merged changes of endpoints objects matching the selector.
+// NOTE: Merging requires knowing all the objects. If resourceVersion matches the state we know (from List or previous
+// stream), watch is resumed from it. Otherwise stream starts with fresh list returned as the first event, the same way
+// single Endpoints watch without resourceVersion does.
+func (c *endpointsSelectorClient) StartChangeStream(ctx context.Context, t targetEntry, resourceVersion string) (io.ReadCloser, error) {
+	var initial *event
+	objects, ok := c.state(resourceVersion)
+	if !ok {
+		list, err := c.list(ctx, t)
+		if err != nil {
+			return nil, err
+		}
+
+		objects = map[string]endpoints{}
+		for _, ep := range list.Items {
+			objects[ep.Metadata.Name] = ep
+		}
+		resourceVersion = list.Metadata.ResourceVersion
+		c.setState(resourceVersion, objects)
+		initial = &event{Type: added, Object: mergeEndpoints(t, resourceVersion, objects)}
+	}
+
+	q := c.cl.watchQuery(resourceVersion)
+	// Merged stream needs to be resumed from exact version, even if it is empty.
+	q.Set("resourceVersion", resourceVersion)
+	watchURL := fmt.Sprintf("%s&%s", c.endpointsURL(t, true), q.Encode())
+	c.cl.warnIfInsecure()
+	body, err := c.cl.startGET(ctx, watchURL)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		err := c.proxyMergedEndpoints(t, initial, objects, newEventDecoder(body, c.cl.maxEventSize), json.NewEncoder(pw))
+		body.Close()
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+// proxyMergedEndpoints decodes endpoints events and encodes merged endpoints events until decoding fails. It returns
+// nil on EOF, so the merged stream is closed in the same way.
+func (c *endpointsSelectorClient) proxyMergedEndpoints(
+	t targetEntry,
+	initial *event,
+	objects map[string]endpoints,
+	decoder *eventDecoder,
+	encoder *json.Encoder,
+) error {
+	if initial != nil {
+		if err := encoder.Encode(initial); err != nil {
+			return err
+		}
+	}
+
+	for {
+		var got event
+		if err := decoder.Decode(&got); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		merged := got
+		switch got.Type {
+		case added, modified, deleted:
+			if got.Type == deleted {
+				// Only addresses of the deleted object are removed from the merged state.
+				delete(objects, got.Object.Metadata.Name)
+			} else {
+				objects[got.Object.Metadata.Name] = got.Object
+			}
+			merged = event{Type: modified, Object: mergeEndpoints(t, got.Object.Metadata.ResourceVersion, objects)}
+		}
+		// Bookmark, status and unknown events are passed as they are. Streamer will handle them.
+
+		if merged.Type == modified || merged.Type == bookmark {
+			// State is updated before the event is consumed, the same way as for merged slices.
+			c.setState(merged.Object.Metadata.ResourceVersion, objects)
+		}
+		if err := encoder.Encode(merged); err != nil {
+			return err
+		}
+	}
+}
+
+// mergeEndpoints merges subsets of all the objects into single endpoints object. Addresses are marked with the name of
+// the object they come from.
+func mergeEndpoints(t targetEntry, resourceVersion string, objects map[string]endpoints) endpoints {
+	var names []string
+	for name := range objects {
+		names = append(names, name)
+	}
+	// Keep subsets order stable.
+	sort.Strings(names)
+
+	ep := endpoints{
+		Kind:       "Endpoints",
+		APIVersion: "v1",
+		Metadata: metadata{
+			Name:            t.service,
+			ResourceVersion: resourceVersion,
+		},
+	}
+	for _, name := range names {
+		for _, sub := range objects[name].Subsets {
+			merged := subset{Ports: sub.Ports}
+			for _, a := range sub.Addresses {
+				a.Service = name
+				merged.Addresses = append(merged.Addresses, a)
+			}
+			for _, a := range sub.NotReadyAddresses {
+				a.Service = name
+				merged.NotReadyAddresses = append(merged.NotReadyAddresses, a)
+			}
+			ep.Subsets = append(ep.Subsets, merged)
+		}
+	}
+	return ep
+}
@@ -0,0 +1,103 @@
+package k8sresolver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/improbable-eng/kedge/pkg/k8s"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/naming"
+)
+
+func newTestShard(name string, resourceVersion string, ips ...string) endpoints {
+	ep := newTestEndpoints(resourceVersion, 8080, ips...)
+	ep.Metadata.Name = name
+	return ep
+}
+
+type endpointsSelectorAPIMock struct {
+	t *testing.T
+
+	lists         chan endpointsList
+	watchVersions chan string
+	watchEventsCh chan event
+}
+
+func (m *endpointsSelectorAPIMock) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	require.Equal(m.t, "app=shardedthing", r.URL.Query().Get("labelSelector"))
+	switch r.URL.Path {
+	case "/api/v1/namespaces/namespace1/endpoints":
+		select {
+		case l := <-m.lists:
+			require.NoError(m.t, json.NewEncoder(w).Encode(l))
+		default:
+			m.t.Errorf("unexpected list request")
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	case "/api/v1/watch/namespaces/namespace1/endpoints":
+		m.watchVersions <- r.URL.Query().Get("resourceVersion")
+		w.(http.Flusher).Flush()
+		for e := range m.watchEventsCh {
+			require.NoError(m.t, json.NewEncoder(w).Encode(e))
+			w.(http.Flusher).Flush()
+		}
+	default:
+		m.t.Errorf("unexpected request %s", r.URL.String())
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestWatcher_EndpointsSelector_AddsAndRemovesShards(t *testing.T) {
+	m := &endpointsSelectorAPIMock{
+		t:             t,
+		lists:         make(chan endpointsList, 10),
+		watchVersions: make(chan string, 10),
+		watchEventsCh: make(chan event, 10),
+	}
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	defer close(m.watchEventsCh)
+
+	m.lists <- endpointsList{
+		Metadata: listMetadata{ResourceVersion: "12"},
+		// The same address in many shards is resolved once.
+		Items: []endpoints{newTestShard("shard-0", "10", "1.2.3.4", "1.2.3.5"), newTestShard("shard-1", "11", "1.2.3.6", "1.2.3.5")},
+	}
+	cl := &endpointsSelectorClient{cl: &client{k8sClient: &k8s.APIClient{Client: srv.Client(), Address: srv.URL}}, selector: "app=shardedthing"}
+	target := targetEntry{service: "shardedthing", namespace: "namespace1", port: noTargetPort}
+	w, err := startNewWatcher(context.Background(), target, cl, newOptions([]Option{WithWatchBackoff(testWatchBackoff)}))
+	require.NoError(t, err)
+	defer w.Close()
+
+	u, err := w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{
+		{Op: naming.Add, Addr: "1.2.3.4:8080"},
+		{Op: naming.Add, Addr: "1.2.3.5:8080"},
+		{Op: naming.Add, Addr: "1.2.3.6:8080"},
+	}, u)
+	// Watch is resumed from the listed version, so objects are not listed again.
+	require.Equal(t, "12", <-m.watchVersions)
+
+	m.watchEventsCh <- event{Type: added, Object: newTestShard("shard-2", "13", "1.2.3.7")}
+	u, err = w.Next()
+	require.NoError(t, err)
+	require.Equal(t, []*naming.Update{
+		{Op: naming.Add, Addr: "1.2.3.7:8080", Metadata: AddressMetadata{IP: "1.2.3.7", Namespace: "namespace1", PortName: "grpc", Service: "shard-2"}},
+	}, u)
+
+	// Only addresses of the deleted shard are removed. Address present in other shard is kept.
+	m.watchEventsCh <- event{Type: deleted, Object: newTestShard("shard-0", "14", "1.2.3.4", "1.2.3.5")}
+	u, err = w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{{Op: naming.Delete, Addr: "1.2.3.4:8080"}}, u)
+	require.Equal(t, []string{"1.2.3.5:8080", "1.2.3.6:8080", "1.2.3.7:8080"}, w.Current())
+
+	m.watchEventsCh <- event{Type: modified, Object: newTestShard("shard-1", "15", "1.2.3.6")}
+	u, err = w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{{Op: naming.Delete, Addr: "1.2.3.5:8080"}}, u)
+}
@@ -0,0 +1,46 @@
+package k8sresolver
+
+import (
+	"github.com/improbable-eng/kedge/pkg/k8s"
+	"github.com/improbable-eng/kedge/pkg/sharedflags"
+	"github.com/pkg/errors"
+)
+
+var (
+	fEndpointAPI = sharedflags.Set.String("k8sresolver_endpoint_api", "endpoints",
+		"Kubernetes API used by k8s resolver to get service endpoints. Either 'auto' (EndpointSlices if served and "+
+			"permitted, Endpoints otherwise), 'endpoints' (core/v1 Endpoints), 'endpointslices' (discovery.k8s.io/v1 EndpointSlices), "+
+			"'selector' (core/v1 Pods selected by the service) or 'clusterip' (ClusterIP of core/v1 Service).")
+)
+
+func endpointAPIFromFlags() (EndpointAPI, error) {
+	switch *fEndpointAPI {
+	case "auto":
+		return AutoEndpointAPI, nil
+	case "endpoints":
+		return EndpointsAPI, nil
+	case "endpointslices":
+		return EndpointSliceAPI, nil
+	case "selector":
+		return SelectorAPI, nil
+	case "clusterip":
+		return ClusterIPAPI, nil
+	default:
+		return EndpointsAPI, errors.Errorf("k8sresolver: k8sresolver_endpoint_api flag needs to be either 'auto', "+
+			"'endpoints', 'endpointslices', 'selector' or 'clusterip'. Value %s", *fEndpointAPI)
+	}
+}
+
+// optionsFromFlags returns options configured by flags. Targets without namespace are resolved in the namespace of the
+// current pod, if running in-cluster.
+func optionsFromFlags() ([]Option, error) {
+	api, err := endpointAPIFromFlags()
+	if err != nil {
+		return nil, err
+	}
+	opts := []Option{WithEndpointAPI(api)}
+	if namespace, err := k8s.InClusterNamespace(); err == nil {
+		opts = append(opts, WithDefaultNamespace(namespace))
+	}
+	return opts, nil
+}
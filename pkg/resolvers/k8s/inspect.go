@@ -0,0 +1,85 @@
+package k8sresolver
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/improbable-eng/kedge/pkg/k8s"
+)
+
+// ResolvedAddress is an address returned by Resolve.
+type ResolvedAddress struct {
+	Addr     string
+	Metadata AddressMetadata
+	// Ready is false for address of pod that is not ready. Watcher resolves it only if WithNotReadyAddresses is used.
+	Ready bool
+}
+
+// Resolve lists endpoints of the target once and returns addresses the watcher would resolve it to right now, without
+// starting any watch, e.g. for CLI checking what the target resolves to. Target is in ExpectedTargetFmt format and
+// options are the same as for the resolver, so ports and addresses are selected in the same way.
+// Addresses of pods that are not ready are returned as well, with Ready false. Addresses are sorted. Target which
+// endpoints do not exist resolves to no addresses.
+func Resolve(ctx context.Context, target string, apiClient *k8s.APIClient, opts ...Option) ([]ResolvedAddress, error) {
+	return newResolver(ctx, apiClient, newOptions(opts)).resolveOnce(ctx, target)
+}
+
+func (r *resolver) resolveOnce(ctx context.Context, target string) ([]ResolvedAddress, error) {
+	targets, err := r.targets(target)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, t := range targets {
+		names = append(names, t.String())
+	}
+	name := strings.Join(names, ",")
+	ctx = withRequestTarget(ctx, name)
+
+	// Ready addresses are resolved separately, so their readiness is known even with WithNotReadyAddresses.
+	readyOpts, allOpts := r.watcherOptions(), r.watcherOptions()
+	readyOpts.includeNotReady, allOpts.includeNotReady = false, true
+	ready, all := newInspectWatcher(ctx, targets, name, readyOpts), newInspectWatcher(ctx, targets, name, allOpts)
+	for _, t := range targets {
+		cl := r.watches.newClient()
+		ep, err := cl.List(ctx, t)
+		if err != nil {
+			if isNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		for _, w := range []*watcher{ready, all} {
+			w.clients[t.namespace] = cl
+			if err := w.updateNamespace(t.namespace, event{Type: added, Object: *ep}); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	readyAddresses := ready.mergedAddresses(map[string]AddressMetadata{})
+	var resolved []ResolvedAddress
+	for addr, md := range all.mergedAddresses(map[string]AddressMetadata{}) {
+		_, isReady := readyAddresses[addr]
+		resolved = append(resolved, ResolvedAddress{Addr: addr, Metadata: md, Ready: isReady})
+	}
+	sort.Slice(resolved, func(i, j int) bool { return resolved[i].Addr < resolved[j].Addr })
+	return resolved, nil
+}
+
+// newInspectWatcher returns watcher which is not subscribed to any watch. It is used only to translate listed endpoints.
+func newInspectWatcher(ctx context.Context, targets []targetEntry, name string, opts options) *watcher {
+	return &watcher{
+		ctx:                     ctx,
+		targets:                 targets,
+		name:                    name,
+		opts:                    opts,
+		clients:                 make(map[string]endpointClient),
+		lastEvents:              make(map[string]event),
+		namespaceAddresses:      make(map[string]map[string]AddressMetadata),
+		spareNamespaceAddresses: make(map[string]map[string]AddressMetadata),
+	}
+}
@@ -0,0 +1,40 @@
+package k8sresolver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolver_ResolveOnce(t *testing.T) {
+	api := NewFakeAPI()
+	api.SetEndpoints("namespace1", "service1", FakeSubset{
+		Addresses:         []string{"1.2.3.5", "1.2.3.4"},
+		NotReadyAddresses: []string{"1.2.3.6"},
+		Ports:             []FakePort{{Name: "metrics", Port: 9100}, {Name: "grpc", Port: 8080}},
+	})
+	api.SetEndpoints("namespace2", "service1", FakeSubset{
+		Addresses: []string{"1.2.3.7"},
+		Ports:     []FakePort{{Name: "grpc", Port: 8081}},
+	})
+
+	// Port is selected the same way as by the watcher.
+	r := api.newResolver(context.Background(), newOptions(nil))
+	resolved, err := r.resolveOnce(context.Background(), "service1.namespace1,namespace2,namespace3")
+	require.NoError(t, err)
+	require.Equal(t, []ResolvedAddress{
+		{Addr: "1.2.3.4:8080", Metadata: AddressMetadata{IP: "1.2.3.4", Namespace: "namespace1", PortName: "grpc"}, Ready: true},
+		{Addr: "1.2.3.5:8080", Metadata: AddressMetadata{IP: "1.2.3.5", Namespace: "namespace1", PortName: "grpc"}, Ready: true},
+		{Addr: "1.2.3.6:8080", Metadata: AddressMetadata{IP: "1.2.3.6", Namespace: "namespace1", PortName: "grpc"}},
+		{Addr: "1.2.3.7:8081", Metadata: AddressMetadata{IP: "1.2.3.7", Namespace: "namespace2", PortName: "grpc"}, Ready: true},
+	}, resolved)
+
+	resolved, err = r.resolveOnce(context.Background(), "service1.namespace1:metrics")
+	require.NoError(t, err)
+	require.Len(t, resolved, 3)
+	require.Equal(t, "1.2.3.4:9100", resolved[0].Addr)
+
+	_, err = r.resolveOnce(context.Background(), "service1.namespace1:not_valid")
+	require.Error(t, err)
+}
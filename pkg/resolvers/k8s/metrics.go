@@ -0,0 +1,132 @@
+package k8sresolver
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/naming"
+)
+
+type metrics struct {
+	watchReconnects  *prometheus.CounterVec
+	updates          *prometheus.CounterVec
+	currentEndpoints *prometheus.GaugeVec
+	invalidAddresses *prometheus.CounterVec
+	circuitState     *prometheus.GaugeVec
+
+	// targets counts watchers and watches using the target label, so its series are deleted with the last one.
+	mu      sync.Mutex
+	targets map[string]int
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		watchReconnects: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "kedge_k8sresolver_watch_reconnects_total",
+				Help: "Total number of attempts to restart the endpoints watch stream.",
+			},
+			[]string{"target"},
+		),
+		updates: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "kedge_k8sresolver_updates_total",
+				Help: "Total number of address updates returned by the resolver.",
+			},
+			[]string{"op"},
+		),
+		currentEndpoints: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "kedge_k8sresolver_current_endpoints",
+				Help: "Number of addresses currently resolved for the target.",
+			},
+			[]string{"target"},
+		),
+		invalidAddresses: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "kedge_k8sresolver_invalid_addresses_total",
+				Help: "Total number of addresses skipped, because their IP could not be parsed.",
+			},
+			[]string{"target"},
+		),
+		circuitState: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "kedge_k8sresolver_circuit_state",
+				Help: "State of the watch circuit breaker of the target: 0 closed, 1 half-open, 2 open.",
+			},
+			[]string{"target"},
+		),
+		targets: make(map[string]int),
+	}
+}
+
+var (
+	registeredMu sync.Mutex
+	registered   = make(map[prometheus.Registerer]*metrics)
+)
+
+// metricsFor returns metrics registered in reg. They are registered on the first use of the registerer, so importing
+// the package registers nothing. Collectors registered in reg already (e.g. by another copy of the package) are reused.
+// It panics if metrics cannot be registered.
+func metricsFor(reg prometheus.Registerer) *metrics {
+	registeredMu.Lock()
+	defer registeredMu.Unlock()
+
+	if m, ok := registered[reg]; ok {
+		return m
+	}
+	m := newMetrics()
+	m.watchReconnects = register(reg, m.watchReconnects).(*prometheus.CounterVec)
+	m.updates = register(reg, m.updates).(*prometheus.CounterVec)
+	m.currentEndpoints = register(reg, m.currentEndpoints).(*prometheus.GaugeVec)
+	m.invalidAddresses = register(reg, m.invalidAddresses).(*prometheus.CounterVec)
+	m.circuitState = register(reg, m.circuitState).(*prometheus.GaugeVec)
+	registered[reg] = m
+	return m
+}
+
+// register registers collector in reg or returns the one registered already.
+func register(reg prometheus.Registerer, c prometheus.Collector) prometheus.Collector {
+	err := reg.Register(c)
+	if err == nil {
+		return c
+	}
+	if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+		return are.ExistingCollector
+	}
+	panic(err)
+}
+
+// acquireTarget marks the target label as used.
+func (m *metrics) acquireTarget(target string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.targets[target]++
+}
+
+// releaseTarget deletes series of the target label, once it is not used anymore.
+func (m *metrics) releaseTarget(target string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.targets[target]--
+	if m.targets[target] > 0 {
+		return
+	}
+	delete(m.targets, target)
+	m.watchReconnects.DeleteLabelValues(target)
+	m.currentEndpoints.DeleteLabelValues(target)
+	m.invalidAddresses.DeleteLabelValues(target)
+	m.circuitState.DeleteLabelValues(target)
+}
+
+func (m *metrics) observeUpdates(target string, updates []*naming.Update, endpoints int) {
+	for _, u := range updates {
+		op := "add"
+		if u.Op == naming.Delete {
+			op = "delete"
+		}
+		m.updates.WithLabelValues(op).Inc()
+	}
+	m.currentEndpoints.WithLabelValues(target).Set(float64(endpoints))
+}
@@ -0,0 +1,128 @@
+package k8sresolver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+// gatheredValue returns value of the metric with given label value.
+func gatheredValue(t *testing.T, reg *prometheus.Registry, name string, labelValue string) float64 {
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			if m.GetLabel()[0].GetValue() != labelValue {
+				continue
+			}
+			if m.GetCounter() != nil {
+				return m.GetCounter().GetValue()
+			}
+			return m.GetGauge().GetValue()
+		}
+	}
+	t.Fatalf("metric %s{%s} not found", name, labelValue)
+	return 0
+}
+
+func TestWatcher_Metrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	listResult := newTestEndpoints("10", 8080, "1.2.3.4", "1.2.3.5")
+	bytesCh := make(chan []byte)
+	epClientMock := &endpointClientMock{
+		t: t,
+		expectedTarget: targetEntry{
+			service:   "service1",
+			port:      noTargetPort,
+			namespace: "namespace1",
+		},
+		bytesCh:    bytesCh,
+		errCh:      make(chan error),
+		startErrCh: make(chan error, 1),
+		streamsCh:  make(chan startedStream, 10),
+		listResult: &listResult,
+	}
+
+	w, err := startNewWatcher(context.Background(), epClientMock.expectedTarget, epClientMock, newOptions([]Option{WithRegisterer(reg)}))
+	require.NoError(t, err)
+	defer w.Close()
+
+	_, err = w.Next()
+	require.NoError(t, err)
+	require.Equal(t, float64(2), gatheredValue(t, reg, "kedge_k8sresolver_updates_total", "add"))
+	require.Equal(t, float64(2), gatheredValue(t, reg, "kedge_k8sresolver_current_endpoints", "service1.namespace1"))
+
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: newTestEndpoints("11", 8080, "1.2.3.6")})
+	_, err = w.Next()
+	require.NoError(t, err)
+	require.Equal(t, float64(3), gatheredValue(t, reg, "kedge_k8sresolver_updates_total", "add"))
+	require.Equal(t, float64(2), gatheredValue(t, reg, "kedge_k8sresolver_updates_total", "delete"))
+	require.Equal(t, float64(1), gatheredValue(t, reg, "kedge_k8sresolver_current_endpoints", "service1.namespace1"))
+
+	// Series of the target are deleted once its last watcher is closed.
+	w.Close()
+	require.False(t, gathered(t, reg, "kedge_k8sresolver_current_endpoints", "service1.namespace1"))
+}
+
+// gathered returns true if there is a series of the metric with given label value.
+func gathered(t *testing.T, reg *prometheus.Registry, name string, labelValue string) bool {
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			if m.GetLabel()[0].GetValue() == labelValue {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestWithRegisterer_RegistersOncePerRegisterer(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	// Collector registered already is reused.
+	existing := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kedge_k8sresolver_updates_total",
+		Help: "Total number of address updates returned by the resolver.",
+	}, []string{"op"})
+	reg.MustRegister(existing)
+
+	opt := WithRegisterer(reg)
+	o1 := newOptions([]Option{opt})
+	o2 := newOptions([]Option{opt, WithRegisterer(reg)})
+	require.True(t, o1.metrics == o2.metrics, "resolvers of the same registerer should share metrics")
+	require.True(t, o1.metrics.updates == existing)
+}
+
+func TestSubsetToAddresses_InvalidIPs(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	sub := subset{
+		Ports: []port{{Name: "grpc", Port: 8080}},
+		Addresses: []address{
+			{IP: "1.2.3.4"},
+			{IP: ""},
+			{IP: "1.2.3"},
+			{IP: "not-an-ip"},
+			{IP: "2001:0db8:0000:0000:0000:0000:0000:0001"},
+			{IP: "2001:DB8::2"},
+		},
+	}
+	target := targetEntry{service: "service1", namespace: "namespace1", port: noTargetPort}
+
+	addrs, err := subsetToAddresses(target, sub, newOptions([]Option{WithRegisterer(reg)}), nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]AddressMetadata{
+		"1.2.3.4:8080":       {IP: "1.2.3.4", PortName: "grpc"},
+		"[2001:db8::1]:8080": {IP: "2001:db8::1", PortName: "grpc"},
+		"[2001:db8::2]:8080": {IP: "2001:db8::2", PortName: "grpc"},
+	}, addrs)
+	require.Equal(t, float64(3), gatheredValue(t, reg, "kedge_k8sresolver_invalid_addresses_total", "service1.namespace1"))
+}
@@ -0,0 +1,772 @@
+package k8sresolver
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/improbable-eng/kedge/pkg/k8s"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/naming"
+)
+
+// Option configures the resolver.
+type Option func(*options)
+
+type options struct {
+	endpointAPI     EndpointAPI
+	includeNotReady bool
+	watchBackoff    WatchBackoff
+	// circuitBreaker throttles restarts of the watch, if not nil.
+	circuitBreaker *CircuitBreaker
+	preferSameZone bool
+	metrics        *metrics
+	// registerer is where metrics are registered, once the options are built.
+	registerer      prometheus.Registerer
+	logger          logrus.FieldLogger
+	addressSelector string
+	ipFamily        IPFamily
+	watchTimeout    time.Duration
+	httpClient      *http.Client
+	// clientCert is presented on connections to kube-apiserver, if not nil.
+	clientCert func(*tls.CertificateRequestInfo) (*tls.Certificate, error)
+	// requestMutator is called on every kube-apiserver request before it is sent, if not nil.
+	requestMutator func(*http.Request)
+	// weightAnnotation is a pod annotation with the address weight. Weights are not resolved if empty.
+	weightAnnotation string
+	watchBufferSize  int
+	tracer           Tracer
+	coalesceEvents   bool
+	deleteGrace      time.Duration
+	// minEndpoints is a number of addresses below which deletes are held back for minEndpointsGrace. Disabled if zero.
+	minEndpoints      int
+	minEndpointsGrace time.Duration
+	listPageSize      int
+	maxEventSize      int64
+	// ports are resolved for targets without port, if not empty.
+	ports       []targetPort
+	onEmpty     func(target string)
+	onRecovered func(target string)
+	onConnState func(target string, state ConnState)
+	// addressMapper translates addresses pushed by resolver.Builder.
+	addressMapper AddressMapper
+	// tlsMapper sets AddressMetadata.TLS from the application protocol of the port.
+	tlsMapper TLSMapper
+	// serverNameTemplate renders resolver.Address.ServerName of addresses pushed by resolver.Builder. Not set if empty.
+	serverNameTemplate string
+	// dnsFallback resolves addresses from DNS when the watch keeps failing. Disabled if nil.
+	dnsFallback DNSResolver
+	// clusterDomain is the DNS domain of the cluster where DNS fallback looks up services.
+	clusterDomain string
+	// rateLimitQPS and rateLimitBurst configure the limiter of kube-apiserver requests. Not limited if QPS is zero.
+	rateLimitQPS   float64
+	rateLimitBurst int
+	// mapServicePorts enables translation of service ports of targets to endpoints ports.
+	mapServicePorts bool
+	// watchServicePorts makes watchers translate service ports again when the service changes.
+	watchServicePorts bool
+	// includeTerminating resolves terminating addresses that are still serving. Only EndpointSliceAPI and SelectorAPI
+	// report them.
+	includeTerminating bool
+	// resolutionCachePath is a file where the last endpoints are persisted. Disabled if empty.
+	resolutionCachePath   string
+	resolutionCacheMaxAge time.Duration
+	// resyncPeriod is an interval of lists reconciling watched state. Disabled if zero.
+	resyncPeriod time.Duration
+	// snapshotUpdates marks the initial state and the state after resync as snapshot.
+	snapshotUpdates bool
+	// gzip requests gzip-compressed responses from kube-apiserver.
+	gzip bool
+	// userAgent replaces DefaultUserAgent, if not empty. requestID generates IDs of requests, if not nil.
+	userAgent string
+	requestID func() string
+	// apiServers are addresses of kube-apiserver replicas used instead of the address of the API client, if not empty.
+	apiServers []string
+	// autoCloseOnError makes watcher fail on any watch error, not only irrecoverable ones.
+	autoCloseOnError bool
+	// defaultNamespace is used for targets without namespace.
+	defaultNamespace string
+	// zone is a zone of the current pod. Detected when resolving, if not specified.
+	zone string
+	// node is a node of the current pod, if same node is preferred. Read from NodeNameEnvVar, if not specified.
+	preferSameNode bool
+	node           string
+	// clock is a source of time of watchers. realClock unless injected by tests.
+	clock clock
+	// pollInterval is an interval of listing endpoints when watch is forbidden. Forbidden watch is fatal if zero.
+	pollInterval time.Duration
+	// initialResolveTimeout bounds the initial list of endpoints, handled according to initialResolveTimeoutPolicy.
+	// Not bounded if zero.
+	initialResolveTimeout       time.Duration
+	initialResolveTimeoutPolicy InitialResolveTimeoutPolicy
+	// clusters are resolved instead of the cluster of the API client, if not empty.
+	clusters []ClusterConfig
+	// updateInterceptor transforms updates returned by Next(), if not nil.
+	updateInterceptor func(updates []*naming.Update) []*naming.Update
+	// waitForService keeps watchers of targets whose service does not exist yet alive until it is created.
+	waitForService bool
+	// portMapMetadata attaches all ports of the subset to AddressMetadata.
+	portMapMetadata bool
+	// maxEndpoints caps addresses of every port resolved by watchers. Not capped if zero.
+	maxEndpoints int
+	// strictMode fails on ambiguous targets instead of guessing.
+	strictMode bool
+	// appProtocol selects the port of targets without port by its appProtocol, if not empty. Ambiguous ports are handled
+	// according to ambiguousAppProtocolPolicy.
+	appProtocol                string
+	ambiguousAppProtocolPolicy AmbiguousAppProtocolPolicy
+	// endpointsSelector makes the resolver merge all endpoints objects matching it instead of watching the target one.
+	endpointsSelector string
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		endpointAPI:           EndpointsAPI,
+		clock:                 realClock{},
+		watchBackoff:          DefaultWatchBackoff,
+		registerer:            prometheus.DefaultRegisterer,
+		logger:                noopLogger(),
+		defaultNamespace:      "default",
+		coalesceEvents:        true,
+		tracer:                noopTracer{},
+		maxEventSize:          DefaultMaxEventSize,
+		autoCloseOnError:      true,
+		includeTerminating:    true,
+		resolutionCacheMaxAge: DefaultResolutionCacheMaxAge,
+		addressMapper:         DefaultAddressMapper,
+		tlsMapper:             DefaultTLSMapper,
+		clusterDomain:         defaultClusterDomain,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	o.metrics = metricsFor(o.registerer)
+	return o
+}
+
+// EndpointAPI specifies which Kubernetes API is used to get service endpoints.
+type EndpointAPI int
+
+const (
+	// EndpointsAPI uses core/v1 Endpoints objects. Note that single Endpoints object is truncated by Kubernetes
+	// for services with more than 1000 addresses.
+	EndpointsAPI EndpointAPI = iota
+	// EndpointSliceAPI uses discovery.k8s.io/v1 EndpointSlice objects. All slices of the service are merged into
+	// single state.
+	EndpointSliceAPI
+	// SelectorAPI resolves pods matching the selector of the service, without relying on the Endpoints controller.
+	// Service ports are mapped to the container ports of every pod. It requires RBAC permission to get services and to
+	// list and watch pods instead of endpoints.
+	SelectorAPI
+	// AutoEndpointAPI uses EndpointSliceAPI if kube-apiserver serves discovery.k8s.io/v1 EndpointSlices and EndpointsAPI
+	// otherwise, e.g. on older clusters. API is detected once per resolver on the first request. EndpointsAPI is used as
+	// well if listing or watching EndpointSlices is forbidden (403), e.g. by RBAC granting only endpoints.
+	AutoEndpointAPI
+	// ClusterIPAPI (VIP mode) resolves the ClusterIP of the core/v1 Service instead of its pods, so kube-proxy balances
+	// connections, e.g. to keep session affinity configured on the service. Ports of targets are service ports, not
+	// container ports. Headless services and targets with pod cannot be resolved. It requires RBAC permission to get and
+	// watch services instead of endpoints.
+	ClusterIPAPI
+)
+
+// WithEndpointAPI specifies which Kubernetes API should be used to get service endpoints. EndpointsAPI by default.
+func WithEndpointAPI(api EndpointAPI) Option {
+	return func(o *options) {
+		o.endpointAPI = api
+	}
+}
+
+// WithTerminatingAddresses specifies if addresses of terminating pods that are still serving should be resolved
+// (default). They are marked by AddressMetadata.Terminating, so balancer can stop picking them for new requests while
+// in-flight ones finish. If disabled, terminating addresses are excluded entirely, even with WithNotReadyAddresses.
+// Terminating condition is reported only by EndpointSliceAPI and SelectorAPI.
+func WithTerminatingAddresses(include bool) Option {
+	return func(o *options) {
+		o.includeTerminating = include
+	}
+}
+
+// WithNotReadyAddresses specifies if addresses of pods that are not ready should be resolved as well. Kubernetes marks
+// addresses as not ready when pod fails readiness probe or is terminating, so they are excluded by default.
+func WithNotReadyAddresses(include bool) Option {
+	return func(o *options) {
+		o.includeNotReady = include
+	}
+}
+
+// WithWatchBackoff specifies backoff used between attempts to restart the watch. DefaultWatchBackoff by default. Max
+// also caps the wait requested by Retry-After header of failed restarts.
+func WithWatchBackoff(b WatchBackoff) Option {
+	return func(o *options) {
+		o.watchBackoff = b
+	}
+}
+
+// WithCircuitBreaker makes watch restarted more than MaxReconnects times within Window stop restarting for Cooldown,
+// e.g. so permanently broken kube-apiserver is not hammered and logs are not spammed. Open circuit is reported as
+// ConnStateCircuitOpen to WithOnConnState and by kedge_k8sresolver_circuit_state metric. Watcher does not fail meanwhile.
+// Disabled by default.
+func WithCircuitBreaker(cb CircuitBreaker) Option {
+	return func(o *options) {
+		o.circuitBreaker = &cb
+	}
+}
+
+// WithPreferSameZone makes the resolver return only addresses from the given zone (or hinted for it by topology hints),
+// if there are any. If zone is empty, it is detected from ZoneEnvVar or NodeNameEnvVar env variables.
+// NOTE: Only EndpointSliceAPI has zone information.
+func WithPreferSameZone(zone string) Option {
+	return func(o *options) {
+		o.preferSameZone = true
+		o.zone = zone
+	}
+}
+
+// WithPreferSameNode makes the resolver return only addresses on the given node, if there are any, e.g. for services
+// backed by DaemonSet. If node is empty, it is read from NodeNameEnvVar env variable. Node of every address is passed in
+// AddressMetadata.NodeName, so balancer can prefer it as well.
+// NOTE: Endpoints and EndpointSlices have node names only if the Endpoints controller knows them (e.g. not for
+// endpoints managed manually).
+func WithPreferSameNode(node string) Option {
+	return func(o *options) {
+		o.preferSameNode = true
+		o.node = node
+	}
+}
+
+// withClock specifies source of time of watchers, so tests can advance it instead of waiting for the real time.
+func withClock(c clock) Option {
+	return func(o *options) {
+		o.clock = c
+	}
+}
+
+// WithPollInterval makes watchers poll list of endpoints every interval when watch is forbidden (403), e.g. in
+// locked-down clusters where RBAC grants only get and list verbs for endpoints. Polling mode is logged, since changes
+// are seen only with the delay of up to interval. Watch is not tried again by the running watch, so permission granted
+// later is picked up after restart. If zero (default), forbidden watch is fatal.
+func WithPollInterval(interval time.Duration) Option {
+	return func(o *options) {
+		o.pollInterval = interval
+	}
+}
+
+// InitialResolveTimeoutPolicy specifies what happens when the initial resolution does not finish within
+// WithInitialResolveTimeout.
+type InitialResolveTimeoutPolicy int
+
+const (
+	// FailOnInitialResolveTimeout fails the resolution with irrecoverable error.
+	FailOnInitialResolveTimeout InitialResolveTimeoutPolicy = iota
+	// EmptyOnInitialResolveTimeout starts the watcher with no addresses and keeps listing endpoints with backoff in the
+	// background, so the caller is not blocked by hung kube-apiserver. Listed endpoints are returned by Next() as any
+	// other change. Ready() of the watcher is closed once the empty state is returned, so servers can start accepting
+	// traffic before the addresses are known.
+	EmptyOnInitialResolveTimeout
+)
+
+// WithInitialResolveTimeout bounds the initial list of endpoints done by Resolve (and Build of resolver.Builder) before
+// the watch starts, so hung kube-apiserver does not block it indefinitely. What happens after timeout is specified by
+// policy. Every retried list is bounded by timeout as well. Not bounded by default.
+func WithInitialResolveTimeout(timeout time.Duration, policy InitialResolveTimeoutPolicy) Option {
+	return func(o *options) {
+		o.initialResolveTimeout = timeout
+		o.initialResolveTimeoutPolicy = policy
+	}
+}
+
+// AmbiguousAppProtocolPolicy specifies what happens when many ports of the subset have appProtocol selected by
+// WithSelectByAppProtocol.
+type AmbiguousAppProtocolPolicy int
+
+const (
+	// FailOnAmbiguousAppProtocol fails the watcher with irrecoverable error.
+	FailOnAmbiguousAppProtocol AmbiguousAppProtocolPolicy = iota
+	// LowestPortOnAmbiguousAppProtocol selects the lowest-numbered port (by name if numbers equal).
+	LowestPortOnAmbiguousAppProtocol
+)
+
+// WithSelectByAppProtocol makes targets without port (e.g. `svc.ns`) resolve the TCP port with given appProtocol (e.g.
+// grpc), no matter its name or number, so targets do not depend on how every service names its ports. Many ports with
+// the appProtocol are handled according to policy. If no port has it, the port is selected as without this option,
+// unless WithStrictMode is enabled, in which case subsets without it are skipped and the watcher fails if there is none
+// with it. Targets with port and ports of WithPorts are not affected.
+func WithSelectByAppProtocol(appProtocol string, policy AmbiguousAppProtocolPolicy) Option {
+	return func(o *options) {
+		o.appProtocol = appProtocol
+		o.ambiguousAppProtocolPolicy = policy
+	}
+}
+
+// WithClusters makes Resolve resolve targets in all the clusters (e.g. active-active deployment across clusters) instead of
+// the cluster of the API client given to the resolver. Every cluster is watched separately with the same options and
+// addresses of all clusters are merged, with cluster name in AddressMetadata.Cluster. If watch of a cluster fails (e.g.
+// the cluster is down), only addresses of that cluster are deleted and it is resolved again with backoff. Resolve fails
+// only if all clusters fail. Once a cluster resolves the target, Resolve waits for the others at most the initial
+// resolve timeout (5s if not set), so a hung cluster joins later instead of blocking it. WithAPIServers is ignored, since
+// replicas belong to single cluster, and resolution cache is kept in a file per cluster, suffixed by its name.
+// NOTE: Only watcher returned by Resolve supports clusters. It implements only naming.Watcher. resolver.Builder and
+// Runner fail.
+func WithClusters(clusters []ClusterConfig) Option {
+	return func(o *options) {
+		o.clusters = clusters
+	}
+}
+
+// WithUpdateInterceptor specifies a function transforming updates computed by Next() right before they are returned,
+// e.g. to add static fallback address, drop denied addresses or reorder them. Addresses of the watcher (e.g. Current()
+// and the state pushed by resolver.Builder) are then what the interceptor returned, and the next updates are computed
+// against them: denied address is added again by every update it is part of and added address is deleted by the next
+// update, so interceptor should drop it again to keep it. Interceptor is called on every Next() call (even without
+// updates) from the goroutine calling it, so it must not block. Updates it returns are not sorted again.
+func WithUpdateInterceptor(interceptor func(updates []*naming.Update) []*naming.Update) Option {
+	return func(o *options) {
+		o.updateInterceptor = interceptor
+	}
+}
+
+// WithWaitForService specifies if target whose service does not exist yet (e.g. client is deployed before its
+// dependency) should be resolved to no addresses until the service is created, instead of failing Resolve. Watch is
+// retried with backoff meanwhile. Missing Endpoints and EndpointSlices are always waited for, so it matters only for
+// APIs that read the service to start the watch, e.g. SelectorAPI. Auth errors (e.g. 403) are irrecoverable either way.
+// Disabled by default.
+func WithWaitForService(wait bool) Option {
+	return func(o *options) {
+		o.waitForService = wait
+	}
+}
+
+// WithPortMapMetadata specifies if all TCP ports of the address should be attached as AddressMetadata.Ports, so clients
+// multiplexing many services over distinct ports of the same pods can resolve them with single watcher and dial the
+// right port per service. Address itself still has the port of the target. Update replaces an address whose ports
+// changed. Disabled by default.
+func WithPortMapMetadata(enabled bool) Option {
+	return func(o *options) {
+		o.portMapMetadata = enabled
+	}
+}
+
+// WithMaxEndpoints caps addresses of every port resolved by watchers at max, for services with so many endpoints that
+// pushing all of them to the balancer is wasteful. If there are more, the same max addresses are sampled by stable hash
+// of the pod IP: sample does not churn when pods outside of it change, and removed address is replaced by single other
+// one. If there are not more than max addresses, all of them are used. It is applied after WithPreferredIPFamily,
+// WithPreferSameZone and WithPreferSameNode.
+// NOTE: All clients sample the same addresses, so the load concentrates on them. Use it only if max is large enough to
+// serve all the clients, or if the service is large enough that it does not matter which pods are used.
+func WithMaxEndpoints(max int) Option {
+	return func(o *options) {
+		o.maxEndpoints = max
+	}
+}
+
+// WithRegisterer specifies registerer for the resolver metrics. Metrics are registered in prometheus.DefaultRegisterer
+// by default. They are registered once per registerer when the first resolver using it is created, so resolvers can share
+// the registerer. It panics if metrics cannot be registered, e.g. because of another collector with the same name.
+func WithRegisterer(reg prometheus.Registerer) Option {
+	return func(o *options) {
+		o.registerer = reg
+	}
+}
+
+// WithLogger specifies logger for the watch lifecycle. Recoverable errors (e.g. watch restarts) are logged on debug
+// level and irrecoverable ones on warn level. Nothing is logged by default.
+func WithLogger(logger logrus.FieldLogger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+func noopLogger() logrus.FieldLogger {
+	l := logrus.New()
+	l.Out = ioutil.Discard
+	return l
+}
+
+// WithAddressSelector specifies label selector (e.g "track!=canary") that pods need to match to have their addresses
+// resolved. Since endpoints do not have pod labels, matching pods are listed when endpoints get a new address or the
+// listed pods are older than 30s.
+// NOTE: Change of pod labels alone does not trigger an update.
+func WithAddressSelector(selector string) Option {
+	return func(o *options) {
+		o.addressSelector = selector
+	}
+}
+
+// WithPreferredIPFamily makes the resolver return only addresses of the given family, if there are any. It is useful for
+// dual-stack clusters, where only one family is routable from the client. AnyIPFamily by default.
+func WithPreferredIPFamily(family IPFamily) Option {
+	return func(o *options) {
+		o.ipFamily = family
+	}
+}
+
+// WithWatchTimeout specifies timeout of a single watch. kube-apiserver is asked to close the watch after the timeout
+// and stream without any event for 1.5x of the timeout is closed by the client. In both cases watch is resumed from
+// the last seen resourceVersion, so hung connections are detected. No timeout by default.
+func WithWatchTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.watchTimeout = timeout
+	}
+}
+
+// WithHTTPClient specifies HTTP client used for all requests to kube-apiserver instead of the one from k8s.APIClient.
+// It is useful to tune timeouts, use custom CA pool or proxy. Note that the client is responsible for authentication.
+// NOTE: k8s.APIClient created by k8s.New or k8s.NewFromFlags has no timeouts at all (including dial and TLS handshake).
+// Client used for watch cannot have http.Client.Timeout set, since it would close every long-lived watch. Use
+// WithWatchTimeout instead.
+func WithHTTPClient(c *http.Client) Option {
+	return func(o *options) {
+		o.httpClient = c
+	}
+}
+
+// WithEndpointsSelector makes the resolver watch all Endpoints objects in the namespace of the target matching the label
+// selector (e.g. "app=shardedthing") and merge their addresses, instead of the Endpoints object of the target service.
+// It is useful for sharded services, where every shard is a separate Service. Shards created or deleted later are
+// added to or removed from the resolved addresses. Service of the target only names the resolved set, so watches are
+// shared by targets of the same name. Resolved addresses carry the name of their shard in AddressMetadata.
+// Endpoints API is always used, since Endpoints objects have the labels of their Service.
+func WithEndpointsSelector(selector string) Option {
+	return func(o *options) {
+		o.endpointsSelector = selector
+	}
+}
+
+// WithRequestMutator specifies function called on every kube-apiserver request (lists and watches) right before it is
+// sent, e.g. to set Impersonate-User and Impersonate-Group headers or tenant headers of multi-tenant control plane.
+// It is called after User-Agent, request ID and token auth of k8s.APIClient created by k8s.New are set, so it can
+// override them. With WithHTTPClient it is called before the transport of the client. It must not block.
+func WithRequestMutator(mutate func(*http.Request)) Option {
+	return func(o *options) {
+		o.requestMutator = mutate
+	}
+}
+
+// WithStrictMode makes the resolver fail on misconfigured targets instead of guessing what they mean. Target without
+// namespace is rejected by Resolve instead of using the default namespace. Target without port fails if endpoints expose
+// more than one TCP port (or none with appProtocol of WithSelectByAppProtocol) and target with port fails if no endpoints
+// subset has it. Both are fatal errors returned by
+// Next of the watcher once the endpoints are known. Ports are checked only for the initial endpoints of every namespace,
+// so later changes of ports (e.g. during rollout) do not fail the watcher. Disabled by default.
+func WithStrictMode(enabled bool) Option {
+	return func(o *options) {
+		o.strictMode = enabled
+	}
+}
+
+// WithClientCert makes the resolver present client certificate and key read from PEM files on LIST and watch
+// connections, for clusters authenticating clients with mTLS. It composes with CA and token auth of k8s.APIClient.
+// Files are read again when they change on disk, so rotated certificates are used by new connections. Watches are not
+// reconnected on rotation. Ignored if WithHTTPClient is used, since the client is responsible for authentication.
+func WithClientCert(certFile string, keyFile string) Option {
+	return func(o *options) {
+		o.clientCert = k8s.ClientCertReloader(certFile, keyFile)
+	}
+}
+
+// WithClientCertificate works as WithClientCert, but with in-memory certificate, which is never reloaded.
+func WithClientCertificate(cert tls.Certificate) Option {
+	return func(o *options) {
+		o.clientCert = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) { return &cert, nil }
+	}
+}
+
+// WithDefaultNamespace specifies namespace used for targets without one. "default" by default. Use
+// k8s.InClusterNamespace() to resolve bare service names in the namespace of the current pod, the same way in-cluster
+// DNS does.
+func WithDefaultNamespace(namespace string) Option {
+	return func(o *options) {
+		o.defaultNamespace = namespace
+	}
+}
+
+// WithPodWeights makes the resolver read weights of addresses from the annotation of their pods and pass them in
+// AddressMetadata.Weight, e.g. to shift traffic to canary pods with weighted balancer. Pods without valid annotation
+// have weight 1. If annotation is empty, DefaultWeightAnnotation is used.
+// NOTE: Pods are listed again only for new addresses or once the listed pods are older than 30s, so changed annotation
+// is picked up with the next endpoints change after that.
+func WithPodWeights(annotation string) Option {
+	return func(o *options) {
+		if annotation == "" {
+			annotation = DefaultWeightAnnotation
+		}
+		o.weightAnnotation = annotation
+	}
+}
+
+// WithWatchBufferSize specifies how many events can wait for every watcher's Next() call. 0 by default.
+func WithWatchBufferSize(size int) Option {
+	return func(o *options) {
+		o.watchBufferSize = size
+	}
+}
+
+// WithCoalesceEvents specifies what happens when watcher's Next() is called slower than events come. If enabled
+// (default), only the latest event is kept for the watcher, since every event holds full endpoints object and
+// intermediate ones would be diffed away anyway. If disabled, every event is passed to every watcher, which blocks the
+// watch shared by all watchers of the service until the slowest one takes the event (beyond buffer size, see
+// WithWatchBufferSize). Blocked watch is not read from kube-apiserver, which can drop it eventually.
+func WithCoalesceEvents(coalesce bool) Option {
+	return func(o *options) {
+		o.coalesceEvents = coalesce
+	}
+}
+
+// WithTracer specifies tracer used to trace kube-apiserver requests and translation of events. No-op by default.
+func WithTracer(t Tracer) Option {
+	return func(o *options) {
+		o.tracer = t
+	}
+}
+
+// WithDeleteGrace specifies how long address deletion is held back by the watcher. Deletion is cancelled if the same
+// address is added back within that time, e.g. when pod IP disappears and reappears during rolling update, so balancer
+// does not reconnect needlessly. 0 (default) means addresses are deleted immediately. Addresses are always deleted
+// immediately when the endpoints object is deleted together with the service, the same as with WithMinEndpoints.
+func WithDeleteGrace(grace time.Duration) Option {
+	return func(o *options) {
+		o.deleteGrace = grace
+	}
+}
+
+// WithMinEndpoints specifies a floor of addresses protecting against flapping readiness. If an event would leave the
+// target with fewer than min addresses while it had at least min of them before, deletes are held back for grace, the
+// same way as with WithDeleteGrace. Deletion is cancelled for addresses that come back within that time, otherwise they
+// are deleted once grace expires. 0 (default) disables the floor.
+func WithMinEndpoints(min int, grace time.Duration) Option {
+	return func(o *options) {
+		o.minEndpoints = min
+		o.minEndpointsGrace = grace
+	}
+}
+
+// WithGzip specifies if responses of kube-apiserver should be gzip-compressed, which cuts bandwidth of watches of large
+// services with frequent changes. Watch stream is still decompressed one event at a time, as kube-apiserver flushes
+// them. Disabled by default.
+func WithGzip(enabled bool) Option {
+	return func(o *options) {
+		o.gzip = enabled
+	}
+}
+
+// WithResyncPeriod specifies how often endpoints are listed to reconcile the watched state with kube-apiserver, as a
+// safety net against missed events. Up to 20% of it is randomly added, so watches do not list at the same time. Only
+// the net difference is returned by watchers, so nothing is returned if the watched state was right. List is shared
+// with ResolveNow and limited the same way. 0 (default) means never.
+func WithResyncPeriod(d time.Duration) Option {
+	return func(o *options) {
+		o.resyncPeriod = d
+	}
+}
+
+// WithSnapshotUpdates specifies if adds of the full state should be marked by AddressMetadata.Snapshot, so balancer can
+// reset its addresses instead of diffing them. The initial state is always full. After resync (e.g. fresh watch after
+// 410 Gone or subscribing again), every resolved address is added as well, even if it did not change. Balancers ignoring
+// metadata see adds of the addresses they already have. Disabled by default.
+func WithSnapshotUpdates(enabled bool) Option {
+	return func(o *options) {
+		o.snapshotUpdates = enabled
+	}
+}
+
+// WithUserAgent specifies User-Agent of kube-apiserver requests, e.g. "kedge-k8sresolver/v1.2.3". Target of the request
+// is appended to it, if known. DefaultUserAgent by default.
+func WithUserAgent(userAgent string) Option {
+	return func(o *options) {
+		o.userAgent = userAgent
+	}
+}
+
+// WithRequestIDs specifies function returning ID sent as RequestIDHeader with every kube-apiserver request, so requests
+// can be correlated with audit logs. It is called concurrently by all watches, so it must be safe for concurrent use.
+// No ID is sent by default.
+func WithRequestIDs(f func() string) Option {
+	return func(o *options) {
+		o.requestID = f
+	}
+}
+
+// WithListPageSize specifies maximum number of EndpointSlices or pods returned by single list request. Slices of large
+// services and pods of large namespaces are then listed page by page and merged. 0 (default) lists all of them at once.
+// It does not affect EndpointsAPI, which lists single Endpoints object.
+func WithListPageSize(size int) Option {
+	return func(o *options) {
+		o.listPageSize = size
+	}
+}
+
+// DefaultMaxEventSize is a default maximum size of single watch event. Single Endpoints and EndpointSlice objects are
+// limited by etcd to 1.5MB, so it leaves plenty of room.
+const DefaultMaxEventSize = 16 << 20
+
+// WithMaxEventSize specifies maximum size in bytes of single event in the watch stream. Bigger event is treated as
+// malformed and the watch is started again. DefaultMaxEventSize by default, 0 means no limit.
+func WithMaxEventSize(size int64) Option {
+	return func(o *options) {
+		o.maxEventSize = size
+	}
+}
+
+// WithOnEmpty specifies function called when the target loses all its addresses, e.g. to alert on it immediately without
+// scraping metrics. It is called from watcher's Next(), so it must not block.
+func WithOnEmpty(f func(target string)) Option {
+	return func(o *options) {
+		o.onEmpty = f
+	}
+}
+
+// WithTLSMapper specifies how AddressMetadata.TLS is decided from the application protocol of the resolved port, e.g. to
+// treat custom protocols as TLS. DefaultTLSMapper by default.
+func WithTLSMapper(m TLSMapper) Option {
+	return func(o *options) {
+		o.tlsMapper = m
+	}
+}
+
+// WithAddressMapper specifies how resolved addresses are translated into resolver.Address by resolver.Builder.
+// DefaultAddressMapper by default. It does not affect naming.Update returned by watchers.
+func WithAddressMapper(m AddressMapper) Option {
+	return func(o *options) {
+		o.addressMapper = m
+	}
+}
+
+// WithServerNameTemplate specifies template of resolver.Address.ServerName set by resolver.Builder on every address, so
+// backends presenting pod specific certificates (e.g. SPIFFE or per-pod SAN) are verified without disabling hostname
+// verification. Placeholders {pod}, {service}, {namespace} and {port} are replaced by the name of the pod backing the
+// address, the name of the service, its namespace and the name of the port, e.g. "{pod}.{service}.{namespace}.svc".
+// Address missing any of the values (e.g. not backed by a pod) has no ServerName, so the authority of grpc.ClientConn
+// is verified. Build fails if the template has any other placeholder. It does not affect naming.Update returned by
+// watchers.
+func WithServerNameTemplate(tmpl string) Option {
+	return func(o *options) {
+		o.serverNameTemplate = tmpl
+	}
+}
+
+// WithOnRecovered specifies function called when the target that lost all its addresses gets any back. It is called
+// from watcher's Next(), so it must not block.
+func WithOnRecovered(f func(target string)) Option {
+	return func(o *options) {
+		o.onRecovered = f
+	}
+}
+
+// WithOnConnState specifies function called when the endpoints watch of the target changes its ConnState, e.g. to drive
+// readiness gate by the health of the watch itself, no matter the addresses. Watch is shared by all watchers of the same
+// service, so target has no port. It is called from the watch go routine, so it must not block.
+func WithOnConnState(f func(target string, state ConnState)) Option {
+	return func(o *options) {
+		o.onConnState = f
+	}
+}
+
+// WithPorts specifies ports resolved for targets without port, e.g. both gRPC and gRPC-web port of the service, so they
+// are resolved through single watcher and watch. Every update has AddressMetadata.PortName of the port it belongs to,
+// so updates can be routed as separate address sets. Ports are names or numbers, the same as in the target. Target with
+// port resolves only that port. Resolution fails if any port is empty, invalid or given more than once.
+func WithPorts(ports []string) Option {
+	return func(o *options) {
+		o.ports = nil
+		for _, p := range ports {
+			o.ports = append(o.ports, targetPort{value: p, isNamed: !numericRegexp.MatchString(p)})
+		}
+	}
+}
+
+// WithDNSFallback makes the resolver fall back to Kubernetes DNS SRV records of the gRPC port
+// (_grpc._tcp.<service>.<namespace>.svc.<domain of WithClusterDomain>) when kube-apiserver cannot be reached, e.g.
+// because of missing RBAC permissions or network partition. Fallback starts when the initial list fails or the watch
+// fails to restart a few times in a row. Irrecoverable watch errors do not stop the resolver then. Watch is retried with
+// backoff and once it is started again, addresses are reconciled with the current endpoints. If the initial list times
+// out (see WithInitialResolveTimeout), addresses resolved from DNS once are used until the list succeeds, regardless of
+// the timeout policy.
+// NOTE: DNS records are best-effort. They are refreshed only every 30s, have no readiness or zone information and only
+// the port named "grpc" is resolved. *net.Resolver can be used as DNSResolver.
+func WithDNSFallback(r DNSResolver) Option {
+	return func(o *options) {
+		o.dnsFallback = r
+	}
+}
+
+// WithClusterDomain specifies the DNS domain of the cluster looked up by WithDNSFallback, for clusters not using the
+// default one. "cluster.local" by default.
+func WithClusterDomain(domain string) Option {
+	return func(o *options) {
+		o.clusterDomain = domain
+	}
+}
+
+// WithRateLimiter limits requests to kube-apiserver (lists and watch starts) made by the resolver to qps on average
+// with bursts of up to burst requests, so watch storms (many targets, frequent reconnects) do not exceed the client
+// budget of kube-apiserver. Limit is shared by all watchers of the resolver. Not limited by default.
+// Regardless of the limit, no request is made before the time requested in Retry-After header of 429 response.
+func WithRateLimiter(qps float64, burst int) Option {
+	return func(o *options) {
+		o.rateLimitQPS = qps
+		o.rateLimitBurst = burst
+	}
+}
+
+// WithServicePortMapping specifies if numeric port of the target should be treated as a service port, when the service
+// has such port. It is then translated to the port exposed by endpoints (service targetPort), e.g. "web.ns1:443"
+// resolves to pod addresses with port 8443, if the service maps 443 to 8443. Service is looked up once per Resolve.
+// Targets with port that service does not have are resolved as endpoints ports, as without the mapping. Disabled by
+// default.
+// NOTE: It requires permission to get services (RBAC "get" verb on "services" resource) in addition to endpoints.
+func WithServicePortMapping(enabled bool) Option {
+	return func(o *options) {
+		o.mapServicePorts = enabled
+	}
+}
+
+// WithServicePortWatch specifies if services of targets with port mapped by WithServicePortMapping are watched along
+// with their endpoints, so the target resolves the new port as soon as the service port is renamed or its target port
+// is changed. Resolved addresses are translated again from the last endpoints, deleting addresses of the old port.
+// Without it, the port is mapped only once per Resolve. Disabled by default.
+// NOTE: It requires permission to watch services (RBAC "watch" verb on "services" resource).
+func WithServicePortWatch(enabled bool) Option {
+	return func(o *options) {
+		o.watchServicePorts = enabled
+	}
+}
+
+// WithAutoCloseOnError specifies if watcher's Next() fails and closes the watcher on any error of the watch (default).
+// If disabled, watcher subscribes to the watch again with backoff after recoverable errors (see
+// ResolveError.Recoverable), keeping the last addresses meanwhile. Irrecoverable errors close the watcher either way.
+func WithAutoCloseOnError(autoClose bool) Option {
+	return func(o *options) {
+		o.autoCloseOnError = autoClose
+	}
+}
+
+// WithResolutionCache specifies a file where the last endpoints of every watched service are persisted. If the list
+// of endpoints fails on startup (e.g. kube-apiserver is unreachable during control plane rollout), watch starts with
+// cached endpoints instead of failing, so there is something to connect to. Cached endpoints are provisional: list is
+// retried with backoff and its result fully replaces them. Endpoints older than WithResolutionCacheMaxAge are not used.
+// Changes are written to the file at most every 5s and when watches stop, so busy services do not rewrite it on every
+// event.
+func WithResolutionCache(path string) Option {
+	return func(o *options) {
+		o.resolutionCachePath = path
+	}
+}
+
+// WithResolutionCacheMaxAge specifies how old cached endpoints can be used. DefaultResolutionCacheMaxAge by default.
+func WithResolutionCacheMaxAge(maxAge time.Duration) Option {
+	return func(o *options) {
+		o.resolutionCacheMaxAge = maxAge
+	}
+}
+
+// WithAPIServers specifies addresses of kube-apiserver replicas of HA cluster, e.g. https://10.0.0.1:6443, used instead
+// of the address of k8s.APIClient. If connection to one fails (e.g. it is draining), request fails over to the next one
+// in order, before the watch counts as failed. Replica that responded last is preferred for next requests. All replicas
+// are authenticated in the same way as the configured k8s.APIClient.
+func WithAPIServers(addresses []string) Option {
+	return func(o *options) {
+		o.apiServers = addresses
+	}
+}
@@ -0,0 +1,97 @@
+package k8sresolver
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// pollingClient is an endpointClient that falls back to polling list of endpoints when watch is forbidden, e.g. when
+// RBAC grants only get and list verbs. Once watch is forbidden, it is never tried again by the client, so permission
+// granted later is picked up only by new watches (e.g. after restart).
+type pollingClient struct {
+	endpointClient
+
+	interval time.Duration
+	logger   logrus.FieldLogger
+	clock    clock
+
+	mu        sync.Mutex
+	forbidden bool
+}
+
+func newPollingClient(cl endpointClient, interval time.Duration, logger logrus.FieldLogger, c clock) *pollingClient {
+	return &pollingClient{endpointClient: cl, interval: interval, logger: logger, clock: c}
+}
+
+// StartChangeStream starts watch or, if it is forbidden, stream of endpoints listed every interval. Listed endpoints
+// are sent as modified event if their resourceVersion changed and as bookmark otherwise, so the stream is not idle.
+func (c *pollingClient) StartChangeStream(ctx context.Context, t targetEntry, resourceVersion string) (io.ReadCloser, error) {
+	if !c.isForbidden() {
+		conn, err := c.endpointClient.StartChangeStream(ctx, t, resourceVersion)
+		if !isForbidden(err) {
+			return conn, err
+		}
+		c.setForbidden()
+		c.logger.WithError(err).WithField("target", t.String()).Warnf(
+			"k8sresolver: Watch is forbidden. Degraded to polling list of endpoints every %v", c.interval)
+	}
+
+	// The first list is done before the stream starts, so list that is forbidden as well fails the same way as watch.
+	ep, err := c.List(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(c.poll(ctx, t, resourceVersion, ep, json.NewEncoder(pw)))
+	}()
+	return pr, nil
+}
+
+// poll encodes listed endpoints every interval until list or encoding fails. It returns nil when ctx is done, so the
+// stream is closed in the same way as watch.
+func (c *pollingClient) poll(ctx context.Context, t targetEntry, resourceVersion string, ep *endpoints, encoder *json.Encoder) error {
+	for {
+		ev := event{Type: bookmark, Object: endpoints{Metadata: metadata{ResourceVersion: ep.Metadata.ResourceVersion}}}
+		if ep.Metadata.ResourceVersion != resourceVersion {
+			ev = event{Type: modified, Object: *ep}
+		}
+		resourceVersion = ep.Metadata.ResourceVersion
+		if err := encoder.Encode(ev); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-c.clock.After(c.interval):
+		}
+
+		var err error
+		if ep, err = c.List(ctx, t); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return errors.Wrap(err, "Failed to poll endpoints")
+		}
+	}
+}
+
+func (c *pollingClient) isForbidden() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.forbidden
+}
+
+func (c *pollingClient) setForbidden() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.forbidden = true
+}
@@ -0,0 +1,58 @@
+package k8sresolver
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/naming"
+)
+
+func TestPollingClient_WatchForbidden_PollsList(t *testing.T) {
+	api := NewFakeAPI()
+	api.SetEndpoints("namespace1", "service1", FakeSubset{
+		Addresses: []string{"1.2.3.4"},
+		Ports:     []FakePort{{Name: "grpc", Port: 8080}},
+	})
+	// Watch is denied, but list is permitted. Forbidden watch is never tried again, so single failure is enough.
+	api.FailNextWatch("namespace1", "service1", http.StatusForbidden)
+
+	w, err := api.Resolver(WithWatchBackoff(testWatchBackoff), WithPollInterval(10*time.Millisecond)).Resolve("service1.namespace1:grpc")
+	require.NoError(t, err)
+	defer w.Close()
+
+	u, err := w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{{Op: naming.Add, Addr: "1.2.3.4:8080"}}, u)
+
+	api.SetEndpoints("namespace1", "service1", FakeSubset{
+		Addresses: []string{"1.2.3.5"},
+		Ports:     []FakePort{{Name: "grpc", Port: 8080}},
+	})
+	for {
+		u, err = w.Next()
+		require.NoError(t, err)
+		if len(u) > 0 {
+			break
+		}
+	}
+	requireUpdates(t, []*naming.Update{
+		{Op: naming.Delete, Addr: "1.2.3.4:8080"},
+		{Op: naming.Add, Addr: "1.2.3.5:8080"},
+	}, u)
+	require.Equal(t, 0, api.Watches("namespace1", "service1"), "changes should be polled without watch")
+}
+
+func TestPollingClient_WatchForbidden_FatalWithoutPollInterval(t *testing.T) {
+	api := NewFakeAPI()
+	api.SetEndpoints("namespace1", "service1", FakeSubset{
+		Addresses: []string{"1.2.3.4"},
+		Ports:     []FakePort{{Name: "grpc", Port: 8080}},
+	})
+	api.FailNextWatch("namespace1", "service1", http.StatusForbidden)
+
+	_, err := api.Resolver(WithWatchBackoff(testWatchBackoff)).Resolve("service1.namespace1:grpc")
+	require.Error(t, err)
+	require.True(t, isFatal(err))
+}
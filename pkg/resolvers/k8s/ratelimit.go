@@ -0,0 +1,96 @@
+package k8sresolver
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket limiting requests to kube-apiserver. It is shared by all watchers of the resolver.
+// It also holds back all requests after 429 response for as long as kube-apiserver asked in Retry-After header.
+type rateLimiter struct {
+	// qps is a rate at which tokens are refilled. Requests are not limited if it is zero.
+	qps   float64
+	burst int
+	clock clock
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	// pausedUntil is a time before which no request is made.
+	pausedUntil time.Time
+}
+
+func newRateLimiter(qps float64, burst int, c clock) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{qps: qps, burst: burst, tokens: float64(burst), last: c.Now(), clock: c}
+}
+
+// wait blocks until request can be made or ctx is done. Token is reserved even if ctx is done before.
+func (l *rateLimiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := l.clock.Now()
+	ready := now
+	if l.qps > 0 {
+		l.tokens += now.Sub(l.last).Seconds() * l.qps
+		if l.tokens > float64(l.burst) {
+			l.tokens = float64(l.burst)
+		}
+		l.last = now
+		l.tokens--
+		if l.tokens < 0 {
+			// Request waits for the token it has just reserved.
+			ready = now.Add(time.Duration(-l.tokens / l.qps * float64(time.Second)))
+		}
+	}
+	if l.pausedUntil.After(ready) {
+		ready = l.pausedUntil
+	}
+	l.mu.Unlock()
+
+	delay := ready.Sub(now)
+	if delay <= 0 {
+		return nil
+	}
+	timer := l.clock.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C():
+		return nil
+	}
+}
+
+// pause holds back all requests for the given duration.
+func (l *rateLimiter) pause(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if until := l.clock.Now().Add(d); until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+}
+
+// retryAfter returns delay requested by Retry-After header of the response in seconds or HTTP date format, relative to
+// now. It returns false if there is no valid header.
+func retryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(v); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
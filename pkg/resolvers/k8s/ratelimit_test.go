@@ -0,0 +1,135 @@
+package k8sresolver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/improbable-eng/kedge/pkg/k8s"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient_RateLimiter_PacesRequests(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	c := &client{k8sClient: &k8s.APIClient{Client: srv.Client(), Address: srv.URL}, limiter: newRateLimiter(20, 2, realClock{})}
+	target := targetEntry{service: "service1", namespace: "namespace1"}
+
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		_, err := c.List(context.Background(), target)
+		require.NoError(t, err)
+	}
+	// Burst of 2 requests is immediate, 4 more need to wait for tokens refilled at 20 QPS.
+	require.True(t, time.Since(start) >= 190*time.Millisecond, "requests should be paced, took %v", time.Since(start))
+	require.Equal(t, int32(6), atomic.LoadInt32(&requests))
+
+	// Waiting request gives up with context.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	c.limiter = newRateLimiter(0.1, 1, realClock{})
+	_, err := c.List(ctx, target)
+	require.NoError(t, err)
+	_, err = c.List(ctx, target)
+	require.Error(t, err)
+	require.True(t, isFatal(err))
+	require.Equal(t, int32(7), atomic.LoadInt32(&requests))
+}
+
+func TestClient_RateLimiter_RespectsRetryAfter(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	c := &client{k8sClient: &k8s.APIClient{Client: srv.Client(), Address: srv.URL}, limiter: newRateLimiter(0, 0, realClock{})}
+	target := targetEntry{service: "service1", namespace: "namespace1"}
+
+	_, err := c.List(context.Background(), target)
+	require.Error(t, err)
+	require.False(t, isFatal(err))
+
+	start := time.Now()
+	conn, err := c.StartChangeStream(context.Background(), target, "")
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+	require.True(t, time.Since(start) >= 900*time.Millisecond, "request should wait for Retry-After, took %v", time.Since(start))
+}
+
+func TestRetryAfter(t *testing.T) {
+	for _, tcase := range []struct {
+		header   string
+		expected time.Duration
+		ok       bool
+	}{
+		{header: ""},
+		{header: "soon"},
+		{header: "-1"},
+		{header: "0", ok: true},
+		{header: "5", expected: 5 * time.Second, ok: true},
+	} {
+		resp := &http.Response{Header: http.Header{}}
+		resp.Header.Set("Retry-After", tcase.header)
+		d, ok := retryAfter(resp, time.Now())
+		require.Equal(t, tcase.ok, ok, tcase.header)
+		require.Equal(t, tcase.expected, d, tcase.header)
+	}
+
+	// HTTP date is relative to the given time.
+	now := newFakeClock().Now()
+	resp := &http.Response{Header: http.Header{}}
+	resp.Header.Set("Retry-After", now.Add(10*time.Second).Format(http.TimeFormat))
+	d, ok := retryAfter(resp, now)
+	require.True(t, ok)
+	require.Equal(t, 10*time.Second, d)
+
+	resp.Header.Set("Retry-After", now.Add(-time.Minute).Format(http.TimeFormat))
+	d, ok = retryAfter(resp, now)
+	require.True(t, ok)
+	require.Equal(t, time.Duration(0), d, "date in the past means no delay")
+}
+
+func TestClient_StatusErrorCarriesRetryAfter(t *testing.T) {
+	headers := make(chan string, 2)
+	headers <- "3"
+	headers <- time.Now().Add(10 * time.Second).UTC().Format(http.TimeFormat)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", <-headers)
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	// Delay is known to the caller even if requests are not rate limited.
+	c := &client{k8sClient: &k8s.APIClient{Client: srv.Client(), Address: srv.URL}}
+	target := targetEntry{service: "service1", namespace: "namespace1"}
+
+	_, err := c.StartChangeStream(context.Background(), target, "")
+	require.Error(t, err)
+	d, ok := retryAfterOf(errors.Wrap(err, "Failed to restart watch stream"))
+	require.True(t, ok)
+	require.Equal(t, 3*time.Second, d)
+
+	_, err = c.List(context.Background(), target)
+	require.Error(t, err)
+	d, ok = retryAfterOf(err)
+	require.True(t, ok)
+	require.True(t, d > 8*time.Second && d <= 10*time.Second, "unexpected delay %v", d)
+
+	_, ok = retryAfterOf(&statusError{code: http.StatusServiceUnavailable})
+	require.False(t, ok)
+}
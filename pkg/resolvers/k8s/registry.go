@@ -0,0 +1,602 @@
+package k8sresolver
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// refreshInterval is a minimum interval between lists of the endpoints requested by ResolveNow. Rapid requests are
+// coalesced into single list, so they cannot overload kube-apiserver.
+var refreshInterval = 5 * time.Second
+
+// watchKey identifies shared watch. Targets differing only by port or pod share the watch of their service.
+type watchKey struct {
+	namespace string
+	service   string
+}
+
+func (k watchKey) String() string {
+	return fmt.Sprintf("%s/%s", k.namespace, k.service)
+}
+
+func watchKeyOf(t targetEntry) watchKey {
+	return watchKey{namespace: t.namespace, service: t.service}
+}
+
+// watchRegistry shares a single endpoints watch between all watchers of the same service. Every watcher still keeps
+// its own state, since every event holds full endpoints object. Watch is stopped when the last watcher is closed.
+// See WithCoalesceEvents for what happens when watcher is slower than the watch.
+type watchRegistry struct {
+	ctx       context.Context
+	newClient func() endpointClient
+	opts      options
+	// cache persists the state of watches. Disabled if nil.
+	cache *resolutionCache
+	// watchServicePorts watches ports of the service of the target. Service ports are not watched if nil.
+	watchServicePorts func(ctx context.Context, t targetEntry) <-chan []servicePort
+
+	mu      sync.Mutex
+	watches map[watchKey]*sharedWatch
+}
+
+func newWatchRegistry(ctx context.Context, newClient func() endpointClient, opts options) *watchRegistry {
+	if opts.pollInterval > 0 {
+		newWatchClient := newClient
+		newClient = func() endpointClient {
+			return newPollingClient(newWatchClient(), opts.pollInterval, opts.logger, opts.clock)
+		}
+	}
+	r := &watchRegistry{
+		ctx:       ctx,
+		newClient: newClient,
+		opts:      opts,
+		watches:   make(map[watchKey]*sharedWatch),
+	}
+	if opts.resolutionCachePath != "" {
+		r.cache = newResolutionCache(opts.resolutionCachePath, opts.resolutionCacheMaxAge, opts.logger, opts.clock)
+	}
+	return r
+}
+
+// sharedWatch is a single endpoints watch with many subscribers.
+type sharedWatch struct {
+	key    watchKey
+	client endpointClient
+	cancel context.CancelFunc
+	events chan watchResult
+	// refresh requests list of endpoints out of the watch. refreshed passes the listed endpoints to fanOut.
+	refresh   chan struct{}
+	refreshed chan watchResult
+
+	// started is closed once the watch is started or failed to start with startErr. Other fields are set by then, so
+	// the registry lock is not held while listing endpoints.
+	started  chan struct{}
+	startErr error
+	// refs and running are guarded by watchRegistry.mu. running is true once the watch started successfully.
+	refs    int
+	running bool
+	// reconnects is a number of times the watch connection was lost. It is accessed atomically.
+	reconnects int64
+
+	mu   sync.Mutex
+	last event
+	subs map[*subscription]struct{}
+}
+
+// subscription is a single watcher of the shared watch.
+type subscription struct {
+	ctx context.Context
+	// cancel stops the subscription before ctx is done, e.g. when it is replaced by the new one.
+	cancel context.CancelFunc
+	// client is a client of the shared watch.
+	client endpointClient
+	watch  *sharedWatch
+	// initial is a state of endpoints when subscribed.
+	initial event
+	// reconnectsBase is a number of reconnects of the watch when subscribed.
+	reconnectsBase int64
+	// done is closed when no more events are sent by the subscription.
+	done chan struct{}
+
+	// queue passes events one by one, if events are not coalesced.
+	queue chan watchResult
+
+	// pending is the latest event not consumed by the watcher yet, if events are coalesced. Older events are dropped,
+	// since every event holds full endpoints object. Errors are never dropped.
+	mu      sync.Mutex
+	pending *watchResult
+	notify  chan struct{}
+}
+
+// subscribe returns subscription with current state of the target endpoints. Further events are sent to eventsCh until
+// ctx is done or the subscription is closed. Watch of the service is started by the first subscriber. Subscribers wait
+// for it until their ctx is done, while watches of other services are not blocked.
+func (r *watchRegistry) subscribe(ctx context.Context, target targetEntry, eventsCh chan<- watchResult) (*subscription, error) {
+	key := watchKeyOf(target)
+	r.mu.Lock()
+	sw, ok := r.watches[key]
+	if !ok {
+		sw = &sharedWatch{key: key, started: make(chan struct{}), subs: make(map[*subscription]struct{})}
+		watchCtx, cancel := context.WithCancel(withRequestTarget(r.ctx, sw.target().String()))
+		sw.cancel = cancel
+		r.watches[key] = sw
+		go r.start(watchCtx, sw)
+	}
+	sw.refs++
+	r.mu.Unlock()
+
+	select {
+	case <-sw.started:
+	case <-ctx.Done():
+		// Watch that nobody waits for anymore is stopped, even if it is still starting.
+		r.release(sw, nil)
+		return nil, ctx.Err()
+	}
+	if sw.startErr != nil {
+		return nil, sw.startErr
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	sub := &subscription{
+		ctx:    ctx,
+		cancel: cancel,
+		client: sw.client,
+		watch:  sw,
+		done:   make(chan struct{}),
+		queue:  make(chan watchResult),
+		notify: make(chan struct{}, 1),
+	}
+	sw.mu.Lock()
+	sub.initial = sw.last
+	sub.reconnectsBase = atomic.LoadInt64(&sw.reconnects)
+	sw.subs[sub] = struct{}{}
+	sw.mu.Unlock()
+
+	go func() {
+		defer close(sub.done)
+		defer r.release(sw, sub)
+		for {
+			res, ok := sub.next()
+			if !ok {
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case eventsCh <- res:
+			}
+		}
+	}()
+	return sub, nil
+}
+
+// close stops the subscription and waits until no more events are sent by it.
+func (s *subscription) close() {
+	s.cancel()
+	<-s.done
+}
+
+// reconnects returns a number of times the watch connection was lost since subscribed.
+func (s *subscription) reconnects() int64 {
+	return atomic.LoadInt64(&s.watch.reconnects) - s.reconnectsBase
+}
+
+// next waits for the next event of the subscription. It returns false if subscription is closed.
+func (s *subscription) next() (watchResult, bool) {
+	for {
+		select {
+		case <-s.ctx.Done():
+			return watchResult{}, false
+		case res := <-s.queue:
+			return res, true
+		case <-s.notify:
+		}
+
+		s.mu.Lock()
+		res := s.pending
+		s.pending = nil
+		s.mu.Unlock()
+		if res != nil {
+			return *res, true
+		}
+	}
+}
+
+// target returns the target of the watch. Port does not matter for the watch, since it is shared between all ports of
+// the service.
+func (sw *sharedWatch) target() targetEntry {
+	return targetEntry{service: sw.key.service, namespace: sw.key.namespace, port: noTargetPort}
+}
+
+// start starts the shared watch and closes its started channel. Failed watch is not shared, so the next subscriber
+// starts it again.
+func (r *watchRegistry) start(ctx context.Context, sw *sharedWatch) {
+	err := r.startWatch(ctx, sw)
+
+	r.mu.Lock()
+	if err == nil && sw.refs == 0 {
+		// All subscribers gave up waiting, so the watch is not used by anyone.
+		err = context.Canceled
+	}
+	if err != nil {
+		sw.cancel()
+		if r.watches[sw.key] == sw {
+			delete(r.watches, sw.key)
+		}
+	} else {
+		// Series of the watch are deleted once it stops.
+		sw.running = true
+		r.opts.metrics.acquireTarget(sw.target().String())
+	}
+	r.mu.Unlock()
+
+	sw.startErr = err
+	close(sw.started)
+}
+
+// startWatch lists endpoints of the not started shared watch and starts watching them until ctx is done. ctx is
+// cancelled by the caller if the watch fails to start.
+func (r *watchRegistry) startWatch(ctx context.Context, sw *sharedWatch) error {
+	key := sw.key
+	target := sw.target()
+
+	sw.client = r.newClient()
+	sw.events = make(chan watchResult)
+	// Refresh requested while one is pending is the same request.
+	sw.refresh = make(chan struct{}, 1)
+	sw.refreshed = make(chan watchResult)
+
+	// Watch event can contain only part of the state, so get full state first and watch for changes since then.
+	ep, timedOut, err := r.boundedList(ctx, sw.client, target)
+	if err != nil {
+		if cached, ok := r.cached(key, err); ok {
+			// Start with provisional state, so there are addresses to connect to until the watch starts.
+			r.opts.logger.WithError(err).WithField("target", target.String()).Warn(
+				"k8sresolver: Failed to list endpoints. Using cached ones until the list succeeds")
+			r.startProvisional(ctx, sw, target, *cached)
+			return nil
+		}
+		if timedOut && r.opts.dnsFallback != nil {
+			dnsEp, dnsErr := r.lookupDNS(ctx, target)
+			if dnsErr == nil {
+				r.opts.logger.WithError(err).WithField("target", target.String()).Warn(
+					"k8sresolver: Initial list of endpoints timed out. Using addresses from DNS until the list succeeds")
+				r.startProvisional(ctx, sw, target, *dnsEp)
+				return nil
+			}
+			r.opts.logger.WithError(dnsErr).WithField("target", target.String()).Warn("k8sresolver: DNS fallback failed")
+		}
+		if timedOut && r.opts.initialResolveTimeoutPolicy == EmptyOnInitialResolveTimeout {
+			r.opts.logger.WithError(err).WithField("target", target.String()).Warn(
+				"k8sresolver: Initial list of endpoints timed out. Starting with no addresses until the list succeeds")
+			r.startProvisional(ctx, sw, target, endpoints{})
+			return nil
+		}
+		if timedOut || r.opts.dnsFallback == nil {
+			return err
+		}
+		// Start with empty state. Watch fails to start as well, so addresses are resolved from DNS until it starts.
+		r.opts.logger.WithError(err).WithField("target", target.String()).Warn("k8sresolver: Failed to list endpoints")
+		ep = &endpoints{}
+	}
+	sw.last = event{Type: added, Object: *ep}
+
+	err = startWatchingEndpointsChanges(ctx, target, sw.client, ep.Metadata.ResourceVersion, sw.events, r.watchOptions(sw))
+	if err != nil {
+		return err
+	}
+	go r.fanOut(ctx, sw)
+	go r.refreshLoop(ctx, sw, target)
+	go r.resyncLoop(ctx, sw)
+	return nil
+}
+
+// watchOptions returns options of the watch stream that count reconnects of the shared watch.
+func (r *watchRegistry) watchOptions(sw *sharedWatch) options {
+	o := r.opts
+	onConnState := o.onConnState
+	o.onConnState = func(target string, state ConnState) {
+		if state == ConnStateReconnecting {
+			atomic.AddInt64(&sw.reconnects, 1)
+		}
+		if onConnState != nil {
+			onConnState(target, state)
+		}
+	}
+	return o
+}
+
+// resolveNow requests list of the endpoints of the subscription's watch. It does not block. Listed state is sent to all
+// subscribers of the watch, as any other event.
+func (s *subscription) resolveNow() {
+	select {
+	case s.watch.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// resyncJitter is a fraction of the resync period that is randomly added, so watches do not list at the same time.
+const resyncJitter = 0.2
+
+// resyncLoop requests list of endpoints every resync period, if configured. Listed state is diffed by watchers as any
+// other event, so nothing is returned if the watch did not miss any change.
+func (r *watchRegistry) resyncLoop(ctx context.Context, sw *sharedWatch) {
+	if r.opts.resyncPeriod <= 0 {
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.opts.clock.After(r.opts.resyncPeriod + time.Duration(float64(r.opts.resyncPeriod)*resyncJitter*rand.Float64())):
+		}
+		select {
+		case sw.refresh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// refreshLoop lists endpoints when refresh is requested, at most once per refreshInterval.
+func (r *watchRegistry) refreshLoop(ctx context.Context, sw *sharedWatch, target targetEntry) {
+	var last time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sw.refresh:
+		}
+
+		if wait := last.Add(refreshInterval).Sub(r.opts.clock.Now()); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-r.opts.clock.After(wait):
+			}
+			// Requests made while waiting are served by this list as well.
+			select {
+			case <-sw.refresh:
+			default:
+			}
+		}
+		last = r.opts.clock.Now()
+
+		ep, err := r.list(ctx, sw.client, target)
+		if err != nil {
+			// Watch keeps the state up to date anyway.
+			r.opts.logger.WithError(err).WithField("target", target.String()).Debug("k8sresolver: Failed to refresh endpoints")
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case sw.refreshed <- watchResult{namespace: target.namespace, ep: &event{Type: modified, Object: *ep}}:
+		}
+	}
+}
+
+// cached returns endpoints of the service from the cache, if list failed with recoverable error.
+func (r *watchRegistry) cached(key watchKey, listErr error) (*endpoints, bool) {
+	if r.cache == nil || isFatal(listErr) {
+		return nil, false
+	}
+	ep, ok, err := r.cache.load(key)
+	if err != nil {
+		r.opts.logger.WithError(err).Warn("k8sresolver: Failed to load resolution cache")
+		return nil, false
+	}
+	return ep, ok
+}
+
+// startProvisional starts the shared watch with provisional state. Watch starts once reconcile lists the endpoints.
+func (r *watchRegistry) startProvisional(ctx context.Context, sw *sharedWatch, target targetEntry, provisional endpoints) {
+	sw.last = event{Type: added, Object: provisional}
+	go r.fanOut(ctx, sw)
+	go r.refreshLoop(ctx, sw, target)
+	go r.resyncLoop(ctx, sw)
+	go r.reconcile(ctx, sw, target)
+}
+
+// reconcile lists endpoints with backoff until it succeeds and then starts the watch. Listed state replaces the
+// provisional one the watch started with.
+func (r *watchRegistry) reconcile(ctx context.Context, sw *sharedWatch, target targetEntry) {
+	b := newBackoff(r.opts.watchBackoff, r.opts.clock)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.opts.clock.After(b.Duration()):
+		}
+
+		ep, timedOut, err := r.boundedList(ctx, sw.client, target)
+		if err != nil && (timedOut || !isFatal(err)) {
+			r.opts.logger.WithError(err).WithField("target", target.String()).Debug("k8sresolver: Failed to list endpoints. Retrying")
+			continue
+		}
+		if err == nil {
+			listed := event{Type: modified, Object: *ep}
+			if ep.Metadata.ResourceVersion == "" {
+				// Endpoints do not exist (anymore), so cached addresses are deleted.
+				listed.Type = deleted
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case sw.refreshed <- watchResult{namespace: target.namespace, ep: &listed}:
+			}
+			err = startWatchingEndpointsChanges(ctx, target, sw.client, ep.Metadata.ResourceVersion, sw.events, r.watchOptions(sw))
+		}
+		if err != nil {
+			select {
+			case <-ctx.Done():
+			case sw.events <- watchResult{namespace: target.namespace, err: err}:
+			}
+		}
+		return
+	}
+}
+
+// boundedList lists endpoints within WithInitialResolveTimeout, if set. It returns true if the list timed out, with
+// irrecoverable error.
+func (r *watchRegistry) boundedList(ctx context.Context, client endpointClient, target targetEntry) (*endpoints, bool, error) {
+	if r.opts.initialResolveTimeout <= 0 {
+		ep, err := r.list(ctx, client, target)
+		return ep, false, err
+	}
+
+	listCtx, cancel := context.WithTimeout(ctx, r.opts.initialResolveTimeout)
+	defer cancel()
+	ep, err := r.list(listCtx, client, target)
+	if err != nil && ctx.Err() == nil && listCtx.Err() == context.DeadlineExceeded {
+		return nil, true, errors.Wrapf(context.DeadlineExceeded, "k8sresolver: Initial list of endpoints for target %v "+
+			"did not finish within %v", target, r.opts.initialResolveTimeout)
+	}
+	return ep, false, err
+}
+
+// lookupDNS resolves endpoints of the target from DNS within WithInitialResolveTimeout, same as the list it replaces.
+func (r *watchRegistry) lookupDNS(ctx context.Context, target targetEntry) (*endpoints, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.opts.initialResolveTimeout)
+	defer cancel()
+	return lookupSRVEndpoints(ctx, r.opts.dnsFallback, r.opts.clusterDomain, target)
+}
+
+func (r *watchRegistry) list(ctx context.Context, client endpointClient, target targetEntry) (*endpoints, error) {
+	ctx, span := r.opts.tracer.Start(ctx, "k8sresolver.List")
+	defer span.End()
+	span.SetAttributes(targetAttributes(target)...)
+
+	ep, err := client.List(ctx, target)
+	if err != nil {
+		if !isNotFound(err) {
+			span.RecordError(err)
+			return nil, errors.Wrapf(err, "k8sresolver: Failed to list endpoints for target %v", target)
+		}
+		// Endpoints object does not exist yet. Start with empty state and watch for it to appear.
+		ep = &endpoints{}
+	}
+	span.SetAttributes(Attribute{Key: ResourceVersionAttributeKey, Value: ep.Metadata.ResourceVersion})
+	return ep, nil
+}
+
+// fanOut passes events of the shared watch to all subscribers. If events are not coalesced, it waits for every
+// subscriber to take the event, so slow watcher holds the watch.
+func (r *watchRegistry) fanOut(ctx context.Context, sw *sharedWatch) {
+	for {
+		var res watchResult
+		select {
+		case <-ctx.Done():
+			return
+		case res = <-sw.refreshed:
+		case res = <-sw.events:
+		}
+		// Watch events and refreshes race, so the older one is stale if it comes after the other.
+		if res.err == nil && isOlderVersion(res.ep.Object.Metadata.ResourceVersion, sw.last.Object.Metadata.ResourceVersion) {
+			continue
+		}
+
+		sw.mu.Lock()
+		if res.err == nil {
+			sw.last = *res.ep
+		}
+		if res.err == nil && r.cache != nil {
+			r.cache.store(sw.key, *res.ep)
+		}
+		subs := make([]*subscription, 0, len(sw.subs))
+		for sub := range sw.subs {
+			subs = append(subs, sub)
+		}
+		sw.mu.Unlock()
+
+		for _, sub := range subs {
+			if r.opts.coalesceEvents {
+				sub.push(res)
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-sub.ctx.Done():
+			case sub.queue <- res:
+			}
+		}
+
+		if res.err != nil {
+			// Watch is stopped after error, so new watchers need to start new one.
+			r.mu.Lock()
+			if r.watches[sw.key] == sw {
+				delete(r.watches, sw.key)
+			}
+			r.mu.Unlock()
+			return
+		}
+	}
+}
+
+// isOlderVersion returns true if resourceVersion v is older than other. Resource versions are meant to be opaque, but
+// they are etcd revisions in practice. False is returned if any of them is not a number.
+func isOlderVersion(v string, other string) bool {
+	a, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return false
+	}
+	b, err := strconv.ParseUint(other, 10, 64)
+	if err != nil {
+		return false
+	}
+	return a < b
+}
+
+// push replaces pending event of the subscription.
+func (s *subscription) push(res watchResult) {
+	s.mu.Lock()
+	if s.pending == nil || s.pending.err == nil {
+		s.pending = &res
+	}
+	s.mu.Unlock()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// release drops the reference of the subscription to the shared watch, stopping the watch with the last one. Subscription
+// is nil if the subscriber gave up before the watch started.
+func (r *watchRegistry) release(sw *sharedWatch, sub *subscription) {
+	if sub != nil {
+		sw.mu.Lock()
+		delete(sw.subs, sub)
+		sw.mu.Unlock()
+	}
+
+	r.mu.Lock()
+	sw.refs--
+	if sw.refs > 0 {
+		r.mu.Unlock()
+		return
+	}
+	if r.watches[sw.key] == sw {
+		delete(r.watches, sw.key)
+	}
+	sw.cancel()
+	if sw.running {
+		r.opts.metrics.releaseTarget(sw.target().String())
+	}
+	r.mu.Unlock()
+
+	if r.cache != nil {
+		// The last state of the stopped watch is written without waiting for the cache write interval.
+		if err := r.cache.flush(); err != nil {
+			r.opts.logger.WithError(err).WithField("target", sw.key.String()).Warn("k8sresolver: Failed to update resolution cache")
+		}
+	}
+}
@@ -0,0 +1,507 @@
+package k8sresolver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/naming"
+)
+
+func TestWatchRegistry_SharesWatch(t *testing.T) {
+	bytesCh := make(chan []byte)
+	listResult := newTestEndpoints("10", 8080, "1.2.3.4")
+	epClientMock := &endpointClientMock{
+		t: t,
+		expectedTarget: targetEntry{
+			service:   "service1",
+			port:      noTargetPort,
+			namespace: "namespace1",
+		},
+		bytesCh:    bytesCh,
+		errCh:      make(chan error),
+		startErrCh: make(chan error, 1),
+		streamsCh:  make(chan startedStream, 10),
+		listResult: &listResult,
+	}
+	clients := 0
+	registry := newWatchRegistry(context.Background(), func() endpointClient {
+		clients++
+		return epClientMock
+	}, newOptions(nil))
+
+	w1, err := startNewMultiWatcher(context.Background(), []targetEntry{epClientMock.expectedTarget}, registry, newOptions(nil))
+	require.NoError(t, err)
+	defer w1.Close()
+	// Different port of the same service uses the same watch.
+	target2 := targetEntry{service: "service1", namespace: "namespace1", port: targetPort{isNamed: true, value: "grpc"}}
+	w2, err := startNewMultiWatcher(context.Background(), []targetEntry{target2}, registry, newOptions(nil))
+	require.NoError(t, err)
+	defer w2.Close()
+
+	stream := <-epClientMock.streamsCh
+	require.Equal(t, 1, clients)
+	require.Len(t, epClientMock.streamsCh, 0, "only one stream should be started")
+
+	for _, w := range []*watcher{w1, w2} {
+		u, err := w.Next()
+		require.NoError(t, err)
+		requireUpdates(t, []*naming.Update{{Op: naming.Add, Addr: "1.2.3.4:8080"}}, u)
+	}
+
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: newTestEndpoints("11", 8080, "1.2.3.5")})
+	for _, w := range []*watcher{w1, w2} {
+		u, err := w.Next()
+		require.NoError(t, err)
+		requireUpdates(t, []*naming.Update{
+			{Op: naming.Add, Addr: "1.2.3.5:8080"},
+			{Op: naming.Delete, Addr: "1.2.3.4:8080"},
+		}, u)
+	}
+
+	// Watch is kept as long as there is any watcher.
+	w1.Close()
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: newTestEndpoints("12", 8080, "1.2.3.6")})
+	u, err := w2.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{
+		{Op: naming.Add, Addr: "1.2.3.6:8080"},
+		{Op: naming.Delete, Addr: "1.2.3.5:8080"},
+	}, u)
+
+	// New watcher gets the current state of the shared watch.
+	w3, err := startNewMultiWatcher(context.Background(), []targetEntry{epClientMock.expectedTarget}, registry, newOptions(nil))
+	require.NoError(t, err)
+	defer w3.Close()
+	u, err = w3.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{{Op: naming.Add, Addr: "1.2.3.6:8080"}}, u)
+	require.Equal(t, 1, clients)
+
+	w2.Close()
+	w3.Close()
+	requireClosedEventually(t, stream.connMock)
+
+	// Watch is started again for the next watcher.
+	w4, err := startNewMultiWatcher(context.Background(), []targetEntry{epClientMock.expectedTarget}, registry, newOptions(nil))
+	require.NoError(t, err)
+	defer w4.Close()
+	select {
+	case <-epClientMock.streamsCh:
+	case <-time.After(time.Second):
+		t.Fatal("new stream was expected to be started")
+	}
+	require.Equal(t, 2, clients)
+}
+
+func startSharedTestWatchers(t *testing.T, opts options) (chan []byte, *watcher, *watcher) {
+	bytesCh := make(chan []byte)
+	listResult := newTestEndpoints("10", 8080, "1.2.3.1")
+	epClientMock := &endpointClientMock{
+		t: t,
+		expectedTarget: targetEntry{
+			service:   "service1",
+			port:      noTargetPort,
+			namespace: "namespace1",
+		},
+		bytesCh:    bytesCh,
+		errCh:      make(chan error),
+		startErrCh: make(chan error, 1),
+		streamsCh:  make(chan startedStream, 10),
+		listResult: &listResult,
+	}
+	registry := newWatchRegistry(context.Background(), func() endpointClient { return epClientMock }, opts)
+
+	var watchers []*watcher
+	for i := 0; i < 2; i++ {
+		w, err := startNewMultiWatcher(context.Background(), []targetEntry{epClientMock.expectedTarget}, registry, opts)
+		require.NoError(t, err)
+		_, err = w.Next()
+		require.NoError(t, err)
+		watchers = append(watchers, w)
+	}
+	return bytesCh, watchers[0], watchers[1]
+}
+
+func TestWatchRegistry_SlowWatcher_EventsAreCoalesced(t *testing.T) {
+	bytesCh, slow, fast := startSharedTestWatchers(t, newOptions(nil))
+	defer slow.Close()
+	defer fast.Close()
+
+	for i := 2; i <= 4; i++ {
+		sendTestEvent(t, bytesCh, event{Type: modified, Object: newTestEndpoints(fmt.Sprintf("1%d", i), 8080, fmt.Sprintf("1.2.3.%d", i))})
+		_, err := fast.Next()
+		require.NoError(t, err)
+	}
+	require.Equal(t, []string{"1.2.3.4:8080"}, fast.Current())
+
+	// Slow watcher gets at most the event already being passed and then the latest one.
+	calls := 0
+	for !reflect.DeepEqual([]string{"1.2.3.4:8080"}, slow.Current()) {
+		_, err := slow.Next()
+		require.NoError(t, err)
+		calls++
+	}
+	require.True(t, calls <= 2, "intermediate events should be coalesced, got %d calls", calls)
+}
+
+func TestWatchRegistry_SlowWatcher_EventsAreBuffered(t *testing.T) {
+	bytesCh, slow, fast := startSharedTestWatchers(t, newOptions([]Option{WithCoalesceEvents(false), WithWatchBufferSize(5)}))
+	defer slow.Close()
+	defer fast.Close()
+
+	for i := 2; i <= 4; i++ {
+		sendTestEvent(t, bytesCh, event{Type: modified, Object: newTestEndpoints(fmt.Sprintf("1%d", i), 8080, fmt.Sprintf("1.2.3.%d", i))})
+		_, err := fast.Next()
+		require.NoError(t, err)
+	}
+
+	// Every event is passed to the slow watcher as well.
+	for i := 2; i <= 4; i++ {
+		u, err := slow.Next()
+		require.NoError(t, err)
+		requireUpdates(t, []*naming.Update{
+			{Op: naming.Delete, Addr: fmt.Sprintf("1.2.3.%d:8080", i-1)},
+			{Op: naming.Add, Addr: fmt.Sprintf("1.2.3.%d:8080", i)},
+		}, u)
+	}
+}
+
+func TestWatchRegistry_ResolveNow(t *testing.T) {
+	defer func(interval time.Duration) { refreshInterval = interval }(refreshInterval)
+	refreshInterval = 300 * time.Millisecond
+
+	bytesCh := make(chan []byte)
+	listResult := newTestEndpoints("10", 8080, "1.2.3.1")
+	epClientMock := &endpointClientMock{
+		t:              t,
+		expectedTarget: targetEntry{service: "service1", port: noTargetPort, namespace: "namespace1"},
+		bytesCh:        bytesCh,
+		errCh:          make(chan error),
+		startErrCh:     make(chan error, 1),
+		streamsCh:      make(chan startedStream, 10),
+		listResult:     &listResult,
+	}
+	registry := newWatchRegistry(context.Background(), func() endpointClient { return epClientMock }, newOptions(nil))
+	var watchers []*watcher
+	for i := 0; i < 2; i++ {
+		w, err := startNewMultiWatcher(context.Background(), []targetEntry{epClientMock.expectedTarget}, registry, newOptions(nil))
+		require.NoError(t, err)
+		defer w.Close()
+		_, err = w.Next()
+		require.NoError(t, err)
+		watchers = append(watchers, w)
+	}
+
+	// Single list refreshes all watchers of the service.
+	refreshed := newTestEndpoints("11", 8080, "1.2.3.2")
+	epClientMock.listResult = &refreshed
+	watchers[0].resolveNow()
+	for _, w := range watchers {
+		u, err := w.Next()
+		require.NoError(t, err)
+		requireUpdates(t, []*naming.Update{
+			{Op: naming.Delete, Addr: "1.2.3.1:8080"},
+			{Op: naming.Add, Addr: "1.2.3.2:8080"},
+		}, u)
+	}
+	require.Equal(t, int32(2), atomic.LoadInt32(&epClientMock.lists))
+
+	// Rapid requests are coalesced into single list after the interval.
+	refreshed = newTestEndpoints("13", 8080, "1.2.3.3")
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		watchers[i%2].resolveNow()
+	}
+	for _, w := range watchers {
+		_, err := w.Next()
+		require.NoError(t, err)
+		require.Equal(t, []string{"1.2.3.3:8080"}, w.Current())
+	}
+	require.True(t, time.Since(start) > 200*time.Millisecond, "list should be debounced")
+	time.Sleep(refreshInterval + 100*time.Millisecond)
+	require.Equal(t, int32(3), atomic.LoadInt32(&epClientMock.lists))
+
+	// Watch event older than the listed state is stale.
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: newTestEndpoints("12", 8080, "1.2.3.2")})
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: newTestEndpoints("14", 8080, "1.2.3.4")})
+	for _, w := range watchers {
+		u, err := w.Next()
+		require.NoError(t, err)
+		requireUpdates(t, []*naming.Update{
+			{Op: naming.Delete, Addr: "1.2.3.3:8080"},
+			{Op: naming.Add, Addr: "1.2.3.4:8080"},
+		}, u)
+	}
+}
+
+// changingListClient lists endpoints set by setListResult.
+type changingListClient struct {
+	*endpointClientMock
+
+	mu         sync.Mutex
+	listResult endpoints
+}
+
+func (c *changingListClient) setListResult(ep endpoints) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.listResult = ep
+}
+
+func (c *changingListClient) List(ctx context.Context, t targetEntry) (*endpoints, error) {
+	atomic.AddInt32(&c.lists, 1)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ep := c.listResult
+	return &ep, nil
+}
+
+func TestWatchRegistry_ResyncPeriod(t *testing.T) {
+	defer func(interval time.Duration) { refreshInterval = interval }(refreshInterval)
+	refreshInterval = 0
+
+	epClient := &changingListClient{
+		endpointClientMock: &endpointClientMock{
+			t:              t,
+			expectedTarget: targetEntry{service: "service1", port: noTargetPort, namespace: "namespace1"},
+			bytesCh:        make(chan []byte),
+			errCh:          make(chan error),
+			startErrCh:     make(chan error, 1),
+			streamsCh:      make(chan startedStream, 10),
+		},
+		listResult: newTestEndpoints("10", 8080, "1.2.3.1"),
+	}
+	opts := newOptions([]Option{WithResyncPeriod(50 * time.Millisecond)})
+	registry := newWatchRegistry(context.Background(), func() endpointClient { return epClient }, opts)
+	w, err := startNewMultiWatcher(context.Background(), []targetEntry{epClient.expectedTarget}, registry, opts)
+	require.NoError(t, err)
+	defer w.Close()
+	_, err = w.Next()
+	require.NoError(t, err)
+
+	// Watch missed the change, so it is returned after resync.
+	epClient.setListResult(newTestEndpoints("11", 8080, "1.2.3.1", "1.2.3.2"))
+	u, err := w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{{Op: naming.Add, Addr: "1.2.3.2:8080"}}, u)
+
+	// Resync without any change returns nothing.
+	lists := atomic.LoadInt32(&epClient.lists)
+	epClient.setListResult(newTestEndpoints("12", 8080, "1.2.3.2", "1.2.3.1"))
+	for atomic.LoadInt32(&epClient.lists) < lists+2 {
+		u, err = w.Next()
+		require.NoError(t, err)
+		require.Empty(t, u)
+	}
+}
+
+// hangingListClient blocks List until the list is released, as hung kube-apiserver does.
+type hangingListClient struct {
+	*endpointClientMock
+
+	released chan struct{}
+}
+
+func (c *hangingListClient) List(ctx context.Context, t targetEntry) (*endpoints, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.released:
+		return c.endpointClientMock.List(ctx, t)
+	}
+}
+
+func startHangingTestWatcher(t *testing.T, policy InitialResolveTimeoutPolicy, opts ...Option) (*hangingListClient, *watcher, error) {
+	listResult := newTestEndpoints("20", 8080, "1.2.3.4")
+	epClient := &hangingListClient{
+		endpointClientMock: &endpointClientMock{
+			t:              t,
+			expectedTarget: targetEntry{service: "service1", port: noTargetPort, namespace: "namespace1"},
+			bytesCh:        make(chan []byte),
+			errCh:          make(chan error),
+			startErrCh:     make(chan error, 1),
+			streamsCh:      make(chan startedStream, 10),
+			listResult:     &listResult,
+		},
+		released: make(chan struct{}),
+	}
+	o := newOptions(append([]Option{WithInitialResolveTimeout(20*time.Millisecond, policy), WithWatchBackoff(testWatchBackoff)}, opts...))
+	registry := newWatchRegistry(context.Background(), func() endpointClient { return epClient }, o)
+	w, err := startNewMultiWatcher(context.Background(), []targetEntry{epClient.expectedTarget}, registry, o)
+	return epClient, w, err
+}
+
+// serviceClients passes requests to the client of the service.
+type serviceClients map[string]endpointClient
+
+func (c serviceClients) List(ctx context.Context, t targetEntry) (*endpoints, error) {
+	return c[t.service].List(ctx, t)
+}
+
+func (c serviceClients) StartChangeStream(ctx context.Context, t targetEntry, resourceVersion string) (io.ReadCloser, error) {
+	return c[t.service].StartChangeStream(ctx, t, resourceVersion)
+}
+
+func (c serviceClients) ListPods(ctx context.Context, namespace string, selector string) (map[string]pod, error) {
+	return nil, nil
+}
+
+func TestWatchRegistry_HungStartDoesNotBlockOtherServices(t *testing.T) {
+	newMock := func(service string) *endpointClientMock {
+		listResult := newTestEndpoints("10", 8080, "1.2.3.4")
+		return &endpointClientMock{
+			t:              t,
+			expectedTarget: targetEntry{service: service, port: noTargetPort, namespace: "namespace1"},
+			bytesCh:        make(chan []byte),
+			errCh:          make(chan error),
+			startErrCh:     make(chan error, 1),
+			streamsCh:      make(chan startedStream, 10),
+			listResult:     &listResult,
+		}
+	}
+	hung := &hangingListClient{endpointClientMock: newMock("service1"), released: make(chan struct{})}
+	other := newMock("service2")
+	registry := newWatchRegistry(context.Background(), func() endpointClient {
+		return serviceClients{"service1": hung, "service2": other}
+	}, newOptions(nil))
+
+	type started struct {
+		w   *watcher
+		err error
+	}
+	hungStarted := make(chan started, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			w, err := startNewMultiWatcher(context.Background(), []targetEntry{hung.expectedTarget}, registry, newOptions(nil))
+			hungStarted <- started{w: w, err: err}
+		}()
+	}
+	require.Eventually(t, func() bool {
+		registry.mu.Lock()
+		defer registry.mu.Unlock()
+		sw, ok := registry.watches[watchKeyOf(hung.expectedTarget)]
+		return ok && sw.refs == 2
+	}, 2*time.Second, time.Millisecond)
+
+	// Other service is resolved while the watch of the first one is starting.
+	w, err := startNewMultiWatcher(context.Background(), []targetEntry{other.expectedTarget}, registry, newOptions(nil))
+	require.NoError(t, err)
+	w.Close()
+	require.Len(t, hungStarted, 0)
+
+	// Both watchers of the hung service share the watch once it starts.
+	close(hung.released)
+	for i := 0; i < 2; i++ {
+		s := <-hungStarted
+		require.NoError(t, s.err)
+		u, err := s.w.Next()
+		require.NoError(t, err)
+		requireUpdates(t, []*naming.Update{{Op: naming.Add, Addr: "1.2.3.4:8080"}}, u)
+		defer s.w.Close()
+	}
+	<-hung.streamsCh
+	require.Len(t, hung.streamsCh, 0, "only one stream should be started")
+}
+
+func TestWatchRegistry_SubscriberGivesUpOnHungStart(t *testing.T) {
+	listResult := newTestEndpoints("10", 8080, "1.2.3.4")
+	hung := &hangingListClient{
+		endpointClientMock: &endpointClientMock{
+			t:              t,
+			expectedTarget: targetEntry{service: "service1", port: noTargetPort, namespace: "namespace1"},
+			bytesCh:        make(chan []byte),
+			errCh:          make(chan error),
+			startErrCh:     make(chan error, 1),
+			streamsCh:      make(chan startedStream, 10),
+			listResult:     &listResult,
+		},
+		released: make(chan struct{}),
+	}
+	registry := newWatchRegistry(context.Background(), func() endpointClient { return hung }, newOptions(nil))
+
+	// Subscriber does not wait for the hung list longer than its context allows.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := registry.subscribe(ctx, hung.expectedTarget, make(chan watchResult))
+	require.Equal(t, context.DeadlineExceeded, err)
+
+	// Nobody waits for the watch, so its list is cancelled and the next subscriber starts it again.
+	require.Eventually(t, func() bool {
+		registry.mu.Lock()
+		defer registry.mu.Unlock()
+		return len(registry.watches) == 0
+	}, 2*time.Second, time.Millisecond)
+}
+
+func TestWatchRegistry_InitialResolveTimeout_Fail(t *testing.T) {
+	_, _, err := startHangingTestWatcher(t, FailOnInitialResolveTimeout)
+	require.Error(t, err)
+	require.True(t, isFatal(err))
+	require.Contains(t, err.Error(), "did not finish within 20ms")
+}
+
+func TestWatchRegistry_InitialResolveTimeout_Empty(t *testing.T) {
+	epClient, w, err := startHangingTestWatcher(t, EmptyOnInitialResolveTimeout)
+	require.NoError(t, err)
+	defer w.Close()
+
+	// Watcher starts with no addresses and is ready, while list is retried.
+	u, err := w.Next()
+	require.NoError(t, err)
+	require.Empty(t, u)
+	select {
+	case <-w.Ready():
+	default:
+		t.Fatal("watcher should be ready after the empty state is returned")
+	}
+
+	// Listed state is returned as a change and watch starts from it.
+	close(epClient.released)
+	u, err = w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{{Op: naming.Add, Addr: "1.2.3.4:8080"}}, u)
+	select {
+	case stream := <-epClient.streamsCh:
+		require.Equal(t, "20", stream.resourceVersion)
+	case <-time.After(time.Second):
+		t.Fatal("watch should be started after the list")
+	}
+}
+
+func TestWatchRegistry_InitialResolveTimeout_DNSFallback(t *testing.T) {
+	dns := &dnsResolverMock{
+		t: t,
+		srvs: map[string][]*net.SRV{
+			"service1.namespace1.svc.cluster.local": {{Target: "pod1.service1.namespace1.svc.cluster.local.", Port: 8080}},
+		},
+		hosts: map[string][]string{"pod1.service1.namespace1.svc.cluster.local.": {"1.2.3.1"}},
+	}
+	epClient, w, err := startHangingTestWatcher(t, FailOnInitialResolveTimeout, WithDNSFallback(dns))
+	require.NoError(t, err)
+	defer w.Close()
+
+	// Addresses from DNS are used instead of failing, while list is retried.
+	u, err := w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{{Op: naming.Add, Addr: "1.2.3.1:8080"}}, u)
+
+	// Listed state replaces the one from DNS and watch starts from it.
+	close(epClient.released)
+	u, err = w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{{Op: naming.Delete, Addr: "1.2.3.1:8080"}, {Op: naming.Add, Addr: "1.2.3.4:8080"}}, u)
+	select {
+	case stream := <-epClient.streamsCh:
+		require.Equal(t, "20", stream.resourceVersion)
+	case <-time.After(time.Second):
+		t.Fatal("watch should be started after the list")
+	}
+}
@@ -1,8 +1,9 @@
 package k8sresolver
 
 import (
+	"context"
 	"fmt"
-	"net/url"
+	"os"
 	"regexp"
 	"strconv"
 	"strings"
@@ -16,12 +17,25 @@ import (
 const (
 	// ExpectedTargetFmt is an expected format of the targetEntry Name given to Resolver. This is complainant with
 	// the kubeDNS/CoreDNS entry format.
-	ExpectedTargetFmt = "<service>(|.<namespace>)(|.<whatever suffix>)(|:<port_name>|:<value number>)"
+	// Many namespaces separated by comma can be specified to resolve the service in all of them. Target without namespace
+	// is resolved in the default namespace (see WithDefaultNamespace). Target with pod name resolves only the address
+	// of that pod, e.g. "web-0@web.namespace1:grpc" for the first pod of StatefulSet.
+	ExpectedTargetFmt = "(|<pod>@)<service>(|.<namespace>(|,<namespace>...))(|.<whatever suffix>)(|:<port_name>|:<value number>)"
 )
 
 // resolver resolves service names using Kubernetes endpoints instead of usual SRV DNS lookup.
 type resolver struct {
-	cl *client
+	// ctx is a parent context of all watchers.
+	ctx context.Context
+	// watches are endpoints watches shared between all watchers of the same service.
+	watches *watchRegistry
+	opts    options
+	// localZone detects zone of the current pod, if same zone is preferred.
+	localZone func(ctx context.Context) (string, error)
+	// servicePorts returns ports of the service, if service ports are mapped.
+	servicePorts func(ctx context.Context, namespace string, name string) ([]servicePort, error)
+	// clusters are resolved instead of the cluster of the API client, if not empty.
+	clusters []cluster
 }
 
 func NewFromConfig(conf *pb.K8SResolver) (target string, name naming.Resolver, err error) {
@@ -29,15 +43,82 @@ func NewFromConfig(conf *pb.K8SResolver) (target string, name naming.Resolver, e
 	if err != nil {
 		return "", nil, err
 	}
-	return conf.GetDnsPortName(), NewWithClient(apiClient), nil
+	opts, err := optionsFromFlags()
+	if err != nil {
+		return "", nil, err
+	}
+	return conf.GetDnsPortName(), NewWithClient(apiClient, opts...), nil
 }
 
 // NewWithClient returns a new Kubernetes resolver using given k8s.APIClient configured to be used against kube-apiserver.
-func NewWithClient(apiClient *k8s.APIClient) naming.Resolver {
+func NewWithClient(apiClient *k8s.APIClient, opts ...Option) naming.Resolver {
+	return NewWithClientContext(context.Background(), apiClient, opts...)
+}
+
+// NewWithClientContext is like NewWithClient, but all watchers are derived from the given context. Cancelling it closes
+// all watchers created by the resolver.
+func NewWithClientContext(ctx context.Context, apiClient *k8s.APIClient, opts ...Option) naming.Resolver {
+	return newResolver(ctx, apiClient, newOptions(opts))
+}
+
+func newResolver(ctx context.Context, apiClient *k8s.APIClient, o options) *resolver {
+	if o.httpClient != nil {
+		apiClient = apiClient.WithHTTPClient(o.httpClient)
+	} else if o.clientCert != nil {
+		apiClient = apiClient.WithClientCertificate(o.clientCert)
+	}
+	if o.requestMutator != nil {
+		apiClient = apiClient.WithRequestMutator(o.requestMutator)
+	}
+	cl := &client{
+		k8sClient:    apiClient,
+		watchTimeout: o.watchTimeout,
+		listPageSize: o.listPageSize,
+		maxEventSize: o.maxEventSize,
+		logger:       o.logger,
+		limiter:      newRateLimiter(o.rateLimitQPS, o.rateLimitBurst, o.clock),
+		gzip:         o.gzip,
+		userAgent:    o.userAgent,
+		requestID:    o.requestID,
+		clock:        o.clock,
+	}
+	if len(o.apiServers) > 0 {
+		cl.servers = newAPIServers(o.apiServers)
+	}
+	newClient := func() endpointClient { return cl }
+	if o.endpointAPI == AutoEndpointAPI {
+		// API is detected once for all watches, but the client keeps the state of slices, if it uses them.
+		detect := endpointAPIDetector(cl)
+		newClient = func() endpointClient { return &autoEndpointClient{cl: cl, detect: detect} }
+	}
+	if o.endpointAPI == EndpointSliceAPI {
+		// Slices client keeps the state of slices, so it cannot be shared between watches.
+		newClient = func() endpointClient { return &endpointSliceClient{cl: cl} }
+	}
+	if o.endpointAPI == SelectorAPI {
+		// Selector client keeps the state of pods, so it cannot be shared between watches either.
+		newClient = func() endpointClient { return &selectorClient{cl: cl} }
+	}
+	if o.endpointAPI == ClusterIPAPI {
+		// Service is translated as a whole, so the client has no state.
+		clusterIPCl := &clusterIPClient{cl: cl}
+		newClient = func() endpointClient { return clusterIPCl }
+	}
+	if o.endpointsSelector != "" {
+		// Merged endpoints objects are kept per watch as well.
+		newClient = func() endpointClient { return &endpointsSelectorClient{cl: cl, selector: o.endpointsSelector} }
+	}
+	watches := newWatchRegistry(ctx, newClient, o)
+	watches.watchServicePorts = func(ctx context.Context, t targetEntry) <-chan []servicePort {
+		return cl.watchServicePorts(ctx, t, o)
+	}
 	return &resolver{
-		cl: &client{
-			k8sClient: apiClient,
-		},
+		ctx:          ctx,
+		watches:      watches,
+		opts:         o,
+		localZone:    localZoneDetector(cl),
+		servicePorts: cl.servicePorts,
+		clusters:     newClusters(ctx, o.clusters, o),
 	}
 }
 
@@ -52,10 +133,65 @@ type targetEntry struct {
 	service   string
 	namespace string
 	port      targetPort
+	// pod is a name of the only pod to resolve, if not empty.
+	pod string
+	// servicePort is the numeric service port of the target, if its port was mapped by WithServicePortMapping.
+	servicePort string
+}
+
+// String returns target in ExpectedTargetFmt format, e.g. svc.ns, svc.ns:grpc or svc.ns:50051. It is parsed back to
+// the equal target, unless its port was mapped by WithServicePortMapping: servicePort is not part of the format.
+func (t targetEntry) String() string {
+	s := fmt.Sprintf("%s.%s", t.service, t.namespace)
+	if t.pod != "" {
+		s = fmt.Sprintf("%s@%s", t.pod, s)
+	}
+	if t.port != noTargetPort {
+		s = fmt.Sprintf("%s:%s", s, t.port.value)
+	}
+	return s
+}
+
+// parseTargets understands 'ExpectedTargetFmt'. It returns target for every namespace specified or for the
+// defaultNamespace, if there is none.
+func parseTargets(targetName string, defaultNamespace string) ([]targetEntry, error) {
+	// Pod name can contain dots, so it is split off before splitting namespaces.
+	pod, host, port := "", targetName, ""
+	if i := strings.Index(host, "@"); i >= 0 && !hasSchema(targetName) {
+		pod, host = host[:i+1], host[i+1:]
+	}
+	if i := strings.LastIndex(host, ":"); i >= 0 && !hasSchema(targetName) {
+		host, port = host[:i], host[i:]
+	}
+	parts := strings.SplitN(host, ".", 3)
+	if len(parts) < 2 || !strings.Contains(parts[1], ",") {
+		t, err := parseTarget(targetName, defaultNamespace)
+		if err != nil {
+			return nil, err
+		}
+		return []targetEntry{t}, nil
+	}
+
+	var targets []targetEntry
+	seen := map[string]struct{}{}
+	for _, namespace := range strings.Split(parts[1], ",") {
+		if _, ok := seen[namespace]; ok {
+			continue
+		}
+		seen[namespace] = struct{}{}
+
+		parts[1] = namespace
+		t, err := parseTarget(pod+strings.Join(parts, ".")+port, defaultNamespace)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, t)
+	}
+	return targets, nil
 }
 
-// parseTarget understands 'ExpectedTargetFmt'.
-func parseTarget(targetName string) (targetEntry, error) {
+// parseTarget understands 'ExpectedTargetFmt' with single namespace. defaultNamespace is used if target has no namespace.
+func parseTarget(targetName string, defaultNamespace string) (targetEntry, error) {
 	if targetName == "" {
 		return targetEntry{}, errors.New("Failed to parse targetEntry. Empty string")
 	}
@@ -64,36 +200,135 @@ func parseTarget(targetName string) (targetEntry, error) {
 		return targetEntry{}, errors.Errorf("Bad targetEntry name. It cannot contain any schema. Expected format: %s", ExpectedTargetFmt)
 	}
 
-	// To be parsed in expected manner we need to add some schema. We validated if there is not any scheme above.
-	u, err := url.Parse(fmt.Sprintf("no-matter://%s", targetName))
-	if err != nil {
-		return targetEntry{}, err
-	}
-
 	target := targetEntry{
-		namespace: "default",
+		namespace: defaultNamespace,
 		port:      noTargetPort,
 	}
-	if p := u.Port(); p != "" {
-		target.port = targetPort{
-			value: p,
-		}
-		if _, err := strconv.Atoi(p); err != nil {
-			// NaN
-			target.port.isNamed = true
+
+	host, port, hasPort := targetName, "", false
+	if i := strings.Index(host, "@"); i >= 0 {
+		target.pod, host = host[:i], host[i+1:]
+		if err := validateDNS1123Subdomain("pod", target.pod); err != nil {
+			return targetEntry{}, errors.Wrapf(err, "Bad targetEntry name %q", targetName)
 		}
 	}
+	if i := strings.LastIndex(host, ":"); i >= 0 {
+		host, port, hasPort = host[:i], host[i+1:], true
+	}
 
-	serviceNamespace := strings.Split(u.Hostname(), ".")
+	// Everything after namespace (e.g. svc.cluster.local) is ignored.
+	serviceNamespace := strings.Split(host, ".")
 	target.service = serviceNamespace[0]
+	if err := validateDNS1123Label("service", target.service); err != nil {
+		return targetEntry{}, errors.Wrapf(err, "Bad targetEntry name %q", targetName)
+	}
 
 	if len(serviceNamespace) >= 2 {
 		target.namespace = serviceNamespace[1]
+		if err := validateDNS1123Label("namespace", target.namespace); err != nil {
+			return targetEntry{}, errors.Wrapf(err, "Bad targetEntry name %q", targetName)
+		}
 	}
 
+	if hasPort {
+		if port == "" {
+			return targetEntry{}, errors.Errorf("Bad targetEntry name %q: port cannot be empty", targetName)
+		}
+		var err error
+		target.port, err = parseTargetPort(port)
+		if err != nil {
+			return targetEntry{}, errors.Wrapf(err, "Bad targetEntry name %q", targetName)
+		}
+	}
 	return target, nil
 }
 
+// matches returns true if the endpoints port is the target port, by name for named port and by number otherwise.
+func (p targetPort) matches(epPort port) bool {
+	if p.isNamed {
+		return epPort.Name == p.value
+	}
+	return strconv.Itoa(epPort.Port) == p.value
+}
+
+// parseTargetPort parses port number or, if it is not numeric, port name.
+func parseTargetPort(port string) (targetPort, error) {
+	if !numericRegexp.MatchString(port) {
+		if len(port) > portNameMaxLength || !dns1123LabelRegexp.MatchString(port) || !strings.ContainsAny(port, "abcdefghijklmnopqrstuvwxyz") {
+			return noTargetPort, errors.Errorf("port name %q must consist of at most %d lower case alphanumeric characters or '-', "+
+				"must contain at least one letter and must start and end with an alphanumeric character", port, portNameMaxLength)
+		}
+		return targetPort{value: port, isNamed: true}, nil
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 1 || p > 65535 {
+		return noTargetPort, errors.Errorf("port number %s is out of range 1-65535", port)
+	}
+	return targetPort{value: port}, nil
+}
+
+// checkPorts returns error if ports of WithPorts are not valid target ports or are not unique.
+func checkPorts(ports []targetPort) error {
+	seen := map[string]struct{}{}
+	for _, p := range ports {
+		if p.value == "" {
+			return errors.New("k8sresolver: port of WithPorts cannot be empty")
+		}
+		if _, err := parseTargetPort(p.value); err != nil {
+			return errors.Wrap(err, "k8sresolver: bad port of WithPorts")
+		}
+		if _, ok := seen[p.value]; ok {
+			return errors.Errorf("k8sresolver: port %q of WithPorts is not unique", p.value)
+		}
+		seen[p.value] = struct{}{}
+	}
+	return nil
+}
+
+const (
+	dns1123LabelMaxLength     = 63
+	dns1123SubdomainMaxLength = 253
+	portNameMaxLength         = 15
+)
+
+var (
+	dns1123LabelRegexp     = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+	dns1123SubdomainRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+	numericRegexp          = regexp.MustCompile(`^[0-9]+$`)
+)
+
+// validateDNS1123Label returns error if value is not a valid DNS-1123 label, as required for names of services and
+// namespaces.
+func validateDNS1123Label(what string, value string) error {
+	if value == "" {
+		return errors.Errorf("%s cannot be empty", what)
+	}
+	if len(value) > dns1123LabelMaxLength {
+		return errors.Errorf("%s %q must be no more than %d characters", what, value, dns1123LabelMaxLength)
+	}
+	if !dns1123LabelRegexp.MatchString(value) {
+		return errors.Errorf("%s %q must consist of lower case alphanumeric characters or '-', and must start and end "+
+			"with an alphanumeric character", what, value)
+	}
+	return nil
+}
+
+// validateDNS1123Subdomain returns error if value is not a valid DNS-1123 subdomain, as required for names of pods.
+func validateDNS1123Subdomain(what string, value string) error {
+	if value == "" {
+		return errors.Errorf("%s cannot be empty", what)
+	}
+	if len(value) > dns1123SubdomainMaxLength {
+		return errors.Errorf("%s %q must be no more than %d characters", what, value, dns1123SubdomainMaxLength)
+	}
+	if !dns1123SubdomainRegexp.MatchString(value) {
+		return errors.Errorf("%s %q must consist of lower case alphanumeric characters, '-' or '.', and must start and "+
+			"end with an alphanumeric character", what, value)
+	}
+	return nil
+}
+
 var schemaRegexp = regexp.MustCompile(`^[0-9a-z]*://.*`)
 
 func hasSchema(targetName string) bool {
@@ -103,11 +338,69 @@ func hasSchema(targetName string) bool {
 // Resolve creates a Kubernetes watcher for the targetEntry.
 // It expects targetEntry in a form of usual k8s DNS entry. See const 'ExpectedTargetFmt'.
 func (r *resolver) Resolve(target string) (naming.Watcher, error) {
-	t, err := parseTarget(target)
+	if len(r.clusters) > 0 {
+		if err := checkClusters(r.opts.clusters); err != nil {
+			return nil, err
+		}
+		return startNewClusterWatcher(r.ctx, target, r.clusters, r.opts)
+	}
+
+	targets, err := r.targets(target)
 	if err != nil {
 		return nil, err
 	}
 
 	// Now the tricky part begins (:
-	return startNewWatcher(t, r.cl)
+	return startNewMultiWatcher(r.ctx, targets, r.watches, r.watcherOptions())
+}
+
+// targets parses the target and maps its service ports, if enabled. In strict mode target without namespace is
+// rejected instead of using the default one. It fails if WithPorts is malformed as well.
+func (r *resolver) targets(target string) ([]targetEntry, error) {
+	if err := checkPorts(r.opts.ports); err != nil {
+		return nil, err
+	}
+	defaultNamespace := r.opts.defaultNamespace
+	if r.opts.strictMode {
+		defaultNamespace = ""
+	}
+	targets, err := parseTargets(target, defaultNamespace)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range targets {
+		if t.namespace == "" {
+			return nil, errors.Errorf("Bad targetEntry name %q. Namespace is required in strict mode. Expected format: %s", target, ExpectedTargetFmt)
+		}
+		if t.pod != "" && r.opts.endpointAPI == ClusterIPAPI {
+			return nil, errors.Errorf("Bad targetEntry name %q. Pod cannot be resolved with ClusterIPAPI", target)
+		}
+	}
+	if r.opts.endpointAPI == ClusterIPAPI {
+		// Ports of ClusterIP are service ports already.
+		return targets, nil
+	}
+	return r.mapServicePorts(targets)
+}
+
+// watcherOptions returns options with zone and node of the current pod, if preferred. If zone or node cannot be
+// detected, all zones or nodes are used.
+func (r *resolver) watcherOptions() options {
+	o := r.opts
+	if o.preferSameNode && o.node == "" {
+		if o.node = os.Getenv(NodeNameEnvVar); o.node == "" {
+			o.logger.Warnf("k8sresolver: failed to detect node of the current pod. %s env variable is not set. All nodes will be used", NodeNameEnvVar)
+		}
+	}
+	if !o.preferSameZone || o.zone != "" {
+		return o
+	}
+
+	zone, err := r.localZone(r.ctx)
+	if err != nil {
+		o.logger.WithError(err).Warn("k8sresolver: failed to detect zone of the current pod. All zones will be used")
+		return o
+	}
+	o.zone = zone
+	return o
 }
@@ -1,8 +1,13 @@
 package k8sresolver
 
 import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"github.com/improbable-eng/kedge/pkg/k8s"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -80,17 +85,112 @@ func TestParseTarget(t *testing.T) {
 			},
 		},
 		{
-			target: "service6.ns6:",
+			target:      "service6.ns6:",
+			expectedErr: errors.New(`Bad targetEntry name "service6.ns6:": port cannot be empty`),
+		},
+		{
+			target: "service7:grpc",
 			expectgedTarget: targetEntry{
-				service:   "service6",
-				namespace: "ns6",
-				port:      noTargetPort,
+				service:   "service7",
+				namespace: "default",
+				port: targetPort{
+					value:   "grpc",
+					isNamed: true,
+				},
+			},
+		},
+		{
+			target: "service8.ns8.svc.cluster.local:65535",
+			expectgedTarget: targetEntry{
+				service:   "service8",
+				namespace: "ns8",
+				port: targetPort{
+					value: "65535",
+				},
+			},
+		},
+		{
+			target:      ".ns1:1010",
+			expectedErr: errors.New(`Bad targetEntry name ".ns1:1010": service cannot be empty`),
+		},
+		{
+			target:      ":1010",
+			expectedErr: errors.New(`Bad targetEntry name ":1010": service cannot be empty`),
+		},
+		{
+			target:      "service1.:1010",
+			expectedErr: errors.New(`Bad targetEntry name "service1.:1010": namespace cannot be empty`),
+		},
+		{
+			target: "Service1.ns1",
+			expectedErr: errors.New(`Bad targetEntry name "Service1.ns1": service "Service1" must consist of lower case ` +
+				`alphanumeric characters or '-', and must start and end with an alphanumeric character`),
+		},
+		{
+			target: "service1.ns_1",
+			expectedErr: errors.New(`Bad targetEntry name "service1.ns_1": namespace "ns_1" must consist of lower case ` +
+				`alphanumeric characters or '-', and must start and end with an alphanumeric character`),
+		},
+		{
+			target: "service1-.ns1",
+			expectedErr: errors.New(`Bad targetEntry name "service1-.ns1": service "service1-" must consist of lower case ` +
+				`alphanumeric characters or '-', and must start and end with an alphanumeric character`),
+		},
+		{
+			target: strings.Repeat("s", 64) + ".ns1",
+			expectedErr: errors.Errorf(`Bad targetEntry name "%s.ns1": service "%s" must be no more than 63 characters`,
+				strings.Repeat("s", 64), strings.Repeat("s", 64)),
+		},
+		{
+			target:      "service1.ns1:0",
+			expectedErr: errors.New(`Bad targetEntry name "service1.ns1:0": port number 0 is out of range 1-65535`),
+		},
+		{
+			target:      "service1.ns1:65536",
+			expectedErr: errors.New(`Bad targetEntry name "service1.ns1:65536": port number 65536 is out of range 1-65535`),
+		},
+		{
+			target:      "service1.ns1:99999999999999999999",
+			expectedErr: errors.New(`Bad targetEntry name "service1.ns1:99999999999999999999": port number 99999999999999999999 is out of range 1-65535`),
+		},
+		{
+			target: "service1.ns1:-1",
+			expectedErr: errors.New(`Bad targetEntry name "service1.ns1:-1": port name "-1" must consist of at most 15 lower case ` +
+				`alphanumeric characters or '-', must contain at least one letter and must start and end with an alphanumeric character`),
+		},
+		{
+			target: "service1.ns1:very-long-port-name",
+			expectedErr: errors.New(`Bad targetEntry name "service1.ns1:very-long-port-name": port name "very-long-port-name" must ` +
+				`consist of at most 15 lower case alphanumeric characters or '-', must contain at least one letter and must start ` +
+				`and end with an alphanumeric character`),
+		},
+		{
+			target: "web-0@web.ns1:grpc",
+			expectgedTarget: targetEntry{
+				service:   "web",
+				namespace: "ns1",
+				port:      targetPort{value: "grpc", isNamed: true},
+				pod:       "web-0",
 			},
 		},
+		{
+			target:      "@web.ns1",
+			expectedErr: errors.New(`Bad targetEntry name "@web.ns1": pod cannot be empty`),
+		},
+		{
+			target: "Web-0@web.ns1",
+			expectedErr: errors.New(`Bad targetEntry name "Web-0@web.ns1": pod "Web-0" must consist of lower case ` +
+				`alphanumeric characters, '-' or '.', and must start and end with an alphanumeric character`),
+		},
+		{
+			target: "service1.ns1:grpc:8080",
+			expectedErr: errors.New(`Bad targetEntry name "service1.ns1:grpc:8080": namespace "ns1:grpc" must consist of lower case ` +
+				`alphanumeric characters or '-', and must start and end with an alphanumeric character`),
+		},
 	} {
 		t.Logf("Case %s", tcase.target)
 
-		res, err := parseTarget(tcase.target)
+		res, err := parseTarget(tcase.target, "default")
 		if tcase.expectedErr != nil {
 			require.Error(t, err)
 			assert.Equal(t, tcase.expectedErr.Error(), err.Error())
@@ -102,3 +202,121 @@ func TestParseTarget(t *testing.T) {
 		assert.Equal(t, tcase.expectgedTarget, res)
 	}
 }
+
+func TestParseTargets(t *testing.T) {
+	targets, err := parseTargets("service1.ns1:1010", "default")
+	require.NoError(t, err)
+	require.Equal(t, []targetEntry{
+		{service: "service1", namespace: "ns1", port: targetPort{value: "1010"}},
+	}, targets)
+
+	targets, err = parseTargets("service1.ns1,ns2,ns1.svc.cluster.local:1010", "default")
+	require.NoError(t, err)
+	require.Equal(t, []targetEntry{
+		{service: "service1", namespace: "ns1", port: targetPort{value: "1010"}},
+		{service: "service1", namespace: "ns2", port: targetPort{value: "1010"}},
+	}, targets)
+
+	targets, err = parseTargets("service1.ns1,ns2", "default")
+	require.NoError(t, err)
+	require.Equal(t, []targetEntry{
+		{service: "service1", namespace: "ns1", port: noTargetPort},
+		{service: "service1", namespace: "ns2", port: noTargetPort},
+	}, targets)
+
+	targets, err = parseTargets("service1:grpc", "ns3")
+	require.NoError(t, err)
+	require.Equal(t, []targetEntry{
+		{service: "service1", namespace: "ns3", port: targetPort{value: "grpc", isNamed: true}},
+	}, targets, "target without namespace should use the default one")
+
+	targets, err = parseTargets("web-0.v2@web.ns1,ns2:grpc", "default")
+	require.NoError(t, err)
+	require.Equal(t, []targetEntry{
+		{service: "web", namespace: "ns1", port: targetPort{value: "grpc", isNamed: true}, pod: "web-0.v2"},
+		{service: "web", namespace: "ns2", port: targetPort{value: "grpc", isNamed: true}, pod: "web-0.v2"},
+	}, targets, "pod name can contain dots")
+
+	_, err = parseTargets("service1.ns1,,ns2:1010", "default")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "namespace cannot be empty")
+}
+
+func TestResolver_StrictModeRequiresNamespace(t *testing.T) {
+	r := &resolver{opts: newOptions([]Option{WithDefaultNamespace("namespace1")})}
+	targets, err := r.targets("service1:grpc")
+	require.NoError(t, err)
+	require.Equal(t, "namespace1", targets[0].namespace)
+
+	r.opts = newOptions([]Option{WithDefaultNamespace("namespace1"), WithStrictMode(true)})
+	_, err = r.targets("service1:grpc")
+	require.Error(t, err)
+	_, err = r.targets("web-0@service1:grpc")
+	require.Error(t, err)
+
+	targets, err = r.targets("service1.namespace2,namespace3:grpc")
+	require.NoError(t, err)
+	require.Len(t, targets, 2)
+}
+
+func TestResolver_InvalidPorts(t *testing.T) {
+	for _, tcase := range []struct {
+		ports       []string
+		expectedErr string
+	}{
+		{ports: []string{"grpc", ""}, expectedErr: "k8sresolver: port of WithPorts cannot be empty"},
+		{ports: []string{"grpc", "8080", "grpc"}, expectedErr: `k8sresolver: port "grpc" of WithPorts is not unique`},
+		{ports: []string{"65536"}, expectedErr: "k8sresolver: bad port of WithPorts: port number 65536 is out of range 1-65535"},
+		{ports: []string{"0"}, expectedErr: "k8sresolver: bad port of WithPorts: port number 0 is out of range 1-65535"},
+		{ports: []string{"GRPC"}, expectedErr: `k8sresolver: bad port of WithPorts: port name "GRPC" must consist of`},
+	} {
+		_, err := NewWithClient(&k8s.APIClient{}, WithPorts(tcase.ports)).Resolve("service1.namespace1")
+		require.Error(t, err, "ports %v", tcase.ports)
+		require.Contains(t, err.Error(), tcase.expectedErr)
+	}
+}
+
+func TestTargetEntry_String(t *testing.T) {
+	for _, tcase := range []struct {
+		target   targetEntry
+		expected string
+	}{
+		{target: targetEntry{service: "svc", namespace: "ns", port: noTargetPort}, expected: "svc.ns"},
+		{target: targetEntry{service: "svc", namespace: "ns", port: targetPort{value: "grpc", isNamed: true}}, expected: "svc.ns:grpc"},
+		{target: targetEntry{service: "svc", namespace: "ns", port: targetPort{value: "50051"}}, expected: "svc.ns:50051"},
+		{target: targetEntry{service: "svc", namespace: "ns", port: targetPort{value: "grpc", isNamed: true}, pod: "svc-0"}, expected: "svc-0@svc.ns:grpc"},
+	} {
+		require.Equal(t, tcase.expected, tcase.target.String())
+
+		parsed, err := parseTarget(tcase.target.String(), "default")
+		require.NoError(t, err)
+		require.Equal(t, tcase.target, parsed, "%s should be parsed back to the equal target", tcase.expected)
+	}
+}
+
+func TestResolver_WithHTTPClient(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/namespaces/namespace1/endpoints/service1":
+			require.NoError(t, json.NewEncoder(w).Encode(newTestEndpoints("10", 8080, "1.2.3.4")))
+		case "/api/v1/watch/namespaces/namespace1/endpoints/service1":
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		default:
+			t.Errorf("unexpected request %s", r.URL.String())
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	// Client of the k8s.APIClient does not trust the test server certificate.
+	r := NewWithClient(&k8s.APIClient{Client: &http.Client{}, Address: srv.URL}, WithHTTPClient(srv.Client()), WithEndpointAPI(EndpointsAPI))
+	w, err := r.Resolve("service1.namespace1")
+	require.NoError(t, err)
+	defer w.Close()
+
+	u, err := w.Next()
+	require.NoError(t, err)
+	require.Len(t, u, 1)
+	require.Equal(t, "1.2.3.4:8080", u[0].Addr)
+}
@@ -0,0 +1,61 @@
+package k8sresolver
+
+import (
+	"context"
+
+	"github.com/improbable-eng/kedge/pkg/k8s"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/naming"
+)
+
+// Runner watches endpoints of the target with explicit lifecycle, so it can be added to a process supervisor like
+// errgroup.Group or run.Group instead of the watcher returned by Resolve, which is driven by the caller of Next and
+// stays open until closed.
+type Runner struct {
+	r        *resolver
+	targets  []targetEntry
+	onUpdate func(updates []*naming.Update)
+}
+
+// NewRunner returns Runner of the target, which is in ExpectedTargetFmt format. Updates are passed to onUpdate the same
+// way Next of the watcher returns them, starting with the initial state. onUpdate is called from Run, so blocking it
+// holds back the next updates.
+func NewRunner(apiClient *k8s.APIClient, target string, onUpdate func(updates []*naming.Update), opts ...Option) (*Runner, error) {
+	return newRunner(newResolver(context.Background(), apiClient, newOptions(opts)), target, onUpdate)
+}
+
+func newRunner(r *resolver, target string, onUpdate func(updates []*naming.Update)) (*Runner, error) {
+	if len(r.clusters) > 0 {
+		return nil, errors.New("k8sresolver: WithClusters is supported only by naming.Resolver")
+	}
+	targets, err := r.targets(target)
+	if err != nil {
+		return nil, err
+	}
+	return &Runner{r: r, targets: targets, onUpdate: onUpdate}, nil
+}
+
+// Run starts watching endpoints and passes updates to onUpdate until ctx is done or watch fails with error that is not
+// recoverable (see Next). It returns nil if ctx is done and *ResolveError otherwise. Failed initial list is returned as
+// it is. All connections are closed when Run returns, so it can be called again to start from the fresh state.
+func (r *Runner) Run(ctx context.Context) error {
+	w, err := startNewMultiWatcher(ctx, r.targets, r.r.watches, r.r.watcherOptions())
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	defer w.Close()
+
+	for {
+		u, err := w.NextContext(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		r.onUpdate(u)
+	}
+}
@@ -0,0 +1,79 @@
+package k8sresolver
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/naming"
+)
+
+func TestRunner_RunsUntilContextDone(t *testing.T) {
+	api := NewFakeAPI()
+	api.SetEndpoints("namespace1", "service1", FakeSubset{
+		Addresses: []string{"1.2.3.4"},
+		Ports:     []FakePort{{Name: "grpc", Port: 8080}},
+	})
+
+	updates := make(chan []*naming.Update, 10)
+	r, err := api.Runner("service1.namespace1:grpc", func(u []*naming.Update) { updates <- u }, WithWatchBackoff(testWatchBackoff))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() { errCh <- r.Run(ctx) }()
+
+	requireUpdates(t, []*naming.Update{{Op: naming.Add, Addr: "1.2.3.4:8080"}}, <-updates)
+	api.SetEndpoints("namespace1", "service1", FakeSubset{
+		Addresses: []string{"1.2.3.5"},
+		Ports:     []FakePort{{Name: "grpc", Port: 8080}},
+	})
+	requireUpdates(t, []*naming.Update{
+		{Op: naming.Delete, Addr: "1.2.3.4:8080"},
+		{Op: naming.Add, Addr: "1.2.3.5:8080"},
+	}, <-updates)
+
+	cancel()
+	select {
+	case err := <-errCh:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after context was cancelled")
+	}
+	// Shared watch is closed asynchronously once its last watcher is closed.
+	for i := 0; i < 20 && api.Watches("namespace1", "service1") > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, 0, api.Watches("namespace1", "service1"), "watch should be closed when Run returns")
+}
+
+func TestRunner_ReturnsFatalError(t *testing.T) {
+	api := NewFakeAPI()
+	api.SetEndpoints("namespace1", "service1", FakeSubset{
+		Addresses: []string{"1.2.3.4"},
+		Ports:     []FakePort{{Name: "grpc", Port: 8080}},
+	})
+
+	_, err := api.Runner("service1.namespace1:not_valid", func([]*naming.Update) {})
+	require.Error(t, err, "malformed target should be returned by NewRunner")
+
+	updates := make(chan []*naming.Update, 10)
+	r, err := api.Runner("service1.namespace1:grpc", func(u []*naming.Update) { updates <- u }, WithWatchBackoff(testWatchBackoff))
+	require.NoError(t, err)
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- r.Run(context.Background()) }()
+	<-updates
+
+	api.SendStatus("namespace1", "service1", http.StatusForbidden, "forbidden")
+	select {
+	case err := <-errCh:
+		require.Error(t, err)
+		_, ok := err.(*ResolveError)
+		require.True(t, ok, "expected *ResolveError, got %T", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after fatal error")
+	}
+}
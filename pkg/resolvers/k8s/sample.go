@@ -0,0 +1,40 @@
+package k8sresolver
+
+import (
+	"hash/fnv"
+	"sort"
+)
+
+// sampledAddresses returns at most max addresses of every port. Addresses with the lowest hash of the IP are kept, so
+// the sample does not change when addresses outside of it come and go, and removed address is replaced by single
+// other one. All addresses are returned if there are not more than max of them.
+func sampledAddresses(max int, addresses map[string]AddressMetadata) map[string]AddressMetadata {
+	byPort := map[string][]string{}
+	for addr, md := range addresses {
+		byPort[md.PortName] = append(byPort[md.PortName], addr)
+	}
+
+	sampled := make(map[string]AddressMetadata)
+	for _, addrs := range byPort {
+		if len(addrs) > max {
+			sort.Slice(addrs, func(i, j int) bool {
+				hi, hj := ipHash(addresses[addrs[i]].IP), ipHash(addresses[addrs[j]].IP)
+				if hi != hj {
+					return hi < hj
+				}
+				return addrs[i] < addrs[j]
+			})
+			addrs = addrs[:max]
+		}
+		for _, addr := range addrs {
+			sampled[addr] = addresses[addr]
+		}
+	}
+	return sampled
+}
+
+func ipHash(ip string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(ip))
+	return h.Sum64()
+}
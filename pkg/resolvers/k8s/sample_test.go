@@ -0,0 +1,87 @@
+package k8sresolver
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testAddresses(from int, to int) map[string]AddressMetadata {
+	addresses := map[string]AddressMetadata{}
+	for i := from; i < to; i++ {
+		ip := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		addresses[ip+":8080"] = AddressMetadata{IP: ip, PortName: "grpc"}
+	}
+	return addresses
+}
+
+func TestSampledAddresses_StableUnderUnrelatedChurn(t *testing.T) {
+	addresses := testAddresses(0, 1000)
+	sample := sampledAddresses(10, addresses)
+	require.Len(t, sample, 10)
+	require.Equal(t, sample, sampledAddresses(10, addresses), "sample should be deterministic")
+
+	// Pods outside of the sample come and go.
+	churned := testAddresses(0, 500)
+	for addr, md := range testAddresses(2000, 3000) {
+		churned[addr] = md
+	}
+	for addr, md := range sample {
+		churned[addr] = md
+	}
+	require.Equal(t, sample, sampledAddresses(10, churned))
+
+	// Removed sampled pod is replaced by single other one.
+	var removed string
+	for addr := range sample {
+		removed = addr
+		break
+	}
+	delete(churned, removed)
+	resampled := sampledAddresses(10, churned)
+	require.Len(t, resampled, 10)
+	kept := 0
+	for addr := range sample {
+		if _, ok := resampled[addr]; ok {
+			kept++
+		}
+	}
+	require.Equal(t, 9, kept)
+
+	// All addresses are used, if there are not more of them than the maximum.
+	few := testAddresses(0, 10)
+	require.Equal(t, few, sampledAddresses(10, few))
+}
+
+func TestSampledAddresses_PerPort(t *testing.T) {
+	addresses := testAddresses(0, 5)
+	for addr, md := range testAddresses(0, 5) {
+		md.PortName = "http"
+		addresses[addr[:len(addr)-len("8080")]+"8081"] = md
+	}
+
+	sample := sampledAddresses(2, addresses)
+	require.Len(t, sample, 4)
+	for addr, md := range sample {
+		if md.PortName == "grpc" {
+			_, ok := sample[md.IP+":8081"]
+			require.True(t, ok, "the same pods should be sampled for every port, %s", addr)
+		}
+	}
+}
+
+func TestWatcher_MaxEndpoints(t *testing.T) {
+	bytesCh, _, w := startTestWatcher(t, newTestEndpoints("10", 8080, "1.2.3.4", "1.2.3.5", "1.2.3.6"), WithMaxEndpoints(2))
+	defer w.Close()
+
+	u, err := w.Next()
+	require.NoError(t, err)
+	require.Len(t, u, 2)
+
+	// Set shrinks below the maximum, so all the addresses are used.
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: newTestEndpoints("11", 8080, "1.2.3.7")})
+	_, err = w.Next()
+	require.NoError(t, err)
+	require.Equal(t, []string{"1.2.3.7:8080"}, w.Current())
+}
@@ -0,0 +1,349 @@
+package k8sresolver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// selectorClient is an endpointClient that resolves the service from pods matching its selector instead of Endpoints,
+// for clusters where the Endpoints controller lags behind. Pods are translated into single endpoints object, with
+// service ports mapped to the container ports of every pod. Service is read again whenever the state of pods is listed,
+// so changes of its selector or ports are picked up on resync.
+// It keeps the last known state of pods to be able to resume watch, so it should be used for single target only.
+type selectorClient struct {
+	cl *client
+
+	mu              sync.Mutex
+	svc             *service
+	pods            map[string]podObject
+	resourceVersion string
+}
+
+// podEvent is a watch event for Pod. Object can be either Pod or Status.
+type podEvent struct {
+	Type   eventType       `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+func (c *selectorClient) podsURL(namespace string, selector string, watch bool) string {
+	watchPath := ""
+	if watch {
+		watchPath = "/watch"
+	}
+	return fmt.Sprintf("/api/v1%s/namespaces/%s/pods?labelSelector=%s",
+		watchPath,
+		namespace,
+		url.QueryEscape(selector),
+	)
+}
+
+// List returns pods selected by the service of the target translated into single endpoints object.
+func (c *selectorClient) List(ctx context.Context, t targetEntry) (*endpoints, error) {
+	svc, list, err := c.list(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+
+	pods := map[string]podObject{}
+	for _, p := range list.Items {
+		pods[p.Metadata.Name] = p
+	}
+	c.setState(list.Metadata.ResourceVersion, svc, pods)
+
+	ep := podsToEndpoints(t, list.Metadata.ResourceVersion, svc, pods)
+	return &ep, nil
+}
+
+// ListPods returns pods in the namespace matching the label selector by their IPs.
+func (c *selectorClient) ListPods(ctx context.Context, namespace string, selector string) (map[string]pod, error) {
+	return c.cl.ListPods(ctx, namespace, selector)
+}
+
+func (c *selectorClient) setState(resourceVersion string, svc *service, pods map[string]podObject) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.resourceVersion = resourceVersion
+	c.svc = svc
+	c.pods = map[string]podObject{}
+	for name, p := range pods {
+		c.pods[name] = p
+	}
+}
+
+// state returns the service and copy of the last known pods if they are in given resourceVersion.
+func (c *selectorClient) state(resourceVersion string) (*service, map[string]podObject, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if resourceVersion == "" || resourceVersion != c.resourceVersion {
+		return nil, nil, false
+	}
+	pods := map[string]podObject{}
+	for name, p := range c.pods {
+		pods[name] = p
+	}
+	return c.svc, pods, true
+}
+
+// list returns the service of the target and all pods it selects.
+func (c *selectorClient) list(ctx context.Context, t targetEntry) (*service, *podList, error) {
+	svc, err := c.cl.service(ctx, t.namespace, t.service)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(svc.Spec.Selector) == 0 {
+		return nil, nil, errors.Errorf("Service %s has no selector, so its pods cannot be resolved", t)
+	}
+
+	podsURL := c.podsURL(t.namespace, labelSelector(svc.Spec.Selector), false)
+	body, err := c.cl.startGET(ctx, podsURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer body.Close()
+
+	var list podList
+	if err := json.NewDecoder(body).Decode(&list); err != nil {
+		return nil, nil, errors.Wrapf(err, "Failed to decode pods from GET %s response", podsURL)
+	}
+	return svc, &list, nil
+}
+
+// StartChangeStream starts stream of changes of the selected pods translated into endpoints.
+// NOTE: Translation requires knowing all the pods. If resourceVersion matches the pods state we know (from List or
+// previous stream), watch is resumed from it. Otherwise stream starts with fresh list of pods returned as the first
+// event, the same way Endpoints watch without resourceVersion does.
+func (c *selectorClient) StartChangeStream(ctx context.Context, t targetEntry, resourceVersion string) (io.ReadCloser, error) {
+	var initial *event
+	svc, pods, ok := c.state(resourceVersion)
+	if !ok {
+		var (
+			list *podList
+			err  error
+		)
+		svc, list, err = c.list(ctx, t)
+		if err != nil {
+			return nil, err
+		}
+
+		pods = map[string]podObject{}
+		for _, p := range list.Items {
+			pods[p.Metadata.Name] = p
+		}
+		resourceVersion = list.Metadata.ResourceVersion
+		c.setState(resourceVersion, svc, pods)
+		initial = &event{Type: added, Object: podsToEndpoints(t, resourceVersion, svc, pods)}
+	}
+
+	q := c.cl.watchQuery(resourceVersion)
+	// Translated stream needs to be resumed from exact version, even if it is empty.
+	q.Set("resourceVersion", resourceVersion)
+	podsWatchURL := fmt.Sprintf("%s&%s", c.podsURL(t.namespace, labelSelector(svc.Spec.Selector), true), q.Encode())
+	c.cl.warnIfInsecure()
+	body, err := c.cl.startGET(ctx, podsWatchURL)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		err := c.proxyPods(t, initial, svc, pods, newEventDecoder(body, c.cl.maxEventSize), json.NewEncoder(pw))
+		body.Close()
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+// proxyPods decodes pod events and encodes translated endpoints events until decoding fails. It returns nil on EOF, so
+// the translated stream is closed in the same way.
+func (c *selectorClient) proxyPods(
+	t targetEntry,
+	initial *event,
+	svc *service,
+	pods map[string]podObject,
+	decoder *eventDecoder,
+	encoder *json.Encoder,
+) error {
+	if initial != nil {
+		if err := encoder.Encode(initial); err != nil {
+			return err
+		}
+	}
+
+	for {
+		var got podEvent
+		if err := decoder.Decode(&got); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		var translated event
+		switch got.Type {
+		case added, modified, deleted:
+			var p podObject
+			if err := json.Unmarshal(got.Object, &p); err != nil {
+				return errors.Wrap(err, "Unable to decode pod from the watch stream")
+			}
+
+			if got.Type == deleted {
+				delete(pods, p.Metadata.Name)
+			} else {
+				pods[p.Metadata.Name] = p
+			}
+			translated = event{Type: modified, Object: podsToEndpoints(t, p.Metadata.ResourceVersion, svc, pods)}
+		default:
+			// Bookmark, status and unknown events are passed as they are. Streamer will handle them.
+			translated = event{Type: got.Type}
+			if err := json.Unmarshal(got.Object, &translated.Object); err != nil {
+				return errors.Wrap(err, "Unable to decode an object from the watch stream")
+			}
+		}
+
+		if translated.Type == modified || translated.Type == bookmark {
+			// State is updated before the event is consumed, the same way as for merged slices.
+			c.setState(translated.Object.Metadata.ResourceVersion, svc, pods)
+		}
+		if err := encoder.Encode(translated); err != nil {
+			return err
+		}
+	}
+}
+
+// labelSelector returns selector matching all the labels, sorted for stable requests.
+func labelSelector(labels map[string]string) string {
+	selector := make([]string, 0, len(labels))
+	for k, v := range labels {
+		selector = append(selector, fmt.Sprintf("%s=%s", k, v))
+	}
+	sort.Strings(selector)
+	return strings.Join(selector, ",")
+}
+
+// podsToEndpoints translates pods into single endpoints object. Pods exposing the same ports are grouped into single
+// subset, the same way the Endpoints controller does it.
+func podsToEndpoints(t targetEntry, resourceVersion string, svc *service, pods map[string]podObject) endpoints {
+	var names []string
+	for name := range pods {
+		names = append(names, name)
+	}
+	// Keep subsets and addresses order stable.
+	sort.Strings(names)
+
+	ep := endpoints{
+		Kind:       "Endpoints",
+		APIVersion: "v1",
+		Metadata: metadata{
+			Name:            t.service,
+			ResourceVersion: resourceVersion,
+		},
+	}
+	subsetByPorts := map[string]int{}
+	for _, name := range names {
+		p := pods[name]
+		if p.Status.Phase == "Succeeded" || p.Status.Phase == "Failed" {
+			// Pod will never run again.
+			continue
+		}
+		ips := p.ips()
+		ports := podPorts(svc.Spec.Ports, p)
+		if len(ips) == 0 || len(ports) == 0 {
+			continue
+		}
+
+		key := fmt.Sprint(ports)
+		i, ok := subsetByPorts[key]
+		if !ok {
+			i = len(ep.Subsets)
+			subsetByPorts[key] = i
+			ep.Subsets = append(ep.Subsets, subset{Ports: ports})
+		}
+		sub := &ep.Subsets[i]
+
+		conditions := p.conditions()
+		for _, ip := range ips {
+			a := address{
+				IP:          ip,
+				Terminating: conditions.isTerminating(),
+				TargetRef: &objectReference{
+					Kind:      "Pod",
+					Name:      p.Metadata.Name,
+					Namespace: p.Metadata.Namespace,
+					UID:       p.Metadata.UID,
+				},
+				NodeName: p.Spec.NodeName,
+			}
+			if !conditions.isReady() {
+				sub.NotReadyAddresses = append(sub.NotReadyAddresses, a)
+				continue
+			}
+			sub.Addresses = append(sub.Addresses, a)
+		}
+	}
+	return ep
+}
+
+// conditions returns endpoint conditions of the pod, the same as the EndpointSlice controller reports them.
+func (p podObject) conditions() endpointConditions {
+	ready := false
+	for _, c := range p.Status.Conditions {
+		if c.Type == "Ready" {
+			ready = c.Status == "True"
+		}
+	}
+	terminating := p.Metadata.DeletionTimestamp != nil
+	readyNotTerminating := ready && !terminating
+	return endpointConditions{Ready: &readyNotTerminating, Serving: &ready, Terminating: &terminating}
+}
+
+// podPorts maps service ports to the ports of the pod. Named target port is looked up in container ports of the pod, so
+// it can differ between pods. Service port the pod does not expose is skipped.
+func podPorts(svcPorts []servicePort, p podObject) []port {
+	var ports []port
+	for _, sp := range svcPorts {
+		num := sp.Port
+		switch tp := string(sp.TargetPort); {
+		case tp == "":
+			// Target port is the same as service port.
+		case numericRegexp.MatchString(tp):
+			num, _ = strconv.Atoi(tp)
+		default:
+			num = containerPortNumber(p, tp, sp.Protocol)
+		}
+		if num == 0 {
+			continue
+		}
+		ports = append(ports, port{Name: sp.Name, Port: num, Protocol: sp.Protocol, AppProtocol: sp.AppProtocol})
+	}
+	return ports
+}
+
+// containerPortNumber returns number of the container port with given name and protocol, or 0 if there is none.
+func containerPortNumber(p podObject, name string, protocol string) int {
+	for _, c := range p.Spec.Containers {
+		for _, cp := range c.Ports {
+			if cp.Name == name && protocolOrTCP(cp.Protocol) == protocolOrTCP(protocol) {
+				return cp.ContainerPort
+			}
+		}
+	}
+	return 0
+}
+
+func protocolOrTCP(protocol string) string {
+	if protocol == "" {
+		return "TCP"
+	}
+	return protocol
+}
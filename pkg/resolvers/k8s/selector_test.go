@@ -0,0 +1,303 @@
+package k8sresolver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/improbable-eng/kedge/pkg/k8s"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/naming"
+)
+
+func newTestPod(name string, resourceVersion string, ready bool, ips ...string) podObject {
+	p := podObject{}
+	p.Metadata.Name = name
+	p.Metadata.Namespace = "namespace1"
+	p.Metadata.ResourceVersion = resourceVersion
+	p.Spec.Containers = []container{{Ports: []containerPort{{Name: "grpc", ContainerPort: 8080}}}}
+	p.Status.Phase = "Running"
+	status := "False"
+	if ready {
+		status = "True"
+	}
+	p.Status.Conditions = []podCondition{{Type: "Ready", Status: status}}
+	for _, ip := range ips {
+		p.Status.PodIPs = append(p.Status.PodIPs, podIP{IP: ip})
+	}
+	return p
+}
+
+func podRef(name string) *objectReference {
+	return &objectReference{Kind: "Pod", Name: name, Namespace: "namespace1"}
+}
+
+type selectorAPIMock struct {
+	t *testing.T
+
+	services      chan service
+	lists         chan podList
+	watchVersions chan string
+	watchEventsCh chan podEvent
+}
+
+func startSelectorAPIMock(t *testing.T) (*selectorAPIMock, *selectorClient, func()) {
+	m := &selectorAPIMock{
+		t:             t,
+		services:      make(chan service, 10),
+		lists:         make(chan podList, 10),
+		watchVersions: make(chan string, 10),
+		watchEventsCh: make(chan podEvent, 10),
+	}
+	srv := httptest.NewServer(m)
+	cl := &selectorClient{cl: &client{k8sClient: &k8s.APIClient{Client: srv.Client(), Address: srv.URL}}}
+	return m, cl, func() {
+		close(m.watchEventsCh)
+		srv.Close()
+	}
+}
+
+func (m *selectorAPIMock) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/api/v1/namespaces/namespace1/services/service1":
+		select {
+		case svc := <-m.services:
+			require.NoError(m.t, json.NewEncoder(w).Encode(svc))
+		default:
+			m.t.Errorf("unexpected service request")
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	case "/api/v1/namespaces/namespace1/pods":
+		require.Equal(m.t, "app=service1,tier=backend", r.URL.Query().Get("labelSelector"))
+		select {
+		case l := <-m.lists:
+			require.NoError(m.t, json.NewEncoder(w).Encode(l))
+		default:
+			m.t.Errorf("unexpected list request")
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	case "/api/v1/watch/namespaces/namespace1/pods":
+		require.Equal(m.t, "app=service1,tier=backend", r.URL.Query().Get("labelSelector"))
+		m.watchVersions <- r.URL.Query().Get("resourceVersion")
+		w.(http.Flusher).Flush()
+		for e := range m.watchEventsCh {
+			require.NoError(m.t, json.NewEncoder(w).Encode(e))
+			w.(http.Flusher).Flush()
+		}
+	default:
+		m.t.Errorf("unexpected request %s", r.URL.String())
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newTestService(ports ...servicePort) service {
+	svc := service{}
+	svc.Spec.Selector = map[string]string{"tier": "backend", "app": "service1"}
+	svc.Spec.Ports = ports
+	return svc
+}
+
+func TestSelectorClient_ListTranslatesPods(t *testing.T) {
+	m, cl, closeFn := startSelectorAPIMock(t)
+	defer closeFn()
+
+	ready := newTestPod("service1-0", "10", true, "1.2.3.4")
+	ready.Metadata.UID = "uid-0"
+	ready.Spec.NodeName = "node1"
+	notReady := newTestPod("service1-1", "11", false, "1.2.3.5")
+	deletedAt := "2018-01-01T00:00:00Z"
+	terminating := newTestPod("service1-2", "11", true, "1.2.3.6")
+	terminating.Metadata.DeletionTimestamp = &deletedAt
+	// Container port of the same name differs, so the pod is in another subset.
+	otherPort := newTestPod("service1-3", "11", true, "1.2.3.7")
+	otherPort.Spec.Containers[0].Ports[0].ContainerPort = 9090
+	noIP := newTestPod("service1-4", "11", true)
+	succeeded := newTestPod("service1-5", "11", true, "1.2.3.8")
+	succeeded.Status.Phase = "Succeeded"
+	noPort := newTestPod("service1-6", "11", true, "1.2.3.9")
+	noPort.Spec.Containers[0].Ports = nil
+
+	m.services <- newTestService(
+		servicePort{Name: "grpc", Port: 80, TargetPort: "grpc", AppProtocol: "grpc"},
+		servicePort{Name: "metrics", Port: 9100},
+		servicePort{Name: "http", Port: 81, TargetPort: "8081"},
+	)
+	m.lists <- podList{
+		Metadata: listMetadata{ResourceVersion: "12"},
+		Items:    []podObject{otherPort, noIP, ready, notReady, terminating, succeeded, noPort},
+	}
+	ep, err := cl.List(context.Background(), testSliceTarget)
+	require.NoError(t, err)
+
+	metricsAndHTTP := []port{{Name: "metrics", Port: 9100}, {Name: "http", Port: 8081}}
+	require.Equal(t, endpoints{
+		Kind:       "Endpoints",
+		APIVersion: "v1",
+		Metadata:   metadata{Name: "service1", ResourceVersion: "12"},
+		Subsets: []subset{
+			{
+				Ports: append([]port{{Name: "grpc", Port: 8080, AppProtocol: "grpc"}}, metricsAndHTTP...),
+				Addresses: []address{
+					{IP: "1.2.3.4", TargetRef: &objectReference{Kind: "Pod", Name: "service1-0", Namespace: "namespace1", UID: "uid-0"}, NodeName: "node1"},
+					{IP: "1.2.3.6", Terminating: true, TargetRef: podRef("service1-2")},
+				},
+				NotReadyAddresses: []address{{IP: "1.2.3.5", TargetRef: podRef("service1-1")}},
+			},
+			{
+				Ports:     append([]port{{Name: "grpc", Port: 9090, AppProtocol: "grpc"}}, metricsAndHTTP...),
+				Addresses: []address{{IP: "1.2.3.7", TargetRef: podRef("service1-3")}},
+			},
+			{
+				Ports:     metricsAndHTTP,
+				Addresses: []address{{IP: "1.2.3.9", TargetRef: podRef("service1-6")}},
+			},
+		},
+	}, *ep)
+}
+
+func TestSelectorClient_ServiceWithoutSelector(t *testing.T) {
+	m, cl, closeFn := startSelectorAPIMock(t)
+	defer closeFn()
+
+	m.services <- service{}
+	_, err := cl.List(context.Background(), testSliceTarget)
+	require.Error(t, err)
+	require.False(t, isFatal(err))
+}
+
+func TestSelectorClient_ResumesWatchFromListedVersion(t *testing.T) {
+	m, cl, closeFn := startSelectorAPIMock(t)
+	defer closeFn()
+
+	m.services <- newTestService(servicePort{Name: "grpc", Port: 80, TargetPort: "grpc"})
+	m.lists <- podList{
+		Metadata: listMetadata{ResourceVersion: "12"},
+		Items:    []podObject{newTestPod("service1-0", "10", true, "1.2.3.4"), newTestPod("service1-1", "11", true, "1.2.3.5")},
+	}
+	_, err := cl.List(context.Background(), testSliceTarget)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Neither service nor pods are listed, since we know the state in this version.
+	stream, err := cl.StartChangeStream(ctx, testSliceTarget, "12")
+	require.NoError(t, err)
+	require.Equal(t, "12", <-m.watchVersions)
+	decoder := json.NewDecoder(stream)
+
+	b, err := json.Marshal(newTestPod("service1-1", "13", false, "1.2.3.5"))
+	require.NoError(t, err)
+	m.watchEventsCh <- podEvent{Type: deleted, Object: json.RawMessage(`{"metadata": {"name": "service1-0", "resourceVersion": "13"}}`)}
+	m.watchEventsCh <- podEvent{Type: modified, Object: b}
+
+	expected := endpoints{
+		Kind:       "Endpoints",
+		APIVersion: "v1",
+		Metadata:   metadata{Name: "service1", ResourceVersion: "13"},
+		Subsets: []subset{
+			{Ports: []port{{Name: "grpc", Port: 8080}}, Addresses: []address{{IP: "1.2.3.5", TargetRef: podRef("service1-1")}}},
+		},
+	}
+	var got event
+	require.NoError(t, decoder.Decode(&got))
+	require.Equal(t, event{Type: modified, Object: expected}, got)
+
+	expected.Subsets = []subset{
+		{Ports: []port{{Name: "grpc", Port: 8080}}, NotReadyAddresses: []address{{IP: "1.2.3.5", TargetRef: podRef("service1-1")}}},
+	}
+	require.NoError(t, decoder.Decode(&got))
+	require.Equal(t, event{Type: modified, Object: expected}, got)
+
+	// Bookmark advances the version of known state.
+	m.watchEventsCh <- podEvent{Type: bookmark, Object: json.RawMessage(`{"metadata": {"resourceVersion": "14"}}`)}
+	require.NoError(t, decoder.Decode(&got))
+	require.Equal(t, bookmark, got.Type)
+	require.Equal(t, "14", got.Object.Metadata.ResourceVersion)
+
+	// Resuming from the last seen version does not need list as well.
+	cancel()
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	defer cancel2()
+	_, err = cl.StartChangeStream(ctx2, testSliceTarget, "14")
+	require.NoError(t, err)
+	require.Equal(t, "14", <-m.watchVersions)
+}
+
+func TestSelectorClient_FreshWatchStartsWithList(t *testing.T) {
+	m, cl, closeFn := startSelectorAPIMock(t)
+	defer closeFn()
+
+	m.services <- newTestService(servicePort{Name: "grpc", Port: 8080})
+	m.lists <- podList{
+		Metadata: listMetadata{ResourceVersion: "20"},
+		Items:    []podObject{newTestPod("service1-0", "10", true, "1.2.3.4")},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := cl.StartChangeStream(ctx, testSliceTarget, "")
+	require.NoError(t, err)
+	require.Equal(t, "20", <-m.watchVersions)
+
+	var got event
+	require.NoError(t, json.NewDecoder(stream).Decode(&got))
+	require.Equal(t, event{
+		Type: added,
+		Object: endpoints{
+			Kind:       "Endpoints",
+			APIVersion: "v1",
+			Metadata:   metadata{Name: "service1", ResourceVersion: "20"},
+			Subsets: []subset{
+				{Ports: []port{{Name: "grpc", Port: 8080}}, Addresses: []address{{IP: "1.2.3.4", TargetRef: podRef("service1-0")}}},
+			},
+		},
+	}, got)
+}
+
+func TestResolver_WaitForService_CreatedAfterResolve(t *testing.T) {
+	var created int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/namespaces/namespace1/services/service1":
+			if atomic.LoadInt32(&created) == 0 {
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = w.Write([]byte(`{"kind": "Status", "code": 404, "message": "services \"service1\" not found"}`))
+				return
+			}
+			require.NoError(t, json.NewEncoder(w).Encode(newTestService(servicePort{Name: "grpc", Port: 8080})))
+		case "/api/v1/namespaces/namespace1/pods":
+			require.NoError(t, json.NewEncoder(w).Encode(podList{
+				Metadata: listMetadata{ResourceVersion: "10"},
+				Items:    []podObject{newTestPod("service1-0", "10", true, "1.2.3.4")},
+			}))
+		case "/api/v1/watch/namespaces/namespace1/pods":
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		default:
+			t.Errorf("unexpected request %s", r.URL.String())
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	apiClient := &k8s.APIClient{Client: srv.Client(), Address: srv.URL}
+
+	// Resolve fails by default, since the service is needed to start the watch.
+	_, err := NewWithClient(apiClient, WithEndpointAPI(SelectorAPI)).Resolve("service1.namespace1")
+	require.Error(t, err)
+
+	w, err := NewWithClient(apiClient, WithEndpointAPI(SelectorAPI), WithWaitForService(true), WithWatchBackoff(testWatchBackoff)).Resolve("service1.namespace1")
+	require.NoError(t, err)
+	defer w.Close()
+	u, err := w.Next()
+	require.NoError(t, err)
+	require.Empty(t, u)
+
+	// Addresses are resolved once the service is created.
+	atomic.StoreInt32(&created, 1)
+	u, err = w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{{Op: naming.Add, Addr: "1.2.3.4:8080"}}, u)
+}
@@ -0,0 +1,65 @@
+package k8sresolver
+
+import (
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+// serverNamePlaceholder matches placeholders of WithServerNameTemplate, e.g. {pod}.
+var serverNamePlaceholder = regexp.MustCompile(`\{[a-z]+\}`)
+
+// checkServerNameTemplate returns error if template has unknown placeholder.
+func checkServerNameTemplate(tmpl string) error {
+	for _, p := range serverNamePlaceholder.FindAllString(tmpl, -1) {
+		switch p {
+		case "{pod}", "{service}", "{namespace}", "{port}":
+		default:
+			return errors.Errorf("unknown placeholder %s in server name template %q. Expected {pod}, {service}, "+
+				"{namespace} or {port}", p, tmpl)
+		}
+	}
+	return nil
+}
+
+// serverName renders server name of the address of the target from the template. It returns empty string if the
+// template is empty or any placeholder has no value for the address, e.g. {pod} for address not backed by a pod, so
+// the authority of the grpc.ClientConn is verified instead.
+func serverName(tmpl string, t targetEntry, md AddressMetadata) string {
+	if tmpl == "" {
+		return ""
+	}
+
+	service := t.service
+	if md.Service != "" {
+		service = md.Service
+	}
+	namespace := t.namespace
+	if md.Namespace != "" {
+		namespace = md.Namespace
+	}
+	missing := false
+	name := serverNamePlaceholder.ReplaceAllStringFunc(tmpl, func(p string) string {
+		var v string
+		switch p {
+		case "{pod}":
+			if md.TargetRef != nil && md.TargetRef.Kind == "Pod" {
+				v = md.TargetRef.Name
+			}
+		case "{service}":
+			v = service
+		case "{namespace}":
+			v = namespace
+		case "{port}":
+			v = md.PortName
+		}
+		if v == "" {
+			missing = true
+		}
+		return v
+	})
+	if missing {
+		return ""
+	}
+	return name
+}
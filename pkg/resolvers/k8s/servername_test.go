@@ -0,0 +1,39 @@
+package k8sresolver
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerName_FromDecodedTargetRef(t *testing.T) {
+	var sub subset
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"addresses": [
+			{"ip": "1.2.3.4", "targetRef": {"kind": "Pod", "name": "service1-0", "namespace": "namespace1", "uid": "uid-0"}},
+			{"ip": "1.2.3.5"}
+		],
+		"ports": [{"name": "grpc", "port": 8080}]
+	}`), &sub))
+	target := targetEntry{service: "service1", namespace: "namespace1", port: noTargetPort}
+	addrs, err := subsetToAddresses(target, sub, newOptions(nil), nil)
+	require.NoError(t, err)
+
+	withPod := addrs["1.2.3.4:8080"]
+	require.Equal(t, "service1-0.service1.namespace1.svc", serverName("{pod}.{service}.{namespace}.svc", target, withPod))
+	require.Equal(t, "grpc.service1", serverName("{port}.{service}", target, withPod))
+	require.Equal(t, "", serverName("", target, withPod))
+
+	// Address without pod falls back to the authority of the connection.
+	withoutPod := addrs["1.2.3.5:8080"]
+	require.Equal(t, "", serverName("{pod}.{service}.{namespace}.svc", target, withoutPod))
+	require.Equal(t, "service1.namespace1.svc", serverName("{service}.{namespace}.svc", target, withoutPod))
+
+	// Endpoints merged by WithEndpointsSelector are named by their own service.
+	withPod.Service = "service1-shard1"
+	require.Equal(t, "service1-0.service1-shard1.namespace1.svc", serverName("{pod}.{service}.{namespace}.svc", target, withPod))
+
+	require.NoError(t, checkServerNameTemplate("spiffe-{pod}.{service}.{namespace}.svc"))
+	require.Error(t, checkServerNameTemplate("{pod}.{cluster}"))
+}
@@ -0,0 +1,45 @@
+package k8sresolver
+
+import (
+	"sync"
+)
+
+// apiServers are addresses of kube-apiserver replicas. Requests go to the last one that responded, so healthy replica
+// is preferred until it fails.
+type apiServers struct {
+	addresses []string
+
+	mu sync.Mutex
+	// preferred is an index of the address that responded last.
+	preferred int
+}
+
+func newAPIServers(addresses []string) *apiServers {
+	return &apiServers{addresses: addresses}
+}
+
+// ordered returns all addresses in order they should be tried, starting from the preferred one.
+func (s *apiServers) ordered() []string {
+	s.mu.Lock()
+	preferred := s.preferred
+	s.mu.Unlock()
+
+	ordered := make([]string, 0, len(s.addresses))
+	for i := range s.addresses {
+		ordered = append(ordered, s.addresses[(preferred+i)%len(s.addresses)])
+	}
+	return ordered
+}
+
+// markHealthy makes the address preferred.
+func (s *apiServers) markHealthy(address string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, a := range s.addresses {
+		if a == address {
+			s.preferred = i
+			return
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package k8sresolver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+type service struct {
+	Metadata metadata `json:"metadata"`
+	Spec     struct {
+		// ClusterIP is the virtual IP of the service, "None" for headless service. ClusterIPs are IPs of all families of
+		// dual-stack service, starting with ClusterIP.
+		ClusterIP  string        `json:"clusterIP"`
+		ClusterIPs []string      `json:"clusterIPs"`
+		Ports      []servicePort `json:"ports"`
+		// Selector are labels of the pods backing the service. Endpoints of service without selector are managed
+		// manually.
+		Selector map[string]string `json:"selector"`
+	} `json:"spec"`
+}
+
+type servicePort struct {
+	Name string `json:"name"`
+	Port int    `json:"port"`
+	// Protocol is TCP, UDP or SCTP. Empty means TCP.
+	Protocol    string `json:"protocol,omitempty"`
+	AppProtocol string `json:"appProtocol,omitempty"`
+	// TargetPort is a number or a name of the container port. Empty means the same number as Port.
+	TargetPort intOrString `json:"targetPort"`
+}
+
+// intOrString is a JSON value that can be either number or string, kept as string.
+type intOrString string
+
+func (v *intOrString) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		*v = intOrString(s)
+		return nil
+	}
+	var i int
+	if err := json.Unmarshal(b, &i); err != nil {
+		return err
+	}
+	*v = intOrString(strconv.Itoa(i))
+	return nil
+}
+
+// service returns the service of given name.
+// See https://kubernetes.io/docs/reference/kubernetes-api/service-resources/service-v1/
+func (c *client) service(ctx context.Context, namespace string, name string) (*service, error) {
+	svcURL := fmt.Sprintf("/api/v1/namespaces/%s/services/%s", namespace, name)
+	body, err := c.startGET(ctx, svcURL)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	var svc service
+	if err := json.NewDecoder(body).Decode(&svc); err != nil {
+		return nil, errors.Wrapf(err, "Failed to decode service from GET %s response", svcURL)
+	}
+	return &svc, nil
+}
+
+// servicePorts returns ports of the service.
+func (c *client) servicePorts(ctx context.Context, namespace string, name string) ([]servicePort, error) {
+	svc, err := c.service(ctx, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	return svc.Spec.Ports, nil
+}
+
+// mapServicePorts translates numeric service ports of the targets to the ports exposed by endpoints, if enabled by
+// WithServicePortMapping. Service of every target is looked up once. Targets of services that do not exist are kept.
+func (r *resolver) mapServicePorts(targets []targetEntry) ([]targetEntry, error) {
+	if !r.opts.mapServicePorts {
+		return targets, nil
+	}
+
+	mapped := make([]targetEntry, 0, len(targets))
+	for _, t := range targets {
+		if t.port == noTargetPort || t.port.isNamed {
+			mapped = append(mapped, t)
+			continue
+		}
+
+		ports, err := r.servicePorts(withRequestTarget(r.ctx, t.String()), t.namespace, t.service)
+		if err != nil {
+			if !isNotFound(err) {
+				return nil, errors.Wrapf(err, "k8sresolver: Failed to get service for target %v", t)
+			}
+			r.opts.logger.WithField("target", t.String()).Debug("k8sresolver: Service not found. Port is not mapped")
+		}
+		m := mapServicePort(t, ports)
+		m.servicePort = t.port.value
+		mapped = append(mapped, m)
+	}
+	return mapped, nil
+}
+
+// mapServicePort returns target with the port that endpoints expose for the service port of the target. Target is
+// returned as it is if service has no such port, since it can be the endpoints port already.
+func mapServicePort(t targetEntry, ports []servicePort) targetEntry {
+	for _, p := range ports {
+		if strconv.Itoa(p.Port) != t.port.value || (p.Protocol != "" && p.Protocol != "TCP") {
+			continue
+		}
+
+		switch {
+		case p.Name != "":
+			// Endpoints ports have the same names as service ports.
+			t.port = targetPort{value: p.Name, isNamed: true}
+		case p.TargetPort == "":
+			// Target port is the same as service port.
+		case numericRegexp.MatchString(string(p.TargetPort)):
+			t.port = targetPort{value: string(p.TargetPort)}
+		default:
+			// Only the service with single port can have it unnamed, so endpoints have single port as well. Its number
+			// is known only from endpoints, since target port is a name of the container port.
+			t.port = noTargetPort
+		}
+		return t
+	}
+	return t
+}
@@ -0,0 +1,141 @@
+package k8sresolver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/improbable-eng/kedge/pkg/k8s"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/naming"
+)
+
+func TestMapServicePort(t *testing.T) {
+	var svc service
+	require.NoError(t, json.Unmarshal([]byte(`{"spec": {"ports": [
+		{"name": "https", "port": 443, "targetPort": 8443},
+		{"name": "dns", "port": 53, "protocol": "UDP", "targetPort": 5353},
+		{"name": "dns-tcp", "port": 53, "protocol": "TCP", "targetPort": "dns-tcp"}
+	]}}`), &svc))
+	unnamed := func(targetPort string) []servicePort {
+		return []servicePort{{Port: 80, TargetPort: intOrString(targetPort)}}
+	}
+
+	for _, tcase := range []struct {
+		port     string
+		ports    []servicePort
+		expected targetPort
+	}{
+		{port: "443", ports: svc.Spec.Ports, expected: targetPort{value: "https", isNamed: true}},
+		{port: "53", ports: svc.Spec.Ports, expected: targetPort{value: "dns-tcp", isNamed: true}},
+		// Port that service does not have is passed as it is.
+		{port: "8443", ports: svc.Spec.Ports, expected: targetPort{value: "8443"}},
+		{port: "80", ports: unnamed("8080"), expected: targetPort{value: "8080"}},
+		{port: "80", ports: unnamed(""), expected: targetPort{value: "80"}},
+		{port: "80", ports: unnamed("http"), expected: noTargetPort},
+		{port: "80", ports: nil, expected: targetPort{value: "80"}},
+	} {
+		target := targetEntry{service: "service1", namespace: "namespace1", port: targetPort{value: tcase.port}}
+		require.Equal(t, tcase.expected, mapServicePort(target, tcase.ports).port, "%s in %v", tcase.port, tcase.ports)
+	}
+}
+
+func TestResolver_ServicePortMapping(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/namespaces/namespace1/services/service1":
+			_, _ = w.Write([]byte(`{"spec": {"ports": [{"name": "https", "port": 443, "targetPort": 8443}]}}`))
+		case "/api/v1/namespaces/namespace2/services/service1":
+			w.WriteHeader(http.StatusNotFound)
+		case "/api/v1/namespaces/namespace1/endpoints/service1", "/api/v1/namespaces/namespace2/endpoints/service1":
+			require.NoError(t, json.NewEncoder(w).Encode(endpoints{
+				Metadata: metadata{ResourceVersion: "10"},
+				Subsets: []subset{{
+					Ports:     []port{{Name: "https", Port: 8443}, {Name: "other", Port: 443}},
+					Addresses: []address{{IP: "1.2.3.4"}},
+				}},
+			}))
+		case "/api/v1/watch/namespaces/namespace1/endpoints/service1", "/api/v1/watch/namespaces/namespace2/endpoints/service1":
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		default:
+			t.Errorf("unexpected request %s", r.URL.String())
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	r := NewWithClient(&k8s.APIClient{Client: srv.Client(), Address: srv.URL}, WithServicePortMapping(true), WithEndpointAPI(EndpointsAPI))
+	w, err := r.Resolve("service1.namespace1,namespace2:443")
+	require.NoError(t, err)
+	defer w.Close()
+
+	// Service port is mapped in namespace1. There is no service in namespace2, so port is used as it is.
+	u, err := w.Next()
+	require.NoError(t, err)
+	require.Len(t, u, 2)
+	require.Equal(t, "1.2.3.4:443", u[0].Addr)
+	require.Equal(t, "namespace2", u[0].Metadata.(AddressMetadata).Namespace)
+	require.Equal(t, "1.2.3.4:8443", u[1].Addr)
+	require.Equal(t, "namespace1", u[1].Metadata.(AddressMetadata).Namespace)
+}
+
+func TestResolver_ServicePortWatch(t *testing.T) {
+	renamed := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/namespaces/namespace1/services/service1":
+			_, _ = w.Write([]byte(`{"spec": {"ports": [{"name": "https", "port": 443, "targetPort": 8443}]}}`))
+		case "/api/v1/namespaces/namespace1/endpoints/service1":
+			require.NoError(t, json.NewEncoder(w).Encode(endpoints{
+				Metadata: metadata{ResourceVersion: "10"},
+				Subsets: []subset{{
+					Ports:     []port{{Name: "https", Port: 8443}, {Name: "web", Port: 9443}},
+					Addresses: []address{{IP: "1.2.3.4"}},
+				}},
+			}))
+		case "/api/v1/watch/namespaces/namespace1/endpoints/service1":
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		case "/api/v1/watch/namespaces/namespace1/services/service1":
+			// Fresh watch starts with the current service, which does not change the mapping.
+			_, _ = w.Write([]byte(`{"type": "ADDED", "object": {"metadata": {"resourceVersion": "11"}, "spec": {"ports": [{"name": "https", "port": 443, "targetPort": 8443}]}}}`))
+			w.(http.Flusher).Flush()
+			<-renamed
+			_, _ = w.Write([]byte(`{"type": "MODIFIED", "object": {"metadata": {"resourceVersion": "12"}, "spec": {"ports": [{"name": "web", "port": 443, "targetPort": 9443}]}}}`))
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		default:
+			t.Errorf("unexpected request %s", r.URL.String())
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	r := NewWithClient(
+		&k8s.APIClient{Client: srv.Client(), Address: srv.URL},
+		WithServicePortMapping(true),
+		WithServicePortWatch(true),
+		WithEndpointAPI(EndpointsAPI),
+	)
+	w, err := r.Resolve("service1.namespace1:443")
+	require.NoError(t, err)
+	defer w.Close()
+
+	u, err := w.Next()
+	require.NoError(t, err)
+	require.Len(t, u, 1)
+	require.Equal(t, naming.Add, u[0].Op)
+	require.Equal(t, "1.2.3.4:8443", u[0].Addr)
+
+	// Service port is renamed, so it maps to another port of the same endpoints.
+	close(renamed)
+	u, err = w.Next()
+	require.NoError(t, err)
+	require.Len(t, u, 2)
+	require.Equal(t, naming.Delete, u[0].Op)
+	require.Equal(t, "1.2.3.4:8443", u[0].Addr)
+	require.Equal(t, naming.Add, u[1].Op)
+	require.Equal(t, "1.2.3.4:9443", u[1].Addr)
+}
@@ -0,0 +1,155 @@
+package k8sresolver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// servicePortsChange are ports of the service of the target in the namespace after it changed.
+type servicePortsChange struct {
+	namespace string
+	ports     []servicePort
+}
+
+// watchServicePorts sends ports of the service every time the service is added or modified, and nil ports when it is
+// deleted, until ctx is done. Watch is restarted with backoff when it fails.
+func (c *client) watchServicePorts(ctx context.Context, t targetEntry, opts options) <-chan []servicePort {
+	portsCh := make(chan []servicePort)
+	go func() {
+		b := newBackoff(opts.watchBackoff, opts.clock)
+		resourceVersion := ""
+		for ctx.Err() == nil {
+			startTime := opts.clock.Now()
+			err := c.proxyServicePorts(ctx, t, &resourceVersion, portsCh)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				opts.logger.WithError(err).WithField("target", t.String()).Debug("k8sresolver: Service watch failed. Restarting")
+			}
+			b.StreamEnded(startTime)
+			select {
+			case <-ctx.Done():
+				return
+			case <-opts.clock.After(b.Duration()):
+			}
+		}
+	}()
+	return portsCh
+}
+
+// proxyServicePorts watches the service from the resourceVersion and sends its ports until the watch ends. Fresh watch
+// (empty resourceVersion) starts with the current service. resourceVersion is updated by every event.
+func (c *client) proxyServicePorts(ctx context.Context, t targetEntry, resourceVersion *string, portsCh chan<- []servicePort) error {
+	svcWatchURL := fmt.Sprintf("/api/v1/watch/namespaces/%s/services/%s", t.namespace, t.service)
+	if q := c.watchQuery(*resourceVersion); len(q) > 0 {
+		svcWatchURL = fmt.Sprintf("%s?%s", svcWatchURL, q.Encode())
+	}
+	body, err := c.startGET(ctx, svcWatchURL)
+	if err != nil {
+		if isGone(err) {
+			*resourceVersion = ""
+		}
+		return err
+	}
+	defer body.Close()
+
+	decoder := newEventDecoder(body, c.maxEventSize)
+	for {
+		var got serviceEvent
+		if err := decoder.Decode(&got); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		var svc service
+		if err := json.Unmarshal(got.Object, &svc); err != nil {
+			return errors.Wrap(err, "Unable to decode service from the watch stream")
+		}
+		var ports []servicePort
+		switch got.Type {
+		case added, modified:
+			ports = svc.Spec.Ports
+		case deleted:
+		case failed:
+			var st endpoints
+			if err := json.Unmarshal(got.Object, &st); err == nil && st.Code == http.StatusGone {
+				*resourceVersion = ""
+			}
+			return errors.Errorf("Service watch failed: %s", st.Message)
+		default:
+			// Bookmark or unknown event only advances resourceVersion.
+			*resourceVersion = svc.Metadata.ResourceVersion
+			continue
+		}
+		*resourceVersion = svc.Metadata.ResourceVersion
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case portsCh <- ports:
+		}
+	}
+}
+
+// watchServicePorts starts watch of service ports of the targets with mapped service port, if enabled by
+// WithServicePortWatch and supported by the registry.
+func (w *watcher) watchServicePorts() {
+	if !w.opts.watchServicePorts || w.registry.watchServicePorts == nil {
+		return
+	}
+	for _, t := range w.targets {
+		if t.servicePort == "" {
+			continue
+		}
+		portsCh := w.registry.watchServicePorts(w.ctx, t)
+		go func(namespace string) {
+			for {
+				select {
+				case <-w.ctx.Done():
+					return
+				case ports := <-portsCh:
+					select {
+					case <-w.ctx.Done():
+						return
+					case w.servicePortsChange <- servicePortsChange{namespace: namespace, ports: ports}:
+					}
+				}
+			}
+		}(t.namespace)
+	}
+}
+
+// remapServicePort maps the service port of the target in the namespace to the port of endpoints again. If it maps to
+// another port (e.g. service port was renamed), the last event of the namespace is returned, so its subsets are
+// translated again for the new port.
+func (w *watcher) remapServicePort(c servicePortsChange) []watchResult {
+	for i, t := range w.targets {
+		if t.namespace != c.namespace || t.servicePort == "" {
+			continue
+		}
+		unmapped := t
+		unmapped.port = targetPort{value: t.servicePort}
+		mapped := mapServicePort(unmapped, c.ports)
+		if mapped.port == t.port {
+			return nil
+		}
+		w.opts.logger.WithField("target", t.String()).WithField("port", mapped.port.value).Info(
+			"k8sresolver: Service port mapping changed. Resolving the new port")
+		w.targets[i].port = mapped.port
+
+		last, ok := w.lastEvents[c.namespace]
+		if !ok {
+			return nil
+		}
+		return []watchResult{{namespace: c.namespace, ep: &last}}
+	}
+	return nil
+}
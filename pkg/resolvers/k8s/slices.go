@@ -0,0 +1,364 @@
+package k8sresolver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const serviceNameLabel = "kubernetes.io/service-name"
+
+// endpointSliceClient is an endpointClient that uses EndpointSlice API instead of Endpoints. Service can have multiple
+// slices, so all of them are merged into single endpoints object before being passed to the watcher.
+// It keeps the last known state of slices to be able to resume watch, so it should be used for single target only.
+type endpointSliceClient struct {
+	cl *client
+
+	mu              sync.Mutex
+	slices          map[string]endpointSlice
+	resourceVersion string
+}
+
+type endpointSliceList struct {
+	Metadata listMetadata    `json:"metadata"`
+	Items    []endpointSlice `json:"items"`
+}
+
+type listMetadata struct {
+	ResourceVersion string `json:"resourceVersion"`
+	// Continue is a token to get the next page of the list. Empty for the last page.
+	Continue string `json:"continue,omitempty"`
+}
+
+type endpointSlice struct {
+	Metadata    metadata        `json:"metadata"`
+	AddressType string          `json:"addressType"`
+	Endpoints   []sliceEndpoint `json:"endpoints"`
+	Ports       []port          `json:"ports"`
+}
+
+type sliceEndpoint struct {
+	Addresses  []string           `json:"addresses"`
+	Conditions endpointConditions `json:"conditions"`
+	Zone       string             `json:"zone"`
+	Hints      *endpointHints     `json:"hints"`
+	TargetRef  *objectReference   `json:"targetRef"`
+	NodeName   string             `json:"nodeName"`
+}
+
+type endpointHints struct {
+	// ForZones are zones that should consume the endpoint when topology aware routing is enabled.
+	ForZones []forZone `json:"forZones"`
+}
+
+type forZone struct {
+	Name string `json:"name"`
+}
+
+type endpointConditions struct {
+	// Nil means unknown state and should be interpreted as ready.
+	Ready *bool `json:"ready"`
+	// Serving is the same as Ready, but it is not changed to false when the pod is terminating. Nil means the same
+	// value as Ready.
+	Serving *bool `json:"serving"`
+	// Terminating is true if the pod is terminating. Nil means false.
+	Terminating *bool `json:"terminating"`
+}
+
+// isReady returns true if the endpoint can get traffic. Terminating endpoint is still ready if it is serving, so it
+// can handle the in-flight requests.
+func (c endpointConditions) isReady() bool {
+	ready := c.Ready == nil || *c.Ready
+	serving := ready
+	if c.Serving != nil {
+		serving = *c.Serving
+	}
+	return ready || (c.isTerminating() && serving)
+}
+
+func (c endpointConditions) isTerminating() bool {
+	return c.Terminating != nil && *c.Terminating
+}
+
+// sliceEvent is a watch event for EndpointSlice. Object can be either EndpointSlice or Status.
+type sliceEvent struct {
+	Type   eventType       `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+func (c *endpointSliceClient) slicesURL(t targetEntry, watch bool) string {
+	watchPath := ""
+	if watch {
+		watchPath = "/watch"
+	}
+	return fmt.Sprintf("/apis/discovery.k8s.io/v1%s/namespaces/%s/endpointslices?labelSelector=%s",
+		watchPath,
+		t.namespace,
+		url.QueryEscape(fmt.Sprintf("%s=%s", serviceNameLabel, t.service)),
+	)
+}
+
+// List returns all slices of the target merged into single endpoints object.
+func (c *endpointSliceClient) List(ctx context.Context, t targetEntry) (*endpoints, error) {
+	list, err := c.list(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+
+	slices := map[string]endpointSlice{}
+	for _, s := range list.Items {
+		slices[s.Metadata.Name] = s
+	}
+	c.setState(list.Metadata.ResourceVersion, slices)
+
+	ep := mergeSlices(t, list.Metadata.ResourceVersion, slices)
+	return &ep, nil
+}
+
+// ListPods returns pods in the namespace matching the label selector by their IPs.
+func (c *endpointSliceClient) ListPods(ctx context.Context, namespace string, selector string) (map[string]pod, error) {
+	return c.cl.ListPods(ctx, namespace, selector)
+}
+
+func (c *endpointSliceClient) setState(resourceVersion string, slices map[string]endpointSlice) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.resourceVersion = resourceVersion
+	c.slices = map[string]endpointSlice{}
+	for name, s := range slices {
+		c.slices[name] = s
+	}
+}
+
+// state returns copy of the last known slices if they are in given resourceVersion.
+func (c *endpointSliceClient) state(resourceVersion string) (map[string]endpointSlice, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if resourceVersion == "" || resourceVersion != c.resourceVersion {
+		return nil, false
+	}
+	slices := map[string]endpointSlice{}
+	for name, s := range c.slices {
+		slices[name] = s
+	}
+	return slices, true
+}
+
+// list returns all slices of the target. If page size is configured, slices are listed page by page, so no single
+// response holds all of them. resourceVersion of the last page is the one of the whole list.
+func (c *endpointSliceClient) list(ctx context.Context, t targetEntry) (*endpointSliceList, error) {
+	list := &endpointSliceList{}
+	continueToken := ""
+	for {
+		page, err := c.listPage(ctx, t, c.cl.listPageSize, continueToken)
+		if err != nil {
+			if continueToken == "" || !isGone(err) {
+				return nil, err
+			}
+			// Continue token expired, since the list took too long. Start over from the first page, as pages of
+			// different resourceVersions cannot be merged.
+			list, continueToken = &endpointSliceList{}, ""
+			continue
+		}
+
+		list.Items = append(list.Items, page.Items...)
+		list.Metadata.ResourceVersion = page.Metadata.ResourceVersion
+		if page.Metadata.Continue == "" {
+			return list, nil
+		}
+		continueToken = page.Metadata.Continue
+	}
+}
+
+func (c *endpointSliceClient) listPage(ctx context.Context, t targetEntry, limit int, continueToken string) (*endpointSliceList, error) {
+	sliceURL := c.slicesURL(t, false)
+	if limit > 0 {
+		q := url.Values{}
+		q.Set("limit", strconv.Itoa(limit))
+		if continueToken != "" {
+			q.Set("continue", continueToken)
+		}
+		sliceURL = fmt.Sprintf("%s&%s", sliceURL, q.Encode())
+	}
+
+	body, err := c.cl.startGET(ctx, sliceURL)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	var page endpointSliceList
+	if err := json.NewDecoder(body).Decode(&page); err != nil {
+		return nil, errors.Wrapf(err, "Failed to decode endpoint slices from GET %s response", sliceURL)
+	}
+	return &page, nil
+}
+
+// StartChangeStream starts stream of merged endpoint slices changes.
+// NOTE: Merging slices requires knowing all of them. If resourceVersion matches the slices state we know (from List
+// or previous stream), watch is resumed from it. Otherwise stream starts with fresh list of slices returned as the
+// first event, the same way Endpoints watch without resourceVersion does.
+func (c *endpointSliceClient) StartChangeStream(ctx context.Context, t targetEntry, resourceVersion string) (io.ReadCloser, error) {
+	var initial *event
+	slices, ok := c.state(resourceVersion)
+	if !ok {
+		list, err := c.list(ctx, t)
+		if err != nil {
+			return nil, err
+		}
+
+		slices = map[string]endpointSlice{}
+		for _, s := range list.Items {
+			slices[s.Metadata.Name] = s
+		}
+		resourceVersion = list.Metadata.ResourceVersion
+		c.setState(resourceVersion, slices)
+		initial = &event{Type: added, Object: mergeSlices(t, resourceVersion, slices)}
+	}
+
+	q := c.cl.watchQuery(resourceVersion)
+	// Merged stream needs to be resumed from exact version, even if it is empty.
+	q.Set("resourceVersion", resourceVersion)
+	sliceWatchURL := fmt.Sprintf("%s&%s", c.slicesURL(t, true), q.Encode())
+	c.cl.warnIfInsecure()
+	body, err := c.cl.startGET(ctx, sliceWatchURL)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		err := c.proxyMergedSlices(t, initial, slices, newEventDecoder(body, c.cl.maxEventSize), json.NewEncoder(pw))
+		body.Close()
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+// proxyMergedSlices decodes slice events and encodes merged endpoints events until decoding fails. It returns nil on
+// EOF, so the merged stream is closed in the same way.
+func (c *endpointSliceClient) proxyMergedSlices(
+	t targetEntry,
+	initial *event,
+	slices map[string]endpointSlice,
+	decoder *eventDecoder,
+	encoder *json.Encoder,
+) error {
+	if initial != nil {
+		if err := encoder.Encode(initial); err != nil {
+			return err
+		}
+	}
+
+	for {
+		var got sliceEvent
+		if err := decoder.Decode(&got); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		var merged event
+		switch got.Type {
+		case added, modified, deleted:
+			var s endpointSlice
+			if err := json.Unmarshal(got.Object, &s); err != nil {
+				return errors.Wrap(err, "Unable to decode endpoint slice from the watch stream")
+			}
+
+			if got.Type == deleted {
+				delete(slices, s.Metadata.Name)
+			} else {
+				slices[s.Metadata.Name] = s
+			}
+			merged = event{Type: modified, Object: mergeSlices(t, s.Metadata.ResourceVersion, slices)}
+		default:
+			// Bookmark, status and unknown events are passed as they are. Streamer will handle them.
+			merged = event{Type: got.Type}
+			if err := json.Unmarshal(got.Object, &merged.Object); err != nil {
+				return errors.Wrap(err, "Unable to decode an object from the watch stream")
+			}
+		}
+
+		if merged.Type == modified || merged.Type == bookmark {
+			// State is updated before the event is consumed, so watch can be resumed from it right after. If the event
+			// is never consumed, stream is resumed from older version that does not match the state, so it is listed
+			// again.
+			c.setState(merged.Object.Metadata.ResourceVersion, slices)
+		}
+		if err := encoder.Encode(merged); err != nil {
+			return err
+		}
+	}
+}
+
+// mergeSlices translates slices into single endpoints object with a subset per slice.
+func mergeSlices(t targetEntry, resourceVersion string, slices map[string]endpointSlice) endpoints {
+	var names []string
+	for name := range slices {
+		names = append(names, name)
+	}
+	// Keep subsets order stable.
+	sort.Strings(names)
+
+	ep := endpoints{
+		Kind:       "Endpoints",
+		APIVersion: "v1",
+		Metadata: metadata{
+			Name:            t.service,
+			ResourceVersion: resourceVersion,
+		},
+	}
+	for _, name := range names {
+		s := slices[name]
+		if s.AddressType != "IPv4" && s.AddressType != "IPv6" {
+			// FQDN slices are not supported.
+			continue
+		}
+		if len(s.Ports) == 0 {
+			// No ports means all ports are allowed, so there is no port we could resolve to.
+			continue
+		}
+
+		sub := subset{Ports: s.Ports}
+		for _, e := range s.Endpoints {
+			var forZones []string
+			if e.Hints != nil {
+				for _, z := range e.Hints.ForZones {
+					forZones = append(forZones, z.Name)
+				}
+			}
+			for _, ip := range e.Addresses {
+				a := address{
+					IP:          ip,
+					Zone:        e.Zone,
+					ForZones:    forZones,
+					TargetRef:   e.TargetRef,
+					NodeName:    e.NodeName,
+					Terminating: e.Conditions.isTerminating(),
+				}
+				if !e.Conditions.isReady() {
+					sub.NotReadyAddresses = append(sub.NotReadyAddresses, a)
+					continue
+				}
+				sub.Addresses = append(sub.Addresses, a)
+			}
+		}
+		if len(sub.Addresses) == 0 && len(sub.NotReadyAddresses) == 0 {
+			// Endpoints API does not include empty subsets as well.
+			continue
+		}
+		ep.Subsets = append(ep.Subsets, sub)
+	}
+	return ep
+}
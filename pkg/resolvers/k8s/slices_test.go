@@ -0,0 +1,299 @@
+package k8sresolver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/improbable-eng/kedge/pkg/k8s"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSlice(name string, resourceVersion string, portNum int, ips ...string) endpointSlice {
+	s := endpointSlice{
+		Metadata: metadata{
+			Name:            name,
+			ResourceVersion: resourceVersion,
+		},
+		AddressType: "IPv4",
+		Ports:       []port{{Name: "grpc", Port: portNum}},
+	}
+	for _, ip := range ips {
+		s.Endpoints = append(s.Endpoints, sliceEndpoint{Addresses: []string{ip}})
+	}
+	return s
+}
+
+type sliceAPIMock struct {
+	t *testing.T
+
+	lists         chan endpointSliceList
+	listQueries   chan url.Values
+	watchVersions chan string
+	watchEventsCh chan sliceEvent
+}
+
+func startSliceAPIMock(t *testing.T) (*sliceAPIMock, *endpointSliceClient, func()) {
+	m := &sliceAPIMock{
+		t:             t,
+		lists:         make(chan endpointSliceList, 10),
+		listQueries:   make(chan url.Values, 10),
+		watchVersions: make(chan string, 10),
+		watchEventsCh: make(chan sliceEvent, 10),
+	}
+	srv := httptest.NewServer(m)
+	cl := &endpointSliceClient{cl: &client{k8sClient: &k8s.APIClient{Client: srv.Client(), Address: srv.URL}}}
+	return m, cl, func() {
+		close(m.watchEventsCh)
+		srv.Close()
+	}
+}
+
+func (m *sliceAPIMock) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	require.Equal(m.t, serviceNameLabel+"=service1", r.URL.Query().Get("labelSelector"))
+	switch r.URL.Path {
+	case "/apis/discovery.k8s.io/v1/namespaces/namespace1/endpointslices":
+		m.listQueries <- r.URL.Query()
+		if r.URL.Query().Get("continue") == "expired" {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		select {
+		case l := <-m.lists:
+			require.NoError(m.t, json.NewEncoder(w).Encode(l))
+		default:
+			m.t.Errorf("unexpected list request")
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	case "/apis/discovery.k8s.io/v1/watch/namespaces/namespace1/endpointslices":
+		m.watchVersions <- r.URL.Query().Get("resourceVersion")
+		w.(http.Flusher).Flush()
+		for e := range m.watchEventsCh {
+			require.NoError(m.t, json.NewEncoder(w).Encode(e))
+			w.(http.Flusher).Flush()
+		}
+	default:
+		m.t.Errorf("unexpected request %s", r.URL.String())
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+var testSliceTarget = targetEntry{service: "service1", namespace: "namespace1", port: noTargetPort}
+
+func TestEndpointSliceClient_ListMergesSlices(t *testing.T) {
+	m, cl, closeFn := startSliceAPIMock(t)
+	defer closeFn()
+
+	notReady, yes := false, true
+	slice1 := newTestSlice("service1-abc", "10", 8080, "1.2.3.4")
+	slice1.Endpoints = append(slice1.Endpoints, sliceEndpoint{
+		Addresses:  []string{"1.2.3.9"},
+		Conditions: endpointConditions{Ready: &notReady},
+	}, sliceEndpoint{
+		Addresses:  []string{"1.2.3.8"},
+		Conditions: endpointConditions{Ready: &notReady, Serving: &yes, Terminating: &yes},
+	})
+	slice2 := newTestSlice("service1-def", "11", 8080, "1.2.3.5")
+	slice2.Endpoints[0].Zone = "zone-a"
+	slice2.Endpoints[0].Hints = &endpointHints{ForZones: []forZone{{Name: "zone-b"}}}
+	slice2.Endpoints[0].NodeName = "node1"
+	slice2.Endpoints[0].TargetRef = &objectReference{Kind: "Pod", Name: "service1-0", Namespace: "namespace1", UID: "uid-0"}
+	noPorts := newTestSlice("service1-ghi", "11", 8080, "1.2.3.6")
+	noPorts.Ports = nil
+	fqdn := newTestSlice("service1-jkl", "11", 8080, "example.org")
+	fqdn.AddressType = "FQDN"
+
+	m.lists <- endpointSliceList{
+		Metadata: listMetadata{ResourceVersion: "12"},
+		Items:    []endpointSlice{slice2, noPorts, slice1, fqdn},
+	}
+	ep, err := cl.List(context.Background(), testSliceTarget)
+	require.NoError(t, err)
+	require.Equal(t, endpoints{
+		Kind:       "Endpoints",
+		APIVersion: "v1",
+		Metadata:   metadata{Name: "service1", ResourceVersion: "12"},
+		Subsets: []subset{
+			{Ports: []port{{Name: "grpc", Port: 8080}}, Addresses: []address{{IP: "1.2.3.4"}, {IP: "1.2.3.8", Terminating: true}}, NotReadyAddresses: []address{{IP: "1.2.3.9"}}},
+			{Ports: []port{{Name: "grpc", Port: 8080}}, Addresses: []address{{
+				IP:        "1.2.3.5",
+				Zone:      "zone-a",
+				ForZones:  []string{"zone-b"},
+				TargetRef: &objectReference{Kind: "Pod", Name: "service1-0", Namespace: "namespace1", UID: "uid-0"},
+				NodeName:  "node1",
+			}}},
+		},
+	}, *ep)
+}
+
+func TestEndpointConditions(t *testing.T) {
+	yes, no := true, false
+	for _, tcase := range []struct {
+		conditions  endpointConditions
+		ready       bool
+		terminating bool
+	}{
+		{conditions: endpointConditions{}, ready: true},
+		{conditions: endpointConditions{Ready: &yes, Serving: &yes, Terminating: &no}, ready: true},
+		{conditions: endpointConditions{Ready: &no}},
+		{conditions: endpointConditions{Ready: &no, Serving: &no, Terminating: &no}},
+		// Serving condition alone is not enough, since pod that is not terminating should be ready as well.
+		{conditions: endpointConditions{Ready: &no, Serving: &yes, Terminating: &no}},
+		{conditions: endpointConditions{Ready: &no, Serving: &yes, Terminating: &yes}, ready: true, terminating: true},
+		{conditions: endpointConditions{Ready: &no, Serving: &no, Terminating: &yes}, terminating: true},
+		// Serving is unknown, so it is the same as ready.
+		{conditions: endpointConditions{Ready: &no, Terminating: &yes}, terminating: true},
+	} {
+		require.Equal(t, tcase.ready, tcase.conditions.isReady(), "%+v", tcase.conditions)
+		require.Equal(t, tcase.terminating, tcase.conditions.isTerminating(), "%+v", tcase.conditions)
+	}
+}
+
+func TestEndpointSliceClient_ListPages(t *testing.T) {
+	m, cl, closeFn := startSliceAPIMock(t)
+	defer closeFn()
+	cl.cl.listPageSize = 2
+
+	m.lists <- endpointSliceList{
+		Metadata: listMetadata{ResourceVersion: "12", Continue: "page2"},
+		Items:    []endpointSlice{newTestSlice("service1-abc", "10", 8080, "1.2.3.4"), newTestSlice("service1-def", "11", 8080, "1.2.3.5")},
+	}
+	m.lists <- endpointSliceList{
+		Metadata: listMetadata{ResourceVersion: "13"},
+		Items:    []endpointSlice{newTestSlice("service1-ghi", "12", 8080, "1.2.3.6")},
+	}
+	ep, err := cl.List(context.Background(), testSliceTarget)
+	require.NoError(t, err)
+	require.Equal(t, "13", ep.Metadata.ResourceVersion, "resourceVersion of the last page should be used")
+	require.Len(t, ep.Subsets, 3)
+
+	q := <-m.listQueries
+	require.Equal(t, "2", q.Get("limit"))
+	require.Equal(t, "", q.Get("continue"))
+	q = <-m.listQueries
+	require.Equal(t, "2", q.Get("limit"))
+	require.Equal(t, "page2", q.Get("continue"))
+}
+
+func TestEndpointSliceClient_ListPages_ExpiredContinue(t *testing.T) {
+	m, cl, closeFn := startSliceAPIMock(t)
+	defer closeFn()
+	cl.cl.listPageSize = 1
+
+	m.lists <- endpointSliceList{
+		Metadata: listMetadata{ResourceVersion: "12", Continue: "expired"},
+		Items:    []endpointSlice{newTestSlice("service1-abc", "10", 8080, "1.2.3.4")},
+	}
+	m.lists <- endpointSliceList{
+		Metadata: listMetadata{ResourceVersion: "20", Continue: "page2"},
+		Items:    []endpointSlice{newTestSlice("service1-abc", "10", 8080, "1.2.3.4")},
+	}
+	m.lists <- endpointSliceList{
+		Metadata: listMetadata{ResourceVersion: "20"},
+		Items:    []endpointSlice{newTestSlice("service1-def", "11", 8080, "1.2.3.5")},
+	}
+	ep, err := cl.List(context.Background(), testSliceTarget)
+	require.NoError(t, err)
+	require.Equal(t, "20", ep.Metadata.ResourceVersion)
+	require.Len(t, ep.Subsets, 2)
+
+	<-m.listQueries
+	require.Equal(t, "expired", (<-m.listQueries).Get("continue"))
+	q := <-m.listQueries
+	require.Equal(t, "1", q.Get("limit"), "list should be restarted from the first page")
+	require.Equal(t, "", q.Get("continue"))
+	require.Equal(t, "page2", (<-m.listQueries).Get("continue"))
+}
+
+func TestEndpointSliceClient_ResumesWatchFromListedVersion(t *testing.T) {
+	m, cl, closeFn := startSliceAPIMock(t)
+	defer closeFn()
+
+	m.lists <- endpointSliceList{
+		Metadata: listMetadata{ResourceVersion: "12"},
+		Items: []endpointSlice{
+			newTestSlice("service1-abc", "10", 8080, "1.2.3.4"),
+			newTestSlice("service1-def", "11", 8080, "1.2.3.5"),
+		},
+	}
+	_, err := cl.List(context.Background(), testSliceTarget)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// No list is expected, since we know the state in this version.
+	stream, err := cl.StartChangeStream(ctx, testSliceTarget, "12")
+	require.NoError(t, err)
+	require.Equal(t, "12", <-m.watchVersions)
+	decoder := json.NewDecoder(stream)
+
+	b, err := json.Marshal(newTestSlice("service1-def", "13", 8080, "1.2.3.6"))
+	require.NoError(t, err)
+	m.watchEventsCh <- sliceEvent{Type: deleted, Object: json.RawMessage(`{"metadata": {"name": "service1-abc", "resourceVersion": "13"}}`)}
+	m.watchEventsCh <- sliceEvent{Type: modified, Object: b}
+
+	expected := endpoints{
+		Kind:       "Endpoints",
+		APIVersion: "v1",
+		Metadata:   metadata{Name: "service1", ResourceVersion: "13"},
+		Subsets: []subset{
+			{Ports: []port{{Name: "grpc", Port: 8080}}, Addresses: []address{{IP: "1.2.3.5"}}},
+		},
+	}
+	var got event
+	require.NoError(t, decoder.Decode(&got))
+	require.Equal(t, event{Type: modified, Object: expected}, got)
+
+	expected.Subsets = []subset{
+		{Ports: []port{{Name: "grpc", Port: 8080}}, Addresses: []address{{IP: "1.2.3.6"}}},
+	}
+	require.NoError(t, decoder.Decode(&got))
+	require.Equal(t, event{Type: modified, Object: expected}, got)
+
+	// Bookmark advances the version of known state.
+	m.watchEventsCh <- sliceEvent{Type: bookmark, Object: json.RawMessage(`{"metadata": {"resourceVersion": "14"}}`)}
+	require.NoError(t, decoder.Decode(&got))
+	require.Equal(t, bookmark, got.Type)
+	require.Equal(t, "14", got.Object.Metadata.ResourceVersion)
+
+	// Resuming from the last seen version does not need list as well.
+	cancel()
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	defer cancel2()
+	_, err = cl.StartChangeStream(ctx2, testSliceTarget, "14")
+	require.NoError(t, err)
+	require.Equal(t, "14", <-m.watchVersions)
+}
+
+func TestEndpointSliceClient_FreshWatchStartsWithList(t *testing.T) {
+	m, cl, closeFn := startSliceAPIMock(t)
+	defer closeFn()
+
+	m.lists <- endpointSliceList{
+		Metadata: listMetadata{ResourceVersion: "20"},
+		Items:    []endpointSlice{newTestSlice("service1-abc", "10", 8080, "1.2.3.4")},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := cl.StartChangeStream(ctx, testSliceTarget, "")
+	require.NoError(t, err)
+	require.Equal(t, "20", <-m.watchVersions)
+
+	var got event
+	require.NoError(t, json.NewDecoder(stream).Decode(&got))
+	require.Equal(t, event{
+		Type: added,
+		Object: endpoints{
+			Kind:       "Endpoints",
+			APIVersion: "v1",
+			Metadata:   metadata{Name: "service1", ResourceVersion: "20"},
+			Subsets: []subset{
+				{Ports: []port{{Name: "grpc", Port: 8080}}, Addresses: []address{{IP: "1.2.3.4"}}},
+			},
+		},
+	}, got)
+}
@@ -3,47 +3,364 @@ package k8sresolver
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
+// minStreamRestartInterval is a minimum time between starts of consecutive streams. It protects kube-apiserver from
+// being hammered in case it closes our watches immediately.
+var minStreamRestartInterval = 1 * time.Second
+
+// ConnState is a state of the endpoints watch connection to kube-apiserver. See WithOnConnState.
+type ConnState int
+
+const (
+	// ConnStateConnecting means that the watch is being started for the first time.
+	ConnStateConnecting ConnState = iota
+	// ConnStateConnected means that the watch stream is open.
+	ConnStateConnected
+	// ConnStateReconnecting means that the watch stream was closed or failed and it is being started again.
+	ConnStateReconnecting
+	// ConnStateFailed means that the watch failed with irrecoverable error and it is not started again.
+	ConnStateFailed
+	// ConnStateCircuitOpen means that the watch was restarted too many times, so it is degraded and not started again
+	// until the cooldown passes. See WithCircuitBreaker.
+	ConnStateCircuitOpen
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case ConnStateConnecting:
+		return "Connecting"
+	case ConnStateConnected:
+		return "Connected"
+	case ConnStateReconnecting:
+		return "Reconnecting"
+	case ConnStateFailed:
+		return "Failed"
+	case ConnStateCircuitOpen:
+		return "CircuitOpen"
+	}
+	return fmt.Sprintf("ConnState(%d)", int(s))
+}
+
 // startWatchingEndpointsChanges starts a stream that in go routine reads from connection for every change event.
-// Since watcher.Next() errors are assumed irrecoverable, it is a caller responsibility to re-resolve on EOF, error event etc.
+// Stream starts from given resourceVersion or from the current state if it is empty.
+// kube-apiserver closes long-lived watches from time to time, so in that case stream is started again from the last
+// resourceVersion seen. This way we only get events we missed instead of the whole state from the scratch.
+// If resourceVersion expired (410 Gone) we start fresh watch. Since every event holds full endpoints object, watcher
+// will reconcile its state with it, without deleting everything blindly.
+// Failed attempts to restart the stream are retried with backoff configured in options.
+// Since watcher.Next() errors are assumed irrecoverable, it is a caller responsibility to re-resolve on error event etc.
+// If DNS fallback is configured, addresses are resolved from DNS while the watch cannot be started and no error is ever
+// passed. See WithDNSFallback.
 // We read connection from separate go routine because read is blocking with no timeout/cancel logic.
 func startWatchingEndpointsChanges(
 	ctx context.Context,
 	target targetEntry,
 	epClient endpointClient,
+	resourceVersion string,
 	eventsCh chan<- watchResult,
+	opts options,
 ) error {
-	innerCtx, innerCancel := context.WithCancel(ctx)
-	stream, err := epClient.StartChangeStream(innerCtx, target)
+	s := &streamWatcher{
+		ctx:             ctx,
+		target:          target,
+		epClient:        epClient,
+		eventsCh:        eventsCh,
+		resourceVersion: resourceVersion,
+		backoff:         newBackoff(opts.watchBackoff, opts.clock),
+		clock:           opts.clock,
+		metrics:         opts.metrics,
+		logger:          opts.logger.WithField("target", target.String()),
+		watchTimeout:    opts.watchTimeout,
+		maxEventSize:    opts.maxEventSize,
+		tracer:          opts.tracer,
+		dnsResolver:     opts.dnsFallback,
+		clusterDomain:   opts.clusterDomain,
+		onConnState:     opts.onConnState,
+		connState:       ConnStateConnecting,
+	}
+	if opts.circuitBreaker != nil {
+		s.circuit = newCircuitBreaker(*opts.circuitBreaker, opts.clock)
+		s.setCircuitState(CircuitClosed)
+	}
+
+	s.notifyConnState()
+	stream, err := s.startStream()
+	if err != nil {
+		err = errors.Wrapf(err, "k8sresolver: Failed to do start stream for target %v", target)
+		if opts.waitForService && isNotFound(err) {
+			// Stream is restarted with backoff until the service appears. Target has no addresses meanwhile.
+			s.logger.WithError(err).Info("k8sresolver: Service does not exist yet. Waiting for it to be created")
+			s.setConnState(ConnStateReconnecting)
+			go func() {
+				if stream, ok := s.restartStream(s.backoff.Duration()); ok {
+					s.run(stream)
+				}
+			}()
+			return nil
+		}
+		if s.dnsResolver == nil {
+			s.setConnState(ConnStateFailed)
+			return err
+		}
+		s.setConnState(ConnStateReconnecting)
+		s.startDNSFallback(err)
+		go func() {
+			if stream, ok := s.restartStream(s.backoff.Duration()); ok {
+				s.run(stream)
+			}
+		}()
+		return nil
+	}
+
+	s.setConnState(ConnStateConnected)
+	go s.run(stream)
+	return nil
+}
+
+type streamWatcher struct {
+	ctx      context.Context
+	target   targetEntry
+	epClient endpointClient
+	eventsCh chan<- watchResult
+
+	// resourceVersion is the last version of endpoints object we have seen.
+	resourceVersion string
+	backoff         *backoff
+	clock           clock
+	metrics         *metrics
+	logger          logrus.FieldLogger
+	// watchTimeout is a timeout of the watch. Stream without any data for longer than 1.5x of it is restarted.
+	watchTimeout time.Duration
+	maxEventSize int64
+	tracer       Tracer
+
+	// dnsResolver is used to resolve addresses while the watch is unavailable. Fallback is disabled if nil.
+	dnsResolver DNSResolver
+	// clusterDomain is the DNS domain of the cluster looked up by the fallback.
+	clusterDomain string
+	// fallback is running DNS fallback, if any.
+	fallback *dnsFallback
+	// failures is a number of failed watch restarts in a row.
+	failures int
+	// circuit throttles restarts, if not nil.
+	circuit *circuitBreaker
+
+	// onConnState is called on every change of connState, if not nil.
+	onConnState func(target string, state ConnState)
+	connState   ConnState
+}
+
+// stream is a single watch connection.
+type stream struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	conn      io.ReadCloser
+	startTime time.Time
+}
+
+// startStream starts watch from the last seen resourceVersion. If it is too old, fresh watch is started.
+func (s *streamWatcher) startStream() (*stream, error) {
+	_, span := s.tracer.Start(s.ctx, "k8sresolver.Watch")
+	defer span.End()
+	span.SetAttributes(targetAttributes(s.target)...)
+
+	innerCtx, innerCancel := context.WithCancel(s.ctx)
+	conn, err := s.epClient.StartChangeStream(innerCtx, s.target, s.resourceVersion)
+	if err != nil && s.resourceVersion != "" && isGone(err) {
+		s.logger.WithError(err).Debugf("k8sresolver: resourceVersion %s is too old. Starting fresh watch", s.resourceVersion)
+		s.resourceVersion = ""
+		conn, err = s.epClient.StartChangeStream(innerCtx, s.target, s.resourceVersion)
+	}
+	span.SetAttributes(Attribute{Key: ResourceVersionAttributeKey, Value: s.resourceVersion})
 	if err != nil {
+		span.RecordError(err)
 		innerCancel()
-		return errors.Wrapf(err, "k8sresolver: Failed to do start stream for target %v", target)
+		return nil, err
+	}
+	return &stream{ctx: innerCtx, cancel: innerCancel, conn: conn, startTime: s.clock.Now()}, nil
+}
+
+// run proxies events from the stream and restarts it with backoff when it is closed or fails to start.
+func (s *streamWatcher) run(st *stream) {
+	for {
+		if !s.proxyStream(st) || s.ctx.Err() != nil {
+			return
+		}
+		s.setConnState(ConnStateReconnecting)
+		s.backoff.StreamEnded(st.startTime)
+
+		delay := s.backoff.Duration()
+		if d := minStreamRestartInterval - s.clock.Now().Sub(st.startTime); d > delay {
+			delay = d
+		}
+		var ok bool
+		if st, ok = s.restartStream(delay); !ok {
+			return
+		}
+	}
+}
+
+// restartStream starts the stream after the delay, retrying with backoff until it succeeds. It returns false if the
+// stream cannot be started anymore.
+func (s *streamWatcher) restartStream(delay time.Duration) (*stream, bool) {
+	for {
+		select {
+		case <-s.ctx.Done():
+			return nil, false
+		case <-s.clock.After(delay):
+		}
+		if s.circuit != nil && s.circuit.Restart() && !s.waitCooldown() {
+			return nil, false
+		}
+
+		s.metrics.watchReconnects.WithLabelValues(s.target.String()).Inc()
+		st, err := s.startStream()
+		if err == nil {
+			if s.circuit != nil && s.circuit.State() != CircuitClosed {
+				s.circuit.Connected()
+				s.setCircuitState(CircuitClosed)
+			}
+			s.setConnState(ConnStateConnected)
+			s.failures = 0
+			// Stream starts from the current state, since resourceVersion is reset when fallback starts.
+			s.stopDNSFallback()
+			return st, true
+		}
+		if s.ctx.Err() != nil {
+			return nil, false
+		}
+		s.failures++
+		err = errors.Wrap(err, "Failed to restart watch stream")
+		if isFatal(err) && s.dnsResolver == nil {
+			s.sendErr(err)
+			return nil, false
+		}
+		if isFatal(err) || s.failures >= dnsFallbackAfterFailures {
+			s.startDNSFallback(err)
+		}
+		if d, ok := retryAfterOf(err); ok {
+			// kube-apiserver told us when to come back (e.g. 429 of API Priority and Fairness), so backoff is not
+			// needed. Misbehaving proxy must not stop the watch for longer than the backoff would, though.
+			delay = d
+			if maxDelay := s.backoff.cnf.Max; maxDelay > 0 && delay > maxDelay {
+				delay = maxDelay
+			}
+		} else {
+			delay = s.backoff.Duration()
+		}
+		s.logger.WithError(err).Debugf("k8sresolver: Failed to restart watch stream. Retrying in %v", delay)
 	}
+}
+
+// waitCooldown waits while the circuit is open and makes it half-open. It returns false if the stream cannot be started
+// anymore.
+func (s *streamWatcher) waitCooldown() bool {
+	cooldown := s.circuit.cnf.Cooldown
+	s.logger.Warnf("k8sresolver: Watch stream restarted too many times. Not restarting it for %v", cooldown)
+	s.setCircuitState(CircuitOpen)
+	s.setConnState(ConnStateCircuitOpen)
+	select {
+	case <-s.ctx.Done():
+		return false
+	case <-s.clock.After(cooldown):
+	}
+	s.circuit.CooledDown()
+	s.setCircuitState(CircuitHalfOpen)
+	s.setConnState(ConnStateReconnecting)
+	return true
+}
+
+// proxyStream proxies all events from given stream and closes it. It returns true if stream can be resumed.
+func (s *streamWatcher) proxyStream(st *stream) bool {
+	defer st.cancel()
 
 	go func() {
 		select {
-		case <-innerCtx.Done():
+		case <-st.ctx.Done():
 			// Request is cancelled, so we need to read what is left there to not leak go routines.
-			_, _ = ioutil.ReadAll(stream)
-			err = stream.Close()
+			_, _ = ioutil.ReadAll(st.conn)
+			err := st.conn.Close()
 			if err != nil {
-				logrus.WithError(err).Warn("k8sresolver: Failed to Close cancelled stream connection")
+				s.logger.WithError(err).Warn("k8sresolver: Failed to Close cancelled stream connection")
 			}
 		}
 	}()
 
-	go func() {
-		proxyAllEvents(innerCtx, json.NewDecoder(stream), eventsCh)
-		innerCancel()
-	}()
+	var r io.Reader = st.conn
+	if s.watchTimeout > 0 {
+		idleTimeout := s.watchTimeout + s.watchTimeout/2
+		timer := s.clock.AfterFunc(idleTimeout, st.cancel)
+		defer timer.Stop()
+		r = &idleTimeoutReader{r: st.conn, timeout: idleTimeout, timer: timer}
+	}
+	return s.proxyAllEvents(st.ctx, newEventDecoder(r, s.maxEventSize))
+}
 
-	return nil
+// idleTimeoutReader resets timer every time it reads some data.
+type idleTimeoutReader struct {
+	r       io.Reader
+	timeout time.Duration
+	timer   timer
+}
+
+func (r *idleTimeoutReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	return n, err
+}
+
+// errEventTooLarge is returned when single event in the watch stream exceeds the maximum size.
+var errEventTooLarge = errors.New("event exceeds maximum size")
+
+// eventDecoder decodes events from the watch stream one at a time, without reading the whole stream. Events are split
+// by JSON object boundaries, not by lines or reads, so event spanning many reads (or many events in single read) is
+// decoded the same way. Decoding fails with errEventTooLarge if single event is bigger than maxSize, so malformed frame
+// cannot make us buffer unbounded data.
+type eventDecoder struct {
+	dec *json.Decoder
+	r   *eventSizeLimitReader
+}
+
+// newEventDecoder returns eventDecoder reading from r. maxSize 0 means no limit.
+func newEventDecoder(r io.Reader, maxSize int64) *eventDecoder {
+	lr := &eventSizeLimitReader{r: r, maxSize: maxSize}
+	return &eventDecoder{dec: json.NewDecoder(lr), r: lr}
+}
+
+// Decode decodes the next event from the stream.
+func (d *eventDecoder) Decode(v interface{}) error {
+	err := d.dec.Decode(v)
+	d.r.eventStart = d.dec.InputOffset()
+	return err
+}
+
+// eventSizeLimitReader fails reading if data read since the start of the current event exceeds maxSize.
+type eventSizeLimitReader struct {
+	r       io.Reader
+	maxSize int64
+	// read is the number of bytes read so far and eventStart is the stream offset of the current event.
+	read       int64
+	eventStart int64
+}
+
+func (r *eventSizeLimitReader) Read(p []byte) (int, error) {
+	if r.maxSize > 0 && r.read-r.eventStart > r.maxSize {
+		return 0, errEventTooLarge
+	}
+	n, err := r.r.Read(p)
+	r.read += int64(n)
+	return n, err
 }
 
 type eventType string
@@ -53,59 +370,146 @@ const (
 	modified eventType = "MODIFIED"
 	deleted  eventType = "DELETED"
 	failed   eventType = "ERROR"
+	// bookmark carries only up to date resourceVersion of the watched objects.
+	bookmark eventType = "BOOKMARK"
 )
 
+// statusKind is a kind of the object apiserver sends instead of the watched one on failure.
+const statusKind = "Status"
+
 // event represents a single event to a watched resource.
 type event struct {
 	Type   eventType `json:"type"`
 	Object endpoints `json:"object"`
 }
 
-// proxyAllEvents gets events in loop and proxies to eventsCh. If event include some error it always returns, because
-// watchers.Next errors are meant to irrecoverable.
-func proxyAllEvents(ctx context.Context, decoder *json.Decoder, eventsCh chan<- watchResult) {
+// proxyAllEvents gets events in loop and proxies to eventsCh. Transient errors (e.g. malformed event) are recovered by
+// resync, since watchers.Next errors are meant to be irrecoverable. It returns true only if watch can be resumed.
+func (s *streamWatcher) proxyAllEvents(ctx context.Context, decoder *eventDecoder) bool {
 	for ctx.Err() == nil {
-		var eventErr error
 		var got event
 		// Blocking read.
 		if err := decoder.Decode(&got); err != nil {
-			if ctx.Err() != nil {
+			if s.ctx.Err() != nil {
 				// Stopping state.
-				return
+				return false
+			}
+			if ctx.Err() != nil {
+				// Stream was idle for too long. We can resume it.
+				s.logger.Debugf("k8sresolver: Watch stream timed out. Resuming from resourceVersion %s", s.resourceVersion)
+				return true
 			}
 			switch err {
 			case io.EOF:
-				// Watch closed normally - weird.
-				eventErr = errors.Wrap(err, "EOF during watch stream event decoding")
+				// Watch closed normally by kube-apiserver. We can resume it.
+				s.logger.Debugf("k8sresolver: Watch stream closed by server. Resuming from resourceVersion %s", s.resourceVersion)
+				return true
 			case io.ErrUnexpectedEOF:
-				eventErr = errors.Wrap(err, "Unexpected EOF during watch stream event decoding")
+				return s.resync(errors.Wrap(err, "Unexpected EOF during watch stream event decoding"))
 			default:
-				eventErr = errors.Wrap(err, "Unable to decode an event from the watch stream")
+				return s.resync(errors.Wrap(err, "Unable to decode an event from the watch stream"))
 			}
 		}
 
-		if eventErr == nil {
-			switch got.Type {
-			case added, modified, deleted:
-			// All is fine.
-			case failed:
-				eventErr = errors.Errorf("%s: %s. Code: %d",
-					got.Object.Status,
-					got.Object.Message,
-					got.Object.Code,
-				)
-			default:
-				eventErr = errors.Errorf("Got invalid watch event type: %v", got.Type)
-			}
+		if got.Type == failed || got.Object.Kind == statusKind {
+			// Status object holds no subsets, so it is never passed to the watcher as endpoints.
+			return s.handleStatus(got.Object)
 		}
 
-		eventsCh <- watchResult{
-			ep:  &got,
-			err: eventErr,
+		switch got.Type {
+		case added, modified, deleted:
+			if v := got.Object.Metadata.ResourceVersion; v != "" {
+				s.resourceVersion = v
+			}
+		case bookmark:
+			// Nothing changed, so there is nothing to pass to the watcher.
+			if v := got.Object.Metadata.ResourceVersion; v != "" {
+				s.resourceVersion = v
+			}
+			continue
+		default:
+			return s.resync(errors.Errorf("Got invalid watch event type: %v", got.Type))
 		}
-		if eventErr != nil {
-			// Error is irrecoverable for watcher.Next(). Return here.
-			return
+
+		select {
+		case <-s.ctx.Done():
+			return false
+		case s.eventsCh <- watchResult{namespace: s.target.namespace, ep: &got}:
 		}
 	}
+	// Stream can be resumed if it was cancelled because of idle timeout.
+	return s.ctx.Err() == nil
+}
+
+// handleStatus handles Status object sent by apiserver instead of endpoints. It returns true if stream can be resumed.
+func (s *streamWatcher) handleStatus(st endpoints) bool {
+	if st.Code == http.StatusGone {
+		// Our resourceVersion is too old. Start fresh watch.
+		s.logger.Debugf("k8sresolver: resourceVersion %s is too old. Starting fresh watch", s.resourceVersion)
+		s.resourceVersion = ""
+		return true
+	}
+	statusErr := &watchStatusError{status: st.Status, message: st.Message, code: st.Code}
+	if !isFatalStatusCode(st.Code) || s.dnsResolver != nil {
+		// Transient error (e.g 429, 500, 503). Stream is restarted with backoff. With DNS fallback, any error is
+		// treated this way, so the fallback starts if restart fails the same way.
+		return s.resync(statusErr)
+	}
+	// Error is irrecoverable for watcher.Next(). Return here.
+	s.sendErr(statusErr)
+	return false
+}
+
+// watchStatusError is returned when kube-apiserver sends Status object in the watch stream.
+type watchStatusError struct {
+	status  string
+	message string
+	code    int
+}
+
+func (e *watchStatusError) Error() string {
+	return fmt.Sprintf("%s: %s. Code: %d", e.status, e.message, e.code)
+}
+
+// isFatalStatusCode returns true if Status object with given code means that watch will never succeed without changes
+// in the configuration. Unlike for list, where NotFound means that endpoints do not exist yet, NotFound sent in the
+// watch stream is fatal.
+func isFatalStatusCode(code int) bool {
+	return isFatalCode(code) || code == http.StatusNotFound
+}
+
+// resync logs transient error and starts fresh watch, which begins with the current state of endpoints.
+func (s *streamWatcher) resync(err error) bool {
+	s.logger.WithError(err).Warn("k8sresolver: Watch stream failed. Resyncing")
+	s.resourceVersion = ""
+	return true
+}
+
+// setConnState changes the state and notifies about it, unless it is the same state.
+func (s *streamWatcher) setConnState(state ConnState) {
+	if state == s.connState {
+		return
+	}
+	s.connState = state
+	s.notifyConnState()
+}
+
+func (s *streamWatcher) setCircuitState(state CircuitState) {
+	s.metrics.circuitState.WithLabelValues(s.target.String()).Set(float64(state))
+}
+
+func (s *streamWatcher) notifyConnState() {
+	if s.onConnState != nil {
+		s.onConnState(s.target.String(), s.connState)
+	}
+}
+
+// sendErr passes fatal error to the watcher.
+func (s *streamWatcher) sendErr(err error) {
+	s.logger.WithError(err).Warn("k8sresolver: Watch stream failed. Giving up")
+	s.setConnState(ConnStateFailed)
+	select {
+	case <-s.ctx.Done():
+	case s.eventsCh <- watchResult{namespace: s.target.namespace, err: err}:
+	}
 }
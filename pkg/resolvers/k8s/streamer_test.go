@@ -1,14 +1,20 @@
 package k8sresolver
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"sync/atomic"
 	"testing"
+	"testing/iotest"
 	"time"
 
+	"github.com/improbable-eng/kedge/pkg/k8s"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -17,14 +23,28 @@ type readerCloserMock struct {
 	BytesCh  <-chan []byte
 	ErrCh    <-chan error
 	IsClosed atomic.Value
+
+	// pending is a rest of the chunk that did not fit into the last read.
+	pending []byte
 }
 
 func (m *readerCloserMock) Read(p []byte) (n int, err error) {
+	// Do not steal bytes designated for the next stream when cancelled.
+	if m.Ctx.Err() != nil {
+		return 0, m.Ctx.Err()
+	}
+	if len(m.pending) > 0 {
+		n = copy(p, m.pending)
+		m.pending = m.pending[n:]
+		return n, nil
+	}
+
 	select {
 	case <-m.Ctx.Done():
 		return 0, m.Ctx.Err()
 	case chunk := <-m.BytesCh:
 		n = copy(p, chunk)
+		m.pending = chunk[n:]
 		return n, nil
 	case err := <-m.ErrCh:
 		return 0, err
@@ -44,31 +64,98 @@ func (m *readerCloserMock) isClosed() bool {
 	return false
 }
 
+// testWatchBackoff does not slow down tests.
+var testWatchBackoff = WatchBackoff{
+	Base:               10 * time.Millisecond,
+	Max:                50 * time.Millisecond,
+	Multiplier:         2,
+	MinHealthyDuration: time.Second,
+}
+
+func init() {
+	// Do not slow down tests.
+	minStreamRestartInterval = 50 * time.Millisecond
+}
+
+// requireClosedEventually waits for connection to be closed, since it is done asynchronously.
+func requireClosedEventually(t *testing.T, connMock *readerCloserMock) {
+	for i := 0; i < 20; i++ {
+		if connMock.isClosed() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("connection was expected to be closed")
+}
+
+type startedStream struct {
+	resourceVersion string
+	connMock        *readerCloserMock
+}
+
 type endpointClientMock struct {
 	t *testing.T
 
-	expectedTarget          targetEntry
-	expectedResourceVersion int
+	expectedTarget targetEntry
 
-	connMock *readerCloserMock
+	bytesCh <-chan []byte
+	errCh   <-chan error
+	// startErrCh allows to fail next StartChangeStream call.
+	startErrCh chan error
+	// streamsCh gets every started stream.
+	streamsCh chan startedStream
+
+	listResult *endpoints
+	listErr    error
+	// lists is a number of List calls.
+	lists int32
+
+	expectedSelector string
+	pods             map[string]pod
+	// podLists is a number of ListPods calls.
+	podLists int32
 }
 
-func (m *endpointClientMock) StartChangeStream(ctx context.Context, t targetEntry) (io.ReadCloser, error) {
+func (m *endpointClientMock) List(_ context.Context, t targetEntry) (*endpoints, error) {
 	require.Equal(m.t, m.expectedTarget, t)
-	m.connMock.Ctx = ctx
-	return m.connMock, nil
+	atomic.AddInt32(&m.lists, 1)
+	return m.listResult, m.listErr
 }
 
-func startTestStream(t *testing.T) (chan []byte, chan error, *readerCloserMock, chan watchResult, func()) {
-	bytesCh := make(chan []byte)
-	errCh := make(chan error)
-	ctx, cancel := context.WithCancel(context.TODO())
+func (m *endpointClientMock) ListPods(_ context.Context, namespace string, selector string) (map[string]pod, error) {
+	require.Equal(m.t, m.expectedTarget.namespace, namespace)
+	require.Equal(m.t, m.expectedSelector, selector)
+	atomic.AddInt32(&m.podLists, 1)
+	// Pods are copied, so changes made by the test are not seen before pods are listed again.
+	pods := make(map[string]pod, len(m.pods))
+	for ip, p := range m.pods {
+		pods[ip] = p
+	}
+	return pods, nil
+}
+
+func (m *endpointClientMock) StartChangeStream(ctx context.Context, t targetEntry, resourceVersion string) (io.ReadCloser, error) {
+	require.Equal(m.t, m.expectedTarget, t)
+	select {
+	case err := <-m.startErrCh:
+		m.streamsCh <- startedStream{resourceVersion: resourceVersion}
+		return nil, err
+	default:
+	}
 
 	connMock := &readerCloserMock{
 		Ctx:     ctx,
-		BytesCh: bytesCh,
-		ErrCh:   errCh,
+		BytesCh: m.bytesCh,
+		ErrCh:   m.errCh,
 	}
+	m.streamsCh <- startedStream{resourceVersion: resourceVersion, connMock: connMock}
+	return connMock, nil
+}
+
+func startTestStream(t *testing.T, opts ...Option) (chan []byte, chan error, *endpointClientMock, *readerCloserMock, chan watchResult, func()) {
+	bytesCh := make(chan []byte)
+	errCh := make(chan error)
+	ctx, cancel := context.WithCancel(context.TODO())
 
 	testTarget := targetEntry{
 		service:   "service1",
@@ -79,98 +166,544 @@ func startTestStream(t *testing.T) (chan []byte, chan error, *readerCloserMock,
 	epClientMock := &endpointClientMock{
 		t:              t,
 		expectedTarget: testTarget,
-		connMock:       connMock,
-	}
-
-	streamWatcherCtx, cancel2 := context.WithCancel(ctx)
-	closeFn := func() {
-		cancel()
-		cancel2()
+		bytesCh:        bytesCh,
+		errCh:          errCh,
+		startErrCh:     make(chan error, 1),
+		streamsCh:      make(chan startedStream, 10),
 	}
 
 	eventsCh := make(chan watchResult)
 
 	err := startWatchingEndpointsChanges(
-		streamWatcherCtx,
+		ctx,
 		testTarget,
 		epClientMock,
+		"",
 		eventsCh,
+		newOptions(append([]Option{WithWatchBackoff(testWatchBackoff)}, opts...)),
 	)
 	if err != nil {
-		closeFn()
+		cancel()
 		t.Fatal(err.Error())
 	}
 
-	return bytesCh, errCh, connMock, eventsCh, closeFn
+	stream := <-epClientMock.streamsCh
+	require.Equal(t, "", stream.resourceVersion, "first stream should start from the current state")
+	return bytesCh, errCh, epClientMock, stream.connMock, eventsCh, cancel
+}
+
+// requireResynced checks that stream was restarted from the current state without passing any event.
+func requireResynced(t *testing.T, epClientMock *endpointClientMock, connMock *readerCloserMock, eventsCh <-chan watchResult) {
+	select {
+	case e := <-eventsCh:
+		t.Errorf("No event was expected, got %v", e)
+	case stream := <-epClientMock.streamsCh:
+		require.Equal(t, "", stream.resourceVersion)
+		require.NotNil(t, stream.connMock)
+	case <-time.After(200 * time.Millisecond):
+		t.Fatal("Stream was not restarted")
+	}
+	requireClosedEventually(t, connMock)
 }
 
-func TestStreamWatcher_DecodingError_EventErr_ClosesStream(t *testing.T) {
-	bytesCh, _, connMock, eventsCh, cancel := startTestStream(t)
+func TestStreamWatcher_DecodingError_Resyncs(t *testing.T) {
+	bytesCh, _, epClientMock, connMock, eventsCh, cancel := startTestStream(t)
 	defer cancel()
 
+	sendTestEvent(t, bytesCh, event{Type: added, Object: endpoints{Metadata: metadata{ResourceVersion: "123"}}})
+	gotEvent := <-eventsCh
+	require.NoError(t, gotEvent.err)
+
 	// Triggering error while decoding.
 	// It should block on connMock.Read by now.
 	// Send some undecodable stuff:
 	bytesCh <- []byte(`{{{{ "temp-err": true}`)
-	event := <-eventsCh
-	require.Error(t, event.err, "we expect it fails to decode eventCh")
+	requireResynced(t, epClientMock, connMock, eventsCh)
+}
+
+func TestStreamWatcher_TooLargeEvent_Resyncs(t *testing.T) {
+	bytesCh, _, epClientMock, connMock, eventsCh, cancel := startTestStream(t, WithMaxEventSize(1024))
+	defer cancel()
+
+	sendTestEvent(t, bytesCh, event{Type: added, Object: newTestEndpoints("123", 8080, "1.2.3.4")})
+	gotEvent := <-eventsCh
+	require.NoError(t, gotEvent.err)
+
+	var ips []string
+	for i := 0; i < 100; i++ {
+		ips = append(ips, fmt.Sprintf("1.2.3.%d", i))
+	}
+	b, err := json.Marshal(event{Type: modified, Object: newTestEndpoints("124", 8080, ips...)})
+	require.NoError(t, err)
+	// Giant frame is passed in small chunks, as it would come from the connection.
+	for len(b) > 0 {
+		n := 100
+		if n > len(b) {
+			n = len(b)
+		}
+		select {
+		case bytesCh <- b[:n]:
+		case stream := <-epClientMock.streamsCh:
+			require.Equal(t, "", stream.resourceVersion)
+			requireClosedEventually(t, connMock)
+			return
+		}
+		b = b[n:]
+	}
+	requireResynced(t, epClientMock, connMock, eventsCh)
+}
+
+func TestEventDecoder_BackToBackEvents(t *testing.T) {
+	var body []byte
+	for i := 0; i < 3; i++ {
+		b, err := json.Marshal(event{Type: modified, Object: newTestEndpoints(fmt.Sprintf("1%d", i), 8080, "1.2.3.4")})
+		require.NoError(t, err)
+		body = append(body, b...)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// All events in single chunk, without separators, and the stream kept open.
+		_, _ = w.Write(body)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
 
-	// Expect connection closed.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cl := &client{k8sClient: &k8s.APIClient{Client: srv.Client(), Address: srv.URL}}
+	conn, err := cl.StartChangeStream(ctx, targetEntry{service: "service1", namespace: "namespace1"}, "10")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Every event is decoded as soon as it is read, without waiting for the stream to end. Limit is lower than the
+	// whole body, but higher than single event.
+	decoder := newEventDecoder(conn, int64(len(body)/2))
+	for i := 0; i < 3; i++ {
+		var got event
+		require.NoError(t, decoder.Decode(&got))
+		require.Equal(t, fmt.Sprintf("1%d", i), got.Object.Metadata.ResourceVersion)
+	}
+}
+
+func TestEventDecoder_EventSplitAcrossReads(t *testing.T) {
+	var body []byte
+	for i := 0; i < 2; i++ {
+		b, err := json.Marshal(event{Type: modified, Object: newTestEndpoints(fmt.Sprintf("1%d", i), 8080, "1.2.3.4", "1.2.3.5")})
+		require.NoError(t, err)
+		// Events are separated by new lines, the same way kube-apiserver sends them.
+		body = append(append(body, b...), '\n')
+	}
+
+	// Every read returns single byte, so every event spans many reads, with new line read separately.
+	decoder := newEventDecoder(iotest.OneByteReader(bytes.NewReader(body)), int64(len(body)/2))
+	for i := 0; i < 2; i++ {
+		var got event
+		require.NoError(t, decoder.Decode(&got))
+		require.Equal(t, event{Type: modified, Object: newTestEndpoints(fmt.Sprintf("1%d", i), 8080, "1.2.3.4", "1.2.3.5")}, got)
+	}
+	var got event
+	require.Equal(t, io.EOF, decoder.Decode(&got))
+}
+
+func TestStreamWatcher_NotSupportedType_Resyncs(t *testing.T) {
+	bytesCh, _, epClientMock, connMock, eventsCh, cancel := startTestStream(t)
+	defer cancel()
+
+	// Triggering not supported event.
+	sendTestEvent(t, bytesCh, event{Type: "not-supported"})
+	requireResynced(t, epClientMock, connMock, eventsCh)
+}
+
+func TestStreamWatcher_ErrorEvent(t *testing.T) {
+	for _, tcase := range []struct {
+		code        int
+		expectFatal bool
+	}{
+		{code: http.StatusInternalServerError},
+		{code: http.StatusTooManyRequests},
+		{code: http.StatusServiceUnavailable},
+		{code: http.StatusForbidden, expectFatal: true},
+		{code: http.StatusUnauthorized, expectFatal: true},
+		{code: http.StatusNotFound, expectFatal: true},
+	} {
+		t.Run(http.StatusText(tcase.code), func(t *testing.T) {
+			bytesCh, _, epClientMock, connMock, eventsCh, cancel := startTestStream(t)
+			defer cancel()
+
+			sendTestEvent(t, bytesCh, event{
+				Type: failed,
+				Object: endpoints{
+					Kind:   "Status",
+					Status: "Failure",
+					Code:   tcase.code,
+				},
+			})
+			if !tcase.expectFatal {
+				requireResynced(t, epClientMock, connMock, eventsCh)
+				return
+			}
+
+			gotEvent := <-eventsCh
+			require.Error(t, gotEvent.err)
+			requireClosedEventually(t, connMock)
+			select {
+			case <-epClientMock.streamsCh:
+				t.Error("Stream should not be restarted after fatal error")
+			case <-time.After(200 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func TestStreamWatcher_StatusObjectWithoutErrorType_IsNotPassedAsEndpoints(t *testing.T) {
+	bytesCh, _, epClientMock, connMock, eventsCh, cancel := startTestStream(t)
+	defer cancel()
+
+	sendTestEvent(t, bytesCh, event{
+		Type: added,
+		Object: endpoints{
+			Kind:    "Status",
+			Status:  "Failure",
+			Message: "endpoints is forbidden",
+			Code:    http.StatusForbidden,
+		},
+	})
+	gotEvent := <-eventsCh
+	require.Error(t, gotEvent.err)
+	require.Nil(t, gotEvent.ep)
+	requireClosedEventually(t, connMock)
 	select {
-	case <-eventsCh:
-		t.Error("No event was expected")
-	// Not really nice to use time in tests, but should be enough for now.
+	case <-epClientMock.streamsCh:
+		t.Error("Stream should not be restarted after fatal error")
 	case <-time.After(200 * time.Millisecond):
 	}
-	require.True(t, connMock.isClosed())
 }
 
-func TestStreamWatcher_NotSupportedType_EventErr_ClosesConn(t *testing.T) {
-	bytesCh, _, connMock, eventsCh, cancel := startTestStream(t)
+func TestStreamWatcher_FatalRestartError_IsReturned(t *testing.T) {
+	_, errCh, epClientMock, _, eventsCh, cancel := startTestStream(t)
 	defer cancel()
 
-	// Triggering not supported event.
-	wrongEvent := event{
-		Type: "not-supported",
+	epClientMock.startErrCh <- &statusError{code: http.StatusUnauthorized}
+	errCh <- io.EOF
+
+	gotEvent := <-eventsCh
+	require.Error(t, gotEvent.err)
+	require.True(t, isFatal(gotEvent.err))
+	<-epClientMock.streamsCh
+	select {
+	case <-epClientMock.streamsCh:
+		t.Error("Stream should not be restarted after fatal error")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestStreamWatcher_OnConnState(t *testing.T) {
+	type connState struct {
+		target string
+		state  ConnState
+	}
+	states := make(chan connState, 10)
+	_, errCh, epClientMock, _, eventsCh, cancel := startTestStream(t, WithOnConnState(func(target string, state ConnState) {
+		states <- connState{target: target, state: state}
+	}))
+	defer cancel()
+	requireStates := func(expected ...ConnState) {
+		for _, e := range expected {
+			select {
+			case got := <-states:
+				require.Equal(t, connState{target: "service1.namespace1", state: e}, got)
+			case <-time.After(2 * time.Second):
+				t.Fatalf("%v state was expected", e)
+			}
+		}
+	}
+	requireStates(ConnStateConnecting, ConnStateConnected)
+
+	// Failed restarts are reported once.
+	epClientMock.startErrCh <- errors.New("connection refused")
+	errCh <- io.EOF
+	<-epClientMock.streamsCh
+	<-epClientMock.streamsCh
+	requireStates(ConnStateReconnecting, ConnStateConnected)
+
+	epClientMock.startErrCh <- &statusError{code: http.StatusForbidden}
+	errCh <- io.EOF
+	<-eventsCh
+	requireStates(ConnStateReconnecting, ConnStateFailed)
+	require.Len(t, states, 0)
+	require.Equal(t, "Failed", ConnStateFailed.String())
+}
+
+func TestStreamWatcher_RestartBackoff_FakeClock(t *testing.T) {
+	clk := newFakeClock()
+	_, errCh, epClientMock, _, _, cancel := startTestStream(t, withClock(clk), WithWatchBackoff(WatchBackoff{
+		Base:               time.Second,
+		Max:                time.Minute,
+		Multiplier:         2,
+		MinHealthyDuration: time.Hour,
+	}))
+	defer cancel()
+
+	requireRestartedAfter := func(delay time.Duration) {
+		errCh <- io.EOF
+		clk.waitForTimers(1)
+		clk.Advance(delay - time.Millisecond)
+		select {
+		case <-epClientMock.streamsCh:
+			t.Fatalf("stream restarted before %v", delay)
+		default:
+		}
+		clk.Advance(time.Millisecond)
+		<-epClientMock.streamsCh
+	}
+	// Stream was not healthy long enough to reset the backoff, so delay grows.
+	requireRestartedAfter(time.Second)
+	requireRestartedAfter(2 * time.Second)
+	requireRestartedAfter(4 * time.Second)
+}
+
+func TestStreamWatcher_RestartRespectsRetryAfter(t *testing.T) {
+	b := testWatchBackoff
+	b.Max = time.Second
+	_, errCh, epClientMock, _, _, cancel := startTestStream(t, WithWatchBackoff(b))
+	defer cancel()
+
+	// First backoff is 10ms, so only Retry-After can hold the restart back for longer.
+	epClientMock.startErrCh <- &statusError{code: http.StatusTooManyRequests, retryAfter: 300 * time.Millisecond}
+	errCh <- io.EOF
+	<-epClientMock.streamsCh
+	failedAt := time.Now()
+
+	select {
+	case <-epClientMock.streamsCh:
+		require.True(t, time.Since(failedAt) >= 300*time.Millisecond, "restart should wait for Retry-After, took %v", time.Since(failedAt))
+	case <-time.After(2 * time.Second):
+		t.Fatal("Stream was not restarted")
 	}
-	b, err := json.Marshal(wrongEvent)
+}
+
+func TestStreamWatcher_RestartRetryAfterIsCappedByMaxBackoff(t *testing.T) {
+	_, errCh, epClientMock, _, _, cancel := startTestStream(t)
+	defer cancel()
+
+	// Restart does not wait for hour long Retry-After, only for the max backoff of 50ms.
+	epClientMock.startErrCh <- &statusError{code: http.StatusTooManyRequests, retryAfter: time.Hour}
+	errCh <- io.EOF
+	<-epClientMock.streamsCh
+
+	select {
+	case <-epClientMock.streamsCh:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Stream was not restarted")
+	}
+}
+
+func TestStreamWatcher_EOF_ResumesFromLastResourceVersion(t *testing.T) {
+	bytesCh, errCh, epClientMock, connMock, eventsCh, cancel := startTestStream(t)
+	defer cancel()
+
+	expectedEvent := event{
+		Type: added,
+		Object: endpoints{
+			Metadata: metadata{
+				ResourceVersion: "123",
+			},
+		},
+	}
+	b, err := json.Marshal(expectedEvent)
+	require.NoError(t, err)
+	bytesCh <- b
+	gotEvent := <-eventsCh
+	require.NoError(t, gotEvent.err)
+
+	// Triggering EOF. Watch closed by server should be resumed, not returned as error.
+	errCh <- io.EOF
+	select {
+	case e := <-eventsCh:
+		t.Errorf("No event was expected, got %v", e)
+	case stream := <-epClientMock.streamsCh:
+		require.Equal(t, "123", stream.resourceVersion)
+		require.False(t, stream.connMock.isClosed())
+	case <-time.After(200 * time.Millisecond):
+		t.Fatal("Stream was not resumed")
+	}
+	requireClosedEventually(t, connMock)
+
+	// New stream should work as usual.
+	bytesCh <- b
+	gotEvent = <-eventsCh
+	require.NoError(t, gotEvent.err)
+	require.Equal(t, expectedEvent, *gotEvent.ep)
+}
+
+func TestStreamWatcher_Bookmark_AdvancesResourceVersion(t *testing.T) {
+	bytesCh, errCh, epClientMock, connMock, eventsCh, cancel := startTestStream(t)
+	defer cancel()
+
+	sendTestEvent(t, bytesCh, event{Type: added, Object: endpoints{Metadata: metadata{ResourceVersion: "123"}}})
+	gotEvent := <-eventsCh
+	require.NoError(t, gotEvent.err)
+
+	sendTestEvent(t, bytesCh, event{Type: bookmark, Object: endpoints{Metadata: metadata{ResourceVersion: "456"}}})
+	errCh <- io.EOF
+	select {
+	case e := <-eventsCh:
+		t.Errorf("No event was expected for bookmark, got %v", e)
+	case stream := <-epClientMock.streamsCh:
+		require.Equal(t, "456", stream.resourceVersion)
+	case <-time.After(200 * time.Millisecond):
+		t.Fatal("Stream was not resumed")
+	}
+	requireClosedEventually(t, connMock)
+}
+
+func TestStreamWatcher_GoneEvent_StartsFreshWatch(t *testing.T) {
+	bytesCh, _, epClientMock, connMock, eventsCh, cancel := startTestStream(t)
+	defer cancel()
+
+	b, err := json.Marshal(event{
+		Type: added,
+		Object: endpoints{
+			Metadata: metadata{
+				ResourceVersion: "123",
+			},
+		},
+	})
 	require.NoError(t, err)
+	bytesCh <- b
+	gotEvent := <-eventsCh
+	require.NoError(t, gotEvent.err)
 
-	bytesCh <- []byte(b)
-	event := <-eventsCh
-	require.Error(t, event.err, "we expect it invalid event type error")
+	b, err = json.Marshal(event{
+		Type: failed,
+		Object: endpoints{
+			Kind:    "Status",
+			Status:  "Failure",
+			Message: "too old resource version: 123 (391)",
+			Code:    http.StatusGone,
+		},
+	})
+	require.NoError(t, err)
+	bytesCh <- b
 
-	// Expect connection closed.
 	select {
-	case <-eventsCh:
-		t.Error("No event was expected")
-	// Not really nice to use time in tests, but should be enough for now.
+	case e := <-eventsCh:
+		t.Errorf("No event was expected, got %v", e)
+	case stream := <-epClientMock.streamsCh:
+		require.Equal(t, "", stream.resourceVersion)
 	case <-time.After(200 * time.Millisecond):
+		t.Fatal("Stream was not restarted")
+	}
+	requireClosedEventually(t, connMock)
+}
+
+func TestStreamWatcher_GoneOnStart_StartsFreshWatch(t *testing.T) {
+	bytesCh, errCh, epClientMock, _, eventsCh, cancel := startTestStream(t)
+	defer cancel()
+
+	b, err := json.Marshal(event{
+		Type: added,
+		Object: endpoints{
+			Metadata: metadata{
+				ResourceVersion: "123",
+			},
+		},
+	})
+	require.NoError(t, err)
+	bytesCh <- b
+	gotEvent := <-eventsCh
+	require.NoError(t, gotEvent.err)
+
+	epClientMock.startErrCh <- &statusError{code: http.StatusGone}
+	errCh <- io.EOF
+
+	stream := <-epClientMock.streamsCh
+	require.Equal(t, "123", stream.resourceVersion)
+	require.Nil(t, stream.connMock, "expected failed stream")
+
+	stream = <-epClientMock.streamsCh
+	require.Equal(t, "", stream.resourceVersion)
+	require.NotNil(t, stream.connMock)
+
+	// Fresh stream starts with the current state.
+	expectedEvent := event{
+		Type: added,
+		Object: endpoints{
+			Metadata: metadata{
+				ResourceVersion: "400",
+			},
+		},
 	}
-	require.True(t, connMock.isClosed())
+	b, err = json.Marshal(expectedEvent)
+	require.NoError(t, err)
+	bytesCh <- b
+	gotEvent = <-eventsCh
+	require.NoError(t, gotEvent.err)
+	require.Equal(t, expectedEvent, *gotEvent.ep)
+}
+
+func TestStreamWatcher_RestartsAreDelayed(t *testing.T) {
+	_, errCh, epClientMock, _, _, cancel := startTestStream(t)
+	defer cancel()
+
+	start := time.Now()
+	errCh <- io.EOF
+	<-epClientMock.streamsCh
+	require.True(t, time.Since(start) >= minStreamRestartInterval, "stream closed immediately should not be restarted right away")
 }
 
-func TestStreamWatcher_EOF_EventErr_ClosesConn(t *testing.T) {
-	_, errCh, connMock, eventsCh, cancel := startTestStream(t)
+func TestStreamWatcher_FailedRestartsAreRetried(t *testing.T) {
+	_, errCh, epClientMock, _, eventsCh, cancel := startTestStream(t)
 	defer cancel()
 
-	// Triggering EOF.
+	epClientMock.startErrCh <- errors.New("connection refused")
 	errCh <- io.EOF
-	event := <-eventsCh
-	require.Error(t, event.err, "we expect it invalid event type error")
 
-	// Expect connection closed.
+	stream := <-epClientMock.streamsCh
+	require.Nil(t, stream.connMock, "expected failed stream")
+
 	select {
-	case <-eventsCh:
-		t.Error("No event was expected")
-	// Not really nice to use time in tests, but should be enough for now.
+	case e := <-eventsCh:
+		t.Errorf("No event was expected, got %v", e)
+	case stream = <-epClientMock.streamsCh:
+		require.NotNil(t, stream.connMock)
 	case <-time.After(200 * time.Millisecond):
+		t.Fatal("Stream was not restarted")
+	}
+}
+
+func TestStreamWatcher_IdleStream_IsResumed(t *testing.T) {
+	bytesCh, _, epClientMock, connMock, eventsCh, cancel := startTestStream(t, WithWatchTimeout(50*time.Millisecond))
+	defer cancel()
+
+	b, err := json.Marshal(event{
+		Type: added,
+		Object: endpoints{
+			Metadata: metadata{
+				ResourceVersion: "123",
+			},
+		},
+	})
+	require.NoError(t, err)
+	bytesCh <- b
+	gotEvent := <-eventsCh
+	require.NoError(t, gotEvent.err)
+
+	// Stream hangs without any data now.
+	select {
+	case e := <-eventsCh:
+		t.Errorf("No event was expected, got %v", e)
+	case stream := <-epClientMock.streamsCh:
+		require.Equal(t, "123", stream.resourceVersion)
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("Idle stream was not restarted")
 	}
-	require.True(t, connMock.isClosed())
+	requireClosedEventually(t, connMock)
 }
 
 func TestStreamWatcher_OK_2OKEvents(t *testing.T) {
-	bytesCh, _, _, eventsCh, cancel := startTestStream(t)
+	bytesCh, _, _, _, eventsCh, cancel := startTestStream(t)
 	defer cancel()
 
 	// Triggering OK gotEvent.
@@ -0,0 +1,16 @@
+package k8sresolver
+
+// TLSMapper decides if the address should be dialed with TLS from the application protocol of its port
+// (AddressMetadata.AppProtocol), which is empty if not set in endpoints. It is called for every address on every
+// change, so it must not block.
+type TLSMapper func(appProtocol string) bool
+
+// DefaultTLSMapper returns true for https, grpc+tls and kubernetes.io/wss application protocols. Others, including h2c,
+// grpc, kubernetes.io/h2c and unknown or empty ones, are plaintext.
+func DefaultTLSMapper(appProtocol string) bool {
+	switch appProtocol {
+	case "https", "grpc+tls", "kubernetes.io/wss":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package k8sresolver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubsetToAddresses_TLS(t *testing.T) {
+	target := targetEntry{service: "web", namespace: "namespace1", port: targetPort{value: "web", isNamed: true}}
+	for _, tcase := range []struct {
+		appProtocol string
+		tls         bool
+	}{
+		{appProtocol: "https", tls: true},
+		{appProtocol: "grpc+tls", tls: true},
+		{appProtocol: "kubernetes.io/wss", tls: true},
+		{appProtocol: "h2c", tls: false},
+		{appProtocol: "grpc", tls: false},
+		{appProtocol: "kubernetes.io/h2c", tls: false},
+		{appProtocol: "", tls: false},
+		{appProtocol: "custom", tls: false},
+	} {
+		t.Run(tcase.appProtocol, func(t *testing.T) {
+			sub := subset{
+				Ports:     []port{{Name: "web", Port: 8443, AppProtocol: tcase.appProtocol}},
+				Addresses: []address{{IP: "1.2.3.4"}},
+			}
+			addrs, err := subsetToAddresses(target, sub, newOptions(nil), nil)
+			require.NoError(t, err)
+			require.Equal(t, tcase.appProtocol, addrs["1.2.3.4:8443"].AppProtocol)
+			require.Equal(t, tcase.tls, addrs["1.2.3.4:8443"].TLS)
+		})
+	}
+}
+
+func TestSubsetToAddresses_TLSMapper(t *testing.T) {
+	target := targetEntry{service: "web", namespace: "namespace1", port: noTargetPort}
+	sub := subset{
+		Ports:     []port{{Name: "web", Port: 8443, AppProtocol: "custom"}},
+		Addresses: []address{{IP: "1.2.3.4"}},
+	}
+	addrs, err := subsetToAddresses(target, sub, newOptions([]Option{WithTLSMapper(func(appProtocol string) bool {
+		return appProtocol == "custom" || DefaultTLSMapper(appProtocol)
+	})}), nil)
+	require.NoError(t, err)
+	require.True(t, addrs["1.2.3.4:8443"].TLS)
+}
@@ -0,0 +1,51 @@
+package k8sresolver
+
+import "context"
+
+// Tracer starts spans around the initial list, every watch (re)connect and translation of every event to updates.
+// It mirrors a subset of OpenTelemetry trace.Tracer, so a thin adapter is enough to use one.
+type Tracer interface {
+	Start(ctx context.Context, spanName string) (context.Context, Span)
+}
+
+// Span is a single traced operation.
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	RecordError(err error)
+	End()
+}
+
+// Attribute is a key-value pair attached to the span. Value is either string or int.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// Attribute keys set by the resolver.
+const (
+	ServiceAttributeKey         = "k8sresolver.service"
+	NamespaceAttributeKey       = "k8sresolver.namespace"
+	ResourceVersionAttributeKey = "k8sresolver.resource_version"
+	AddUpdatesAttributeKey      = "k8sresolver.updates.add"
+	DeleteUpdatesAttributeKey   = "k8sresolver.updates.delete"
+)
+
+// targetAttributes returns attributes identifying the target.
+func targetAttributes(t targetEntry) []Attribute {
+	return []Attribute{
+		{Key: ServiceAttributeKey, Value: t.service},
+		{Key: NamespaceAttributeKey, Value: t.namespace},
+	}
+}
+
+type noopTracer struct{}
+
+func (noopTracer) Start(ctx context.Context, _ string) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(...Attribute) {}
+func (noopSpan) RecordError(error)          {}
+func (noopSpan) End()                       {}
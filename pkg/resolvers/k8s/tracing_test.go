@@ -0,0 +1,158 @@
+package k8sresolver
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type recordedSpan struct {
+	name  string
+	attrs map[string]interface{}
+	errs  []error
+	ended bool
+}
+
+type tracerMock struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+func (m *tracerMock) Start(ctx context.Context, spanName string) (context.Context, Span) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := &recordedSpan{name: spanName, attrs: map[string]interface{}{}}
+	m.spans = append(m.spans, s)
+	return ctx, &spanMock{m: m, s: s}
+}
+
+func (m *tracerMock) recorded() []recordedSpan {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var spans []recordedSpan
+	for _, s := range m.spans {
+		spans = append(spans, *s)
+	}
+	return spans
+}
+
+type spanMock struct {
+	m *tracerMock
+	s *recordedSpan
+}
+
+func (s *spanMock) SetAttributes(attrs ...Attribute) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	for _, a := range attrs {
+		s.s.attrs[a.Key] = a.Value
+	}
+}
+
+func (s *spanMock) RecordError(err error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	s.s.errs = append(s.s.errs, err)
+}
+
+func (s *spanMock) End() {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	s.s.ended = true
+}
+
+func TestWatcher_Tracing(t *testing.T) {
+	tracer := &tracerMock{}
+	bytesCh := make(chan []byte)
+	listResult := newTestEndpoints("10", 8080, "1.2.3.4", "1.2.3.5")
+	epClientMock := &endpointClientMock{
+		t: t,
+		expectedTarget: targetEntry{
+			service:   "service1",
+			port:      noTargetPort,
+			namespace: "namespace1",
+		},
+		bytesCh:    bytesCh,
+		errCh:      make(chan error),
+		startErrCh: make(chan error, 1),
+		streamsCh:  make(chan startedStream, 10),
+		listResult: &listResult,
+	}
+
+	w, err := startNewWatcher(context.Background(), epClientMock.expectedTarget, epClientMock, newOptions([]Option{WithTracer(tracer)}))
+	require.NoError(t, err)
+	defer w.Close()
+
+	_, err = w.Next()
+	require.NoError(t, err)
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: newTestEndpoints("11", 8080, "1.2.3.6")})
+	_, err = w.Next()
+	require.NoError(t, err)
+
+	require.Equal(t, []recordedSpan{
+		{
+			name: "k8sresolver.List",
+			attrs: map[string]interface{}{
+				ServiceAttributeKey:         "service1",
+				NamespaceAttributeKey:       "namespace1",
+				ResourceVersionAttributeKey: "10",
+			},
+			ended: true,
+		},
+		{
+			name: "k8sresolver.Watch",
+			attrs: map[string]interface{}{
+				ServiceAttributeKey:         "service1",
+				NamespaceAttributeKey:       "namespace1",
+				ResourceVersionAttributeKey: "10",
+			},
+			ended: true,
+		},
+		{
+			name: "k8sresolver.Next",
+			attrs: map[string]interface{}{
+				ServiceAttributeKey:         "service1",
+				NamespaceAttributeKey:       "namespace1",
+				ResourceVersionAttributeKey: "10",
+				AddUpdatesAttributeKey:      2,
+				DeleteUpdatesAttributeKey:   0,
+			},
+			ended: true,
+		},
+		{
+			name: "k8sresolver.Next",
+			attrs: map[string]interface{}{
+				ServiceAttributeKey:         "service1",
+				NamespaceAttributeKey:       "namespace1",
+				ResourceVersionAttributeKey: "11",
+				AddUpdatesAttributeKey:      1,
+				DeleteUpdatesAttributeKey:   2,
+			},
+			ended: true,
+		},
+	}, tracer.recorded())
+}
+
+func TestStreamWatcher_Tracing_FailedReconnect(t *testing.T) {
+	tracer := &tracerMock{}
+	_, errCh, epClientMock, _, _, cancel := startTestStream(t, WithTracer(tracer))
+	defer cancel()
+
+	epClientMock.startErrCh <- &statusError{code: http.StatusServiceUnavailable}
+	errCh <- io.EOF
+	// Failed and then successful reconnect.
+	<-epClientMock.streamsCh
+	<-epClientMock.streamsCh
+
+	spans := tracer.recorded()
+	require.Len(t, spans, 3)
+	for _, s := range spans {
+		require.Equal(t, "k8sresolver.Watch", s.name)
+	}
+	require.Len(t, spans[1].errs, 1, "failed reconnect should be recorded")
+	require.True(t, spans[1].ended)
+}
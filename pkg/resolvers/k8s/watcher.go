@@ -2,116 +2,828 @@ package k8sresolver
 
 import (
 	"context"
+	"fmt"
 	"net"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	"google.golang.org/grpc/naming"
 )
 
 type watchResult struct {
-	ep  *event
-	err error
+	// namespace is a namespace of the watched endpoints.
+	namespace string
+	ep        *event
+	err       error
 }
 
 // A Watcher provides name resolution updates by watching endpoints API.
 // It works by watching endpoint Watch API (retries if connection broke). Returned events with
 // changes inside endpoints are translated to resolution naming.Updates.
+// Watcher can watch the same service in many namespaces. Addresses from all of them are merged.
 type watcher struct {
 	ctx    context.Context
 	cancel context.CancelFunc
 
-	target      targetEntry
+	targets     []targetEntry
+	name        string
+	opts        options
 	watchChange chan watchResult
-	lastUpdates map[string]struct{}
+
+	// clients are endpoint clients per namespace.
+	clients map[string]endpointClient
+	// lastEvents are the last events per namespace, so they can be translated again after service ports change.
+	lastEvents map[string]event
+	// servicePortsChange passes changed ports of services, if watched.
+	servicePortsChange chan servicePortsChange
+	// namespaceAddresses are the last addresses per namespace.
+	namespaceAddresses map[string]map[string]AddressMetadata
+	// strictChecked are namespaces with initial endpoints checked by strict mode.
+	strictChecked map[string]bool
+	// pods are pods matching the address selector per namespace, listed only if the selector or pod weights are used.
+	pods map[string]*podCache
+	// spareNamespaceAddresses and spareUpdates are maps of the previous Next() call reused by the next one, so large
+	// services do not allocate new maps on every event.
+	spareNamespaceAddresses map[string]map[string]AddressMetadata
+	spareUpdates            map[string]AddressMetadata
+
+	// lastUpdates is modified only by Next(), so mutex is needed only to read it from other go routines.
+	mu          sync.RWMutex
+	lastUpdates map[string]AddressMetadata
+	// err is an error which stopped the watcher.
+	err error
+	// stats are returned by Stats(). Reconnects of current subscriptions are counted by the shared watches, so only
+	// reconnects of replaced subscriptions are added here.
+	stats WatcherStats
+
+	// ready is closed when the initial state is returned by Next() or the watcher is stopped.
+	ready     chan struct{}
+	readyOnce sync.Once
+	// closeOnce releases metrics of the watcher on the first Close.
+	closeOnce sync.Once
+	// pendingDeletes are deadlines of deletes held back by delete grace or minimum endpoints. Pending addresses are still in lastUpdates.
+	pendingDeletes map[string]time.Time
+	// lostAll is true if the target lost all its addresses and did not get any back yet.
+	lostAll bool
+
+	registry *watchRegistry
+	// subscriptions are subscriptions to the shared watches, at least one per namespace. They are guarded by subsMu,
+	// since subscriptions are replaced by Next() when auto close on error is disabled.
+	subsMu        sync.Mutex
+	subscriptions []*subscription
+	// unsubscribed are namespaces with watch failed with recoverable error, which are subscribed again at
+	// resubscribeAt. Used only if auto close on error is disabled.
+	unsubscribed       []string
+	resubscribeAt      time.Time
+	resubscribeBackoff *backoff
+
+	// initial is a full state of endpoints in every namespace fetched before starting watch. It is returned by first
+	// Next() call.
+	initial []watchResult
 }
 
-func startNewWatcher(target targetEntry, epClient endpointClient) (*watcher, error) {
-	// NOTE(bplotka): Would love to have proper context from above but naming.Resolver does not allow that.
-	ctx, cancel := context.WithCancel(context.Background())
+func startNewWatcher(parentCtx context.Context, target targetEntry, epClient endpointClient, opts options) (*watcher, error) {
+	registry := newWatchRegistry(parentCtx, func() endpointClient { return epClient }, opts)
+	return startNewMultiWatcher(parentCtx, []targetEntry{target}, registry, opts)
+}
+
+// startNewMultiWatcher starts watcher for all the targets. Targets are expected to differ only by namespace and port.
+// Endpoints watches are shared through the registry with other watchers of the same service.
+func startNewMultiWatcher(parentCtx context.Context, targets []targetEntry, registry *watchRegistry, opts options) (*watcher, error) {
+	var names []string
+	for _, t := range targets {
+		names = append(names, t.String())
+	}
+	// NOTE(bplotka): naming.Resolver does not pass context, so parentCtx is context.Background() unless resolver
+	// was created with NewWithClientContext. Requests of the watcher are attributed to its targets.
+	ctx, cancel := context.WithCancel(withRequestTarget(parentCtx, strings.Join(names, ",")))
+	// Ports of targets change if service ports are watched, so the slice of the caller is copied.
+	targets = append([]targetEntry(nil), targets...)
 	w := &watcher{
-		ctx:         ctx,
-		cancel:      cancel,
-		target:      target,
-		watchChange: make(chan watchResult),
-		lastUpdates: make(map[string]struct{}),
+		ctx:                     ctx,
+		cancel:                  cancel,
+		targets:                 targets,
+		name:                    strings.Join(names, ","),
+		opts:                    opts,
+		watchChange:             make(chan watchResult, opts.watchBufferSize),
+		clients:                 make(map[string]endpointClient),
+		lastEvents:              make(map[string]event),
+		servicePortsChange:      make(chan servicePortsChange),
+		namespaceAddresses:      make(map[string]map[string]AddressMetadata),
+		spareNamespaceAddresses: make(map[string]map[string]AddressMetadata),
+		strictChecked:           make(map[string]bool),
+		pods:                    make(map[string]*podCache),
+		lastUpdates:             make(map[string]AddressMetadata),
+		pendingDeletes:          make(map[string]time.Time),
+		ready:                   make(chan struct{}),
+		registry:                registry,
+		resubscribeBackoff:      newBackoff(opts.watchBackoff, opts.clock),
 	}
+	opts.metrics.acquireTarget(w.name)
 
-	err := startWatchingEndpointsChanges(ctx, target, epClient, w.watchChange)
+	for _, target := range targets {
+		sub, err := w.subscribe(target)
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+		w.initial = append(w.initial, watchResult{namespace: target.namespace, ep: &sub.initial})
+	}
+	w.watchServicePorts()
+	return w, nil
+}
+
+// subscribe subscribes the watcher to the shared watch of the target.
+func (w *watcher) subscribe(target targetEntry) (*subscription, error) {
+	// Lock is held while subscribing, so Close waits for the subscription it has not seen.
+	w.subsMu.Lock()
+	defer w.subsMu.Unlock()
+
+	if w.ctx.Err() != nil {
+		return nil, w.ctx.Err()
+	}
+	sub, err := w.registry.subscribe(w.ctx, target, w.watchChange)
 	if err != nil {
 		return nil, err
 	}
-	return w, nil
+	w.subscriptions = append(w.subscriptions, sub)
+	w.clients[target.namespace] = sub.client
+	return sub, nil
 }
 
-// Close closes the watcher, cleaning up any open connections.
+// replaceSubscriptions closes all subscriptions of the namespace except sub, e.g. the ones to the failed watch once
+// subscribed again. Their reconnects are still counted by Stats().
+func (w *watcher) replaceSubscriptions(namespace string, sub *subscription) {
+	w.subsMu.Lock()
+	defer w.subsMu.Unlock()
+
+	// New slice is allocated, since Close iterates the old one without the lock.
+	subs := make([]*subscription, 0, len(w.subscriptions))
+	for _, s := range w.subscriptions {
+		if s == sub || s.watch.key.namespace != namespace {
+			subs = append(subs, s)
+			continue
+		}
+		s.close()
+		w.mu.Lock()
+		w.stats.Reconnects += s.reconnects()
+		w.mu.Unlock()
+	}
+	w.subscriptions = subs
+}
+
+// resolveNow requests list of endpoints of all namespaces out of the watch. Listed state is returned by Next() as any
+// other event. Lists requested too often are coalesced, see refreshInterval.
+func (w *watcher) resolveNow() {
+	w.subsMu.Lock()
+	defer w.subsMu.Unlock()
+
+	for _, sub := range w.subscriptions {
+		sub.resolveNow()
+	}
+}
+
+// Close closes the watcher, cleaning up any open connections. It is safe to call it many times and concurrently with
+// Next(), which returns error after Close. When Close returns, no more events are sent to the watcher.
 func (w *watcher) Close() {
 	w.cancel()
+	w.subsMu.Lock()
+	subs := w.subscriptions
+	w.subsMu.Unlock()
+	for _, sub := range subs {
+		<-sub.done
+	}
+	w.closeOnce.Do(func() { w.opts.metrics.releaseTarget(w.name) })
+	w.markReady()
 }
 
 // Next updates the endpoints for the targetEntry being watched.
-// As from Watcher interface: It should return an error if and only if Watcher cannot recover.
+// As from Watcher interface: It should return an error if and only if Watcher cannot recover. Transient errors (e.g.
+// malformed event) are recovered internally and only logged. Updates are sorted: deletes before adds, each by address.
+// Returned error is *ResolveError.
 func (w *watcher) Next() ([]*naming.Update, error) {
+	return w.NextContext(context.Background())
+}
+
+// NextContext works as Next, but it returns ctx.Err() as well when ctx is done before any update. It is not treated as
+// watcher failure, so watcher stays open and next call returns updates since the last returned ones. It allows to poll
+// the watcher with timeout, e.g. for diagnostics.
+// naming.Watcher returned by the resolver can be asserted to
+// interface{ NextContext(context.Context) ([]*naming.Update, error) } to use it.
+func (w *watcher) NextContext(ctx context.Context) ([]*naming.Update, error) {
 	if w.ctx.Err() != nil {
 		// We already stopped.
-		return []*naming.Update(nil), errors.Wrap(w.ctx.Err(), "k8sresolver: watcher.Next already stopped or Next returned error already. "+
-			"Note that watcher errors are not recoverable.")
+		return []*naming.Update(nil), w.resolveError(errors.Wrap(w.ctx.Err(), "k8sresolver: watcher.Next already stopped or Next returned error already. "+
+			"Note that watcher errors are not recoverable."))
+	}
+	u, err := w.next(ctx)
+	if err != nil && err == ctx.Err() && w.ctx.Err() == nil {
+		// Caller gave up waiting. Watcher is fine.
+		return u, err
 	}
-	u, err := w.next()
 	if err != nil {
+		err = w.resolveError(err)
+		if w.ctx.Err() == nil {
+			w.opts.logger.WithError(err).WithField("target", w.name).Warn("k8sresolver: Watcher failed. Giving up")
+			w.mu.Lock()
+			w.err = err
+			w.mu.Unlock()
+		}
 		// Just in case.
 		w.Close()
 	}
+	w.markReady()
 	return u, err
 }
 
-func (w *watcher) next() ([]*naming.Update, error) {
-	updates := make([]*naming.Update, 0)
-	updatedEndpoints := make(map[string]struct{})
-	var event event
-	select {
-	case <-w.ctx.Done():
-		// We already stopped.
-		return []*naming.Update(nil), w.ctx.Err()
-	case r := <-w.watchChange:
-		if r.err != nil {
-			return []*naming.Update(nil), errors.Wrap(r.err, "k8sresolver: error on reading event stream")
-		}
-		event = *r.ep
+// Ready returns channel closed once the initial state of endpoints is returned by Next(), so callers can wait for the
+// first addresses before accepting traffic. It is closed as well if the watcher fails or is closed before that, so
+// Err() should be checked after it is closed.
+// naming.Watcher returned by the resolver can be asserted to interface{ Ready() <-chan struct{} } to use it.
+func (w *watcher) Ready() <-chan struct{} {
+	return w.ready
+}
+
+// Err returns the error that stopped the watcher or nil if it is running or was closed by the caller.
+func (w *watcher) Err() error {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.err
+}
+
+func (w *watcher) markReady() {
+	w.readyOnce.Do(func() { close(w.ready) })
+}
+
+// Current returns sorted addresses returned by Next() so far. It is safe to call it concurrently with Next().
+// It returns nil after the watcher failed (see Err), since addresses are not watched anymore.
+// naming.Watcher returned by the resolver can be asserted to interface{ Current() []string } to use it.
+func (w *watcher) Current() []string {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if w.err != nil {
+		return nil
 	}
 
-	// Translate kube api endpoint watch event to resolver address and put into map for easier lookup.
-	for _, subset := range event.Object.Subsets {
-		updatedAddresses, err := subsetToAddresses(w.target, subset)
-		if err != nil {
-			return []*naming.Update(nil), errors.Wrap(err, "k8sresolver: failed to convert k8s endpoint subset to update Addr")
+	addrs := make([]string, 0, len(w.lastUpdates))
+	for addr := range w.lastUpdates {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// WatcherStats is a snapshot of the watcher statistics, e.g. to expose them without Prometheus.
+type WatcherStats struct {
+	// Events is a number of endpoints events processed by Next(), including the initial state.
+	Events int64
+	// Adds and Deletes are numbers of updates returned by Next().
+	Adds    int64
+	Deletes int64
+	// Reconnects is a number of times the watch connection was lost since the watcher subscribed to it.
+	Reconnects int64
+	// LastEvent is the time the last event was processed. Zero if there was none yet.
+	LastEvent time.Time
+	// Endpoints is a number of addresses currently resolved.
+	Endpoints int
+}
+
+// Stats returns statistics of the watcher. It is safe to call it concurrently with Next().
+// naming.Watcher returned by the resolver can be asserted to interface{ Stats() WatcherStats } to use it.
+func (w *watcher) Stats() WatcherStats {
+	w.mu.RLock()
+	stats := w.stats
+	w.mu.RUnlock()
+
+	w.subsMu.Lock()
+	defer w.subsMu.Unlock()
+	for _, sub := range w.subscriptions {
+		stats.Reconnects += sub.reconnects()
+	}
+	return stats
+}
+
+// noUpdates is returned when nothing changed, so no slice is allocated. Appending to it allocates new slice, since it has
+// no capacity.
+var noUpdates = []*naming.Update{}
+
+// minReusableSize is a number of addresses that a reused map can have in excess.
+const minReusableSize = 64
+
+func (w *watcher) next(ctx context.Context) ([]*naming.Update, error) {
+	var updates []*naming.Update
+	results := w.initial
+	w.initial = nil
+	snapshot := results != nil && w.opts.snapshotUpdates
+	if results == nil {
+		// Wake up when the earliest delete held back by grace is due, even if no event comes.
+		var graceExpired <-chan time.Time
+		if deadline, ok := w.earliestPendingDelete(); ok {
+			timer := w.opts.clock.NewTimer(deadline.Sub(w.opts.clock.Now()))
+			defer timer.Stop()
+			graceExpired = timer.C()
+		}
+		var resubscribe <-chan time.Time
+		if len(w.unsubscribed) > 0 {
+			timer := w.opts.clock.NewTimer(w.resubscribeAt.Sub(w.opts.clock.Now()))
+			defer timer.Stop()
+			resubscribe = timer.C()
 		}
 
-		for _, address := range updatedAddresses {
-			updatedEndpoints[address] = struct{}{}
+		select {
+		case <-w.ctx.Done():
+			// We already stopped.
+			return []*naming.Update(nil), w.ctx.Err()
+		case <-ctx.Done():
+			return []*naming.Update(nil), ctx.Err()
+		case r := <-w.watchChange:
+			if r.err != nil {
+				err := errors.Wrap(r.err, "k8sresolver: error on reading event stream")
+				if w.opts.autoCloseOnError || isFatal(err) {
+					return []*naming.Update(nil), err
+				}
+				// Shared watch is stopped after error. Keep the last addresses until subscribed to the new one.
+				w.opts.logger.WithError(err).WithField("target", w.name).Warn("k8sresolver: Watch failed. Subscribing again")
+				if !containsString(w.unsubscribed, r.namespace) {
+					// Every subscription of the namespace fails with the watch, but all are replaced by single one.
+					w.unsubscribed = append(w.unsubscribed, r.namespace)
+				}
+				w.resubscribeAt = w.opts.clock.Now().Add(w.resubscribeBackoff.Duration())
+				break
+			}
+			results = []watchResult{r}
+		case c := <-w.servicePortsChange:
+			results = w.remapServicePort(c)
+			if results == nil {
+				// Mapping did not change, so there is nothing to update. Wait for the next change.
+				return w.next(ctx)
+			}
+		case <-graceExpired:
+		case <-resubscribe:
+			var err error
+			results, err = w.resubscribe()
+			if err != nil {
+				return []*naming.Update(nil), err
+			}
 		}
 	}
 
+	_, span := w.opts.tracer.Start(w.ctx, "k8sresolver.Next")
+	defer span.End()
+	var eventNamespaces, versions []string
+	for _, r := range results {
+		eventNamespaces = append(eventNamespaces, r.namespace)
+		versions = append(versions, r.ep.Object.Metadata.ResourceVersion)
+	}
+	span.SetAttributes(
+		Attribute{Key: ServiceAttributeKey, Value: w.targets[0].service},
+		Attribute{Key: NamespaceAttributeKey, Value: strings.Join(eventNamespaces, ",")},
+		Attribute{Key: ResourceVersionAttributeKey, Value: strings.Join(versions, ",")},
+	)
+
+	// removedNamespaces are namespaces which endpoints object was deleted. Their addresses are deleted immediately.
+	var removedNamespaces map[string]struct{}
+	for _, r := range results {
+		if r.ep.Type == added && w.opts.snapshotUpdates {
+			// Fresh watch (e.g. after 410 Gone) starts with the full state.
+			snapshot = true
+		}
+		if r.ep.Type == deleted {
+			if removedNamespaces == nil {
+				removedNamespaces = map[string]struct{}{}
+			}
+			removedNamespaces[r.namespace] = struct{}{}
+		}
+		if err := w.updateNamespace(r.namespace, *r.ep); err != nil {
+			span.RecordError(err)
+			if _, ok := errors.Cause(err).(*portNotFoundError); ok || isFatal(err) {
+				// No subset has the port of the target, so its addresses cannot be resolved from any event.
+				return []*naming.Update(nil), err
+			}
+			// Next event contains full state again, so keep the last addresses of the namespace until then.
+			w.opts.logger.WithError(err).WithField("target", w.name).Warn("k8sresolver: Ignoring malformed event")
+		}
+	}
+
+	updatedEndpoints := w.mergedAddresses(emptied(w.spareUpdates))
+
 	// Create updates to add new endpoints.
 	for addr, md := range updatedEndpoints {
-		if _, ok := w.lastUpdates[addr]; ok {
-			continue
+		// Address is back within delete grace, so there is no need to delete it.
+		delete(w.pendingDeletes, addr)
+		if last, ok := w.lastUpdates[addr]; ok {
+			if equalMetadata(last, md) {
+				continue
+			}
+			// There is no update for changed metadata, so the address is replaced for balancer to notice it.
+			updates = append(updates, &naming.Update{Op: naming.Delete, Addr: addr, Metadata: nil})
 		}
 
 		updates = append(updates, &naming.Update{Op: naming.Add, Addr: addr, Metadata: md})
 	}
 	// Create updates to delete old endpoints.
-	for addr := range w.lastUpdates {
+	now := w.opts.clock.Now()
+	grace := w.deleteGrace(len(w.lastUpdates), len(updatedEndpoints))
+	for addr, md := range w.lastUpdates {
 		if _, ok := updatedEndpoints[addr]; ok {
 			continue
 		}
+		if _, ok := removedNamespaces[md.Namespace]; ok {
+			// Service was removed, so there is nothing to wait for.
+			delete(w.pendingDeletes, addr)
+			updates = append(updates, &naming.Update{Op: naming.Delete, Addr: addr, Metadata: nil})
+			continue
+		}
+		deadline, ok := w.pendingDeletes[addr]
+		if !ok && grace > 0 {
+			deadline, ok = now.Add(grace), true
+			w.pendingDeletes[addr] = deadline
+		}
+		if ok {
+			if now.Before(deadline) {
+				// Keep the address until grace expires.
+				updatedEndpoints[addr] = md
+				continue
+			}
+			delete(w.pendingDeletes, addr)
+		}
 		updates = append(updates, &naming.Update{Op: naming.Delete, Addr: addr, Metadata: nil})
 	}
 
+	if snapshot {
+		updates = snapshotUpdates(updates, updatedEndpoints)
+	}
+	sortUpdates(updates)
+	if w.opts.updateInterceptor != nil {
+		updates = w.opts.updateInterceptor(updates)
+		// Addresses are tracked as the interceptor emitted them, so the next diff is made against what the caller has.
+		updatedEndpoints = interceptedAddresses(updatedEndpoints, w.lastUpdates, updates)
+	}
+	adds := 0
+	for _, u := range updates {
+		if u.Op == naming.Add {
+			adds++
+		}
+	}
+	span.SetAttributes(
+		Attribute{Key: AddUpdatesAttributeKey, Value: adds},
+		Attribute{Key: DeleteUpdatesAttributeKey, Value: len(updates) - adds},
+	)
+
+	w.notifyEmpty(len(w.lastUpdates), len(updatedEndpoints))
+	w.mu.Lock()
+	// Map is replaced under lock, so it can be reused once Current() is not reading it anymore.
+	w.spareUpdates = reusable(w.lastUpdates, len(updatedEndpoints))
 	w.lastUpdates = updatedEndpoints
+	if len(results) > 0 {
+		w.stats.Events += int64(len(results))
+		w.stats.LastEvent = w.opts.clock.Now()
+	}
+	w.stats.Adds += int64(adds)
+	w.stats.Deletes += int64(len(updates) - adds)
+	w.stats.Endpoints = len(updatedEndpoints)
+	w.mu.Unlock()
+	w.opts.metrics.observeUpdates(w.name, updates, len(updatedEndpoints))
+	if len(updates) == 0 {
+		return noUpdates, nil
+	}
 	return updates, nil
 }
 
+// snapshotUpdates returns the updates with an add for every resolved address, marked as a part of the snapshot.
+// Addresses not changed are added again, so balancer can replace its whole set of addresses.
+func snapshotUpdates(updates []*naming.Update, resolved map[string]AddressMetadata) []*naming.Update {
+	added := make(map[string]struct{}, len(updates))
+	for _, u := range updates {
+		if u.Op == naming.Add {
+			added[u.Addr] = struct{}{}
+		}
+	}
+	for addr, md := range resolved {
+		if _, ok := added[addr]; !ok {
+			updates = append(updates, &naming.Update{Op: naming.Add, Addr: addr, Metadata: md})
+		}
+	}
+	for _, u := range updates {
+		if md, ok := u.Metadata.(AddressMetadata); ok {
+			// Only the update is marked, not the resolved address returned by e.g. Current().
+			md.Snapshot = true
+			u.Metadata = md
+		}
+	}
+	return updates
+}
+
+// interceptedAddresses fills dst with the last addresses changed by updates returned by the interceptor.
+func interceptedAddresses(dst map[string]AddressMetadata, last map[string]AddressMetadata, updates []*naming.Update) map[string]AddressMetadata {
+	dst = emptied(dst)
+	for addr, md := range last {
+		dst[addr] = md
+	}
+	for _, u := range updates {
+		if u.Op == naming.Delete {
+			delete(dst, u.Addr)
+			continue
+		}
+		md, _ := u.Metadata.(AddressMetadata)
+		md.Snapshot = false
+		dst[u.Addr] = md
+	}
+	return dst
+}
+
+// mergedAddresses merges addresses of all namespaces into dst and filters them by preferred IP family, zone and node.
+// Addresses removed from one namespace are kept if present in another one.
+func (w *watcher) mergedAddresses(dst map[string]AddressMetadata) map[string]AddressMetadata {
+	var namespaces []string
+	for ns := range w.namespaceAddresses {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	for _, ns := range namespaces {
+		for addr, md := range w.namespaceAddresses[ns] {
+			if _, ok := dst[addr]; ok {
+				continue
+			}
+			dst[addr] = md
+		}
+	}
+
+	if w.opts.ipFamily != AnyIPFamily {
+		dst = preferredFamilyAddresses(w.opts.ipFamily, dst)
+	}
+	if w.opts.preferSameZone && w.opts.zone != "" {
+		dst = sameZoneAddresses(w.opts.zone, dst)
+	}
+	if w.opts.preferSameNode && w.opts.node != "" {
+		dst = sameNodeAddresses(w.opts.node, dst)
+	}
+	if w.opts.maxEndpoints > 0 {
+		dst = sampledAddresses(w.opts.maxEndpoints, dst)
+	}
+	return dst
+}
+
+// resubscribe subscribes again to the watches of unsubscribed namespaces. It returns initial state of every namespace
+// subscribed. Namespaces that failed to subscribe with recoverable error are subscribed later with backoff.
+func (w *watcher) resubscribe() ([]watchResult, error) {
+	var results []watchResult
+	var failed []string
+	for _, namespace := range w.unsubscribed {
+		sub, err := w.subscribe(w.namespaceTarget(namespace))
+		if err != nil {
+			if isFatal(err) {
+				return nil, err
+			}
+			w.opts.logger.WithError(err).WithField("target", w.name).Debug("k8sresolver: Failed to subscribe watch again")
+			failed = append(failed, namespace)
+			continue
+		}
+		w.replaceSubscriptions(namespace, sub)
+		results = append(results, watchResult{namespace: namespace, ep: &sub.initial})
+	}
+
+	w.unsubscribed = failed
+	if len(failed) > 0 {
+		w.resubscribeAt = w.opts.clock.Now().Add(w.resubscribeBackoff.Duration())
+	} else {
+		w.resubscribeBackoff = newBackoff(w.opts.watchBackoff, w.opts.clock)
+	}
+	return results, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// notifyEmpty calls hooks when the target loses all its addresses or gets any back after that.
+func (w *watcher) notifyEmpty(last int, current int) {
+	switch {
+	case last > 0 && current == 0:
+		w.lostAll = true
+		if w.opts.onEmpty != nil {
+			w.opts.onEmpty(w.name)
+		}
+	case w.lostAll && current > 0:
+		w.lostAll = false
+		if w.opts.onRecovered != nil {
+			w.opts.onRecovered(w.name)
+		}
+	}
+}
+
+// deleteGrace returns how long deletes are held back when the number of addresses goes from last to current.
+func (w *watcher) deleteGrace(last int, current int) time.Duration {
+	grace := w.opts.deleteGrace
+	if w.opts.minEndpoints > 0 && last >= w.opts.minEndpoints && current < w.opts.minEndpoints &&
+		w.opts.minEndpointsGrace > grace {
+		w.opts.logger.WithField("target", w.name).Warnf("k8sresolver: Holding back deletes, since only %d addresses would be left, fewer than %d minimum", current, w.opts.minEndpoints)
+		return w.opts.minEndpointsGrace
+	}
+	return grace
+}
+
+// earliestPendingDelete returns the earliest deadline of the deletes held back by delete grace.
+func (w *watcher) earliestPendingDelete() (time.Time, bool) {
+	var earliest time.Time
+	for _, deadline := range w.pendingDeletes {
+		if earliest.IsZero() || deadline.Before(earliest) {
+			earliest = deadline
+		}
+	}
+	return earliest, !earliest.IsZero()
+}
+
+// sortUpdates sorts updates deterministically: deletes before adds, each sorted by address.
+func sortUpdates(updates []*naming.Update) {
+	sort.SliceStable(updates, func(i, j int) bool {
+		if updates[i].Op != updates[j].Op {
+			return updates[i].Op == naming.Delete
+		}
+		return updates[i].Addr < updates[j].Addr
+	})
+}
+
+// podCacheMaxAge is an age after which cached pods are listed again, so changed labels and annotations of pods that
+// stay in the endpoints are noticed.
+const podCacheMaxAge = 30 * time.Second
+
+// podCache holds pods listed for the endpoints of the namespace, so pods are not listed on every endpoints event.
+type podCache struct {
+	pods map[string]pod
+	// ips are IPs of the endpoints addresses the pods were listed for. Pods are listed again if any other address shows
+	// up, since its pod might not exist at the time of the list.
+	ips    map[string]struct{}
+	listed time.Time
+}
+
+func newPodCache(pods map[string]pod, subsets []subset, listed time.Time) *podCache {
+	c := &podCache{pods: pods, ips: map[string]struct{}{}, listed: listed}
+	for _, s := range subsets {
+		for _, list := range [][]address{s.Addresses, s.NotReadyAddresses} {
+			for _, a := range list {
+				c.ips[canonicalIP(a.IP)] = struct{}{}
+			}
+		}
+	}
+	return c
+}
+
+// covers returns true if pods were listed for all addresses of the subsets.
+func (c *podCache) covers(subsets []subset) bool {
+	for _, s := range subsets {
+		for _, list := range [][]address{s.Addresses, s.NotReadyAddresses} {
+			for _, a := range list {
+				if _, ok := c.ips[canonicalIP(a.IP)]; !ok {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// namespacePods returns pods matching the address selector by their IPs. Pods are listed only if some address of the
+// subsets is new or the cached pods are too old.
+func (w *watcher) namespacePods(namespace string, subsets []subset) (map[string]pod, error) {
+	now := w.opts.clock.Now()
+	if c, ok := w.pods[namespace]; ok && now.Sub(c.listed) < podCacheMaxAge && c.covers(subsets) {
+		return c.pods, nil
+	}
+	pods, err := w.clients[namespace].ListPods(w.ctx, namespace, w.opts.addressSelector)
+	if err != nil {
+		return nil, err
+	}
+	w.pods[namespace] = newPodCache(pods, subsets, now)
+	return pods, nil
+}
+
+// updateNamespace translates endpoints event to addresses of the given namespace.
+func (w *watcher) updateNamespace(namespace string, event event) error {
+	subsets := event.Object.Subsets
+	if event.Type == deleted {
+		// Endpoints object was removed together with the service, so there are no backends anymore.
+		subsets = nil
+	}
+	if event.Type != deleted && len(subsets) == 0 && len(w.namespaceAddresses[namespace]) > 0 && event.Object.Metadata.ResourceVersion == "" {
+		// Every genuine endpoints object has resourceVersion. Do not delete all backends because of malformed event.
+		// Deleted event is explicit, e.g. endpoints listed after they were resolved from the cache do not exist.
+		w.opts.logger.WithField("target", w.name).Debug("k8sresolver: Ignoring empty event without resourceVersion")
+		return nil
+	}
+
+	target := w.namespaceTarget(namespace)
+
+	var pods map[string]pod
+	if (w.opts.addressSelector != "" || w.opts.weightAnnotation != "") && len(subsets) > 0 {
+		var err error
+		pods, err = w.namespacePods(namespace, subsets)
+		if err != nil {
+			return errors.Wrapf(err, "k8sresolver: failed to list pods matching %q selector", w.opts.addressSelector)
+		}
+	}
+
+	// Translate kube api endpoint watch event to resolver address and put into map for easier lookup.
+	// Empty subsets (e.g. service scaled to zero) mean that all previous addresses are deleted.
+	// Map guarantees that every address is returned once, even if it is present in many subsets. Addresses of
+	// different ports never collide, since address includes the port.
+	// Map of the previous event is reused, since the state usually changes only a little.
+	updatedEndpoints := emptied(w.spareNamespaceAddresses[namespace])
+	var portNotFoundErr error
+	portFound := false
+	// Target is checked against the initial endpoints only. Ports of later events are not checked, so rollout of
+	// changed ports does not fail the watcher.
+	checkStrict := w.opts.strictMode && len(subsets) > 0 && !w.strictChecked[namespace]
+	for _, portTarget := range w.portTargets(target) {
+		if checkStrict {
+			if err := checkStrictTarget(portTarget, subsets, w.opts.appProtocol); err != nil {
+				return err
+			}
+		}
+		for _, subset := range subsets {
+			if err := addSubsetAddresses(updatedEndpoints, namespace, portTarget, subset, w.opts, pods); err != nil {
+				if _, ok := err.(*portNotFoundError); ok {
+					// Subsets can have different sets of ports. Only fail if no subset has any of the ports.
+					w.opts.logger.WithError(err).WithField("target", portTarget.String()).Debug("k8sresolver: Skipping subset")
+					portNotFoundErr = err
+					continue
+				}
+				return errors.Wrap(err, "k8sresolver: failed to convert k8s endpoint subset to update Addr")
+			}
+			portFound = true
+		}
+	}
+
+	if checkStrict {
+		w.strictChecked[namespace] = true
+	}
+	if !portFound && portNotFoundErr != nil {
+		return errors.Wrap(portNotFoundErr, "k8sresolver: failed to convert k8s endpoint subset to update Addr")
+	}
+
+	w.spareNamespaceAddresses[namespace] = reusable(w.namespaceAddresses[namespace], len(updatedEndpoints))
+	w.namespaceAddresses[namespace] = updatedEndpoints
+	if w.opts.watchServicePorts {
+		w.lastEvents[namespace] = event
+	}
+	return nil
+}
+
+// emptied returns the map emptied for reuse or a new one if it is nil.
+func emptied(m map[string]AddressMetadata) map[string]AddressMetadata {
+	if m == nil {
+		return make(map[string]AddressMetadata)
+	}
+	for addr := range m {
+		delete(m, addr)
+	}
+	return m
+}
+
+// reusable returns the map if it can be reused for the given number of addresses. Maps never shrink, so map of the
+// service that scaled down a lot is dropped instead of holding the memory for all the addresses it had.
+func reusable(m map[string]AddressMetadata, size int) map[string]AddressMetadata {
+	if len(m) > 2*size+minReusableSize {
+		return nil
+	}
+	return m
+}
+
+// namespaceTarget returns target of the namespace. Targets can differ by port as well, if service ports are mapped (see
+// WithServicePortMapping).
+func (w *watcher) namespaceTarget(namespace string) targetEntry {
+	for _, t := range w.targets {
+		if t.namespace == namespace {
+			return t
+		}
+	}
+	return w.targets[0]
+}
+
+// portTargets returns target for every port resolved for the target. Target without port resolves all ports
+// configured by WithPorts, if any.
+func (w *watcher) portTargets(target targetEntry) []targetEntry {
+	if target.port != noTargetPort || len(w.opts.ports) == 0 {
+		return []targetEntry{target}
+	}
+	targets := make([]targetEntry, 0, len(w.opts.ports))
+	for _, p := range w.opts.ports {
+		target.port = p
+		targets = append(targets, target)
+	}
+	return targets
+}
+
 type endpoints struct {
 	Kind       string   `json:"kind"`
 	APIVersion string   `json:"apiVersion"`
@@ -131,42 +843,465 @@ type metadata struct {
 
 type subset struct {
 	Addresses []address `json:"addresses"`
-	Ports     []port    `json:"ports"`
+	// NotReadyAddresses are addresses of pods that are not ready (e.g failing readiness probe or terminating).
+	NotReadyAddresses []address `json:"notReadyAddresses"`
+	Ports             []port    `json:"ports"`
 }
 
 type address struct {
 	IP string `json:"ip"`
+	// Zone, ForZones and Terminating are not part of Endpoints API. They are set only when merging EndpointSlices.
+	Zone        string   `json:"zone,omitempty"`
+	ForZones    []string `json:"forZones,omitempty"`
+	Terminating bool     `json:"terminating,omitempty"`
+	// TargetRef is an object backing the address, usually pod.
+	TargetRef *objectReference `json:"targetRef,omitempty"`
+	NodeName  string           `json:"nodeName,omitempty"`
+	// Service is not part of Endpoints API as well. It is a name of the endpoints object the address comes from, set
+	// only when merging objects matching WithEndpointsSelector.
+	Service string `json:"service,omitempty"`
+}
+
+type objectReference struct {
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	UID       string `json:"uid"`
+}
+
+// isPod returns true if address is backed by the pod with given name.
+func (a address) isPod(name string) bool {
+	return a.TargetRef != nil && a.TargetRef.Kind == "Pod" && a.TargetRef.Name == name
+}
+
+// AddressMetadata is attached as a Metadata to every naming.Update adding an address.
+type AddressMetadata struct {
+	// IP is an IP of the pod.
+	IP string
+	// Namespace is a namespace of the endpoints with the address.
+	Namespace string
+	// PortName is a name of the resolved port. Empty if port is not named in endpoints.
+	PortName string
+	// AppProtocol is an application protocol of the resolved port (e.g. grpc, h2c or https). Empty if not set in endpoints.
+	AppProtocol string
+	// TLS is true if the address should be dialed with TLS according to its AppProtocol, so connection manager can pick
+	// credentials per backend. See WithTLSMapper.
+	TLS bool
+	// Zone is a zone where the pod is placed. Set only for EndpointSliceAPI.
+	Zone string
+	// ForZones are zones that should consume the address according to topology hints. Set only for EndpointSliceAPI.
+	ForZones []string
+	// Terminating is true if the pod is terminating, but still serving. Balancer should keep the connection for in-flight
+	// requests, but not pick it for new ones. Set only for EndpointSliceAPI and SelectorAPI.
+	Terminating bool
+	// Weight is a weight of the address taken from the pod annotation. Set only if enabled by WithPodWeights.
+	Weight int
+	// NodeName is a name of the node hosting the pod, so balancer can prefer the addresses on its own node. Empty if
+	// not known.
+	NodeName string
+	// TargetRef identifies the object backing the address, usually pod. Nil if endpoints do not reference any.
+	TargetRef *TargetRef
+	// Service is a name of the endpoints object with the address. Set only for WithEndpointsSelector, which resolves
+	// many of them.
+	Service string
+	// Cluster is a name of the cluster with the address, e.g. for locality-aware balancing. Set only for WithClusters.
+	Cluster string
+	// Ports are all TCP ports of the subset with the address by port name, e.g. to dial other services multiplexed on
+	// the same pods without watching them. Addr uses the resolved port either way. The only port of endpoints can be
+	// unnamed, so its name is empty. Ports are shared by addresses of the subset and must not be modified. Set only if
+	// enabled by WithPortMapMetadata.
+	Ports map[string]Port
+	// Snapshot is true if the add is a part of the full state of the target: adds of the same Next() call are all the
+	// resolved addresses, so balancer can replace its addresses by them instead of merging. Set only if enabled by
+	// WithSnapshotUpdates.
+	Snapshot bool
+}
+
+// Port is a port exposed by the address.
+type Port struct {
+	Port int
+	// AppProtocol is an application protocol of the port. Empty if not set in endpoints.
+	AppProtocol string
+}
+
+// portMap returns TCP ports by name.
+func portMap(ports []port) map[string]Port {
+	m := make(map[string]Port, len(ports))
+	for _, p := range ports {
+		if p.isTCP() {
+			m[p.Name] = Port{Port: p.Port, AppProtocol: p.AppProtocol}
+		}
+	}
+	return m
+}
+
+// equalMetadata returns true if both metadata describe the same address, so there is no need to re-add it. Snapshot is
+// ignored, since it describes the update rather than the address.
+func equalMetadata(a, b AddressMetadata) bool {
+	if a.IP != b.IP || a.Namespace != b.Namespace || a.PortName != b.PortName || a.AppProtocol != b.AppProtocol ||
+		a.TLS != b.TLS || a.Zone != b.Zone || a.Terminating != b.Terminating || a.Weight != b.Weight ||
+		a.NodeName != b.NodeName || a.Service != b.Service || a.Cluster != b.Cluster {
+		return false
+	}
+	if (a.TargetRef == nil) != (b.TargetRef == nil) || (a.TargetRef != nil && *a.TargetRef != *b.TargetRef) {
+		return false
+	}
+	return equalZones(a.ForZones, b.ForZones) && equalPorts(a.Ports, b.Ports)
+}
+
+// equalZones returns true if both addresses are hinted for the same zones.
+func equalZones(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// equalPorts returns true if both addresses have the same ports.
+func equalPorts(a, b map[string]Port) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, p := range a {
+		if other, ok := b[name]; !ok || other != p {
+			return false
+		}
+	}
+	return true
+}
+
+// TargetRef identifies the object backing the address, so the address can be mapped to the concrete pod.
+type TargetRef struct {
+	Kind      string
+	Name      string
+	Namespace string
+	UID       string
+	// NodeName is a name of the node hosting the object, if known.
+	NodeName string
 }
 
 type port struct {
 	Name string `json:"name"`
 	Port int    `json:"port"`
+	// Protocol is TCP, UDP or SCTP. Empty means TCP.
+	Protocol string `json:"protocol,omitempty"`
+	// AppProtocol is an application protocol of the port, e.g. grpc, h2c or https.
+	AppProtocol string `json:"appProtocol,omitempty"`
 }
 
-func subsetToAddresses(t targetEntry, sub subset) ([]string, error) {
-	if len(sub.Ports) == 0 {
-		return []string(nil), errors.Errorf("retrieved subset update contains no port")
+const grpcAppProtocol = "grpc"
+
+// isTCP returns true if port can be used by gRPC.
+func (p port) isTCP() bool {
+	return p.Protocol == "" || p.Protocol == "TCP"
+}
+
+// defaultPort returns the port used for target without port, or nil if there is no TCP port. Order of ports in subset is
+// not guaranteed, so port is selected by precedence to stay the same across events:
+// port with `appProtocol: grpc`, then port named `grpc`, then the lowest-numbered TCP port (by name if numbers equal).
+func defaultPort(ports []port) *port {
+	var resolved *port
+	for i, p := range ports {
+		if !p.isTCP() {
+			continue
+		}
+		if resolved == nil || p.preferredTo(*resolved) {
+			resolved = &ports[i]
+		}
+	}
+	return resolved
+}
+
+// preferredTo returns true if port takes precedence over the other one when target has no port.
+func (p port) preferredTo(other port) bool {
+	if rank, otherRank := p.rank(), other.rank(); rank != otherRank {
+		return rank < otherRank
+	}
+	if p.Port != other.Port {
+		return p.Port < other.Port
+	}
+	return p.Name < other.Name
+}
+
+func (p port) rank() int {
+	switch {
+	case p.AppProtocol == grpcAppProtocol:
+		return 0
+	case p.Name == "grpc":
+		return 1
+	default:
+		return 2
+	}
+}
+
+// appProtocolPort returns the TCP port with appProtocol selected by WithSelectByAppProtocol, or nil if there is none or
+// the selection is disabled.
+func appProtocolPort(ports []port, opts options) (*port, error) {
+	if opts.appProtocol == "" {
+		return nil, nil
+	}
+	var resolved *port
+	for i, p := range ports {
+		if !p.isTCP() || p.AppProtocol != opts.appProtocol {
+			continue
+		}
+		if resolved == nil {
+			resolved = &ports[i]
+			continue
+		}
+		if opts.ambiguousAppProtocolPolicy == FailOnAmbiguousAppProtocol {
+			return nil, &strictModeError{msg: fmt.Sprintf("ports %s and %s both have appProtocol %q",
+				resolved.Name, p.Name, opts.appProtocol)}
+		}
+		if p.Port < resolved.Port || (p.Port == resolved.Port && p.Name < resolved.Name) {
+			resolved = &ports[i]
+		}
+	}
+	return resolved, nil
+}
+
+// ResolveError is returned by watcher's Next() when it fails. It can be inspected with errors.As of the standard library
+// to log structured fields.
+type ResolveError struct {
+	// Target is the resolved target. Targets of many namespaces are separated by comma.
+	Target string
+	// Cause is the error that stopped the watcher.
+	Cause error
+	// Recoverable is true if resolving the target again can succeed. It is false if the failure is caused by the
+	// configuration (e.g. missing permissions) or cancelled context.
+	Recoverable bool
+}
+
+func (w *watcher) resolveError(err error) *ResolveError {
+	return &ResolveError{Target: w.name, Cause: err, Recoverable: !isFatal(err)}
+}
+
+func (e *ResolveError) Error() string {
+	return fmt.Sprintf("k8sresolver: resolving %s failed: %v", e.Target, e.Cause)
+}
+
+// Unwrap returns the cause for errors.Is and errors.As of the standard library.
+func (e *ResolveError) Unwrap() error {
+	return e.Cause
+}
+
+// portNotFoundError is returned when subset does not have port requested by the target or, if target has no port, any
+// TCP port (with appProtocol, if it is required). Protocol is set if the port exists, but it is not TCP.
+type portNotFoundError struct {
+	port        targetPort
+	appProtocol string
+	protocol    string
+}
+
+func (e *portNotFoundError) Error() string {
+	if e.protocol != "" {
+		return fmt.Sprintf("port %s has %s protocol, only TCP is supported", e.port.value, e.protocol)
+	}
+	if e.appProtocol != "" {
+		return fmt.Sprintf("no TCP port with appProtocol %q present in subset", e.appProtocol)
+	}
+	if e.port == noTargetPort {
+		return "no TCP port present in subset"
+	}
+	if e.port.isNamed {
+		return fmt.Sprintf("named port %q not present in subset", e.port.value)
+	}
+	return fmt.Sprintf("port %s not present in subset", e.port.value)
+}
+
+// strictModeError is returned when the target is ambiguous in strict mode or many ports have the appProtocol of
+// WithSelectByAppProtocol and it should fail. It is fatal, since resolving the target again cannot succeed without
+// changes in configuration.
+type strictModeError struct {
+	msg string
+}
+
+func (e *strictModeError) Error() string {
+	return "k8sresolver: " + e.msg
+}
+
+// checkStrictTarget returns error if resolving the target to the subsets requires guessing, see WithStrictMode. Target
+// without port needs a port with appProtocol, if it is not empty. Nothing is checked if there are no subsets, since ports
+// are not known.
+func checkStrictTarget(t targetEntry, subsets []subset, appProtocol string) error {
+	if len(subsets) == 0 {
+		return nil
 	}
 
-	var port string
+	if t.port == noTargetPort && appProtocol != "" {
+		for _, sub := range subsets {
+			for _, p := range sub.Ports {
+				if p.isTCP() && p.AppProtocol == appProtocol {
+					return nil
+				}
+			}
+		}
+		return &strictModeError{msg: fmt.Sprintf("target %s has no port and no endpoints port has appProtocol %q",
+			t, appProtocol)}
+	}
 	if t.port == noTargetPort {
-		// Get first one spotted.
-		port = strconv.Itoa(sub.Ports[0].Port)
-	} else if t.port.isNamed {
+		names := map[string]struct{}{}
+		for _, sub := range subsets {
+			for _, p := range sub.Ports {
+				if p.isTCP() {
+					names[p.Name] = struct{}{}
+				}
+			}
+		}
+		if len(names) > 1 {
+			return &strictModeError{msg: fmt.Sprintf("target %s has no port, but endpoints expose %d TCP ports. "+
+				"Port is required in strict mode", t, len(names))}
+		}
+		return nil
+	}
+
+	for _, sub := range subsets {
 		for _, p := range sub.Ports {
-			if p.Name == t.port.value {
-				port = strconv.Itoa(p.Port)
-				break
+			if t.port.matches(p) {
+				return nil
 			}
 		}
+	}
+	return &strictModeError{msg: fmt.Sprintf("port %s of target %s is not exposed by any endpoints subset", t.port.value, t)}
+}
+
+// addSubsetAddresses adds addresses of the subset resolved for the target in the namespace with their metadata to dst.
+// Pods are used to select addresses and read their weights, if configured in options. Nothing is added on error.
+func addSubsetAddresses(
+	dst map[string]AddressMetadata,
+	namespace string,
+	t targetEntry,
+	sub subset,
+	opts options,
+	pods map[string]pod,
+) error {
+	if len(sub.Ports) == 0 {
+		return errors.Errorf("retrieved subset update contains no port")
+	}
+
+	var resolved *port
+	if t.port == noTargetPort {
+		var err error
+		if resolved, err = appProtocolPort(sub.Ports, opts); err != nil {
+			return err
+		}
+		if resolved == nil && opts.appProtocol != "" && opts.strictMode {
+			// Only ports with the appProtocol are resolved in strict mode.
+			return &portNotFoundError{appProtocol: opts.appProtocol}
+		}
+		if resolved == nil {
+			resolved = defaultPort(sub.Ports)
+		}
+		if resolved == nil {
+			return &portNotFoundError{}
+		}
 	} else {
-		port = t.port.value
+		var nonTCP *port
+		for i, p := range sub.Ports {
+			if t.port.matches(p) {
+				if !p.isTCP() {
+					// The same port number can be exposed for both TCP and UDP, so keep looking.
+					nonTCP = &sub.Ports[i]
+					continue
+				}
+				if resolved == nil || p.AppProtocol == grpcAppProtocol {
+					// Prefer port declared as gRPC if there are multiple candidates.
+					resolved = &sub.Ports[i]
+				}
+				if p.AppProtocol == grpcAppProtocol {
+					break
+				}
+			}
+		}
+		if resolved == nil && nonTCP != nil {
+			return &portNotFoundError{port: t.port, protocol: nonTCP.Protocol}
+		}
+		if resolved == nil {
+			// Named port is matched against the endpoint port names, which are copied from the service port names.
+			// Numeric port is matched against the endpoint port numbers (service targetPort), so we never route to
+			// a port that is not exposed by the pods.
+			return &portNotFoundError{port: t.port}
+		}
 	}
 
-	var updatedAddresses []string
-	for _, address := range sub.Addresses {
-		updatedAddresses = append(updatedAddresses, net.JoinHostPort(address.IP, port))
+	portValue := strconv.Itoa(resolved.Port)
+
+	var ports map[string]Port
+	if opts.portMapMetadata {
+		ports = portMap(sub.Ports)
 	}
 
-	return updatedAddresses, nil
+	addresses := sub.Addresses
+	if opts.includeNotReady {
+		addresses = append(append([]address(nil), sub.Addresses...), sub.NotReadyAddresses...)
+	}
+
+	for _, address := range addresses {
+		if t.pod != "" && !address.isPod(t.pod) {
+			// Only the requested pod is resolved. No addresses are resolved until it appears.
+			continue
+		}
+		if address.Terminating && !opts.includeTerminating {
+			continue
+		}
+		parsed := net.ParseIP(address.IP)
+		if parsed == nil {
+			// Address could not be dialed anyway.
+			opts.logger.WithField("target", t.String()).Debugf("k8sresolver: Skipping address with invalid IP %q", address.IP)
+			opts.metrics.invalidAddresses.WithLabelValues(t.String()).Inc()
+			continue
+		}
+		// The same IPv6 address can be written differently, so it is returned in canonical form. Valid IPv4 address is
+		// canonical already, so no string is allocated for it.
+		ip := address.IP
+		if strings.Contains(ip, ":") {
+			ip = parsed.String()
+		}
+		p, ok := pods[ip]
+		if opts.addressSelector != "" && !ok {
+			continue
+		}
+		md := AddressMetadata{
+			IP:          ip,
+			Namespace:   namespace,
+			PortName:    resolved.Name,
+			AppProtocol: resolved.AppProtocol,
+			TLS:         opts.tlsMapper(resolved.AppProtocol),
+			Zone:        address.Zone,
+			ForZones:    address.ForZones,
+			Terminating: address.Terminating,
+			NodeName:    address.NodeName,
+			Service:     address.Service,
+			Ports:       ports,
+		}
+		if opts.weightAnnotation != "" {
+			md.Weight = podWeight(p, opts)
+		}
+		if ref := address.TargetRef; ref != nil {
+			md.TargetRef = &TargetRef{
+				Kind:      ref.Kind,
+				Name:      ref.Name,
+				Namespace: ref.Namespace,
+				UID:       ref.UID,
+				NodeName:  address.NodeName,
+			}
+		}
+		dst[net.JoinHostPort(ip, portValue)] = md
+	}
+	return nil
+}
+
+// canonicalIP returns IP in its canonical form, so the same address written differently (e.g. IPv6 with leading zeros)
+// is not returned as two different addresses.
+func canonicalIP(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	return parsed.String()
 }
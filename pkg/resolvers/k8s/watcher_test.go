@@ -0,0 +1,1677 @@
+package k8sresolver
+
+import (
+	"context"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fortytw2/leaktest"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/naming"
+)
+
+func newTestEndpoints(resourceVersion string, portNum int, ips ...string) endpoints {
+	var addresses []address
+	for _, ip := range ips {
+		addresses = append(addresses, address{IP: ip})
+	}
+
+	return endpoints{
+		Metadata: metadata{
+			ResourceVersion: resourceVersion,
+		},
+		Subsets: []subset{
+			{
+				Ports:     []port{{Port: portNum, Name: "grpc"}},
+				Addresses: addresses,
+			},
+		},
+	}
+}
+
+// subsetToAddresses returns addresses of the subset resolved for the target.
+func subsetToAddresses(t targetEntry, sub subset, opts options, pods map[string]pod) (map[string]AddressMetadata, error) {
+	addrs := map[string]AddressMetadata{}
+	if err := addSubsetAddresses(addrs, "", t, sub, opts, pods); err != nil {
+		return nil, err
+	}
+	return addrs, nil
+}
+
+func startTestWatcher(t *testing.T, listResult endpoints, opts ...Option) (chan []byte, *endpointClientMock, *watcher) {
+	bytesCh := make(chan []byte)
+	epClientMock := &endpointClientMock{
+		t: t,
+		expectedTarget: targetEntry{
+			service:   "service1",
+			port:      noTargetPort,
+			namespace: "namespace1",
+		},
+		bytesCh:    bytesCh,
+		errCh:      make(chan error),
+		startErrCh: make(chan error, 1),
+		streamsCh:  make(chan startedStream, 10),
+		listResult: &listResult,
+	}
+
+	w, err := startNewWatcher(context.Background(), epClientMock.expectedTarget, epClientMock, newOptions(opts))
+	require.NoError(t, err)
+	return bytesCh, epClientMock, w
+}
+
+func sendTestEvent(t *testing.T, bytesCh chan<- []byte, e event) {
+	b, err := json.Marshal(e)
+	require.NoError(t, err)
+	bytesCh <- b
+}
+
+func requireUpdates(t *testing.T, expected []*naming.Update, got []*naming.Update) {
+	sortUpdates := func(u []*naming.Update) {
+		sort.Slice(u, func(i, j int) bool {
+			if u[i].Op != u[j].Op {
+				return u[i].Op < u[j].Op
+			}
+			return u[i].Addr < u[j].Addr
+		})
+	}
+	sortUpdates(expected)
+	sortUpdates(got)
+
+	require.Len(t, got, len(expected))
+	for i := range expected {
+		require.Equal(t, expected[i].Op, got[i].Op)
+		require.Equal(t, expected[i].Addr, got[i].Addr)
+		if expected[i].Metadata != nil {
+			require.Equal(t, expected[i].Metadata, got[i].Metadata)
+		}
+	}
+}
+
+func TestWatcher_InitialListIsReturnedFirst(t *testing.T) {
+	bytesCh, epClientMock, w := startTestWatcher(t, newTestEndpoints("10", 8080, "1.2.3.4", "1.2.3.5"))
+	defer w.Close()
+
+	stream := <-epClientMock.streamsCh
+	require.Equal(t, "10", stream.resourceVersion, "watch should start from listed version")
+
+	u, err := w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{
+		{Op: naming.Add, Addr: "1.2.3.4:8080"},
+		{Op: naming.Add, Addr: "1.2.3.5:8080"},
+	}, u)
+
+	// Further events are diffed against the listed state.
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: newTestEndpoints("11", 8080, "1.2.3.5", "1.2.3.6")})
+	u, err = w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{
+		{Op: naming.Delete, Addr: "1.2.3.4:8080"},
+		{Op: naming.Add, Addr: "1.2.3.6:8080"},
+	}, u)
+}
+
+func TestWatcher_Resync_ReturnsWholeDiffAtOnce(t *testing.T) {
+	bytesCh, _, w := startTestWatcher(t, newTestEndpoints("10", 8080, "1.2.3.1", "1.2.3.2", "1.2.3.3"))
+	defer w.Close()
+	_, err := w.Next()
+	require.NoError(t, err)
+
+	// Fresh watch after resync starts with the full state. Only the difference is returned, in single Next.
+	sendTestEvent(t, bytesCh, event{Type: added, Object: newTestEndpoints("20", 8080, "1.2.3.3", "1.2.3.4", "1.2.3.5")})
+	u, err := w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{
+		{Op: naming.Delete, Addr: "1.2.3.1:8080"},
+		{Op: naming.Delete, Addr: "1.2.3.2:8080"},
+		{Op: naming.Add, Addr: "1.2.3.4:8080"},
+		{Op: naming.Add, Addr: "1.2.3.5:8080"},
+	}, u)
+
+	sendTestEvent(t, bytesCh, event{Type: added, Object: newTestEndpoints("30", 8080, "1.2.3.5", "1.2.3.4", "1.2.3.3")})
+	u, err = w.Next()
+	require.NoError(t, err)
+	require.Empty(t, u)
+}
+
+func TestWatcher_UpdatesAreSorted(t *testing.T) {
+	var expected []*naming.Update
+	for i := 0; i < 10; i++ {
+		bytesCh, _, w := startTestWatcher(t, newTestEndpoints("10", 8080, "1.2.3.9", "1.2.3.1", "1.2.3.5", "1.2.3.3"))
+		_, err := w.Next()
+		require.NoError(t, err)
+
+		sendTestEvent(t, bytesCh, event{Type: modified, Object: newTestEndpoints("11", 8080, "1.2.3.8", "1.2.3.5", "1.2.3.2", "1.2.3.7")})
+		u, err := w.Next()
+		require.NoError(t, err)
+		w.Close()
+
+		if expected == nil {
+			expected = u
+			require.Equal(t, []*naming.Update{
+				{Op: naming.Delete, Addr: "1.2.3.1:8080"},
+				{Op: naming.Delete, Addr: "1.2.3.3:8080"},
+				{Op: naming.Delete, Addr: "1.2.3.9:8080"},
+				{Op: naming.Add, Addr: "1.2.3.2:8080", Metadata: AddressMetadata{IP: "1.2.3.2", Namespace: "namespace1", PortName: "grpc"}},
+				{Op: naming.Add, Addr: "1.2.3.7:8080", Metadata: AddressMetadata{IP: "1.2.3.7", Namespace: "namespace1", PortName: "grpc"}},
+				{Op: naming.Add, Addr: "1.2.3.8:8080", Metadata: AddressMetadata{IP: "1.2.3.8", Namespace: "namespace1", PortName: "grpc"}},
+			}, u)
+			continue
+		}
+		require.Equal(t, expected, u, "updates should be in the same order for the same input")
+	}
+}
+
+func TestWatcher_DeleteGrace(t *testing.T) {
+	bytesCh, _, w := startTestWatcher(t, newTestEndpoints("10", 8080, "1.2.3.1", "1.2.3.2"), WithDeleteGrace(200*time.Millisecond))
+	defer w.Close()
+	_, err := w.Next()
+	require.NoError(t, err)
+
+	// Both deletes are held back.
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: newTestEndpoints("11", 8080, "1.2.3.3")})
+	u, err := w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{{Op: naming.Add, Addr: "1.2.3.3:8080"}}, u)
+	require.Equal(t, []string{"1.2.3.1:8080", "1.2.3.2:8080", "1.2.3.3:8080"}, w.Current())
+
+	// Address is back within grace, so its delete is cancelled.
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: newTestEndpoints("12", 8080, "1.2.3.2", "1.2.3.3")})
+	u, err = w.Next()
+	require.NoError(t, err)
+	require.Empty(t, u)
+
+	// Delete is returned once grace expires, even without new events.
+	start := time.Now()
+	u, err = w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{{Op: naming.Delete, Addr: "1.2.3.1:8080"}}, u)
+	require.True(t, time.Since(start) > 50*time.Millisecond, "delete should be held back")
+	require.Equal(t, []string{"1.2.3.2:8080", "1.2.3.3:8080"}, w.Current())
+}
+
+func TestWatcher_MinEndpoints(t *testing.T) {
+	bytesCh, _, w := startTestWatcher(t, newTestEndpoints("10", 8080, "1.2.3.1", "1.2.3.2", "1.2.3.3"), WithMinEndpoints(2, 200*time.Millisecond))
+	defer w.Close()
+	_, err := w.Next()
+	require.NoError(t, err)
+
+	// Deletes above the floor are not held back.
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: newTestEndpoints("11", 8080, "1.2.3.1", "1.2.3.2")})
+	u, err := w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{{Op: naming.Delete, Addr: "1.2.3.3:8080"}}, u)
+
+	// Set would drop below the floor, so deletes are held back until it recovers.
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: newTestEndpoints("12", 8080)})
+	u, err = w.Next()
+	require.NoError(t, err)
+	require.Empty(t, u)
+	require.Equal(t, []string{"1.2.3.1:8080", "1.2.3.2:8080"}, w.Current())
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: newTestEndpoints("13", 8080, "1.2.3.1", "1.2.3.2")})
+	u, err = w.Next()
+	require.NoError(t, err)
+	require.Empty(t, u)
+
+	// Set does not recover, so deletes are returned once grace expires.
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: newTestEndpoints("14", 8080, "1.2.3.1")})
+	u, err = w.Next()
+	require.NoError(t, err)
+	require.Empty(t, u)
+	start := time.Now()
+	u, err = w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{{Op: naming.Delete, Addr: "1.2.3.2:8080"}}, u)
+	require.True(t, time.Since(start) > 50*time.Millisecond, "delete should be held back")
+
+	// Previous set was below the floor already, so deletes are not held back.
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: newTestEndpoints("15", 8080)})
+	u, err = w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{{Op: naming.Delete, Addr: "1.2.3.1:8080"}}, u)
+}
+
+func TestWatcher_Ready(t *testing.T) {
+	bytesCh, _, w := startTestWatcher(t, newTestEndpoints("10", 8080, "1.2.3.4"))
+	defer w.Close()
+
+	select {
+	case <-w.Ready():
+		t.Fatal("watcher should not be ready before initial state is returned")
+	default:
+	}
+	_, err := w.Next()
+	require.NoError(t, err)
+	<-w.Ready()
+	require.NoError(t, w.Err())
+
+	sendTestEvent(t, bytesCh, event{Type: failed, Object: endpoints{Kind: "Status", Code: http.StatusForbidden}})
+	_, err = w.Next()
+	require.Error(t, err)
+	require.Error(t, w.Err())
+	require.Nil(t, w.Current())
+}
+
+func TestWatcher_NextContext(t *testing.T) {
+	bytesCh, _, w := startTestWatcher(t, newTestEndpoints("10", 8080, "1.2.3.4"))
+	defer w.Close()
+
+	_, err := w.NextContext(context.Background())
+	require.NoError(t, err)
+
+	// Caller timeout does not stop the watcher.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	u, err := w.NextContext(ctx)
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.Empty(t, u)
+	require.NoError(t, w.Err())
+	require.Equal(t, []string{"1.2.3.4:8080"}, w.Current())
+
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: newTestEndpoints("11", 8080, "1.2.3.5")})
+	u, err = w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{
+		{Op: naming.Delete, Addr: "1.2.3.4:8080"},
+		{Op: naming.Add, Addr: "1.2.3.5:8080"},
+	}, u)
+}
+
+func TestWatcher_FatalError_IsResolveError(t *testing.T) {
+	bytesCh, _, w := startTestWatcher(t, newTestEndpoints("10", 8080, "1.2.3.4"))
+	defer w.Close()
+	_, err := w.Next()
+	require.NoError(t, err)
+
+	sendTestEvent(t, bytesCh, event{Type: failed, Object: endpoints{Kind: "Status", Status: "Failure", Message: "forbidden", Code: http.StatusForbidden}})
+	_, err = w.Next()
+	require.Error(t, err)
+	var resolveErr *ResolveError
+	require.True(t, stderrors.As(err, &resolveErr))
+	require.Equal(t, "service1.namespace1", resolveErr.Target)
+	require.False(t, resolveErr.Recoverable)
+	require.Equal(t, "k8sresolver: resolving service1.namespace1 failed: k8sresolver: error on reading event stream: Failure: forbidden. Code: 403", err.Error())
+
+	// Next after failure returns the error with target as well.
+	_, err = w.Next()
+	require.True(t, stderrors.As(err, &resolveErr))
+	require.Equal(t, "service1.namespace1", resolveErr.Target)
+}
+
+func TestWatcher_AutoCloseOnErrorDisabled(t *testing.T) {
+	bytesCh, _, w := startTestWatcher(t, newTestEndpoints("10", 8080, "1.2.3.4"), WithAutoCloseOnError(false), WithWatchBackoff(testWatchBackoff))
+	defer w.Close()
+	_, err := w.Next()
+	require.NoError(t, err)
+
+	// Recoverable error does not close the watcher. It subscribes again, keeping the addresses.
+	go func() { w.watchChange <- watchResult{namespace: "namespace1", err: stderrors.New("connection reset")} }()
+	u, err := w.Next()
+	require.NoError(t, err)
+	require.Empty(t, u)
+	u, err = w.Next()
+	require.NoError(t, err)
+	require.Empty(t, u)
+	require.Empty(t, w.unsubscribed)
+	require.Len(t, w.subscriptions, 1, "subscription to the failed watch should be replaced")
+	w.registry.mu.Lock()
+	refs := w.registry.watches[watchKey{namespace: "namespace1", service: "service1"}].refs
+	w.registry.mu.Unlock()
+	require.Equal(t, 1, refs, "replaced subscription should release the watch")
+	require.Equal(t, []string{"1.2.3.4:8080"}, w.Current())
+
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: newTestEndpoints("11", 8080, "1.2.3.5")})
+	u, err = w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{
+		{Op: naming.Delete, Addr: "1.2.3.4:8080"},
+		{Op: naming.Add, Addr: "1.2.3.5:8080"},
+	}, u)
+
+	// Irrecoverable error closes the watcher anyway.
+	sendTestEvent(t, bytesCh, event{Type: failed, Object: endpoints{Kind: "Status", Code: http.StatusForbidden}})
+	for err == nil {
+		_, err = w.Next()
+	}
+	var resolveErr *ResolveError
+	require.True(t, stderrors.As(err, &resolveErr))
+	require.False(t, resolveErr.Recoverable)
+	require.Error(t, w.Err())
+	require.Error(t, w.ctx.Err(), "watcher should be closed")
+}
+
+func TestWatcher_FailedBeforeReady(t *testing.T) {
+	bytesCh, _, w := startTestWatcher(t, newTestEndpoints("10", 8080, "1.2.3.4"))
+	defer w.Close()
+	// Drop initial state, so watcher fails before it is returned.
+	w.initial = nil
+
+	sendTestEvent(t, bytesCh, event{Type: failed, Object: endpoints{Kind: "Status", Code: http.StatusForbidden}})
+	_, err := w.Next()
+	require.Error(t, err)
+	select {
+	case <-w.Ready():
+	default:
+		t.Fatal("ready should be closed after failure")
+	}
+	require.Error(t, w.Err())
+	require.Nil(t, w.Current())
+}
+
+func TestSubsetToAddresses_Pod(t *testing.T) {
+	podAddress := func(ip string, name string) address {
+		return address{IP: ip, TargetRef: &objectReference{Kind: "Pod", Name: name}}
+	}
+	sub := subset{
+		Ports: []port{{Name: "grpc", Port: 8080}},
+		Addresses: []address{
+			podAddress("1.2.3.1", "web-0"),
+			podAddress("1.2.3.2", "web-1"),
+			podAddress("1.2.3.3", "web-10"),
+			{IP: "1.2.3.4"},
+		},
+	}
+	target := targetEntry{service: "web", namespace: "namespace1", port: noTargetPort, pod: "web-1"}
+
+	addrs, err := subsetToAddresses(target, sub, newOptions(nil), nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]AddressMetadata{"1.2.3.2:8080": {
+		IP:        "1.2.3.2",
+		PortName:  "grpc",
+		TargetRef: &TargetRef{Kind: "Pod", Name: "web-1"},
+	}}, addrs)
+
+	// Pod that is not there yet resolves to no addresses.
+	target.pod = "web-2"
+	addrs, err = subsetToAddresses(target, sub, newOptions(nil), nil)
+	require.NoError(t, err)
+	require.Empty(t, addrs)
+
+	target.pod = ""
+	addrs, err = subsetToAddresses(target, sub, newOptions(nil), nil)
+	require.NoError(t, err)
+	require.Len(t, addrs, 4)
+}
+
+func TestSubsetToAddresses_TargetRef(t *testing.T) {
+	var ep endpoints
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"kind": "Endpoints",
+		"subsets": [{
+			"addresses": [
+				{"ip": "1.2.3.1", "nodeName": "node1", "targetRef": {"kind": "Pod", "name": "web-0", "namespace": "namespace1", "uid": "uid-0"}},
+				{"ip": "1.2.3.2"}
+			],
+			"ports": [{"name": "grpc", "port": 8080}]
+		}]
+	}`), &ep))
+
+	addrs, err := subsetToAddresses(targetEntry{service: "web", namespace: "namespace1", port: noTargetPort}, ep.Subsets[0], newOptions(nil), nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]AddressMetadata{
+		"1.2.3.1:8080": {
+			IP:        "1.2.3.1",
+			PortName:  "grpc",
+			NodeName:  "node1",
+			TargetRef: &TargetRef{Kind: "Pod", Name: "web-0", Namespace: "namespace1", UID: "uid-0", NodeName: "node1"},
+		},
+		"1.2.3.2:8080": {IP: "1.2.3.2", PortName: "grpc"},
+	}, addrs)
+}
+
+func TestSubsetToAddresses_AppProtocol(t *testing.T) {
+	var ep endpoints
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"kind": "Endpoints",
+		"subsets": [{
+			"addresses": [{"ip": "1.2.3.1"}],
+			"ports": [
+				{"name": "web", "port": 8080, "appProtocol": "https"},
+				{"name": "web", "port": 8080, "appProtocol": "grpc"},
+				{"name": "metrics", "port": 9090}
+			]
+		}]
+	}`), &ep))
+
+	// Port with grpc appProtocol is preferred if multiple ports match.
+	addrs, err := subsetToAddresses(targetEntry{service: "web", namespace: "namespace1", port: targetPort{value: "web", isNamed: true}}, ep.Subsets[0], newOptions(nil), nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]AddressMetadata{"1.2.3.1:8080": {IP: "1.2.3.1", PortName: "web", AppProtocol: "grpc"}}, addrs)
+
+	addrs, err = subsetToAddresses(targetEntry{service: "web", namespace: "namespace1", port: targetPort{value: "metrics", isNamed: true}}, ep.Subsets[0], newOptions(nil), nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]AddressMetadata{"1.2.3.1:9090": {IP: "1.2.3.1", PortName: "metrics"}}, addrs)
+}
+
+func TestSubsetToAddresses_Terminating(t *testing.T) {
+	sub := subset{
+		Ports:             []port{{Name: "grpc", Port: 8080}},
+		Addresses:         []address{{IP: "1.2.3.1"}, {IP: "1.2.3.2", Terminating: true}},
+		NotReadyAddresses: []address{{IP: "1.2.3.3", Terminating: true}, {IP: "1.2.3.4"}},
+	}
+	target := targetEntry{service: "service1", namespace: "namespace1", port: noTargetPort}
+
+	// Terminating address that is still serving is resolved and marked.
+	addrs, err := subsetToAddresses(target, sub, newOptions(nil), nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]AddressMetadata{
+		"1.2.3.1:8080": {IP: "1.2.3.1", PortName: "grpc"},
+		"1.2.3.2:8080": {IP: "1.2.3.2", PortName: "grpc", Terminating: true},
+	}, addrs)
+
+	addrs, err = subsetToAddresses(target, sub, newOptions([]Option{WithTerminatingAddresses(false)}), nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]AddressMetadata{"1.2.3.1:8080": {IP: "1.2.3.1", PortName: "grpc"}}, addrs)
+
+	// Terminating addresses are excluded entirely, even if not ready addresses are included.
+	addrs, err = subsetToAddresses(target, sub, newOptions([]Option{WithTerminatingAddresses(false), WithNotReadyAddresses(true)}), nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]AddressMetadata{
+		"1.2.3.1:8080": {IP: "1.2.3.1", PortName: "grpc"},
+		"1.2.3.4:8080": {IP: "1.2.3.4", PortName: "grpc"},
+	}, addrs)
+}
+
+func TestWatcher_TerminatingAddressIsReplaced(t *testing.T) {
+	bytesCh, _, w := startTestWatcher(t, newTestEndpoints("10", 8080, "1.2.3.4", "1.2.3.5"))
+	defer w.Close()
+	_, err := w.Next()
+	require.NoError(t, err)
+
+	// Address is replaced, so balancer notices it is terminating.
+	terminating := newTestEndpoints("11", 8080, "1.2.3.5")
+	terminating.Subsets[0].Addresses = append(terminating.Subsets[0].Addresses, address{IP: "1.2.3.4", Terminating: true})
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: terminating})
+	u, err := w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{
+		{Op: naming.Delete, Addr: "1.2.3.4:8080"},
+		{Op: naming.Add, Addr: "1.2.3.4:8080", Metadata: AddressMetadata{IP: "1.2.3.4", Namespace: "namespace1", PortName: "grpc", Terminating: true}},
+	}, u)
+}
+
+func TestWatcher_AddressIsReplacedWhenNodeChanges(t *testing.T) {
+	bytesCh, _, w := startTestWatcher(t, newTestEndpoints("10", 8080, "1.2.3.4"))
+	defer w.Close()
+	_, err := w.Next()
+	require.NoError(t, err)
+
+	// Any metadata change replaces the address, not only weight, terminating state or ports.
+	moved := newTestEndpoints("11", 8080, "1.2.3.4")
+	moved.Subsets[0].Addresses[0].NodeName = "node2"
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: moved})
+	u, err := w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{
+		{Op: naming.Delete, Addr: "1.2.3.4:8080"},
+		{Op: naming.Add, Addr: "1.2.3.4:8080", Metadata: AddressMetadata{IP: "1.2.3.4", Namespace: "namespace1", PortName: "grpc", NodeName: "node2"}},
+	}, u)
+}
+
+func TestSubsetToAddresses_PortMap(t *testing.T) {
+	sub := subset{
+		Ports: []port{
+			{Name: "grpc", Port: 8080, AppProtocol: "grpc"},
+			{Name: "http", Port: 8081},
+			{Name: "dns", Port: 53, Protocol: "UDP"},
+		},
+		Addresses: []address{{IP: "1.2.3.4"}},
+	}
+	target := targetEntry{service: "web", namespace: "namespace1", port: targetPort{value: "http", isNamed: true}}
+
+	addrs, err := subsetToAddresses(target, sub, newOptions([]Option{WithPortMapMetadata(true)}), nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]AddressMetadata{"1.2.3.4:8081": {
+		IP:       "1.2.3.4",
+		PortName: "http",
+		Ports:    map[string]Port{"grpc": {Port: 8080, AppProtocol: "grpc"}, "http": {Port: 8081}},
+	}}, addrs)
+
+	// Ports are not attached by default.
+	addrs, err = subsetToAddresses(target, sub, newOptions(nil), nil)
+	require.NoError(t, err)
+	require.Nil(t, addrs["1.2.3.4:8081"].Ports)
+}
+
+func TestWatcher_PortMapMetadata_AddressIsReplacedWhenPortsChange(t *testing.T) {
+	list := newTestEndpoints("10", 8080, "1.2.3.4")
+	list.Subsets[0].Ports = append(list.Subsets[0].Ports, port{Name: "http", Port: 8081})
+	bytesCh, _, w := startTestWatcher(t, list, WithPortMapMetadata(true))
+	defer w.Close()
+	u, err := w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{{Op: naming.Add, Addr: "1.2.3.4:8080", Metadata: AddressMetadata{
+		IP:        "1.2.3.4",
+		Namespace: "namespace1",
+		PortName:  "grpc",
+		Ports:     map[string]Port{"grpc": {Port: 8080}, "http": {Port: 8081}},
+	}}}, u)
+
+	// Resolved port stays the same, but the address is replaced, so the client notices the other port.
+	changed := newTestEndpoints("11", 8080, "1.2.3.4")
+	changed.Subsets[0].Ports = append(changed.Subsets[0].Ports, port{Name: "http", Port: 9081})
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: changed})
+	u, err = w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{
+		{Op: naming.Delete, Addr: "1.2.3.4:8080"},
+		{Op: naming.Add, Addr: "1.2.3.4:8080", Metadata: AddressMetadata{
+			IP:        "1.2.3.4",
+			Namespace: "namespace1",
+			PortName:  "grpc",
+			Ports:     map[string]Port{"grpc": {Port: 8080}, "http": {Port: 9081}},
+		}},
+	}, u)
+}
+
+func TestWatcher_UpdateInterceptor(t *testing.T) {
+	const fallback = "10.9.9.9:8080"
+	denied := "1.2.3.5:8080"
+	interceptor := func(updates []*naming.Update) []*naming.Update {
+		var out []*naming.Update
+		hasFallback := false
+		for _, u := range updates {
+			if u.Addr == denied {
+				continue
+			}
+			if u.Addr == fallback {
+				// Fallback address is kept, even though watcher does not resolve it.
+				hasFallback = true
+				continue
+			}
+			out = append(out, u)
+		}
+		if !hasFallback {
+			out = append(out, &naming.Update{Op: naming.Add, Addr: fallback})
+		}
+		return out
+	}
+	bytesCh, _, w := startTestWatcher(t, newTestEndpoints("10", 8080, "1.2.3.4", "1.2.3.5"), WithUpdateInterceptor(interceptor))
+	defer w.Close()
+
+	u, err := w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{
+		{Op: naming.Add, Addr: "1.2.3.4:8080"},
+		{Op: naming.Add, Addr: fallback},
+	}, u)
+	require.Equal(t, []string{"1.2.3.4:8080", fallback}, w.Current())
+
+	// Address that is not denied anymore is added, since the caller does not have it yet, even though it did not change.
+	// Delete of the fallback address is dropped by the interceptor, so it is kept.
+	denied = ""
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: newTestEndpoints("11", 8080, "1.2.3.5")})
+	u, err = w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{
+		{Op: naming.Delete, Addr: "1.2.3.4:8080"},
+		{Op: naming.Add, Addr: "1.2.3.5:8080"},
+	}, u)
+	require.Equal(t, []string{"1.2.3.5:8080", fallback}, w.Current())
+	require.Equal(t, 2, w.Stats().Endpoints)
+}
+
+func TestWatcher_Pod_AppearsWhenScaledUp(t *testing.T) {
+	bytesCh := make(chan []byte)
+	epClientMock := &endpointClientMock{
+		t: t,
+		expectedTarget: targetEntry{
+			service:   "web",
+			port:      noTargetPort,
+			namespace: "namespace1",
+		},
+		bytesCh:    bytesCh,
+		errCh:      make(chan error),
+		startErrCh: make(chan error, 1),
+		streamsCh:  make(chan startedStream, 10),
+		listResult: &endpoints{
+			Metadata: metadata{ResourceVersion: "10"},
+			Subsets: []subset{{
+				Ports:     []port{{Name: "grpc", Port: 8080}},
+				Addresses: []address{{IP: "1.2.3.1", TargetRef: &objectReference{Kind: "Pod", Name: "web-0"}}},
+			}},
+		},
+	}
+	target := targetEntry{service: "web", namespace: "namespace1", port: noTargetPort, pod: "web-1"}
+	registry := newWatchRegistry(context.Background(), func() endpointClient { return epClientMock }, newOptions(nil))
+	w, err := startNewMultiWatcher(context.Background(), []targetEntry{target}, registry, newOptions(nil))
+	require.NoError(t, err)
+	defer w.Close()
+
+	u, err := w.Next()
+	require.NoError(t, err)
+	require.Empty(t, u)
+
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: endpoints{
+		Metadata: metadata{ResourceVersion: "11"},
+		Subsets: []subset{{
+			Ports: []port{{Name: "grpc", Port: 8080}},
+			Addresses: []address{
+				{IP: "1.2.3.1", TargetRef: &objectReference{Kind: "Pod", Name: "web-0"}},
+				{IP: "1.2.3.2", TargetRef: &objectReference{Kind: "Pod", Name: "web-1"}},
+			},
+		}},
+	}})
+	u, err = w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{{Op: naming.Add, Addr: "1.2.3.2:8080"}}, u)
+}
+
+func TestWatcher_OnEmptyAndOnRecovered(t *testing.T) {
+	var calls []string
+	bytesCh, _, w := startTestWatcher(t, newTestEndpoints("10", 8080),
+		WithOnEmpty(func(target string) { calls = append(calls, "empty "+target) }),
+		WithOnRecovered(func(target string) { calls = append(calls, "recovered "+target) }),
+	)
+	defer w.Close()
+	_, err := w.Next()
+	require.NoError(t, err)
+
+	// Getting first addresses is not a recovery.
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: newTestEndpoints("11", 8080, "1.2.3.4")})
+	_, err = w.Next()
+	require.NoError(t, err)
+	require.Empty(t, calls)
+
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: newTestEndpoints("12", 8080)})
+	_, err = w.Next()
+	require.NoError(t, err)
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: newTestEndpoints("13", 8080)})
+	_, err = w.Next()
+	require.NoError(t, err)
+	require.Equal(t, []string{"empty service1.namespace1"}, calls)
+
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: newTestEndpoints("14", 8080, "1.2.3.5")})
+	_, err = w.Next()
+	require.NoError(t, err)
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: newTestEndpoints("15", 8080, "1.2.3.5", "1.2.3.6")})
+	_, err = w.Next()
+	require.NoError(t, err)
+	require.Equal(t, []string{"empty service1.namespace1", "recovered service1.namespace1"}, calls)
+}
+
+func TestWatcher_ManyPorts(t *testing.T) {
+	listResult := endpoints{
+		Metadata: metadata{ResourceVersion: "10"},
+		Subsets: []subset{{
+			Ports:     []port{{Name: "grpc", Port: 8080}, {Name: "grpc-web", Port: 8081}, {Name: "metrics", Port: 9090}},
+			Addresses: []address{{IP: "1.2.3.4"}},
+		}},
+	}
+	bytesCh, _, w := startTestWatcher(t, listResult, WithPorts([]string{"grpc", "grpc-web"}))
+	defer w.Close()
+
+	u, err := w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{
+		{Op: naming.Add, Addr: "1.2.3.4:8080", Metadata: AddressMetadata{IP: "1.2.3.4", Namespace: "namespace1", PortName: "grpc"}},
+		{Op: naming.Add, Addr: "1.2.3.4:8081", Metadata: AddressMetadata{IP: "1.2.3.4", Namespace: "namespace1", PortName: "grpc-web"}},
+	}, u)
+
+	// Subset without one of the ports resolves the other one.
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: endpoints{
+		Metadata: metadata{ResourceVersion: "11"},
+		Subsets: []subset{
+			{Ports: []port{{Name: "grpc", Port: 8080}, {Name: "grpc-web", Port: 8081}}, Addresses: []address{{IP: "1.2.3.4"}}},
+			{Ports: []port{{Name: "grpc", Port: 8080}}, Addresses: []address{{IP: "1.2.3.5"}}},
+		},
+	}})
+	u, err = w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{
+		{Op: naming.Add, Addr: "1.2.3.5:8080", Metadata: AddressMetadata{IP: "1.2.3.5", Namespace: "namespace1", PortName: "grpc"}},
+	}, u)
+
+	// Event without any of the ports fails the watcher.
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: endpoints{
+		Metadata: metadata{ResourceVersion: "12"},
+		Subsets:  []subset{{Ports: []port{{Name: "metrics", Port: 9090}}, Addresses: []address{{IP: "1.2.3.4"}}}},
+	}})
+	_, err = w.Next()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `not present in subset`)
+}
+
+func TestWatcher_ParentContextCancel_ClosesWatcher(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	epClientMock := &endpointClientMock{
+		t: t,
+		expectedTarget: targetEntry{
+			service:   "service1",
+			port:      noTargetPort,
+			namespace: "namespace1",
+		},
+		bytesCh:    make(chan []byte),
+		errCh:      make(chan error),
+		startErrCh: make(chan error, 1),
+		streamsCh:  make(chan startedStream, 10),
+		listResult: &endpoints{},
+	}
+
+	w, err := startNewWatcher(ctx, epClientMock.expectedTarget, epClientMock, newOptions(nil))
+	require.NoError(t, err)
+	stream := <-epClientMock.streamsCh
+
+	_, err = w.Next()
+	require.NoError(t, err)
+
+	cancel()
+	_, err = w.Next()
+	require.Error(t, err)
+	requireClosedEventually(t, stream.connMock)
+}
+
+func TestStartNewMultiWatcher_FailedStartDoesNotLeak(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	newClient := func(namespace string, startErr error) *endpointClientMock {
+		listResult := newTestEndpoints("10", 8080, "1.2.3.4")
+		m := &endpointClientMock{
+			t:              t,
+			expectedTarget: targetEntry{service: "service1", port: noTargetPort, namespace: namespace},
+			bytesCh:        make(chan []byte),
+			errCh:          make(chan error),
+			startErrCh:     make(chan error, 1),
+			streamsCh:      make(chan startedStream, 10),
+			listResult:     &listResult,
+		}
+		if startErr != nil {
+			m.startErrCh <- startErr
+		}
+		return m
+	}
+	// Watch of namespace1 is started, before watch of namespace2 fails to start.
+	clients := []endpointClient{
+		newClient("namespace1", nil),
+		newClient("namespace2", &statusError{code: http.StatusForbidden}),
+	}
+	var started int32
+	o := newOptions([]Option{WithWatchBackoff(testWatchBackoff)})
+	registry := newWatchRegistry(context.Background(), func() endpointClient {
+		return clients[atomic.AddInt32(&started, 1)-1]
+	}, o)
+	_, err := startNewMultiWatcher(context.Background(), []targetEntry{
+		{service: "service1", port: noTargetPort, namespace: "namespace1"},
+		{service: "service1", port: noTargetPort, namespace: "namespace2"},
+	}, registry, o)
+	require.Error(t, err)
+	require.True(t, isFatal(err))
+
+	// Started watch is released, since its only watcher failed.
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	require.Empty(t, registry.watches)
+}
+
+func TestWatcher_CloseConcurrentWithNext(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	for i := 0; i < 20; i++ {
+		bytesCh, epClientMock, w := startTestWatcher(t, newTestEndpoints("10", 8080, "1.2.3.4"))
+		stream := <-epClientMock.streamsCh
+
+		stopCh := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for rv := 11; ; rv++ {
+				b, err := json.Marshal(event{Type: modified, Object: newTestEndpoints(strconv.Itoa(rv), 8080, "1.2.3.4", fmt.Sprintf("1.2.3.%d", rv%200))})
+				require.NoError(t, err)
+				select {
+				case <-stopCh:
+					return
+				case bytesCh <- b:
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for {
+				if _, err := w.Next(); err != nil {
+					return
+				}
+			}
+		}()
+
+		// Close many times concurrently with Next.
+		var closeWG sync.WaitGroup
+		for j := 0; j < 3; j++ {
+			closeWG.Add(1)
+			go func() {
+				defer closeWG.Done()
+				w.Close()
+			}()
+		}
+		closeWG.Wait()
+		w.Close()
+
+		_, err := w.Next()
+		require.Error(t, err)
+		requireClosedEventually(t, stream.connMock)
+		close(stopCh)
+		wg.Wait()
+	}
+}
+
+func TestSubsetToAddresses_NamedPortNotFound(t *testing.T) {
+	sub := subset{
+		Ports: []port{
+			{Name: "grpc", Port: 8080},
+			{Name: "http", Port: 8081},
+		},
+		Addresses: []address{{IP: "1.2.3.4"}},
+	}
+	target := targetEntry{
+		service:   "service1",
+		namespace: "namespace1",
+		port:      targetPort{isNamed: true, value: "metrics"},
+	}
+
+	_, err := subsetToAddresses(target, sub, newOptions(nil), nil)
+	require.Error(t, err)
+	require.Equal(t, `named port "metrics" not present in subset`, err.Error())
+
+	target.port.value = "http"
+	addrs, err := subsetToAddresses(target, sub, newOptions(nil), nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]AddressMetadata{"1.2.3.4:8081": {IP: "1.2.3.4", PortName: "http"}}, addrs)
+
+	// Numeric port gets name from subset, if there is one.
+	target.port = targetPort{value: "8080"}
+	addrs, err = subsetToAddresses(target, sub, newOptions(nil), nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]AddressMetadata{"1.2.3.4:8080": {IP: "1.2.3.4", PortName: "grpc"}}, addrs)
+
+	// Numeric port is validated against the subset as well.
+	target.port = targetPort{value: "9090"}
+	_, err = subsetToAddresses(target, sub, newOptions(nil), nil)
+	require.Error(t, err)
+	require.Equal(t, "port 9090 not present in subset", err.Error())
+	_, ok := err.(*portNotFoundError)
+	require.True(t, ok)
+}
+
+func TestSubsetToAddresses_MixedProtocols(t *testing.T) {
+	sub := subset{
+		Ports: []port{
+			{Name: "dns-udp", Port: 53, Protocol: "UDP"},
+			{Name: "dns-tcp", Port: 53, Protocol: "TCP"},
+			{Name: "metrics-sctp", Port: 9090, Protocol: "SCTP"},
+			{Name: "grpc", Port: 8080},
+		},
+		Addresses: []address{{IP: "1.2.3.4"}},
+	}
+
+	// Only TCP port is used if target has no port.
+	addrs, err := subsetToAddresses(targetEntry{service: "service1", namespace: "namespace1", port: noTargetPort}, sub, newOptions(nil), nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]AddressMetadata{"1.2.3.4:8080": {IP: "1.2.3.4", PortName: "grpc"}}, addrs)
+
+	// TCP port is used if the same number is exposed for UDP as well.
+	addrs, err = subsetToAddresses(targetEntry{service: "service1", namespace: "namespace1", port: targetPort{value: "53"}}, sub, newOptions(nil), nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]AddressMetadata{"1.2.3.4:53": {IP: "1.2.3.4", PortName: "dns-tcp"}}, addrs)
+
+	_, err = subsetToAddresses(targetEntry{service: "service1", namespace: "namespace1", port: targetPort{value: "dns-udp", isNamed: true}}, sub, newOptions(nil), nil)
+	require.Error(t, err)
+	require.Equal(t, "port dns-udp has UDP protocol, only TCP is supported", err.Error())
+	_, ok := err.(*portNotFoundError)
+	require.True(t, ok, "UDP only port should fail Next as missing port")
+
+	_, err = subsetToAddresses(targetEntry{service: "service1", namespace: "namespace1", port: targetPort{value: "9090"}}, sub, newOptions(nil), nil)
+	require.Error(t, err)
+	require.Equal(t, "port 9090 has SCTP protocol, only TCP is supported", err.Error())
+
+	// Subset without TCP ports is skipped.
+	_, err = subsetToAddresses(targetEntry{service: "service1", namespace: "namespace1", port: noTargetPort}, subset{
+		Ports:     []port{{Name: "dns-udp", Port: 53, Protocol: "UDP"}},
+		Addresses: []address{{IP: "1.2.3.4"}},
+	}, newOptions(nil), nil)
+	require.Error(t, err)
+	_, ok = err.(*portNotFoundError)
+	require.True(t, ok)
+}
+
+func TestSubsetToAddresses_SelectByAppProtocol(t *testing.T) {
+	target := targetEntry{service: "service1", namespace: "namespace1", port: noTargetPort}
+	for _, tcase := range []struct {
+		name     string
+		ports    []port
+		opts     []Option
+		expected string
+		err      string
+	}{
+		{
+			name:     "port named after the team convention",
+			ports:    []port{{Name: "http", Port: 8080}, {Name: "api", Port: 9000, AppProtocol: "h2c"}},
+			opts:     []Option{WithSelectByAppProtocol("h2c", FailOnAmbiguousAppProtocol)},
+			expected: "1.2.3.4:9000",
+		},
+		{
+			name:     "port named grpc, but with other appProtocol",
+			ports:    []port{{Name: "grpc", Port: 8080, AppProtocol: "grpc"}, {Name: "web", Port: 8443, AppProtocol: "https"}},
+			opts:     []Option{WithSelectByAppProtocol("https", FailOnAmbiguousAppProtocol)},
+			expected: "1.2.3.4:8443",
+		},
+		{
+			name:     "unnamed single port",
+			ports:    []port{{Port: 50051, AppProtocol: "h2c"}},
+			opts:     []Option{WithSelectByAppProtocol("h2c", FailOnAmbiguousAppProtocol)},
+			expected: "1.2.3.4:50051",
+		},
+		{
+			name:  "non TCP port is not selected",
+			ports: []port{{Name: "quic", Port: 443, Protocol: "UDP", AppProtocol: "https"}, {Name: "http", Port: 80}},
+			opts:  []Option{WithSelectByAppProtocol("https", FailOnAmbiguousAppProtocol)},
+			// Falls back to the default port.
+			expected: "1.2.3.4:80",
+		},
+		{
+			name:  "many ports fail",
+			ports: []port{{Name: "api", Port: 9000, AppProtocol: "h2c"}, {Name: "admin", Port: 9001, AppProtocol: "h2c"}},
+			opts:  []Option{WithSelectByAppProtocol("h2c", FailOnAmbiguousAppProtocol)},
+			err:   `k8sresolver: ports api and admin both have appProtocol "h2c"`,
+		},
+		{
+			name:     "many ports pick the lowest one",
+			ports:    []port{{Name: "api", Port: 9001, AppProtocol: "h2c"}, {Name: "admin", Port: 9000, AppProtocol: "h2c"}},
+			opts:     []Option{WithSelectByAppProtocol("h2c", LowestPortOnAmbiguousAppProtocol)},
+			expected: "1.2.3.4:9000",
+		},
+		{
+			name:     "no port falls back to the default port",
+			ports:    []port{{Name: "metrics", Port: 9100}, {Name: "grpc", Port: 8080}},
+			opts:     []Option{WithSelectByAppProtocol("h2c", FailOnAmbiguousAppProtocol)},
+			expected: "1.2.3.4:8080",
+		},
+		{
+			name:  "no port in strict mode",
+			ports: []port{{Name: "metrics", Port: 9100}, {Name: "grpc", Port: 8080}},
+			opts:  []Option{WithSelectByAppProtocol("h2c", FailOnAmbiguousAppProtocol), WithStrictMode(true)},
+			err:   `no TCP port with appProtocol "h2c" present in subset`,
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			sub := subset{Ports: tcase.ports, Addresses: []address{{IP: "1.2.3.4"}}}
+			addrs, err := subsetToAddresses(target, sub, newOptions(tcase.opts), nil)
+			if tcase.err != "" {
+				require.Error(t, err)
+				require.Equal(t, tcase.err, err.Error())
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, addrs, 1)
+			_, ok := addrs[tcase.expected]
+			require.True(t, ok, "expected %s, got %v", tcase.expected, addrs)
+		})
+	}
+
+	// Target with port is not affected.
+	sub := subset{Ports: []port{{Name: "http", Port: 8080}, {Name: "api", Port: 9000, AppProtocol: "h2c"}}, Addresses: []address{{IP: "1.2.3.4"}}}
+	addrs, err := subsetToAddresses(targetEntry{service: "service1", namespace: "namespace1", port: targetPort{value: "http", isNamed: true}},
+		sub, newOptions([]Option{WithSelectByAppProtocol("h2c", FailOnAmbiguousAppProtocol)}), nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]AddressMetadata{"1.2.3.4:8080": {IP: "1.2.3.4", PortName: "http"}}, addrs)
+}
+
+func TestWatcher_SelectByAppProtocol(t *testing.T) {
+	ep := newTestEndpoints("10", 8080, "1.2.3.4")
+	ep.Subsets[0].Ports = []port{{Name: "metrics", Port: 9100}, {Name: "rpc", Port: 8080, AppProtocol: "h2c"}}
+
+	// Strict mode accepts target without port if the appProtocol selects it.
+	_, _, w := startTestWatcher(t, ep, WithSelectByAppProtocol("h2c", FailOnAmbiguousAppProtocol), WithStrictMode(true))
+	u, err := w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{{Op: naming.Add, Addr: "1.2.3.4:8080"}}, u)
+	w.Close()
+
+	// Ambiguous appProtocol is fatal.
+	ep.Subsets[0].Ports = append(ep.Subsets[0].Ports, port{Name: "rpc-admin", Port: 8081, AppProtocol: "h2c"})
+	_, _, w = startTestWatcher(t, ep, WithSelectByAppProtocol("h2c", FailOnAmbiguousAppProtocol))
+	_, err = w.Next()
+	require.Error(t, err)
+	resolveErr, ok := err.(*ResolveError)
+	require.True(t, ok)
+	require.False(t, resolveErr.Recoverable)
+	w.Close()
+
+	// Strict mode fails if no port has the appProtocol.
+	_, _, w = startTestWatcher(t, ep, WithSelectByAppProtocol("grpc", FailOnAmbiguousAppProtocol), WithStrictMode(true))
+	defer w.Close()
+	_, err = w.Next()
+	require.Error(t, err)
+	var strictErr *strictModeError
+	require.True(t, stderrors.As(err, &strictErr), "expected strict mode error, got %v", err)
+}
+
+func TestDefaultPort(t *testing.T) {
+	for _, tcase := range []struct {
+		name     string
+		ports    []port
+		expected string
+	}{
+		{
+			name:     "gRPC app protocol",
+			ports:    []port{{Name: "http", Port: 80}, {Name: "grpc", Port: 8080}, {Name: "api", Port: 9090, AppProtocol: "grpc"}},
+			expected: "api",
+		},
+		{
+			name:     "named grpc",
+			ports:    []port{{Name: "http", Port: 80}, {Name: "grpc", Port: 8080}, {Name: "grpc-udp", Port: 70, Protocol: "UDP"}},
+			expected: "grpc",
+		},
+		{
+			name:     "lowest number",
+			ports:    []port{{Name: "metrics", Port: 9100}, {Name: "http", Port: 80}, {Name: "dns", Port: 53, Protocol: "UDP"}},
+			expected: "http",
+		},
+		{
+			name:     "by name if numbers equal",
+			ports:    []port{{Name: "b", Port: 80}, {Name: "a", Port: 80}},
+			expected: "a",
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			// Port has to be the same regardless of the order apiserver returns them.
+			for i := range tcase.ports {
+				ports := append(append([]port(nil), tcase.ports[i:]...), tcase.ports[:i]...)
+				p := defaultPort(ports)
+				require.NotNil(t, p)
+				require.Equal(t, tcase.expected, p.Name, "ports %v", ports)
+			}
+		})
+	}
+
+	require.Nil(t, defaultPort([]port{{Name: "dns", Port: 53, Protocol: "UDP"}}))
+}
+
+func TestCheckStrictTarget(t *testing.T) {
+	subsets := []subset{
+		{Ports: []port{{Name: "grpc", Port: 8080}, {Name: "dns", Port: 53, Protocol: "UDP"}}},
+		{Ports: []port{{Name: "grpc", Port: 8081}, {Name: "metrics", Port: 9100}}},
+	}
+	for _, tcase := range []struct {
+		name        string
+		port        targetPort
+		subsets     []subset
+		expectedErr bool
+	}{
+		{name: "no port, single TCP port", port: noTargetPort, subsets: subsets[:1]},
+		{name: "no port, many TCP ports", port: noTargetPort, subsets: subsets, expectedErr: true},
+		{name: "named port in some subset", port: targetPort{value: "metrics", isNamed: true}, subsets: subsets},
+		{name: "named port missing", port: targetPort{value: "http", isNamed: true}, subsets: subsets, expectedErr: true},
+		{name: "numeric port in some subset", port: targetPort{value: "8081"}, subsets: subsets},
+		{name: "numeric port missing", port: targetPort{value: "80"}, subsets: subsets, expectedErr: true},
+		{name: "no endpoints", port: targetPort{value: "http", isNamed: true}},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			err := checkStrictTarget(targetEntry{service: "service1", namespace: "namespace1", port: tcase.port}, tcase.subsets, "")
+			if !tcase.expectedErr {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			require.True(t, isFatal(err))
+		})
+	}
+}
+
+func TestWatcher_StrictMode_ManyPorts(t *testing.T) {
+	ep := newTestEndpoints("10", 8080, "1.2.3.4")
+	ep.Subsets[0].Ports = append(ep.Subsets[0].Ports, port{Name: "metrics", Port: 9100})
+
+	// Port is picked by default.
+	_, _, w := startTestWatcher(t, ep)
+	u, err := w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{{Op: naming.Add, Addr: "1.2.3.4:8080"}}, u)
+	w.Close()
+
+	_, _, w = startTestWatcher(t, ep, WithStrictMode(true))
+	defer w.Close()
+	_, err = w.Next()
+	require.Error(t, err)
+	resolveErr, ok := err.(*ResolveError)
+	require.True(t, ok)
+	require.False(t, resolveErr.Recoverable)
+	var strictErr *strictModeError
+	require.True(t, stderrors.As(err, &strictErr), "expected strict mode error, got %v", err)
+	require.Contains(t, strictErr.Error(), "k8sresolver: target service1.namespace1 has no port")
+}
+
+func TestWatcher_StrictMode_ChecksInitialStateOnly(t *testing.T) {
+	bytesCh, _, w := startTestWatcher(t, newTestEndpoints("10", 8080, "1.2.3.4"), WithStrictMode(true))
+	defer w.Close()
+	_, err := w.Next()
+	require.NoError(t, err)
+
+	// Port added during rollout does not fail the watcher that was checked already.
+	ep := newTestEndpoints("11", 8080, "1.2.3.4")
+	ep.Subsets[0].Ports = append(ep.Subsets[0].Ports, port{Name: "metrics", Port: 9100})
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: ep})
+	u, err := w.Next()
+	require.NoError(t, err)
+	require.Empty(t, u)
+}
+
+func TestWatcher_NotFoundList_WaitsForEndpoints(t *testing.T) {
+	bytesCh := make(chan []byte)
+	epClientMock := &endpointClientMock{
+		t: t,
+		expectedTarget: targetEntry{
+			service:   "service1",
+			port:      noTargetPort,
+			namespace: "namespace1",
+		},
+		bytesCh:    bytesCh,
+		errCh:      make(chan error),
+		startErrCh: make(chan error, 1),
+		streamsCh:  make(chan startedStream, 10),
+		listErr:    &statusError{code: http.StatusNotFound},
+	}
+
+	w, err := startNewWatcher(context.Background(), epClientMock.expectedTarget, epClientMock, newOptions(nil))
+	require.NoError(t, err)
+	defer w.Close()
+
+	stream := <-epClientMock.streamsCh
+	require.Equal(t, "", stream.resourceVersion, "watch should start from the current state")
+
+	u, err := w.Next()
+	require.NoError(t, err)
+	require.Empty(t, u)
+
+	sendTestEvent(t, bytesCh, event{Type: added, Object: newTestEndpoints("11", 8080, "1.2.3.4")})
+	u, err = w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{
+		{Op: naming.Add, Addr: "1.2.3.4:8080"},
+	}, u)
+}
+
+func TestWatcher_NamedPortInOneOfSubsets(t *testing.T) {
+	bytesCh := make(chan []byte)
+	target := targetEntry{
+		service:   "service1",
+		port:      targetPort{isNamed: true, value: "http"},
+		namespace: "namespace1",
+	}
+	epClientMock := &endpointClientMock{
+		t: t,
+		// Watch is shared between all ports of the service, so it is started without port.
+		expectedTarget: targetEntry{service: "service1", namespace: "namespace1", port: noTargetPort},
+		bytesCh:        bytesCh,
+		errCh:          make(chan error),
+		startErrCh:     make(chan error, 1),
+		streamsCh:      make(chan startedStream, 10),
+		listResult: &endpoints{
+			Metadata: metadata{ResourceVersion: "10"},
+			Subsets: []subset{
+				{
+					Ports:     []port{{Name: "grpc", Port: 8080}},
+					Addresses: []address{{IP: "1.2.3.4"}},
+				},
+				{
+					Ports:     []port{{Name: "grpc", Port: 8080}, {Name: "http", Port: 8081}},
+					Addresses: []address{{IP: "1.2.3.5"}},
+				},
+			},
+		},
+	}
+
+	logger, hook := test.NewNullLogger()
+	logger.SetLevel(logrus.DebugLevel)
+	w, err := startNewWatcher(context.Background(), target, epClientMock, newOptions([]Option{WithLogger(logger)}))
+	require.NoError(t, err)
+	defer w.Close()
+
+	u, err := w.Next()
+	require.NoError(t, err)
+	require.Equal(t, logrus.DebugLevel, hook.LastEntry().Level, "skipped subset should be logged")
+	requireUpdates(t, []*naming.Update{
+		{Op: naming.Add, Addr: "1.2.3.5:8081", Metadata: AddressMetadata{IP: "1.2.3.5", Namespace: "namespace1", PortName: "http"}},
+	}, u)
+
+	// None of the subsets has the port.
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: newTestEndpoints("11", 8080, "1.2.3.4")})
+	_, err = w.Next()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `named port "http" not present in subset`)
+	require.Equal(t, logrus.WarnLevel, hook.LastEntry().Level, "failed watcher should be logged")
+}
+
+func TestSubsetToAddresses_NotReadyAddresses(t *testing.T) {
+	sub := subset{
+		Ports:             []port{{Name: "grpc", Port: 8080}},
+		Addresses:         []address{{IP: "1.2.3.4"}},
+		NotReadyAddresses: []address{{IP: "1.2.3.5"}},
+	}
+	target := targetEntry{service: "service1", namespace: "namespace1", port: noTargetPort}
+
+	addrs, err := subsetToAddresses(target, sub, newOptions(nil), nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]AddressMetadata{
+		"1.2.3.4:8080": {IP: "1.2.3.4", PortName: "grpc"},
+	}, addrs, "not ready addresses should be excluded by default")
+
+	addrs, err = subsetToAddresses(target, sub, newOptions([]Option{WithNotReadyAddresses(true)}), nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]AddressMetadata{
+		"1.2.3.4:8080": {IP: "1.2.3.4", PortName: "grpc"},
+		"1.2.3.5:8080": {IP: "1.2.3.5", PortName: "grpc"},
+	}, addrs)
+}
+
+func TestWatcher_OverlappingSubsets_UniqueUpdates(t *testing.T) {
+	bytesCh, _, w := startTestWatcher(t, endpoints{
+		Metadata: metadata{ResourceVersion: "10"},
+		Subsets: []subset{
+			{
+				Ports:     []port{{Name: "grpc", Port: 8080}},
+				Addresses: []address{{IP: "1.2.3.4"}, {IP: "fd00::1"}},
+			},
+			{
+				Ports:     []port{{Name: "grpc-alt", Port: 8080}, {Name: "http", Port: 8081}},
+				Addresses: []address{{IP: "1.2.3.4"}, {IP: "fd00:0:0::0001"}},
+			},
+		},
+	})
+	defer w.Close()
+
+	u, err := w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{
+		{Op: naming.Add, Addr: "1.2.3.4:8080"},
+		{Op: naming.Add, Addr: "[fd00::1]:8080"},
+	}, u)
+
+	// Removing address from one of the subsets does not remove it.
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: endpoints{
+		Metadata: metadata{ResourceVersion: "11"},
+		Subsets: []subset{
+			{
+				Ports:     []port{{Name: "grpc", Port: 8080}},
+				Addresses: []address{{IP: "1.2.3.4"}},
+			},
+			{
+				Ports:     []port{{Name: "grpc-alt", Port: 8080}},
+				Addresses: []address{{IP: "1.2.3.4"}, {IP: "fd00::1"}},
+			},
+		},
+	}})
+	u, err = w.Next()
+	require.NoError(t, err)
+	require.Empty(t, u)
+}
+
+func TestWatcher_EmptySubsets_DeletesAll(t *testing.T) {
+	bytesCh, _, w := startTestWatcher(t, newTestEndpoints("10", 8080, "1.2.3.4", "1.2.3.5"))
+	defer w.Close()
+
+	u, err := w.Next()
+	require.NoError(t, err)
+	require.Len(t, u, 2)
+
+	// Malformed event without resourceVersion does not remove backends.
+	sendTestEvent(t, bytesCh, event{Type: modified})
+	u, err = w.Next()
+	require.NoError(t, err)
+	require.Empty(t, u)
+
+	// Scaled to zero.
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: endpoints{Metadata: metadata{ResourceVersion: "11"}}})
+	u, err = w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{
+		{Op: naming.Delete, Addr: "1.2.3.4:8080"},
+		{Op: naming.Delete, Addr: "1.2.3.5:8080"},
+	}, u)
+
+	// Scaled up again.
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: newTestEndpoints("12", 8080, "1.2.3.6")})
+	u, err = w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{
+		{Op: naming.Add, Addr: "1.2.3.6:8080"},
+	}, u)
+
+	// Deleted object contains its last state, but all backends are gone.
+	sendTestEvent(t, bytesCh, event{Type: deleted, Object: newTestEndpoints("13", 8080, "1.2.3.6")})
+	u, err = w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{
+		{Op: naming.Delete, Addr: "1.2.3.6:8080"},
+	}, u)
+}
+
+func TestWatcher_DeletedEvent(t *testing.T) {
+	bytesCh, _, w := startTestWatcher(t, endpoints{Metadata: metadata{ResourceVersion: "10"}}, WithDeleteGrace(time.Hour), WithMinEndpoints(2, time.Hour))
+	defer w.Close()
+	u, err := w.Next()
+	require.NoError(t, err)
+	require.Empty(t, u)
+
+	sendTestEvent(t, bytesCh, event{Type: added, Object: newTestEndpoints("11", 8080, "1.2.3.4")})
+	u, err = w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{{Op: naming.Add, Addr: "1.2.3.4:8080"}}, u)
+
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: newTestEndpoints("12", 8080, "1.2.3.5", "1.2.3.6")})
+	u, err = w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{
+		{Op: naming.Add, Addr: "1.2.3.5:8080"},
+		{Op: naming.Add, Addr: "1.2.3.6:8080"},
+	}, u)
+	require.Equal(t, []string{"1.2.3.4:8080", "1.2.3.5:8080", "1.2.3.6:8080"}, w.Current(), "delete should be held back")
+
+	// Deleted object still has stale subsets, but all addresses are deleted immediately, including held back ones.
+	sendTestEvent(t, bytesCh, event{Type: deleted, Object: newTestEndpoints("13", 8080, "1.2.3.5", "1.2.3.7")})
+	u, err = w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{
+		{Op: naming.Delete, Addr: "1.2.3.4:8080"},
+		{Op: naming.Delete, Addr: "1.2.3.5:8080"},
+		{Op: naming.Delete, Addr: "1.2.3.6:8080"},
+	}, u)
+	require.Empty(t, w.Current())
+}
+
+func TestWatcher_Stats(t *testing.T) {
+	listResult := newTestEndpoints("10", 8080, "1.2.3.4", "1.2.3.5")
+	bytesCh, errCh := make(chan []byte), make(chan error)
+	epClientMock := &endpointClientMock{
+		t:              t,
+		expectedTarget: targetEntry{service: "service1", port: noTargetPort, namespace: "namespace1"},
+		bytesCh:        bytesCh,
+		errCh:          errCh,
+		startErrCh:     make(chan error, 1),
+		streamsCh:      make(chan startedStream, 10),
+		listResult:     &listResult,
+	}
+	w, err := startNewWatcher(context.Background(), epClientMock.expectedTarget, epClientMock, newOptions([]Option{WithWatchBackoff(testWatchBackoff)}))
+	require.NoError(t, err)
+	defer w.Close()
+	<-epClientMock.streamsCh
+	require.Equal(t, WatcherStats{}, w.Stats())
+
+	_, err = w.Next()
+	require.NoError(t, err)
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: newTestEndpoints("11", 8080, "1.2.3.5", "1.2.3.6", "1.2.3.7")})
+	_, err = w.Next()
+	require.NoError(t, err)
+
+	// Stream is closed by server and restarted.
+	errCh <- io.EOF
+	<-epClientMock.streamsCh
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: newTestEndpoints("12", 8080, "1.2.3.7")})
+	_, err = w.Next()
+	require.NoError(t, err)
+
+	stats := w.Stats()
+	require.WithinDuration(t, time.Now(), stats.LastEvent, time.Second)
+	stats.LastEvent = time.Time{}
+	require.Equal(t, WatcherStats{Events: 3, Adds: 4, Deletes: 3, Reconnects: 1, Endpoints: 1}, stats)
+}
+
+func TestWatcher_SnapshotUpdates(t *testing.T) {
+	bytesCh, _, w := startTestWatcher(t, newTestEndpoints("10", 8080, "1.2.3.4", "1.2.3.5"), WithSnapshotUpdates(true))
+	defer w.Close()
+	snapshotAdd := func(ip string) *naming.Update {
+		return &naming.Update{Op: naming.Add, Addr: ip + ":8080", Metadata: AddressMetadata{IP: ip, Namespace: "namespace1", PortName: "grpc", Snapshot: true}}
+	}
+
+	u, err := w.Next()
+	require.NoError(t, err)
+	require.Equal(t, []*naming.Update{snapshotAdd("1.2.3.4"), snapshotAdd("1.2.3.5")}, u)
+
+	// Incremental changes are not marked.
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: newTestEndpoints("11", 8080, "1.2.3.4", "1.2.3.5", "1.2.3.6")})
+	u, err = w.Next()
+	require.NoError(t, err)
+	require.Equal(t, []*naming.Update{
+		{Op: naming.Add, Addr: "1.2.3.6:8080", Metadata: AddressMetadata{IP: "1.2.3.6", Namespace: "namespace1", PortName: "grpc"}},
+	}, u)
+
+	// Fresh watch after resync returns all the addresses, including unchanged ones.
+	sendTestEvent(t, bytesCh, event{Type: added, Object: newTestEndpoints("20", 8080, "1.2.3.5", "1.2.3.6")})
+	u, err = w.Next()
+	require.NoError(t, err)
+	require.Equal(t, []*naming.Update{
+		{Op: naming.Delete, Addr: "1.2.3.4:8080"},
+		snapshotAdd("1.2.3.5"),
+		snapshotAdd("1.2.3.6"),
+	}, u)
+	require.Equal(t, []string{"1.2.3.5:8080", "1.2.3.6:8080"}, w.Current())
+}
+
+func TestWatcher_Current(t *testing.T) {
+	bytesCh, _, w := startTestWatcher(t, newTestEndpoints("10", 8080, "1.2.3.5", "1.2.3.4"))
+	defer w.Close()
+	require.Empty(t, w.Current())
+
+	_, err := w.Next()
+	require.NoError(t, err)
+	require.Equal(t, []string{"1.2.3.4:8080", "1.2.3.5:8080"}, w.Current())
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := w.Next()
+		require.NoError(t, err)
+	}()
+	// Current can be called while Next is in progress.
+	_ = w.Current()
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: newTestEndpoints("11", 8080, "1.2.3.6")})
+	<-done
+	require.Equal(t, []string{"1.2.3.6:8080"}, w.Current())
+}
+
+func TestWatcher_ManyNamespaces(t *testing.T) {
+	var (
+		mocks   []*endpointClientMock
+		bytesCh []chan []byte
+	)
+	ep1 := newTestEndpoints("10", 8080, "1.2.3.4", "1.2.3.5")
+	ep2 := newTestEndpoints("20", 8080, "1.2.3.5", "1.2.3.6")
+	for _, ns := range []struct {
+		name string
+		ep   *endpoints
+	}{{name: "namespace1", ep: &ep1}, {name: "namespace2", ep: &ep2}} {
+		b := make(chan []byte)
+		bytesCh = append(bytesCh, b)
+		mocks = append(mocks, &endpointClientMock{
+			t: t,
+			expectedTarget: targetEntry{
+				service:   "service1",
+				port:      noTargetPort,
+				namespace: ns.name,
+			},
+			bytesCh:    b,
+			errCh:      make(chan error),
+			startErrCh: make(chan error, 1),
+			streamsCh:  make(chan startedStream, 10),
+			listResult: ns.ep,
+		})
+	}
+	targets := []targetEntry{mocks[0].expectedTarget, mocks[1].expectedTarget}
+	i := 0
+	newClient := func() endpointClient {
+		i++
+		return mocks[i-1]
+	}
+
+	w, err := startNewMultiWatcher(context.Background(), targets, newWatchRegistry(context.Background(), newClient, newOptions(nil)), newOptions(nil))
+	require.NoError(t, err)
+	defer w.Close()
+
+	u, err := w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{
+		{Op: naming.Add, Addr: "1.2.3.4:8080"},
+		{Op: naming.Add, Addr: "1.2.3.5:8080"},
+		{Op: naming.Add, Addr: "1.2.3.6:8080", Metadata: AddressMetadata{IP: "1.2.3.6", Namespace: "namespace2", PortName: "grpc"}},
+	}, u)
+
+	// Address removed from one namespace is still present in the other one, but it is replaced, since its metadata
+	// comes from the other namespace now.
+	sendTestEvent(t, bytesCh[0], event{Type: modified, Object: newTestEndpoints("11", 8080, "1.2.3.4")})
+	u, err = w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{
+		{Op: naming.Delete, Addr: "1.2.3.5:8080"},
+		{Op: naming.Add, Addr: "1.2.3.5:8080", Metadata: AddressMetadata{IP: "1.2.3.5", Namespace: "namespace2", PortName: "grpc"}},
+	}, u)
+
+	sendTestEvent(t, bytesCh[1], event{Type: modified, Object: endpoints{Metadata: metadata{ResourceVersion: "21"}}})
+	u, err = w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{
+		{Op: naming.Delete, Addr: "1.2.3.5:8080"},
+		{Op: naming.Delete, Addr: "1.2.3.6:8080"},
+	}, u)
+	require.Equal(t, []string{"1.2.3.4:8080"}, w.Current())
+}
+
+func TestWatcher_AddressSelector(t *testing.T) {
+	bytesCh := make(chan []byte)
+	listResult := newTestEndpoints("10", 8080, "1.2.3.4", "1.2.3.5")
+	epClientMock := &endpointClientMock{
+		t: t,
+		expectedTarget: targetEntry{
+			service:   "service1",
+			port:      noTargetPort,
+			namespace: "namespace1",
+		},
+		bytesCh:          bytesCh,
+		errCh:            make(chan error),
+		startErrCh:       make(chan error, 1),
+		streamsCh:        make(chan startedStream, 10),
+		listResult:       &listResult,
+		expectedSelector: "track!=canary",
+		pods:             map[string]pod{"1.2.3.4": {}, "1.2.3.6": {}},
+	}
+
+	w, err := startNewWatcher(context.Background(), epClientMock.expectedTarget, epClientMock, newOptions([]Option{WithAddressSelector("track!=canary")}))
+	require.NoError(t, err)
+	defer w.Close()
+
+	u, err := w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{
+		{Op: naming.Add, Addr: "1.2.3.4:8080"},
+	}, u)
+
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: newTestEndpoints("11", 8080, "1.2.3.4", "1.2.3.5", "1.2.3.6")})
+	u, err = w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{
+		{Op: naming.Add, Addr: "1.2.3.6:8080"},
+	}, u)
+	require.Equal(t, []string{"1.2.3.4:8080", "1.2.3.6:8080"}, w.Current())
+}
+
+func TestWatcher_ReusedMaps(t *testing.T) {
+	var ips []string
+	for i := 0; i < 20; i++ {
+		ips = append(ips, fmt.Sprintf("10.0.0.%d", i))
+	}
+	bytesCh, _, w := startTestWatcher(t, newTestEndpoints("10", 8080, ips...))
+	defer w.Close()
+	_, err := w.Next()
+	require.NoError(t, err)
+
+	// Maps of the previous call are reused, without leaking addresses into the next state.
+	for i, rv := range []string{"11", "12"} {
+		sendTestEvent(t, bytesCh, event{Type: modified, Object: newTestEndpoints(rv, 8080, ips[i+1:]...)})
+		u, err := w.Next()
+		require.NoError(t, err)
+		requireUpdates(t, []*naming.Update{{Op: naming.Delete, Addr: fmt.Sprintf("10.0.0.%d:8080", i)}}, u)
+		require.Len(t, w.Current(), len(ips)-i-1)
+	}
+	require.NotNil(t, w.spareUpdates)
+
+	// Nothing changed, so shared empty slice is returned.
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: newTestEndpoints("13", 8080, ips[2:]...)})
+	u, err := w.Next()
+	require.NoError(t, err)
+	require.Empty(t, u)
+	require.NotNil(t, u)
+
+	// Maps are not reused after the service scaled down a lot, so they do not hold the memory.
+	large := map[string]AddressMetadata{}
+	for i := 0; i < 2*10+minReusableSize+1; i++ {
+		large[fmt.Sprintf("10.0.1.%d:8080", i)] = AddressMetadata{}
+	}
+	require.Nil(t, reusable(large, 10))
+	require.NotNil(t, reusable(large, 11))
+}
+
+// BenchmarkWatcher_Next_Churn measures Next() of a service with 5000 addresses where 1% of them change per event.
+func BenchmarkWatcher_Next_Churn(b *testing.B) {
+	const block = 50
+	var events []event
+	for removed := 0; removed <= 100; removed++ {
+		var ips []string
+		for i := 0; i <= 100; i++ {
+			if i == removed {
+				continue
+			}
+			for j := 0; j < block; j++ {
+				ips = append(ips, fmt.Sprintf("10.0.%d.%d", i, j))
+			}
+		}
+		events = append(events, event{Type: modified, Object: newTestEndpoints(strconv.Itoa(removed+10), 8080, ips...)})
+	}
+	results := make([][]watchResult, len(events))
+	for i := range events {
+		results[i] = []watchResult{{namespace: "namespace1", ep: &events[i]}}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	target := targetEntry{service: "service1", namespace: "namespace1", port: noTargetPort}
+	w := &watcher{
+		ctx:                     ctx,
+		cancel:                  cancel,
+		targets:                 []targetEntry{target},
+		name:                    target.String(),
+		opts:                    newOptions(nil),
+		clients:                 make(map[string]endpointClient),
+		namespaceAddresses:      make(map[string]map[string]AddressMetadata),
+		spareNamespaceAddresses: make(map[string]map[string]AddressMetadata),
+		lastUpdates:             make(map[string]AddressMetadata),
+		pendingDeletes:          make(map[string]time.Time),
+		ready:                   make(chan struct{}),
+	}
+	w.initial = results[0]
+	if _, err := w.next(ctx); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Every event adds back the block removed by the previous one and removes the next block.
+		w.initial = results[1+i%(len(results)-1)]
+		u, err := w.next(ctx)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(u) != 2*block {
+			b.Fatalf("expected %d updates, got %d", 2*block, len(u))
+		}
+	}
+}
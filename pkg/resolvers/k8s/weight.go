@@ -0,0 +1,25 @@
+package k8sresolver
+
+import "strconv"
+
+const (
+	// DefaultWeightAnnotation is a pod annotation with weight of its addresses, used by WithPodWeights if no other
+	// annotation is specified.
+	DefaultWeightAnnotation = "kedge.io/weight"
+	// defaultWeight is a weight of pods without valid weight annotation.
+	defaultWeight = 1
+)
+
+// podWeight returns weight from the pod annotation or defaultWeight if there is no valid one.
+func podWeight(p pod, opts options) int {
+	v, ok := p.Annotations[opts.weightAnnotation]
+	if !ok {
+		return defaultWeight
+	}
+	weight, err := strconv.Atoi(v)
+	if err != nil || weight < 0 {
+		opts.logger.WithField("annotation", opts.weightAnnotation).Warnf("k8sresolver: Invalid pod weight %q. Using %d", v, defaultWeight)
+		return defaultWeight
+	}
+	return weight
+}
@@ -0,0 +1,120 @@
+package k8sresolver
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/naming"
+)
+
+func TestWatcher_PodWeights(t *testing.T) {
+	bytesCh := make(chan []byte)
+	listResult := newTestEndpoints("10", 8080, "1.2.3.4", "1.2.3.5", "1.2.3.6")
+	epClientMock := &endpointClientMock{
+		t: t,
+		expectedTarget: targetEntry{
+			service:   "service1",
+			port:      noTargetPort,
+			namespace: "namespace1",
+		},
+		bytesCh:    bytesCh,
+		errCh:      make(chan error),
+		startErrCh: make(chan error, 1),
+		streamsCh:  make(chan startedStream, 10),
+		listResult: &listResult,
+		pods: map[string]pod{
+			"1.2.3.4": {Annotations: map[string]string{DefaultWeightAnnotation: "5"}},
+			"1.2.3.5": {},
+			"1.2.3.6": {Annotations: map[string]string{DefaultWeightAnnotation: "not-a-number"}},
+		},
+	}
+
+	clk := newFakeClock()
+	w, err := startNewWatcher(context.Background(), epClientMock.expectedTarget, epClientMock, newOptions([]Option{WithPodWeights(""), withClock(clk)}))
+	require.NoError(t, err)
+	defer w.Close()
+
+	u, err := w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{
+		{Op: naming.Add, Addr: "1.2.3.4:8080", Metadata: AddressMetadata{IP: "1.2.3.4", Namespace: "namespace1", PortName: "grpc", Weight: 5}},
+		{Op: naming.Add, Addr: "1.2.3.5:8080", Metadata: AddressMetadata{IP: "1.2.3.5", Namespace: "namespace1", PortName: "grpc", Weight: 1}},
+		{Op: naming.Add, Addr: "1.2.3.6:8080", Metadata: AddressMetadata{IP: "1.2.3.6", Namespace: "namespace1", PortName: "grpc", Weight: 1}},
+	}, u)
+
+	// Pods are cached for the same addresses.
+	epClientMock.pods["1.2.3.5"] = pod{Annotations: map[string]string{DefaultWeightAnnotation: "0"}}
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: newTestEndpoints("11", 8080, "1.2.3.4", "1.2.3.5", "1.2.3.6")})
+	u, err = w.Next()
+	require.NoError(t, err)
+	require.Empty(t, u)
+	require.Equal(t, int32(1), atomic.LoadInt32(&epClientMock.podLists))
+
+	// Changed weight replaces the address once the cached pods are too old.
+	clk.Advance(podCacheMaxAge)
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: newTestEndpoints("12", 8080, "1.2.3.4", "1.2.3.5", "1.2.3.6")})
+	u, err = w.Next()
+	require.NoError(t, err)
+	require.Len(t, u, 2)
+	require.Equal(t, naming.Update{Op: naming.Delete, Addr: "1.2.3.5:8080"}, *u[0])
+	require.Equal(t, naming.Update{
+		Op:       naming.Add,
+		Addr:     "1.2.3.5:8080",
+		Metadata: AddressMetadata{IP: "1.2.3.5", Namespace: "namespace1", PortName: "grpc", Weight: 0},
+	}, *u[1])
+}
+
+func TestWatcher_PodsListedForNewAddress(t *testing.T) {
+	bytesCh := make(chan []byte)
+	listResult := newTestEndpoints("10", 8080, "1.2.3.4")
+	epClientMock := &endpointClientMock{
+		t: t,
+		expectedTarget: targetEntry{
+			service:   "service1",
+			port:      noTargetPort,
+			namespace: "namespace1",
+		},
+		bytesCh:    bytesCh,
+		errCh:      make(chan error),
+		startErrCh: make(chan error, 1),
+		streamsCh:  make(chan startedStream, 10),
+		listResult: &listResult,
+		pods:       map[string]pod{"1.2.3.4": {}},
+	}
+
+	w, err := startNewWatcher(context.Background(), epClientMock.expectedTarget, epClientMock, newOptions([]Option{WithPodWeights("")}))
+	require.NoError(t, err)
+	defer w.Close()
+	_, err = w.Next()
+	require.NoError(t, err)
+
+	// Pod of the new address was not listed yet, so pods are listed again.
+	epClientMock.pods["1.2.3.5"] = pod{Annotations: map[string]string{DefaultWeightAnnotation: "3"}}
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: newTestEndpoints("11", 8080, "1.2.3.4", "1.2.3.5")})
+	u, err := w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{
+		{Op: naming.Add, Addr: "1.2.3.5:8080", Metadata: AddressMetadata{IP: "1.2.3.5", Namespace: "namespace1", PortName: "grpc", Weight: 3}},
+	}, u)
+	require.Equal(t, int32(2), atomic.LoadInt32(&epClientMock.podLists))
+}
+
+func TestWatcher_PodWeights_CustomAnnotation(t *testing.T) {
+	sub := subset{
+		Ports:     []port{{Name: "grpc", Port: 8080}},
+		Addresses: []address{{IP: "1.2.3.4"}, {IP: "1.2.3.5"}},
+	}
+	pods := map[string]pod{
+		"1.2.3.4": {Annotations: map[string]string{"example.com/weight": "10", DefaultWeightAnnotation: "5"}},
+	}
+
+	addrs, err := subsetToAddresses(targetEntry{service: "service1", namespace: "namespace1", port: noTargetPort}, sub,
+		newOptions([]Option{WithPodWeights("example.com/weight")}), pods)
+	require.NoError(t, err)
+	require.Equal(t, map[string]AddressMetadata{
+		"1.2.3.4:8080": {IP: "1.2.3.4", PortName: "grpc", Weight: 10},
+		"1.2.3.5:8080": {IP: "1.2.3.5", PortName: "grpc", Weight: 1},
+	}, addrs)
+}
@@ -0,0 +1,120 @@
+package k8sresolver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// ZoneEnvVar is an environment variable that can specify zone of the current pod directly.
+	ZoneEnvVar = "K8SRESOLVER_ZONE"
+	// NodeNameEnvVar is an environment variable with the node name of the current pod, usually set using downward API
+	// (fieldRef: spec.nodeName). Zone is then read from the node zoneLabel.
+	NodeNameEnvVar = "K8SRESOLVER_NODE_NAME"
+
+	zoneLabel = "topology.kubernetes.io/zone"
+)
+
+type node struct {
+	Metadata struct {
+		Labels map[string]string `json:"labels"`
+	} `json:"metadata"`
+}
+
+// nodeZone returns zone label of the given node.
+func (c *client) nodeZone(ctx context.Context, nodeName string) (string, error) {
+	nodeURL := fmt.Sprintf("/api/v1/nodes/%s", nodeName)
+	body, err := c.startGET(ctx, nodeURL)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	var n node
+	if err := json.NewDecoder(body).Decode(&n); err != nil {
+		return "", errors.Wrapf(err, "Failed to decode node from GET %s response", nodeURL)
+	}
+	zone, ok := n.Metadata.Labels[zoneLabel]
+	if !ok {
+		return "", errors.Errorf("node %s does not have %s label", nodeName, zoneLabel)
+	}
+	return zone, nil
+}
+
+// localZoneDetector returns function that detects zone of the current pod from ZoneEnvVar or the label of the node
+// specified by NodeNameEnvVar. Result is cached after first successful detection.
+func localZoneDetector(cl *client) func(ctx context.Context) (string, error) {
+	var (
+		mu   sync.Mutex
+		zone string
+	)
+	return func(ctx context.Context) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if zone != "" {
+			return zone, nil
+		}
+		if z := os.Getenv(ZoneEnvVar); z != "" {
+			zone = z
+			return zone, nil
+		}
+		nodeName := os.Getenv(NodeNameEnvVar)
+		if nodeName == "" {
+			return "", errors.Errorf("zone cannot be detected. Neither %s nor %s env variable is set", ZoneEnvVar, NodeNameEnvVar)
+		}
+		z, err := cl.nodeZone(ctx, nodeName)
+		if err != nil {
+			return "", err
+		}
+		zone = z
+		return zone, nil
+	}
+}
+
+// sameZoneAddresses returns addresses that should be used by the client in the given zone. Addresses with topology
+// hints are used if hinted for the zone, otherwise addresses placed in the zone are used.
+// If there are no such addresses, all of them are returned to never black-hole the traffic.
+func sameZoneAddresses(zone string, addresses map[string]AddressMetadata) map[string]AddressMetadata {
+	sameZone := make(map[string]AddressMetadata)
+	for addr, md := range addresses {
+		if len(md.ForZones) == 0 {
+			if md.Zone == zone {
+				sameZone[addr] = md
+			}
+			continue
+		}
+		for _, z := range md.ForZones {
+			if z == zone {
+				sameZone[addr] = md
+				break
+			}
+		}
+	}
+
+	if len(sameZone) == 0 {
+		return addresses
+	}
+	return sameZone
+}
+
+// sameNodeAddresses returns addresses on the given node. If there are no such addresses, all of them are returned to
+// never black-hole the traffic.
+func sameNodeAddresses(node string, addresses map[string]AddressMetadata) map[string]AddressMetadata {
+	sameNode := make(map[string]AddressMetadata)
+	for addr, md := range addresses {
+		if md.NodeName == node {
+			sameNode[addr] = md
+		}
+	}
+
+	if len(sameNode) == 0 {
+		return addresses
+	}
+	return sameNode
+}
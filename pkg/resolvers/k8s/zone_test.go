@@ -0,0 +1,144 @@
+package k8sresolver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/improbable-eng/kedge/pkg/k8s"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/naming"
+)
+
+func TestSameZoneAddresses(t *testing.T) {
+	addresses := map[string]AddressMetadata{
+		"1.2.3.4:8080": {IP: "1.2.3.4", Zone: "zone-a"},
+		"1.2.3.5:8080": {IP: "1.2.3.5", Zone: "zone-b"},
+		// Hinted address is used by zone-a, even though it is in zone-b.
+		"1.2.3.6:8080": {IP: "1.2.3.6", Zone: "zone-b", ForZones: []string{"zone-a"}},
+		// Hinted address is not used by zone-b, since it is hinted for other zone only.
+		"1.2.3.7:8080": {IP: "1.2.3.7", Zone: "zone-b", ForZones: []string{"zone-c"}},
+	}
+
+	require.Equal(t, map[string]AddressMetadata{
+		"1.2.3.4:8080": addresses["1.2.3.4:8080"],
+		"1.2.3.6:8080": addresses["1.2.3.6:8080"],
+	}, sameZoneAddresses("zone-a", addresses))
+	require.Equal(t, map[string]AddressMetadata{
+		"1.2.3.5:8080": addresses["1.2.3.5:8080"],
+	}, sameZoneAddresses("zone-b", addresses))
+	require.Equal(t, addresses, sameZoneAddresses("zone-d", addresses), "all addresses should be used if none is in the zone")
+}
+
+func TestWatcher_PreferSameZone(t *testing.T) {
+	ep := newTestEndpoints("10", 8080)
+	ep.Subsets[0].Addresses = []address{
+		{IP: "1.2.3.4", Zone: "zone-a"},
+		{IP: "1.2.3.5", Zone: "zone-b"},
+	}
+	epClientMock := &endpointClientMock{
+		t: t,
+		expectedTarget: targetEntry{
+			service:   "service1",
+			port:      noTargetPort,
+			namespace: "namespace1",
+		},
+		bytesCh:    make(chan []byte),
+		errCh:      make(chan error),
+		startErrCh: make(chan error, 1),
+		streamsCh:  make(chan startedStream, 10),
+		listResult: &ep,
+	}
+
+	w, err := startNewWatcher(context.Background(), epClientMock.expectedTarget, epClientMock, newOptions([]Option{WithPreferSameZone("zone-b")}))
+	require.NoError(t, err)
+	defer w.Close()
+
+	u, err := w.Next()
+	require.NoError(t, err)
+	require.Len(t, u, 1)
+	require.Equal(t, "1.2.3.5:8080", u[0].Addr)
+	require.Equal(t, AddressMetadata{IP: "1.2.3.5", Namespace: "namespace1", PortName: "grpc", Zone: "zone-b"}, u[0].Metadata)
+}
+
+func TestSameNodeAddresses(t *testing.T) {
+	addresses := map[string]AddressMetadata{
+		"1.2.3.4:8080": {IP: "1.2.3.4", NodeName: "node1"},
+		"1.2.3.5:8080": {IP: "1.2.3.5", NodeName: "node2"},
+		"1.2.3.6:8080": {IP: "1.2.3.6"},
+	}
+
+	require.Equal(t, map[string]AddressMetadata{
+		"1.2.3.5:8080": addresses["1.2.3.5:8080"],
+	}, sameNodeAddresses("node2", addresses))
+	require.Equal(t, addresses, sameNodeAddresses("node3", addresses), "all addresses should be used if none is on the node")
+}
+
+func TestWatcher_PreferSameNode(t *testing.T) {
+	ep := newTestEndpoints("10", 8080)
+	ep.Subsets[0].Addresses = []address{
+		{IP: "1.2.3.4", NodeName: "node1"},
+		{IP: "1.2.3.5", NodeName: "node2"},
+	}
+	bytesCh, _, w := startTestWatcher(t, ep, WithPreferSameNode("node2"))
+	defer w.Close()
+
+	u, err := w.Next()
+	require.NoError(t, err)
+	require.Equal(t, []*naming.Update{
+		{Op: naming.Add, Addr: "1.2.3.5:8080", Metadata: AddressMetadata{IP: "1.2.3.5", Namespace: "namespace1", PortName: "grpc", NodeName: "node2"}},
+	}, u)
+
+	// Local backend is gone, so all the others are used.
+	ep.Metadata.ResourceVersion = "11"
+	ep.Subsets[0].Addresses = []address{
+		{IP: "1.2.3.4", NodeName: "node1"},
+		{IP: "1.2.3.6", NodeName: "node3"},
+	}
+	sendTestEvent(t, bytesCh, event{Type: modified, Object: ep})
+	u, err = w.Next()
+	require.NoError(t, err)
+	requireUpdates(t, []*naming.Update{
+		{Op: naming.Delete, Addr: "1.2.3.5:8080"},
+		{Op: naming.Add, Addr: "1.2.3.4:8080"},
+		{Op: naming.Add, Addr: "1.2.3.6:8080"},
+	}, u)
+}
+
+func TestResolver_WatcherOptions_DetectsNode(t *testing.T) {
+	defer os.Unsetenv(NodeNameEnvVar)
+	r := &resolver{opts: newOptions([]Option{WithPreferSameNode("")})}
+	require.Equal(t, "", r.watcherOptions().node)
+
+	require.NoError(t, os.Setenv(NodeNameEnvVar, "node1"))
+	require.Equal(t, "node1", r.watcherOptions().node)
+	r.opts = newOptions([]Option{WithPreferSameNode("node2")})
+	require.Equal(t, "node2", r.watcherOptions().node, "node specified explicitly should take precedence")
+}
+
+func TestLocalZoneDetector(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/api/v1/nodes/node1", r.URL.Path)
+		w.Write([]byte(`{"metadata": {"labels": {"topology.kubernetes.io/zone": "zone-a"}}}`))
+	}))
+	defer srv.Close()
+	cl := &client{k8sClient: &k8s.APIClient{Client: srv.Client(), Address: srv.URL}}
+
+	defer os.Unsetenv(ZoneEnvVar)
+	defer os.Unsetenv(NodeNameEnvVar)
+
+	_, err := localZoneDetector(cl)(context.Background())
+	require.Error(t, err)
+
+	require.NoError(t, os.Setenv(NodeNameEnvVar, "node1"))
+	zone, err := localZoneDetector(cl)(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "zone-a", zone)
+
+	require.NoError(t, os.Setenv(ZoneEnvVar, "zone-b"))
+	zone, err = localZoneDetector(cl)(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "zone-b", zone, "env variable should take precedence over node label")
+}
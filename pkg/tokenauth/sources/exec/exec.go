@@ -0,0 +1,81 @@
+package execauth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/improbable-eng/kedge/pkg/tokenauth"
+	"github.com/pkg/errors"
+)
+
+// execCredential is an output of the credential plugin.
+// See https://kubernetes.io/docs/reference/access-authn-authz/authentication/#client-go-credential-plugins
+type execCredential struct {
+	Status struct {
+		Token               string     `json:"token"`
+		ExpirationTimestamp *time.Time `json:"expirationTimestamp"`
+	} `json:"status"`
+}
+
+type source struct {
+	name    string
+	command string
+	args    []string
+	env     []string
+
+	mu         sync.Mutex
+	token      string
+	expiration *time.Time
+}
+
+// New returns new auth source that gets token by running the given credential plugin command, the same way kubectl
+// does. Token is cached until its expiration time. If plugin does not return expiration, token is cached forever.
+// Env variables are passed to the command in addition to the current process environment in a form of "key=value".
+func New(name string, command string, args []string, env []string) tokenauth.Source {
+	return &source{
+		name:    name,
+		command: command,
+		args:    args,
+		env:     env,
+	}
+}
+
+// Name of the auth source.
+func (s *source) Name() string {
+	return s.name
+}
+
+// Token returns a token returned by the credential plugin.
+func (s *source) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" && (s.expiration == nil || time.Now().Before(*s.expiration)) {
+		return s.token, nil
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, s.command, s.args...)
+	cmd.Env = append(os.Environ(), s.env...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", errors.Wrapf(err, "failed to run credential plugin %s. Stderr: %s", s.command, stderr.String())
+	}
+
+	var cred execCredential
+	if err := json.Unmarshal(stdout.Bytes(), &cred); err != nil {
+		return "", errors.Wrapf(err, "failed to decode credential plugin %s output", s.command)
+	}
+	if cred.Status.Token == "" {
+		return "", errors.Errorf("credential plugin %s did not return token", s.command)
+	}
+	s.token = cred.Status.Token
+	s.expiration = cred.Status.ExpirationTimestamp
+	return s.token, nil
+}
@@ -0,0 +1,38 @@
+package fileauth
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+
+	"github.com/improbable-eng/kedge/pkg/tokenauth"
+	"github.com/pkg/errors"
+)
+
+type source struct {
+	name string
+	path string
+}
+
+// New returns new auth source that reads token from the given file on every Token call. This way rotated tokens
+// (e.g. Kubernetes bound service account tokens) are picked up without restart.
+func New(name string, path string) tokenauth.Source {
+	return &source{
+		name: name,
+		path: path,
+	}
+}
+
+// Name of the auth source.
+func (s *source) Name() string {
+	return s.name
+}
+
+// Token returns a token read from the file.
+func (s *source) Token(_ context.Context) (string, error) {
+	token, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read token from %s", s.path)
+	}
+	return strings.TrimSpace(string(token)), nil
+}
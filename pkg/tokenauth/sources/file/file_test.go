@@ -0,0 +1,32 @@
+package fileauth
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSource_RereadsRotatedToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fileauth")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "token")
+	s := New("test", path)
+	_, err = s.Token(context.Background())
+	require.Error(t, err)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("token1\n"), 0600))
+	token, err := s.Token(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "token1", token)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("token2"), 0600))
+	token, err = s.Token(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "token2", token)
+}